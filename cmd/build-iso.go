@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"github.com/kairos-io/enki/pkg/action"
 	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
 	"github.com/kairos-io/enki/pkg/utils"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"strings"
 )
 
 // NewBuildISOCmd returns a new instance of the build-iso subcommand and appends it to
@@ -19,7 +21,8 @@ func NewBuildISOCmd() *cobra.Command {
 		Long: "Build bootable installation media ISOs\n\n" +
 			"SOURCE - should be provided as uri in following format <sourceType>:<sourceName>\n" +
 			"    * <sourceType> - might be [\"dir\", \"file\", \"oci\", \"docker\"], as default is \"docker\"\n" +
-			"    * <sourceName> - is path to file or directory, image name with tag version",
+			"    * <sourceName> - is path to file or directory, image name with tag version\n\n" +
+			"Set the SOURCE_DATE_EPOCH environment variable to use it as the timestamp of all the generated files for reproducible builds.",
 		Args: cobra.MaximumNArgs(1),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			return CheckRoot()
@@ -105,6 +108,8 @@ func NewBuildISOCmd() *cobra.Command {
 	archType := newEnumFlag([]string{"x86_64", "arm64"}, "x86_64")
 	c.Flags().Bool("squash-no-compression", true, "Disable squashfs compression.")
 	c.Flags().VarP(archType, "arch", "a", "Arch to build the image for")
+	isoBackend := newEnumFlag(constants.ISOBackends(), constants.NativeISOBackend)
+	c.Flags().Var(isoBackend, "iso-backend", fmt.Sprintf("Tool used to write the ISO image [%s]", strings.Join(constants.ISOBackends(), ", ")))
 	return c
 }
 
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/kairos-io/enki/pkg/action"
 	"github.com/kairos-io/enki/pkg/config"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/types"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -33,14 +35,45 @@ func NewBuildUKICmd() *cobra.Command {
 			"    - KEK.auth\n" +
 			"    - PK.der\n" +
 			"    - PK.auth\n" +
-			"    - tpm2-pcr-private.pem\n",
+			"    - tpm2-pcr-private.pem\n" +
+			"The db.key and tpm2-pcr-private.pem private keys are not needed if --sb-key and --pcr-key are set. These can be PEM files\n" +
+			"or PKCS#11 URIs of keys in an HSM, like \"pkcs11:token=kairos;object=db;type=private?pin-source=/run/hsm-pin\".\n" +
+			"The PKCS#11 keys are used through OpenSSL, with the pkcs11 provider by default, see --private-key-source.\n\n" +
+			"The PCR policies can be signed with several keys, each for some boot phases only, by repeating --pcr-key along with\n" +
+			"--pcr-phases, like ukify does. For instance, to have a key that only unlocks secrets in the initrd:\n" +
+			"    --pcr-key initrd.pem --pcr-phases enter-initrd --pcr-key system.pem \\\n" +
+			"    --pcr-phases enter-initrd:leave-initrd,enter-initrd:leave-initrd:sysinit,enter-initrd:leave-initrd:sysinit:ready\n" +
+			"The first key is the one embedded in the UKI files in the .pcrpkey section.\n\n" +
+			"Set the SOURCE_DATE_EPOCH environment variable to use it as the timestamp of all the generated files, and as the signing\n" +
+			"time of the secure boot signatures, for reproducible builds.\n\n" +
+			"Instead of the cmdline flags, the boot entries can be listed under uki.entries in the manifest.yaml file of the config dir:\n" +
+			"    uki:\n" +
+			"      entries:\n" +
+			"        - title: Kairos\n" +
+			"          default: true\n" +
+			"          tries: 3\n" +
+			"        - title: Kairos (debug)\n" +
+			"          cmdline: rd.debug\n" +
+			"          file-name: debug\n" +
+			"          sort-key: b\n" +
+			"    The cmdline of each entry is appended to the default one. tries enables boot counting for the entry, like --boot-tries.\n\n" +
+			"The SBAT entries of --sbat are added to the ones of systemd-stub and systemd-boot, so the EFI files can be revoked by\n" +
+			"their generation in the SbatLevel variable instead of by their db key. They can be set under uki.sbat in the manifest too:\n" +
+			"    uki:\n" +
+			"      sbat:\n" +
+			"        - component: kairos\n" +
+			"          generation: 1\n" +
+			"          vendor: Kairos\n" +
+			"          package: kairos\n" +
+			"          version: v3.2.1\n" +
+			"          url: https://kairos.io\n",
 		Args: cobra.ExactArgs(1),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			artifact, err := cmd.Flags().GetString("output-type")
 			if err != nil {
 				return err
 			}
-			if artifact != string(constants.DefaultOutput) && artifact != string(constants.IsoOutput) && artifact != string(constants.ContainerOutput) {
+			if !slices.Contains(constants.OutPutTypes(), artifact) {
 				return fmt.Errorf("invalid output type: %s", artifact)
 			}
 
@@ -55,12 +88,6 @@ func NewBuildUKICmd() *cobra.Command {
 				if !ol.IsDir() {
 					return fmt.Errorf("overlay-rootfs is not a directory: %s", overlayRootfs)
 				}
-
-				// Transform it into absolute path
-				absolutePath, err := filepath.Abs(overlayRootfs)
-				if err != nil {
-					viper.Set("overlay-rootfs", absolutePath)
-				}
 			}
 			overlayIso, _ := cmd.Flags().GetString("overlay-iso")
 			if overlayIso != "" {
@@ -78,11 +105,12 @@ func NewBuildUKICmd() *cobra.Command {
 				if artifact != string(constants.IsoOutput) {
 					return fmt.Errorf("overlay-iso is only supported for iso artifacts")
 				}
+			}
 
-				// Transform it into absolute path
-				absolutePath, err := filepath.Abs(overlayIso)
-				if err != nil {
-					viper.Set("overlay-iso", absolutePath)
+			sbat, _ := cmd.Flags().GetStringArray("sbat")
+			for _, entry := range sbat {
+				if _, err := types.ParseSbatEntry(entry); err != nil {
+					return err
 				}
 			}
 
@@ -93,7 +121,18 @@ func NewBuildUKICmd() *cobra.Command {
 				return fmt.Errorf("keys directory does not exist: %s", keysDir)
 			}
 			// Check if the keys directory contains the required files
-			requiredFiles := []string{"db.der", "db.key", "db.auth", "KEK.der", "KEK.auth", "PK.der", "PK.auth", "tpm2-pcr-private.pem"}
+			requiredFiles := []string{"db.der", "db.auth", "KEK.der", "KEK.auth", "PK.der", "PK.auth"}
+			// The private keys can be given on their own, like PKCS#11 URIs, instead, and are not needed at all
+			// for unsigned builds
+			if unsigned, _ := cmd.Flags().GetBool("unsigned"); !unsigned {
+				requiredFiles = append(requiredFiles, "db.pem")
+				if sbKey, _ := cmd.Flags().GetString("sb-key"); sbKey == "" {
+					requiredFiles = append(requiredFiles, "db.key")
+				}
+				if pcrKeys, _ := cmd.Flags().GetStringArray("pcr-key"); len(pcrKeys) == 0 {
+					requiredFiles = append(requiredFiles, "tpm2-pcr-private.pem")
+				}
+			}
 			for _, file := range requiredFiles {
 				_, err = os.Stat(filepath.Join(keysDir, file))
 				if err != nil {
@@ -123,11 +162,14 @@ func NewBuildUKICmd() *cobra.Command {
 				return err
 			}
 
-			flags := cmd.Flags()
-			outputDir, _ := flags.GetString("output-dir")
-			keysDir, _ := flags.GetString("keys")
-			outputType, _ := flags.GetString("output-type")
-			a := action.NewBuildUKIAction(cfg, imgSource, outputDir, keysDir, outputType)
+			spec, err := config.ReadBuildUKI(cfg, cmd.Flags())
+			if err != nil {
+				cfg.Logger.Errorf("invalid build-uki options: %s", err)
+				return err
+			}
+			spec.Image = imgSource
+
+			a := action.NewBuildUKIAction(cfg, spec)
 			err = a.Run()
 			if err != nil {
 				cfg.Logger.Errorf(err.Error())
@@ -143,7 +185,7 @@ func NewBuildUKICmd() *cobra.Command {
 	c.Flags().StringP("output-type", "t", string(constants.DefaultOutput), fmt.Sprintf("Artifact output type [%s]", strings.Join(constants.OutPutTypes(), ", ")))
 	c.Flags().StringP("overlay-rootfs", "o", "", "Dir with files to be applied to the system rootfs.\nAll the files under this dir will be copied into the rootfs of the uki respecting the directory structure under the dir.")
 	c.Flags().StringP("overlay-iso", "i", "", "Dir with files to be copied to the Iso rootfs.")
-	c.Flags().StringP("boot-branding", "", "Kairos", "Boot title branding")
+	c.Flags().StringP("boot-branding", "", constants.UkiBootBranding, "Boot title branding")
 	c.Flags().BoolP("include-version-in-config", "", false, "Include the OS version in the .config file")
 	c.Flags().BoolP("include-cmdline-in-config", "", false, "Include the cmdline in the .config file. Only the extra values are included.")
 	c.Flags().StringSliceP("extra-cmdline", "c", []string{}, "Add extra efi files with this cmdline for the default 'norole' artifacts. This creates efi files with the default cmdline and extra efi files with the default+provided cmdline.")
@@ -151,14 +193,47 @@ func NewBuildUKICmd() *cobra.Command {
 	c.Flags().StringSliceP("single-efi-cmdline", "s", []string{}, "Add one extra efi file with the default+provided cmdline. The syntax is '--single-efi-cmdline \"My Entry: cmdline,options,here\"'. The boot entry name is the text under which it appears in systemd-boot menu.")
 	c.Flags().StringP("keys", "k", "", "Directory with the signing keys")
 	c.Flags().StringP("default-entry", "e", "", "Default entry selected in the boot menu.\nSupported glob wildcard patterns are \"?\", \"*\", and \"[...]\".\nIf not selected, the default entry with install-mode is selected.")
-	c.Flags().Int64P("efi-size-warn", "", 1024, "EFI file size warning threshold in megabytes. Default is 1024.")
-	c.Flags().String("secure-boot-enroll", "if-safe", "The value of secure-boot-enroll option of systemd-boot. Possible values: off|manual|if-safe|force. Minimum systemd version: 253. Docs: https://manpages.debian.org/experimental/systemd-boot/loader.conf.5.en.html. !! Danger: this feature might soft-brick your device if used improperly !!")
+	c.Flags().Int64P("efi-size-warn", "", constants.UkiEfiSizeWarn, "EFI file size warning threshold in megabytes, 0 disables it. Builds with UKI files over the FAT32 limit of 4GiB always fail.")
+	c.Flags().Bool("multi-profile", false, fmt.Sprintf("Build a single UKI file with a profile for each boot entry, instead of a UKI file per entry with the same kernel and initrd. Needs systemd-stub and systemd-boot %d or newer.", constants.UkiProfilesMinVersion))
+	c.Flags().String("sb-key", "", "Secure boot db key to sign the EFI files with, a PEM file or a PKCS#11 URI. Defaults to db.key in the keys dir. The certificate is always db.pem in the keys dir.")
+	c.Flags().StringArray("pcr-key", []string{}, "RSA key to sign the PCR policies with, a PEM file or a PKCS#11 URI. Can be repeated to sign with several keys. Defaults to tpm2-pcr-private.pem in the keys dir.")
+	c.Flags().StringArray("pcr-phases", []string{}, "Comma separated phase paths to sign the PCR policies of the --pcr-key at the same position for, like enter-initrd,enter-initrd:leave-initrd. Can be repeated, once per key. Defaults to the policy after every boot phase.")
+	c.Flags().String("private-key-source", constants.DefaultPrivateKeySource, "OpenSSL engine or provider to use the PKCS#11 keys with, as engine:NAME or provider:NAME. The PKCS#11 module is set in the OpenSSL config, or with the PKCS11_PROVIDER_MODULE environment variable for the pkcs11 provider.")
+	c.Flags().Bool("unsigned", false, fmt.Sprintf("Do not sign the UKI files, their PCR policies and systemd-boot, so no private keys are needed. A %s manifest is written to the output dir to sign them later with enki sign. Only for the %s output type.", constants.SignManifestFile, constants.DefaultOutput))
+	c.Flags().Bool("pcr-predict", false, "Write the expected PCR 4, 7 and 11 values of booting the UKI files, as the pcr predict command does, to a .pcr.json file in the output dir.")
+	c.Flags().StringArray("sbat", []string{}, "SBAT entry to add to the UKI files and systemd-boot, as component,generation,vendor,package,version,url. Can be repeated.")
+	c.Flags().Int("workers", 0, fmt.Sprintf("Number of UKI files to build in parallel. Every build holds its UKI file in memory a few times while signing it, so the peak memory use is about 3 times the UKI size per worker. Defaults to the number of CPUs, up to %d.", constants.UkiMaxDefaultWorkers))
+	c.Flags().String("secure-boot-enroll", constants.UkiSecureBootEnroll, "The value of secure-boot-enroll option of systemd-boot. Possible values: off|manual|if-safe|force. Minimum systemd version: 252. Docs: https://manpages.debian.org/experimental/systemd-boot/loader.conf.5.en.html. !! Danger: this feature might soft-brick your device if used improperly !!")
 	c.Flags().StringP("splash", "", "", "Path to the custom logo splash BMP file.")
+	c.Flags().Int("boot-tries", 0, "Enable the boot counting of systemd-boot with this number of tries. An entry failing to boot that many times is marked as bad and the next one is booted instead. The booted OS must run systemd-bless-boot to mark the entry as good. 0 disables it.")
+	c.Flags().StringSlice("boot-tries-entries", []string{}, "Glob patterns of the entry file names boot counting is enabled for, like \"norole*\". All the entries if not set.")
+	c.Flags().String("loader-timeout", constants.UkiLoaderTimeout, fmt.Sprintf("Seconds the systemd-boot menu is shown, or one of [%s]. Use 0 to boot the default entry right away.", strings.Join(constants.LoaderMenuTimeouts(), ", ")))
+	loaderConsoleMode := newEnumFlag(constants.LoaderConsoleModes(), constants.UkiLoaderConsole)
+	c.Flags().Var(loaderConsoleMode, "loader-console-mode", fmt.Sprintf("Console mode of systemd-boot [%s]", strings.Join(constants.LoaderConsoleModes(), ", ")))
+	c.Flags().Bool("loader-auto-entries", true, "Show the automatic entries of systemd-boot, like the Windows boot manager. Left to the systemd-boot default if not set.")
+	c.Flags().Bool("loader-auto-firmware", true, "Show the entry to reboot into the firmware setup. Left to the systemd-boot default if not set.")
+	c.Flags().Bool("loader-beep", false, "Beep when showing the systemd-boot menu. Minimum systemd version: 251. Left to the systemd-boot default if not set.")
+	c.Flags().Bool("loader-reboot-for-bitlocker", false, "Reboot into the Windows boot manager when it is selected, for BitLocker TPM unlocking. Minimum systemd version: 251. Left to the systemd-boot default if not set.")
+	initrdCompression := newEnumFlag(constants.InitrdCompressions(), constants.ZstdCompression)
+	c.Flags().Var(initrdCompression, "initrd-compression", fmt.Sprintf("Compression algorithm of the initramfs in the UKI files [%s]. The kernel must support it.", strings.Join(constants.InitrdCompressions(), ", ")))
+	c.Flags().Int("initrd-compression-level", 0, "Compression level of the initramfs, from 1 to 22 for zstd and from 1 to 9 for xz, lz4 and gzip. The zstd levels are mapped to the 4 levels of the encoder: 1-2 fastest, 3-5 default, 6-9 better and 10-22 best compression. Defaults to the level of each algorithm.")
+	c.Flags().StringSlice("initrd-exclude", []string{}, "Glob pattern of rootfs paths to leave out of the initramfs, like /usr/share/doc or **/*.pyc. A \"**\" element matches any number of directories.")
+	c.Flags().StringSlice("initrd-include", []string{}, "Glob pattern of rootfs paths to keep in the initramfs even if they match an --initrd-exclude pattern.")
+	c.Flags().String("hardware-profile", "", "File with the kernel modules, device modaliases or lsmod output of the target hardware, one per line. The kernel modules and firmware not needed by it are left out of the initramfs.")
+	c.Flags().StringSlice("keep-firmware", []string{}, "Path or glob relative to /lib/firmware to keep in the initramfs with --hardware-profile, like the firmware loaded from userspace. The intel-ucode and amd-ucode microcode directories are always kept.")
+	c.Flags().Int64("esp-size", constants.UkiEspSize, "Minimum size in megabytes of the EFI System Partition for the raw and qcow2 output types. It grows to fit the UKI files if needed.")
+	c.Flags().Int64("oem-size", 0, "Size in megabytes of an empty ext4 COS_OEM partition added to the raw and qcow2 output types. 0 leaves it out.")
+	containerCompression := newEnumFlag(constants.ContainerCompressions(), constants.GzipCompression)
+	c.Flags().Var(containerCompression, "container-compression", fmt.Sprintf("Compression of the image layer for the container output type [%s]", strings.Join(constants.ContainerCompressions(), ", ")))
+	containerFormat := newEnumFlag(constants.ContainerFormats(), constants.DockerContainerFormat)
+	c.Flags().Var(containerFormat, "container-format", fmt.Sprintf("Format of the container output type, a tarball for docker load or an OCI layout directory [%s]", strings.Join(constants.ContainerFormats(), ", ")))
+	c.Flags().String("push", "", "Image reference to push the container output type to, like quay.io/org/uki:v1.0.0. The credentials are read from the docker config file.")
+	isoBackend := newEnumFlag(constants.ISOBackends(), constants.NativeISOBackend)
+	c.Flags().Var(isoBackend, "iso-backend", fmt.Sprintf("Tool used to write the ISO image for the iso output type [%s]", strings.Join(constants.ISOBackends(), ", ")))
 
 	c.MarkFlagRequired("keys")
 	// Mark some flags as mutually exclusive
 	c.MarkFlagsMutuallyExclusive([]string{"extra-cmdline", "extend-cmdline"}...)
-	viper.BindPFlags(c.Flags())
 	return c
 }
 
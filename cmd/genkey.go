@@ -8,13 +8,16 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/signer"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/foxboron/go-uefi/efi/attributes"
 	"github.com/foxboron/go-uefi/efi/signature"
 	efiutil "github.com/foxboron/go-uefi/efi/util"
 	"github.com/foxboron/go-uefi/efivar"
@@ -138,6 +141,44 @@ func NewGenkeyCmd() *cobra.Command {
 	c.Flags().String(customCertDirFlag, "", "Path to a directory containing custom certificates to enroll")
 
 	viper.BindPFlag("expiration-in-days", c.Flags().Lookup("expiration-in-days"))
+	c.AddCommand(NewGenkeyRotateCmd())
+	return c
+}
+
+// NewGenkeyRotateCmd returns a new instance of the genkey rotate subcommand
+func NewGenkeyRotateCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "rotate NAME",
+		Short: "Replace the db key with a new one signed by the existing KEK",
+		Long: "Replace the db key of a keys directory generated by genkey with a new one, keeping the PK and KEK\n\n" +
+			"NAME - name of the new db certificate, like for genkey.\n\n" +
+			"The new db.key and db.pem are generated and the old ones are kept as db-SERIAL.key and db-SERIAL.pem. The new\n" +
+			"certificate is added to db.esl and db.der, which hold both the old and the new db certificates. db.auth is the\n" +
+			"update appending the new certificate to the db variable of the deployed devices, signed by the KEK so it does not\n" +
+			"need the firmware setup mode. For instance, with efitools:\n" +
+			"    efi-updatevar -a -f db.auth db\n" +
+			"Once it is applied, they boot the UKI files signed with the new key. The devices enrolling the keys from now on\n" +
+			"only get the new certificate from db.auth.\n",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cobraCmd *cobra.Command, args []string) error {
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cobraCmd.SilenceUsage = true
+
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cobraCmd.Flags())
+			if err != nil {
+				return err
+			}
+			keysDir, _ := cobraCmd.Flags().GetString("keys")
+			days, _ := cobraCmd.Flags().GetString("expiration-in-days")
+			if err := rotateDbKey(cfg.Logger, args[0], keysDir, days); err != nil {
+				cfg.Logger.Errorf("Error rotating the db key: %s", err)
+				return err
+			}
+			return nil
+		},
+	}
+	c.Flags().StringP("keys", "k", "keys/", "Directory with the keys generated by genkey")
+	c.Flags().StringP("expiration-in-days", "e", "365", "In how many days from today should the new db certificate expire")
 	return c
 }
 
@@ -216,6 +257,201 @@ func generateAuthKeys(guid efiutil.EFIGUID, keyPath, keyType, customDerCertDir s
 	return nil
 }
 
+// rotateDbKey generates a new db key in keysDir, adding its certificate to db.esl and db.der along with the old ones
+// and writing the db.auth update appending it, signed by the KEK
+func rotateDbKey(l sdkTypes.KairosLogger, name, keysDir, days string) error {
+	kekKey, err := os.ReadFile(filepath.Join(keysDir, "KEK.key"))
+	if err != nil {
+		return fmt.Errorf("reading the KEK key: %w", err)
+	}
+	kekPem, err := os.ReadFile(filepath.Join(keysDir, "KEK.pem"))
+	if err != nil {
+		return fmt.Errorf("reading the KEK certificate: %w", err)
+	}
+	oldCert, err := signer.ReadCertificate(filepath.Join(keysDir, "db.pem"))
+	if err != nil {
+		return err
+	}
+	esl, err := os.ReadFile(filepath.Join(keysDir, "db.esl"))
+	if err != nil {
+		return fmt.Errorf("reading the db signature list: %w", err)
+	}
+	sigdb, err := signature.ReadSignatureDatabase(bytes.NewReader(esl))
+	if err != nil {
+		return fmt.Errorf("reading the db signature list: %w", err)
+	}
+	der, err := os.ReadFile(filepath.Join(keysDir, "db.der"))
+	if err != nil {
+		return fmt.Errorf("reading the db certificates: %w", err)
+	}
+
+	// The new certificate has the same owner as the old one, genkey generates a new one for every keys dir
+	guid := efiutil.StringToGUID(string(sbctl.CreateUUID()))
+	for _, list := range sigdb {
+		for _, sig := range list.Signatures {
+			if bytes.Equal(sig.Data, oldCert.Raw) {
+				guid = &sig.Owner
+			}
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "enki-genkey-rotate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	key := filepath.Join(tmpDir, "db.key")
+	pem := filepath.Join(tmpDir, "db.pem")
+	l.Infof("Generating the new db key")
+	args := []string{
+		"req", "-nodes", "-x509", "-subj", fmt.Sprintf("/CN=%s-db/", name),
+		"-keyout", key,
+		"-out", pem,
+	}
+	if days != "" {
+		args = append(args, "-days", days)
+	}
+	out, err := exec.Command("openssl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("generating the db key: %s", string(out))
+	}
+	newCert, err := signer.ReadCertificate(pem)
+	if err != nil {
+		return err
+	}
+
+	if err := sigdb.Append(signature.CERT_X509_GUID, *guid, newCert.Raw); err != nil {
+		return fmt.Errorf("appending the new db certificate: %w", err)
+	}
+	// The db.auth update only holds the new certificate, as the firmware appends it to the db variable. It is signed by
+	// the KEK, so the deployed devices accept it without going through the firmware setup mode.
+	update := signature.NewSignatureDatabase()
+	if err := update.Append(signature.CERT_X509_GUID, *guid, newCert.Raw); err != nil {
+		return fmt.Errorf("appending the new db certificate: %w", err)
+	}
+	appendDb := efivar.Db
+	appendDb.Attributes |= attributes.EFI_VARIABLE_APPEND_WRITE
+	signedUpdate, err := sbctl.SignDatabase(update, kekKey, kekPem, appendDb)
+	if err != nil {
+		return fmt.Errorf("creating the signed db update: %w", err)
+	}
+	newKey, err := os.ReadFile(key)
+	if err != nil {
+		return err
+	}
+	newPem, err := os.ReadFile(pem)
+	if err != nil {
+		return err
+	}
+	oldKey, err := os.ReadFile(filepath.Join(keysDir, "db.key"))
+	if err != nil {
+		return fmt.Errorf("reading the db key: %w", err)
+	}
+	oldPem, err := os.ReadFile(filepath.Join(keysDir, "db.pem"))
+	if err != nil {
+		return fmt.Errorf("reading the db certificate: %w", err)
+	}
+
+	// The old key is kept around, to sign with it until every device has the new certificate
+	backup := fmt.Sprintf("db-%s", oldCert.SerialNumber.Text(16))
+	files := []keyFile{
+		{backup + ".key", oldKey, 0o600},
+		{backup + ".pem", oldPem, 0o644},
+		{"db.key", newKey, 0o600},
+		{"db.pem", newPem, 0o644},
+		{"db.esl", sigdb.Bytes(), 0o644},
+		{"db.der", slices.Concat(der, newCert.Raw), 0o644},
+		{"db.auth", signedUpdate, 0o644},
+	}
+	if err := replaceFiles(keysDir, files); err != nil {
+		return err
+	}
+	l.Infof("The old db key was moved to %s.key and %s.pem", filepath.Join(keysDir, backup), filepath.Join(keysDir, backup))
+	l.Infof("New db key generated at %s, the db update for the deployed devices is at %s", filepath.Join(keysDir, "db.key"), filepath.Join(keysDir, "db.auth"))
+	return nil
+}
+
+// keyFile is a file of a keys dir to be written by replaceFiles
+type keyFile struct {
+	name string
+	data []byte
+	perm os.FileMode
+}
+
+// replaceFiles writes the files in dir, replacing the existing ones. Every file is written to a temporary file first
+// and only renamed once all of them are written. If a file cannot be replaced, the ones already replaced are restored
+// and the ones that did not exist are removed, so a failure leaves dir as it was.
+func replaceFiles(dir string, files []keyFile) (err error) {
+	tmpFiles := make([]string, len(files))
+	defer func() {
+		for _, tmp := range tmpFiles {
+			if tmp != "" {
+				_ = os.Remove(tmp)
+			}
+		}
+	}()
+	for i, f := range files {
+		if tmpFiles[i], err = writeTempFile(dir, f.name, f.data, f.perm); err != nil {
+			return fmt.Errorf("writing %s: %w", f.name, err)
+		}
+	}
+
+	// A copy of every replaced file is kept until all of them are replaced, to restore it on failure
+	type replaced struct{ target, previous string }
+	var done []replaced
+	defer func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			r := done[i]
+			switch {
+			case err == nil && r.previous != "":
+				_ = os.Remove(r.previous)
+			case err != nil && r.previous != "":
+				_ = os.Rename(r.previous, r.target)
+			case err != nil:
+				_ = os.Remove(r.target)
+			}
+		}
+	}()
+	for i, f := range files {
+		r := replaced{target: filepath.Join(dir, f.name)}
+		if info, serr := os.Lstat(r.target); serr == nil {
+			data, rerr := os.ReadFile(r.target)
+			if rerr != nil {
+				return fmt.Errorf("reading %s: %w", f.name, rerr)
+			}
+			if r.previous, err = writeTempFile(dir, f.name, data, info.Mode().Perm()); err != nil {
+				return fmt.Errorf("copying %s: %w", f.name, err)
+			}
+		}
+		done = append(done, r)
+		if err = os.Rename(tmpFiles[i], r.target); err != nil {
+			return fmt.Errorf("writing %s: %w", f.name, err)
+		}
+		tmpFiles[i] = ""
+	}
+	return nil
+}
+
+// writeTempFile writes data to a new temporary file in dir named after name, and returns its path
+func writeTempFile(dir, name string, data []byte, perm os.FileMode) (string, error) {
+	f, err := os.CreateTemp(dir, "."+name+"-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
 // prepareCustomDerDir takes a cert directory with keys as they are exported
 // from the UEFI firmware and prepares them for use with sbctl.
 // The keys are exported in the "authenticated variables" format.
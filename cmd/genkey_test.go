@@ -0,0 +1,121 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/kairos-io/enki/pkg/signer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+)
+
+var _ = Describe("Genkey", Label("genkey", "cmd"), func() {
+	AfterEach(func() {
+		viper.Reset()
+	})
+	It("rotates the db key keeping the PK and KEK", func() {
+		keysDir, err := os.MkdirTemp("", "enki-genkey-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, keysDir)
+		_, _, err = executeCommandC(rootCmd, "genkey", "test", "-o", keysDir, "--"+skipMicrosoftCertsFlag)
+		Expect(err).ToNot(HaveOccurred())
+		oldCert, err := signer.ReadCertificate(filepath.Join(keysDir, "db.pem"))
+		Expect(err).ToNot(HaveOccurred())
+		kek, err := os.ReadFile(filepath.Join(keysDir, "KEK.auth"))
+		Expect(err).ToNot(HaveOccurred())
+
+		_, _, err = executeCommandC(rootCmd, "genkey", "rotate", "test", "-k", keysDir)
+		Expect(err).ToNot(HaveOccurred())
+		newCert, err := signer.ReadCertificate(filepath.Join(keysDir, "db.pem"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(newCert.Equal(oldCert)).To(BeFalse())
+		Expect(filepath.Join(keysDir, "db-"+oldCert.SerialNumber.Text(16)+".key")).To(BeARegularFile())
+		Expect(os.ReadFile(filepath.Join(keysDir, "KEK.auth"))).To(Equal(kek))
+
+		esl, err := os.ReadFile(filepath.Join(keysDir, "db.esl"))
+		Expect(err).ToNot(HaveOccurred())
+		sigdb, err := signature.ReadSignatureDatabase(bytes.NewReader(esl))
+		Expect(err).ToNot(HaveOccurred())
+		var certs [][]byte
+		for _, list := range sigdb {
+			for _, sig := range list.Signatures {
+				Expect(sig.Owner).To(Equal(sigdb[0].Signatures[0].Owner))
+				certs = append(certs, sig.Data)
+			}
+		}
+		Expect(certs).To(Equal([][]byte{oldCert.Raw, newCert.Raw}))
+		der, err := os.ReadFile(filepath.Join(keysDir, "db.der"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(x509.ParseCertificates(der)).To(HaveLen(2))
+		Expect(der).To(Equal(append(oldCert.Raw, newCert.Raw...)))
+		leftovers, err := filepath.Glob(filepath.Join(keysDir, ".*"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(leftovers).To(BeEmpty())
+
+		// The update is signed by the KEK and only appends the new certificate
+		update, err := os.ReadFile(filepath.Join(keysDir, "db.auth"))
+		Expect(err).ToNot(HaveOccurred())
+		auth, err := signature.ReadEFIVariableAuthencation2(bytes.NewReader(update))
+		Expect(err).ToNot(HaveOccurred())
+		kekCert, err := signer.ReadCertificate(filepath.Join(keysDir, "KEK.pem"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(auth.Verify(kekCert)).To(BeTrue())
+		appended := signature.NewSignatureDatabase()
+		Expect(appended.Append(signature.CERT_X509_GUID, sigdb[0].Signatures[0].Owner, newCert.Raw)).To(Succeed())
+		Expect(update).To(HaveSuffix(string(appended.Bytes())))
+	})
+	It("leaves the keys dir as it was if the rotation fails", func() {
+		keysDir, err := os.MkdirTemp("", "enki-genkey-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, keysDir)
+		_, _, err = executeCommandC(rootCmd, "genkey", "test", "-o", keysDir, "--"+skipMicrosoftCertsFlag)
+		Expect(err).ToNot(HaveOccurred())
+		// A directory in place of db.auth makes the rotation fail once every other db file is replaced
+		Expect(os.Remove(filepath.Join(keysDir, "db.auth"))).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(keysDir, "db.auth", "busy"), 0o755)).To(Succeed())
+		before := readDir(keysDir)
+
+		_, _, err = executeCommandC(rootCmd, "genkey", "rotate", "test", "-k", keysDir)
+		Expect(err).To(HaveOccurred())
+		Expect(readDir(keysDir)).To(Equal(before))
+	})
+})
+
+// readDir returns the contents and permissions of the regular files in dir
+func readDir(dir string) map[string]string {
+	files := map[string]string{}
+	entries, err := os.ReadDir(dir)
+	Expect(err).ToNot(HaveOccurred())
+	for _, entry := range entries {
+		info, err := entry.Info()
+		Expect(err).ToNot(HaveOccurred())
+		if !info.Mode().IsRegular() {
+			files[entry.Name()] = info.Mode().String()
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		Expect(err).ToNot(HaveOccurred())
+		files[entry.Name()] = info.Mode().String() + string(data)
+	}
+	return files
+}
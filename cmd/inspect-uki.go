@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/signer"
+	"github.com/kairos-io/enki/pkg/utils"
+	ukiTypes "github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// NewInspectUkiCmd returns a new instance of the inspect-uki subcommand and appends it to
+// the root command.
+func NewInspectUkiCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "inspect-uki FILE",
+		Short: "Show the sections, cmdline, PCR policies and signatures of a UKI",
+		Long: "Show the sections, cmdline, PCR policies and signatures of a UKI, or of any other EFI file like systemd-boot\n\n" +
+			"FILE - EFI file to inspect.\n\n" +
+			"The sections are listed with their size and SHA256, as systemd-stub reads them. If --keys or --sb-cert is set,\n" +
+			"the Authenticode signatures are verified with that db certificate and the command fails if none is valid.\n" +
+			"The kernel, initrd and cmdline can be extracted to a directory with --extract.\n\n" +
+			"Use the global --quiet flag to only get the output in stdout.\n",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+			keys, _ := cmd.Flags().GetString("keys")
+			certFile, _ := cmd.Flags().GetString("sb-cert")
+			format, _ := cmd.Flags().GetString("format")
+			extract, _ := cmd.Flags().GetString("extract")
+
+			if certFile == "" && keys != "" {
+				certFile = filepath.Join(keys, "db.pem")
+			}
+			var certs []*x509.Certificate
+			if certFile != "" {
+				cert, err := signer.ReadCertificate(certFile)
+				if err != nil {
+					cfg.Logger.Errorf("reading the db certificate: %s", err)
+					return err
+				}
+				certs = append(certs, cert)
+			}
+
+			inspection, err := utils.InspectUki(args[0], certs)
+			if err != nil {
+				cfg.Logger.Errorf("inspecting %s: %s", args[0], err)
+				return err
+			}
+			if format == "json" {
+				data, err := json.MarshalIndent(inspection, "", "  ")
+				if err != nil {
+					return err
+				}
+				_, err = cmd.OutOrStdout().Write(append(data, '\n'))
+				if err != nil {
+					return err
+				}
+			} else {
+				printUkiInspection(cmd.OutOrStdout(), inspection)
+			}
+
+			if extract != "" {
+				if err := utils.ExtractUki(args[0], extract); err != nil {
+					cfg.Logger.Errorf("extracting %s: %s", args[0], err)
+					return err
+				}
+				cfg.Logger.Infof("Extracted the kernel, initrd and cmdline to: %s", extract)
+			}
+
+			if len(certs) > 0 {
+				for _, sig := range inspection.Signatures {
+					if *sig.Verified {
+						return nil
+					}
+				}
+				err = fmt.Errorf("no signature of %s is valid for %s", args[0], certFile)
+				cfg.Logger.Errorf("verifying the signatures: %s", err)
+				return err
+			}
+			return nil
+		},
+	}
+	c.Flags().StringP("keys", "k", "", "Directory with the db.pem secure boot certificate to verify the signatures with")
+	c.Flags().String("sb-cert", "", "Secure boot db certificate to verify the signatures with, instead of the one in the keys dir")
+	c.Flags().String("extract", "", "Directory to extract the kernel, initrd and cmdline to")
+	format := newEnumFlag(constants.InspectFormats(), constants.DefaultInspectFormat)
+	c.Flags().Var(format, "format", fmt.Sprintf("Output format [%s]", strings.Join(constants.InspectFormats(), ", ")))
+	return c
+}
+
+// printUkiInspection writes the inspection in a human readable way
+func printUkiInspection(w io.Writer, i *utils.UkiInspection) {
+	fmt.Fprintf(w, "File: %s\n\nSections:\n", i.File)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  NAME\tSIZE\tSHA256\tPROFILE")
+	for _, s := range i.Sections {
+		profile := ""
+		if s.Profile != nil {
+			profile = fmt.Sprint(*s.Profile)
+		}
+		fmt.Fprintf(tw, "  %s\t%d\t%s\t%s\n", s.Name, s.Size, s.SHA256, profile)
+	}
+	_ = tw.Flush()
+
+	if name := i.OsRelease["PRETTY_NAME"]; name != "" {
+		fmt.Fprintf(w, "\nOS release: %s\n", name)
+	}
+	if i.Uname != "" {
+		fmt.Fprintf(w, "Kernel release: %s\n", i.Uname)
+	}
+	if i.Cmdline != "" {
+		fmt.Fprintf(w, "Cmdline: %s\n", i.Cmdline)
+	}
+	if i.SBAT != "" {
+		fmt.Fprintf(w, "\nSBAT:\n  %s\n", strings.ReplaceAll(i.SBAT, "\n", "\n  "))
+	}
+	if i.PCRPKeyFingerprint != "" {
+		fmt.Fprintf(w, "\nPCR public key fingerprint: %s\n", i.PCRPKeyFingerprint)
+	}
+	if i.PCRSig != nil {
+		fmt.Fprintln(w, "PCR policy signatures:")
+		printPCRSig(w, i.PCRSig, "  ")
+	}
+
+	for n, p := range i.Profiles {
+		fmt.Fprintf(w, "\nProfile %d: %s (%s)\n  Cmdline: %s\n", n, p.ID, p.Title, p.Cmdline)
+		if p.PCRSig != nil {
+			fmt.Fprintln(w, "  PCR policy signatures:")
+			printPCRSig(w, p.PCRSig, "    ")
+		}
+	}
+
+	fmt.Fprintln(w, "\nAuthenticode signatures:")
+	if len(i.Signatures) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, s := range i.Signatures {
+		status := ""
+		if s.Verified != nil {
+			status = " (not valid for the db certificate)"
+			if *s.Verified {
+				status = " (valid for the db certificate)"
+			}
+		}
+		fmt.Fprintf(w, "  %s, issued by %s, serial %s%s\n", s.Subject, s.Issuer, s.Serial, status)
+	}
+}
+
+// printPCRSig writes the policies of every PCR bank, with the fingerprint of the key that signed them
+func printPCRSig(w io.Writer, data *ukiTypes.PCRData, indent string) {
+	banks := []struct {
+		name  string
+		banks []ukiTypes.BankData
+	}{{"sha1", data.SHA1}, {"sha256", data.SHA256}, {"sha384", data.SHA384}, {"sha512", data.SHA512}}
+	for _, b := range banks {
+		for _, bank := range b.banks {
+			fmt.Fprintf(w, "%s%s: PCRs %v, policy %s, key %s\n", indent, b.name, bank.PCRs, bank.Pol, bank.PKFP)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(NewInspectUkiCmd())
+}
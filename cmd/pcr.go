@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// NewPcrCmd returns a new instance of the pcr command, with its subcommands
+func NewPcrCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "pcr",
+		Short: "Inspect the TPM measurements of the generated EFI files",
+	}
+	c.AddCommand(NewPcrPredictCmd())
+	return c
+}
+
+// NewPcrPredictCmd returns a new instance of the pcr predict subcommand
+func NewPcrPredictCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "predict FILE_OR_DIR...",
+		Short: "Predict the PCR values of booting the given UKIs and EFI files",
+		Long: "Predict the PCR values of booting the given UKIs and EFI files, as JSON\n\n" +
+			"FILE_OR_DIR - EFI file, like a UKI or systemd-boot, or a directory to look for .efi files in.\n\n" +
+			"For every UKI, the PCR 11 value after each boot phase is reported for each of its profiles, with the signed\n" +
+			"PCR policy of the UKI if any. For every file, the Authenticode hashes measured into PCR 4 are reported.\n" +
+			"If --keys is set, the PCR 7 events of booting with those secure boot keys enrolled are reported too.\n\n" +
+			"Use the global --quiet flag to only get the JSON in stdout.\n",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+			keys, _ := cmd.Flags().GetString("keys")
+			bank, _ := cmd.Flags().GetString("bank")
+			output, _ := cmd.Flags().GetString("output")
+
+			files, err := utils.FindEfiFiles(args)
+			if err != nil {
+				cfg.Logger.Errorf("finding EFI files: %s", err)
+				return err
+			}
+			prediction, err := utils.PredictPCRs(files, keys, bank)
+			if err != nil {
+				cfg.Logger.Errorf("predicting PCR values: %s", err)
+				return err
+			}
+			data, err := json.MarshalIndent(prediction, "", "  ")
+			if err != nil {
+				return err
+			}
+			data = append(data, '\n')
+			if output == "" {
+				_, err = cmd.OutOrStdout().Write(data)
+				return err
+			}
+			if err = os.WriteFile(output, data, 0644); err != nil {
+				cfg.Logger.Errorf("writing %s: %s", output, err)
+				return err
+			}
+			return nil
+		},
+	}
+	c.Flags().StringP("keys", "k", "", "Directory with the secure boot keys, to predict the PCR 7 events")
+	c.Flags().StringP("output", "o", "", "File to write the prediction to, instead of stdout")
+	bank := newEnumFlag(constants.PCRBanks(), constants.DefaultPCRBank)
+	c.Flags().Var(bank, "bank", fmt.Sprintf("PCR bank of the predicted digests [%s]", strings.Join(constants.PCRBanks(), ", ")))
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewPcrCmd())
+}
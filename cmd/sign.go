@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"github.com/kairos-io/enki/pkg/action"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// NewSignCmd returns a new instance of the sign subcommand and appends it to
+// the root command.
+func NewSignCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "sign PATH...",
+		Short: "Sign EFI files, like the ones of an unsigned build-uki",
+		Long: "Sign EFI files in place, like the ones of an unsigned build-uki\n\n" +
+			"PATH - EFI file to sign, or output dir of build-uki --unsigned with the " + constants.SignManifestFile + " manifest listing the files to sign.\n\n" +
+			"All the files get an Authenticode signature with the secure boot db key. The PCR policies of the UKI files are\n" +
+			"signed too if there is a PCR key, and the .pcrpkey section with its public key is added if missing.\n" +
+			"The keys default to db.key, db.pem and tpm2-pcr-private.pem in the keys dir. The private keys can be PKCS#11 URIs\n" +
+			"too, like for build-uki.\n",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+			spec := &types.SignSpec{Paths: args}
+			spec.KeysDirectory, _ = cmd.Flags().GetString("keys")
+			spec.SecureBootKey, _ = cmd.Flags().GetString("sb-key")
+			spec.SecureBootCert, _ = cmd.Flags().GetString("sb-cert")
+			spec.PCRKeys, _ = cmd.Flags().GetStringArray("pcr-key")
+			spec.PCRPhases, _ = cmd.Flags().GetStringArray("pcr-phases")
+			spec.PrivateKeySource, _ = cmd.Flags().GetString("private-key-source")
+			if err := spec.Sanitize(); err != nil {
+				cfg.Logger.Errorf("invalid sign options: %s", err)
+				return err
+			}
+
+			if err := action.NewSignAction(cfg, spec).Run(); err != nil {
+				cfg.Logger.Errorf("signing: %s", err)
+				return err
+			}
+			return nil
+		},
+	}
+	c.Flags().StringP("keys", "k", "", "Directory with the db.key, db.pem and tpm2-pcr-private.pem keys")
+	c.Flags().String("sb-key", "", "Secure boot db key to sign the EFI files with, a PEM file or a PKCS#11 URI")
+	c.Flags().String("sb-cert", "", "Secure boot db certificate of the key")
+	c.Flags().StringArray("pcr-key", []string{}, "RSA key to sign the PCR policies of the UKI files with, a PEM file or a PKCS#11 URI. Can be repeated to sign with several keys.")
+	c.Flags().StringArray("pcr-phases", []string{}, "Comma separated phase paths to sign the PCR policies of the --pcr-key at the same position for, like build-uki. Can be repeated, once per key.")
+	c.Flags().String("private-key-source", constants.DefaultPrivateKeySource, "OpenSSL engine or provider to use the PKCS#11 keys with, as engine:NAME or provider:NAME")
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewSignCmd())
+}
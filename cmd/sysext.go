@@ -3,7 +3,11 @@ package cmd
 import (
 	"fmt"
 	"github.com/gofrs/uuid"
+	container "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/signer"
+	enkiutils "github.com/kairos-io/enki/pkg/utils"
 	"github.com/kairos-io/kairos-sdk/sysext"
 	"github.com/kairos-io/kairos-sdk/utils"
 	"github.com/spf13/cobra"
@@ -25,6 +29,9 @@ func NewSysextCmd() *cobra.Command {
 			if arch != "amd64" && arch != "arm64" {
 				return fmt.Errorf("unsupported architecture: %s", arch)
 			}
+			if _, _, err := signer.ParseKeySource(viper.GetString("private-key-source")); err != nil {
+				return err
+			}
 			return nil
 		},
 		RunE: func(cobraCmd *cobra.Command, args []string) error {
@@ -115,6 +122,10 @@ func NewSysextCmd() *cobra.Command {
 				fmt.Sprintf("--private-key=%s", viper.Get("private-key")),
 				fmt.Sprintf("--certificate=%s", viper.Get("certificate")),
 			)
+			if signer.IsPKCS11URI(viper.GetString("private-key")) {
+				// systemd-repart uses the key in the token through OpenSSL too
+				command.Args = append(command.Args, fmt.Sprintf("--private-key-source=%s", viper.GetString("private-key-source")))
+			}
 			out, err := command.CombinedOutput()
 			cfg.Logger.Logger.Debug().Str("output", string(out)).Msg("building sysext")
 			if err != nil {
@@ -123,14 +134,32 @@ func NewSysextCmd() *cobra.Command {
 			}
 
 			cfg.Logger.Logger.Info().Str("output", output).Msg("🎉 Done sysext creation")
+
+			if ref := viper.GetString("push"); ref != "" {
+				cfg.Logger.Logger.Info().Str("ref", ref).Msg("📤 Pushing sysext")
+				platform := &container.Platform{OS: "linux", Architecture: viper.GetString("arch")}
+				artifact, err := enkiutils.FileArtifact(output, constants.SysextArtifactType, constants.SysextLayerType, platform)
+				if err != nil {
+					cfg.Logger.Logger.Error().Err(err).Str("output", output).Msg("⛔ creating sysext artifact")
+					return err
+				}
+				pushed, err := enkiutils.PushImage(artifact, ref)
+				if err != nil {
+					cfg.Logger.Logger.Error().Err(err).Str("ref", ref).Msg("⛔ pushing sysext")
+					return err
+				}
+				cfg.Logger.Logger.Info().Str("ref", pushed).Msg("🎉 Done sysext push")
+			}
 			return nil
 		},
 	}
-	c.Flags().String("private-key", "", "Private key to sign the sysext with")
+	c.Flags().String("private-key", "", "Private key to sign the sysext with, a PEM file or a PKCS#11 URI like \"pkcs11:token=kairos;object=sysext;type=private\". PKCS#11 keys need systemd-repart 256 or newer.")
+	c.Flags().String("private-key-source", constants.DefaultPrivateKeySource, "OpenSSL engine or provider to use a PKCS#11 private key with, as engine:NAME or provider:NAME")
 	c.Flags().String("certificate", "", "Certificate to sign the sysext with")
 	c.Flags().Bool("service-reload", false, "Make systemctl reload the service when loading the sysext. This is useful for sysext that provide systemd service files.")
 	c.Flags().String("arch", "amd64", "Arch to get the image from and build the sysext for. Accepts amd64 and arm64 values.")
 	c.Flags().String("output", "", "Output dir")
+	c.Flags().String("push", "", "Reference to push the sysext to as an OCI artifact, like quay.io/org/sysext:v1.0.0. The credentials are read from the docker config file.")
 	_ = c.MarkFlagRequired("private-key")
 	_ = c.MarkFlagRequired("certificate")
 
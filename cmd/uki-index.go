@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// NewUkiIndexCmd returns a new instance of the uki-index subcommand and appends it to
+// the root command.
+func NewUkiIndexCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "uki-index OUTPUT IMAGE...",
+		Short: "Combine UKI container images of different architectures into an OCI image index",
+		Long: "Combine UKI container images of different architectures into an OCI image index\n\n" +
+			"IMAGE - image tarball generated by build-uki with the container output type. There can only be one image per platform.\n" +
+			"The build-uki tarballs are named after the version only, so build every arch to a different output dir or with --name.\n" +
+			"OUTPUT - OCI layout directory to write the index to. If it ends with .tar, a tarball of the layout is written instead.\n\n" +
+			"Set the SOURCE_DATE_EPOCH environment variable to use it as the timestamp of the tarball entries for reproducible builds.\n",
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.ReadConfigBuild(viper.GetString("config-dir"), cmd.Flags())
+			if err != nil {
+				return err
+			}
+
+			// Set this after parsing of the flags, so it fails on parsing and prints usage properly
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true // Do not propagate errors down the line, we control them
+
+			tag, _ := cmd.Flags().GetString("tag")
+			err = utils.CreateImageIndex(args[1:], args[0], tag, cfg.SourceDateEpoch)
+			if err != nil {
+				cfg.Logger.Errorf("creating image index: %s", err)
+				return err
+			}
+			cfg.Logger.Infof("Done building image index at: %s", args[0])
+			return nil
+		},
+	}
+	c.Flags().String("tag", "", "Reference name of the index in the OCI layout, like \"v3.2.1\"")
+	return c
+}
+
+func init() {
+	rootCmd.AddCommand(NewUkiIndexCmd())
+}
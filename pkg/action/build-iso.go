@@ -15,18 +15,27 @@ import (
 )
 
 type BuildISOAction struct {
-	cfg  *types.BuildConfig
-	spec *types.LiveISO
-	e    *elemental.Elemental
+	cfg    *types.BuildConfig
+	spec   *types.LiveISO
+	e      *elemental.Elemental
+	writer utils.ISOWriter
 }
 
 type BuildISOActionOption func(a *BuildISOAction)
 
+// WithISOWriter sets the writer used to create the ISO image, overriding the configured backend
+func WithISOWriter(writer utils.ISOWriter) BuildISOActionOption {
+	return func(a *BuildISOAction) {
+		a.writer = writer
+	}
+}
+
 func NewBuildISOAction(cfg *types.BuildConfig, spec *types.LiveISO, opts ...BuildISOActionOption) *BuildISOAction {
 	b := &BuildISOAction{
-		cfg:  cfg,
-		e:    elemental.NewElemental(&cfg.Config),
-		spec: spec,
+		cfg:    cfg,
+		e:      elemental.NewElemental(&cfg.Config),
+		spec:   spec,
+		writer: utils.NewISOWriter(cfg.ISOBackend, cfg.Runner, cfg.Logger),
 	}
 	for _, opt := range opts {
 		opt(b)
@@ -188,10 +197,15 @@ func (b BuildISOAction) createEFI(rootdir string, isoDir string) error {
 	// workaround this by copying it there as well
 	// read the kairos-release from the rootfs to know if we are creating a ubuntu based iso
 	var flavor string
-	flavor, err = sdk.OSRelease("FLAVOR", filepath.Join(rootdir, "etc/kairos-release"))
+	// OSRelease reads from the host, so use the raw paths of the rootfs
+	rawRootdir, err := b.cfg.Fs.RawPath(rootdir)
+	if err != nil {
+		return err
+	}
+	flavor, err = sdk.OSRelease("FLAVOR", filepath.Join(rawRootdir, "etc/kairos-release"))
 	if err != nil {
 		// fallback to os-release
-		flavor, err = sdk.OSRelease("FLAVOR", filepath.Join(rootdir, "etc/os-release"))
+		flavor, err = sdk.OSRelease("FLAVOR", filepath.Join(rawRootdir, "etc/os-release"))
 		if err != nil {
 			b.cfg.Logger.Warnf("Failed reading os-release from %s and %s: %v", filepath.Join(rootdir, "etc/kairos-release"), filepath.Join(rootdir, "etc/os-release"), err)
 			return err
@@ -381,12 +395,14 @@ func (b BuildISOAction) copyGrub(tempdir, rootdir string) error {
 }
 
 func (b BuildISOAction) burnISO(root string) error {
-	cmd := "xorriso"
 	var outputFile string
 	var isoFileName string
 
 	if b.cfg.Date {
 		currTime := time.Now()
+		if !b.cfg.SourceDateEpoch.IsZero() {
+			currTime = b.cfg.SourceDateEpoch
+		}
 		isoFileName = fmt.Sprintf("%s.%s.iso", b.cfg.Name, currTime.Format("20060102"))
 	} else {
 		isoFileName = fmt.Sprintf("%s.iso", b.cfg.Name)
@@ -405,14 +421,26 @@ func (b BuildISOAction) burnISO(root string) error {
 		}
 	}
 
-	args := []string{
-		"-volid", b.spec.Label, "-joliet", "on", "-padding", "0",
-		"-outdev", outputFile, "-map", root, "/", "-chmod", "0755", "--",
+	// The writer works on the host paths, not on the ones of the configured filesystem
+	rawRoot, err := b.cfg.Fs.RawPath(root)
+	if err != nil {
+		return err
+	}
+	rawOutput, err := b.cfg.Fs.RawPath(outputFile)
+	if err != nil {
+		return err
 	}
-	args = append(args, constants.GetXorrisoBooloaderArgs(root)...)
 
-	out, err := b.cfg.Runner.Run(cmd, args...)
-	b.cfg.Logger.Debugf("Xorriso: %s", string(out))
+	err = b.writer.Write(utils.ISOSpec{
+		Label:        b.spec.Label,
+		Root:         rawRoot,
+		Output:       rawOutput,
+		ModTime:      b.cfg.SourceDateEpoch,
+		BIOSImage:    constants.IsoBootFile,
+		BootCatalog:  constants.IsoBootCatalog,
+		HybridMBR:    filepath.Join(rawRoot, constants.IsoHybridMBR),
+		EFIPartition: filepath.Join(rawRoot, constants.IsoEFIPath),
+	})
 	if err != nil {
 		return err
 	}
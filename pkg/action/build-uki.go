@@ -1,23 +1,31 @@
 package action
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
-	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/google/uuid"
 	"github.com/kairos-io/enki/pkg/constants"
-	"github.com/klauspost/compress/zstd"
+	"github.com/kairos-io/enki/pkg/cpio"
+	"github.com/kairos-io/enki/pkg/disk"
+	"github.com/kairos-io/enki/pkg/fat32"
+	"github.com/kairos-io/enki/pkg/kmod"
+	"github.com/kairos-io/enki/pkg/signer"
 	"github.com/sanity-io/litter"
-	"github.com/spf13/viper"
-	"github.com/u-root/u-root/pkg/cpio"
 	"golang.org/x/exp/maps"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/kairos-io/enki/pkg/types"
 	"github.com/kairos-io/enki/pkg/utils"
@@ -27,34 +35,58 @@ import (
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
 )
 
+// releaseLabels are the kairos-release values set as labels of the container images
+var releaseLabels = map[string]string{
+	"KAIROS_FLAVOR":           "io.kairos.flavor",
+	"KAIROS_FLAVOR_RELEASE":   "io.kairos.flavor-release",
+	"KAIROS_MODEL":            "io.kairos.model",
+	"KAIROS_VARIANT":          "io.kairos.variant",
+	"KAIROS_TARGETARCH":       "io.kairos.targetarch",
+	"KAIROS_SOFTWARE_VERSION": "io.kairos.software-version",
+	"KAIROS_RELEASE":          "io.kairos.release",
+}
+
 type BuildUKIAction struct {
-	img           *v1.ImageSource
-	e             *elemental.Elemental
-	outputDir     string
-	keysDirectory string
-	logger        sdkTypes.KairosLogger
-	outputType    string
-	version       string
-	arch          string
-	name          string
-}
-
-func NewBuildUKIAction(cfg *types.BuildConfig, img *v1.ImageSource, outputDir, keysDirectory, outputType string) *BuildUKIAction {
+	spec            *types.BuildUKISpec
+	e               *elemental.Elemental
+	fs              v1.FS
+	logger          sdkTypes.KairosLogger
+	version         string
+	arch            string
+	name            string
+	isoBackend      string
+	isoWriter       utils.ISOWriter
+	runner          v1.Runner
+	sourceDateEpoch time.Time
+	// release are the values of the kairos-release file of the rootfs
+	release map[string]string
+	// entries are the boot entries built
+	entries []utils.BootEntry
+	// initrdSizes are the sizes of the files in the initramfs, to show what makes the UKI files big
+	initrdSizes map[string]int64
+}
+
+func NewBuildUKIAction(cfg *types.BuildConfig, spec *types.BuildUKISpec) *BuildUKIAction {
 	b := &BuildUKIAction{
-		logger:        cfg.Logger,
-		img:           img,
-		e:             elemental.NewElemental(&cfg.Config),
-		outputDir:     outputDir,
-		keysDirectory: keysDirectory,
-		outputType:    outputType,
-		arch:          cfg.Arch,
-		name:          cfg.Name,
+		logger:          cfg.Logger,
+		spec:            spec,
+		e:               elemental.NewElemental(&cfg.Config),
+		fs:              cfg.Fs,
+		arch:            cfg.Arch,
+		name:            cfg.Name,
+		isoBackend:      cfg.ISOBackend,
+		isoWriter:       utils.NewISOWriter(cfg.ISOBackend, cfg.Runner, cfg.Logger),
+		runner:          cfg.Runner,
+		sourceDateEpoch: cfg.SourceDateEpoch,
 	}
 	b.logger.Debugf("BuildUKIAction: %+v", litter.Sdump(b))
 	return b
 }
 
 func (b *BuildUKIAction) Run() error {
+	if b.spec.Image == nil {
+		return fmt.Errorf("no source image set")
+	}
 	err := b.checkDeps()
 	if err != nil {
 		return err
@@ -76,9 +108,9 @@ func (b *BuildUKIAction) Run() error {
 	}
 	defer os.RemoveAll(sourceDir)
 
-	if viper.GetString("overlay-rootfs") != "" {
-		b.logger.Infof("Adding files from %s to rootfs", viper.GetString("overlay-rootfs"))
-		overlay, err := v1.NewSrcFromURI(fmt.Sprintf("dir:%s", viper.GetString("overlay-rootfs")))
+	if b.spec.OverlayRootfs != "" {
+		b.logger.Infof("Adding files from %s to rootfs", b.spec.OverlayRootfs)
+		overlay, err := v1.NewSrcFromURI(fmt.Sprintf("dir:%s", b.spec.OverlayRootfs))
 		if err != nil {
 			b.logger.Errorf("error creating overlay image: %s", err)
 			return err
@@ -91,131 +123,501 @@ func (b *BuildUKIAction) Run() error {
 		}
 	}
 
-	// Store the version so we only need to check it once
-	kairosVersion, err := findKairosVersion(sourceDir)
+	// Store the release values so we only need to read them once
+	b.release, err = utils.ReadKairosRelease(sourceDir)
 	if err != nil {
 		return err
 	}
-	b.version = kairosVersion
+	b.version = b.release["KAIROS_RELEASE"]
+	if b.version == "" {
+		return fmt.Errorf("KAIROS_RELEASE is not set in the kairos-release file")
+	}
 
 	b.logger.Info("Creating additional directories in the rootfs")
 	if err := b.setupDirectoriesAndFiles(sourceDir); err != nil {
 		return err
 	}
 
+	if err := b.prepareSource(sourceDir, artifactsTempDir); err != nil {
+		return err
+	}
+
+	b.logger.Info("Creating an initramfs file")
+	if err := b.createInitramfs(sourceDir, artifactsTempDir); err != nil {
+		return err
+	}
+
+	entries, err := b.bootEntries()
+	if err != nil {
+		return err
+	}
+	b.entries = entries
+	if err := b.buildUKIs(sourceDir, artifactsTempDir, entries); err != nil {
+		return err
+	}
+	if err := b.checkUKISizes(sourceDir, entries); err != nil {
+		return err
+	}
+
+	b.logger.Info("Creating kairos and loader conf files")
+	for _, entry := range entries {
+		if err := b.createConfFiles(sourceDir, entry); err != nil {
+			return err
+		}
+	}
+
+	err = b.createSystemdConf(sourceDir)
+	if err != nil {
+		return err
+	}
+
+	if b.spec.PCRPredict {
+		if err := b.predictPCRs(sourceDir); err != nil {
+			return err
+		}
+	}
+
+	switch b.spec.OutputType {
+	case string(constants.IsoOutput):
+		err = b.createISO(sourceDir)
+		b.logger.Infof("Done building %s at: %s", b.spec.OutputType, b.spec.OutputDir)
+	case string(constants.ContainerOutput):
+		err = b.createContainer(sourceDir)
+		if err != nil {
+			return err
+		}
+	case string(constants.RawOutput), string(constants.Qcow2Output):
+		err = b.createDiskImage(sourceDir)
+		if err != nil {
+			return err
+		}
+		b.logger.Infof("Done building %s at: %s", b.spec.OutputType, b.spec.OutputDir)
+	case string(constants.DefaultOutput):
+		err = b.createArtifact(sourceDir, b.spec.OutputDir)
+		if err != nil {
+			return err
+		}
+		if b.spec.Unsigned {
+			if err = b.writeSignManifest(sourceDir); err != nil {
+				return err
+			}
+			b.logger.Infof("The EFI files are not signed, sign them with: enki sign %s", b.spec.OutputDir)
+		}
+		b.logger.Infof("Done building %s at: %s", b.spec.OutputType, b.spec.OutputDir)
+	}
+
+	return err
+}
+
+// prepareSource copies the kernel of sourceDir into artifactsTempDir and leaves in sourceDir the files for the
+// initramfs. The kernel configs are checked before the boot dir holding them is removed.
+func (b *BuildUKIAction) prepareSource(sourceDir, artifactsTempDir string) error {
 	b.logger.Info("Copying kernel")
 	if err := b.copyKernel(sourceDir, artifactsTempDir); err != nil {
 		return err
 	}
+	b.checkKernelCompression(sourceDir)
 
 	b.logger.Info("Cleaning up the source directory")
 	b.cleanSource(sourceDir)
 
-	b.logger.Info("Creating an initramfs file")
-	if err := b.createInitramfs(sourceDir, artifactsTempDir); err != nil {
+	if b.spec.HardwareProfile != "" {
+		if err := b.pruneKernelModules(sourceDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildUKIs builds the UKI file of every entry into sourceDir, running up to the configured number of builds in parallel.
+// All the entries share the kernel and initrd from artifactsTempDir, and the signed systemd-boot.
+func (b *BuildUKIAction) buildUKIs(sourceDir, artifactsTempDir string, entries []utils.BootEntry) error {
+	if b.logger.GetLevel().String() == "debug" {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+	if b.spec.MultiProfile {
+		return b.buildMultiProfileUKI(sourceDir, artifactsTempDir, entries)
+	}
+
+	stub, err := b.getEfiStub()
+	if err != nil {
+		return err
+	}
+	// Get systemd-boot info, it is signed along with the UKI files
+	systemdBoot, outputSystemdBootEfi, err := b.systemdBoot()
+	if err != nil {
+		return err
+	}
+	if stub, systemdBoot, err = b.addSbat(artifactsTempDir, stub, systemdBoot); err != nil {
+		return err
+	}
+
+	sbSigner, pcrPolicies, err := b.signers()
+	if err != nil {
+		return err
+	}
+	if err := b.signOrCopy(sbSigner, systemdBoot, filepath.Join(sourceDir, outputSystemdBootEfi)); err != nil {
+		return fmt.Errorf("signing systemd-boot: %w", err)
+	}
+	unsignedDir := filepath.Join(artifactsTempDir, "uki")
+	if err := os.MkdirAll(unsignedDir, constants.DirPerm); err != nil {
 		return err
 	}
 
-	entries := append(utils.GetUkiCmdline(), utils.GetUkiSingleCmdlines(b.logger)...)
+	workers := b.spec.Workers
+	if workers <= 0 {
+		workers = min(runtime.NumCPU(), constants.UkiMaxDefaultWorkers)
+	}
+	b.logger.Infof("Building %d UKI files with up to %d workers", len(entries), workers)
+
+	g := new(errgroup.Group)
+	g.SetLimit(workers)
 	for _, entry := range entries {
-		b.logger.Info(fmt.Sprintf("Running ukify for cmdline: %s: %s", entry.Title, entry.Cmdline))
+		builder := &uki.Builder{
+			Arch:       b.arch,
+			Version:    b.version,
+			SdStubPath: stub,
+			KernelPath: filepath.Join(artifactsTempDir, "vmlinuz"),
+			InitrdPath: filepath.Join(artifactsTempDir, "initrd"),
+			Cmdline:    entry.Cmdline,
+			OsRelease:  filepath.Join(sourceDir, "etc/os-release"),
+			OutUKIPath: filepath.Join(unsignedDir, entry.FileName+".efi"),
+			Splash:     b.spec.Splash,
+		}
 
-		b.logger.Infof("Generating: " + entry.FileName + ".efi")
+		g.Go(func() error {
+			b.logger.Infof("Running ukify for cmdline: %s: %s", entry.Title, entry.Cmdline)
+			b.logger.Infof("Generating: %s.efi", entry.FileName)
+			if err := buildUnsigned(builder); err != nil {
+				return fmt.Errorf("building %s.efi: %w", entry.FileName, err)
+			}
+			if err := b.signUki(sbSigner, pcrPolicies, builder.OutUKIPath, filepath.Join(sourceDir, entry.FileName+".efi")); err != nil {
+				return fmt.Errorf("signing %s.efi: %w", entry.FileName, err)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
 
-		// New ukifier !!
-		// Create Builder instance
-		stub, err := b.getEfiStub()
+// buildMultiProfileUKI builds a single UKI file into sourceDir with a profile for each entry, so the kernel and initrd
+// are stored once. The base UKI is built without signing, the profiles with their cmdline are appended to it and then
+// its PCR policies and itself are signed along with systemd-boot.
+func (b *BuildUKIAction) buildMultiProfileUKI(sourceDir, artifactsTempDir string, entries []utils.BootEntry) error {
+	stub, err := b.getEfiStub()
+	if err != nil {
+		return err
+	}
+	systemdBoot, outputSystemdBootEfi, err := b.systemdBoot()
+	if err != nil {
+		return err
+	}
+	for _, file := range []string{stub, systemdBoot} {
+		version, err := utils.SystemdBootVersion(file)
 		if err != nil {
-			return err
+			b.logger.Warnf("Not checking if %s supports multi-profile UKIs: %s", file, err)
+			continue
 		}
-		// Get systemd-boot info (we can sign it at the same time)
-		var systemdBoot string
-		var outputSystemdBootEfi string
-		if utils.IsAmd64(b.arch) {
-			systemdBoot = constants.UkiSystemdBootx86
-			outputSystemdBootEfi = constants.EfiFallbackNamex86
-		} else if utils.IsArm64(b.arch) {
-			systemdBoot = constants.UkiSystemdBootArm
-			outputSystemdBootEfi = constants.EfiFallbackNameArm
-		} else {
-			return fmt.Errorf("unsupported arch: %s", b.arch)
+		if version < constants.UkiProfilesMinVersion {
+			return fmt.Errorf("multi-profile UKIs need systemd %d, but %s is version %d", constants.UkiProfilesMinVersion, file, version)
 		}
+	}
+	if stub, systemdBoot, err = b.addSbat(artifactsTempDir, stub, systemdBoot); err != nil {
+		return err
+	}
+
+	sbSigner, pcrPolicies, err := b.signers()
+	if err != nil {
+		return err
+	}
+
+	builder := &uki.Builder{
+		Arch:       b.arch,
+		Version:    b.version,
+		SdStubPath: stub,
+		KernelPath: filepath.Join(artifactsTempDir, "vmlinuz"),
+		InitrdPath: filepath.Join(artifactsTempDir, "initrd"),
+		Cmdline:    entries[0].Cmdline,
+		OsRelease:  filepath.Join(sourceDir, "etc/os-release"),
+		OutUKIPath: filepath.Join(artifactsTempDir, "base.efi"),
+		Splash:     b.spec.Splash,
+	}
+	b.logger.Infof("Generating: %s.efi with %d profiles", entries[0].EfiName(), len(entries))
+	if err := buildUnsigned(builder); err != nil {
+		return fmt.Errorf("building the base UKI: %w", err)
+	}
+
+	var profiles []utils.UkiProfile
+	for _, entry := range entries {
+		b.logger.Infof("Adding profile %d for cmdline: %s: %s", entry.Profile, entry.Title, entry.Cmdline)
+		profiles = append(profiles, utils.UkiProfile{ID: entry.FileName, Title: entry.Title, Cmdline: entry.Cmdline})
+	}
+	profilesUKI := filepath.Join(artifactsTempDir, "profiles.efi")
+	if err := utils.AddUkiProfiles(builder.OutUKIPath, profilesUKI, profiles); err != nil {
+		return err
+	}
+	if err := b.signUki(sbSigner, pcrPolicies, profilesUKI, filepath.Join(sourceDir, entries[0].EfiName()+".efi")); err != nil {
+		return fmt.Errorf("signing %s.efi: %w", entries[0].EfiName(), err)
+	}
+	if err := b.signOrCopy(sbSigner, systemdBoot, filepath.Join(sourceDir, outputSystemdBootEfi)); err != nil {
+		return fmt.Errorf("signing systemd-boot: %w", err)
+	}
+	return nil
+}
 
-		if b.logger.GetLevel().String() == "debug" {
-			slog.SetLogLoggerLevel(slog.LevelDebug)
+// addSbat returns copies of the stub and systemd-boot in dir with the SBAT entries of the spec added, so every UKI
+// built from the stub gets them too. The files are returned as is if there are none.
+func (b *BuildUKIAction) addSbat(dir, stub, systemdBoot string) (string, string, error) {
+	if len(b.spec.SBAT) == 0 {
+		return stub, systemdBoot, nil
+	}
+	var entries []string
+	for _, e := range b.spec.SBAT {
+		entries = append(entries, e.String())
+	}
+	b.logger.Infof("Adding the SBAT entries: %s", strings.Join(entries, " "))
+	var files []string
+	for _, file := range []string{stub, systemdBoot} {
+		output := filepath.Join(dir, filepath.Base(file))
+		if err := utils.AddSbatEntries(file, output, entries); err != nil {
+			return "", "", fmt.Errorf("adding the SBAT entries to %s: %w", file, err)
 		}
-		builder := &uki.Builder{
-			Arch:          b.arch,
-			Version:       b.version,
-			SdStubPath:    stub,
-			KernelPath:    filepath.Join(artifactsTempDir, "vmlinuz"),
-			InitrdPath:    filepath.Join(artifactsTempDir, "initrd"),
-			Cmdline:       entry.Cmdline,
-			OsRelease:     filepath.Join(sourceDir, "etc/os-release"),
-			OutUKIPath:    entry.FileName + ".efi",
-			PCRKey:        filepath.Join(b.keysDirectory, "tpm2-pcr-private.pem"),
-			SBKey:         filepath.Join(b.keysDirectory, "db.key"),
-			SBCert:        filepath.Join(b.keysDirectory, "db.pem"),
-			SdBootPath:    systemdBoot,
-			OutSdBootPath: outputSystemdBootEfi,
-			Splash:        viper.GetString("splash"),
-		}
-
-		if err := os.Chdir(sourceDir); err != nil {
-			return fmt.Errorf("changing to %s directory: %w", sourceDir, err)
-		}
-
-		if err := builder.Build(); err != nil {
+		files = append(files, output)
+	}
+	return files[0], files[1], nil
+}
+
+// buildUnsigned builds the UKI file without signing it, so enki signs its PCR policies and the file itself afterwards
+func buildUnsigned(builder *uki.Builder) error {
+	if err := builder.Build(); err != nil {
+		return err
+	}
+	// ukify writes the unsigned files with "signed" replaced by "unsigned" in their path
+	if unsignedPath := strings.ReplaceAll(builder.OutUKIPath, "signed", "unsigned"); unsignedPath != builder.OutUKIPath {
+		return os.Rename(unsignedPath, builder.OutUKIPath)
+	}
+	return nil
+}
+
+// signUki signs the PCR policies of the UKI file and the file itself into output, or copies it as is for unsigned
+// builds
+func (b *BuildUKIAction) signUki(sbSigner *signer.PESigner, pcrPolicies []signer.PCRPolicy, input, output string) error {
+	if len(pcrPolicies) > 0 {
+		withPCR := strings.TrimSuffix(input, ".efi") + ".pcr.efi"
+		if err := utils.AddUkiPCRSignatures(input, withPCR, pcrPolicies); err != nil {
 			return err
 		}
+		input = withPCR
+	}
+	return b.signOrCopy(sbSigner, input, output)
+}
 
-		b.logger.Info("Creating kairos and loader conf files")
-		if err := b.createConfFiles(sourceDir, entry.Cmdline, entry.Title, entry.FileName); err != nil {
-			return err
+// signOrCopy signs the EFI file into output, or copies it as is if there is no signer for unsigned builds
+func (b *BuildUKIAction) signOrCopy(sbSigner *signer.PESigner, input, output string) error {
+	if sbSigner == nil {
+		return utils.CopyFile(b.fs, input, output)
+	}
+	return sbSigner.Sign(input, output)
+}
+
+// signers returns the signer of the EFI files and the ones of the PCR policies, with the keys of the spec or the ones
+// in the keys directory. There are none for unsigned builds.
+func (b *BuildUKIAction) signers() (*signer.PESigner, []signer.PCRPolicy, error) {
+	if b.spec.Unsigned {
+		return nil, nil, nil
+	}
+	sbKey := b.spec.SecureBootKey
+	if sbKey == "" {
+		sbKey = filepath.Join(b.spec.KeysDirectory, "db.key")
+	}
+	pcrKeys := b.spec.PCRKeys
+	if len(pcrKeys) == 0 {
+		pcrKeys = []string{filepath.Join(b.spec.KeysDirectory, "tpm2-pcr-private.pem")}
+	}
+	sbSigner, err := signer.SecureBoot(filepath.Join(b.spec.KeysDirectory, "db.pem"), sbKey, b.spec.PrivateKeySource)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the secure boot key: %w", err)
+	}
+	// The signatures carry the signing time, so it is the one of the build for it to be reproducible
+	sbSigner.SigningTime = b.sourceDateEpoch
+	pcrPolicies, err := signer.PCRPolicies(pcrKeys, b.spec.PCRPhases, b.spec.PrivateKeySource)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the PCR policy keys: %w", err)
+	}
+	return sbSigner, pcrPolicies, nil
+}
+
+// systemdBoot returns the systemd-boot binary for the arch, and its name in the ESP
+func (b *BuildUKIAction) systemdBoot() (string, string, error) {
+	if utils.IsAmd64(b.arch) {
+		return constants.UkiSystemdBootx86, constants.EfiFallbackNamex86, nil
+	} else if utils.IsArm64(b.arch) {
+		return constants.UkiSystemdBootArm, constants.EfiFallbackNameArm, nil
+	}
+	return "", "", fmt.Errorf("unsupported arch: %s", b.arch)
+}
+
+// writeSignManifest writes the manifest of the EFI files to sign into the output dir, as laid out by createArtifact
+func (b *BuildUKIAction) writeSignManifest(sourceDir string) error {
+	filesMap, err := b.imageFiles(sourceDir)
+	if err != nil {
+		return err
+	}
+	var files []utils.SignFile
+	for _, dir := range []string{"EFI/BOOT", "EFI/kairos"} {
+		for _, f := range filesMap[dir] {
+			files = append(files, utils.SignFile{Path: filepath.Join(dir, filepath.Base(f)), UKI: dir == "EFI/kairos"})
 		}
 	}
+	return utils.WriteSignManifest(b.fs, b.spec.OutputDir, files)
+}
 
-	err = b.createSystemdConf(sourceDir)
+// predictPCRs writes the expected PCR values of booting systemd-boot and the UKI files in sourceDir to the output dir
+func (b *BuildUKIAction) predictPCRs(sourceDir string) error {
+	_, outputSystemdBootEfi, err := b.systemdBoot()
+	if err != nil {
+		return err
+	}
+	// The files are reported by their path in the ESP, not in the temporary dir
+	espPaths := map[string]string{filepath.Join(sourceDir, outputSystemdBootEfi): filepath.Join("EFI/BOOT", outputSystemdBootEfi)}
+	files := []string{filepath.Join(sourceDir, outputSystemdBootEfi)}
+	for _, entry := range b.entries {
+		efi := filepath.Join(sourceDir, entry.EfiName()+".efi")
+		if _, ok := espPaths[efi]; !ok {
+			espPaths[efi] = filepath.Join("EFI/kairos", entry.EfiName()+".efi")
+			files = append(files, efi)
+		}
+	}
+	prediction, err := utils.PredictPCRs(files, b.spec.KeysDirectory, constants.DefaultPCRBank)
+	if err != nil {
+		return fmt.Errorf("predicting PCR values: %w", err)
+	}
+	for i := range prediction.Files {
+		prediction.Files[i].File = espPaths[prediction.Files[i].File]
+	}
+	data, err := json.MarshalIndent(prediction, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	switch b.outputType {
-	case string(constants.IsoOutput):
-		err = b.createISO(sourceDir)
-		b.logger.Infof("Done building %s at: %s", b.outputType, b.outputDir)
-	case string(constants.ContainerOutput):
-		// First create the files
-		err = b.createArtifact(sourceDir)
-		if err != nil {
-			return err
+	name := fmt.Sprintf("kairos_%s", b.version)
+	if b.name != "" {
+		name = b.name
+	}
+	output := filepath.Join(b.spec.OutputDir, name+".pcr.json")
+	if err := os.MkdirAll(b.spec.OutputDir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(output, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	b.logger.Infof("Wrote the PCR prediction to %s", output)
+	return nil
+}
+
+// bootEntries returns the boot entries to build a UKI file for, as set by the entries or the cmdline options of the spec
+func (b *BuildUKIAction) bootEntries() ([]utils.BootEntry, error) {
+	entries, err := utils.GetUkiCmdline(b.spec.BootBranding, b.spec.ExtendCmdline, b.spec.ExtraCmdlines, b.spec.Entries)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, utils.GetUkiSingleCmdlines(b.spec.BootBranding, b.spec.SingleEfiCmdlines, b.logger)...)
+	if b.spec.BootTries > 0 {
+		for i, entry := range entries {
+			if entry.Tries == 0 && utils.MatchesAny(entry.FileName, b.spec.BootTriesEntries) {
+				entries[i].Tries = b.spec.BootTries
+			}
+		}
+	}
+	if b.spec.MultiProfile {
+		for i := range entries {
+			entries[i].UKI = constants.UkiMultiProfileName
+			entries[i].Profile = i
 		}
-		// Then build the image
+	}
+	return entries, utils.ValidateBootEntries(entries)
+}
 
-		err = b.createContainer(b.outputDir, kairosVersion)
-		if err != nil {
-			return err
+// checkUKISizes fails if any UKI file is too big to be stored in a FAT32 filesystem and warns about the ones bigger than
+// the efi-size-warn threshold. Either way it shows what takes the most space in the initramfs.
+func (b *BuildUKIAction) checkUKISizes(sourceDir string, entries []utils.BootEntry) error {
+	warnSize := b.spec.EfiSizeWarn * 1024 * 1024
+	var tooBig, overThreshold bool
+	var checked []string
+	for _, entry := range entries {
+		name := entry.EfiName()
+		if slices.Contains(checked, name) {
+			continue
 		}
-		//Then remove the output dir files as we dont need them, the container has been loaded
-		err = b.removeUkiFiles()
+		checked = append(checked, name)
+		info, err := os.Stat(filepath.Join(sourceDir, name+".efi"))
 		if err != nil {
-			return err
+			return fmt.Errorf("checking the size of %s.efi: %w", name, err)
 		}
-	case string(constants.DefaultOutput):
-		err = b.createArtifact(sourceDir)
-		if err != nil {
-			return err
+		size := uint64(info.Size())
+		switch {
+		case info.Size() > constants.UkiMaxSize:
+			b.logger.Errorf("%s.efi is %s, over the FAT32 file size limit", name, humanize.IBytes(size))
+			tooBig = true
+		case warnSize > 0 && info.Size() > warnSize:
+			b.logger.Warnf("%s.efi is %s, over the efi-size-warn threshold of %d MB", name, humanize.IBytes(size), b.spec.EfiSizeWarn)
+			overThreshold = true
 		}
-		b.logger.Infof("Done building %s at: %s", b.outputType, b.outputDir)
 	}
+	if tooBig || overThreshold {
+		b.logInitrdBreakdown()
+	}
+	if tooBig {
+		return fmt.Errorf("UKI files bigger than %s cannot be stored in the EFI partition", humanize.IBytes(constants.UkiMaxSize))
+	}
+	return nil
+}
 
-	return err
+// logInitrdBreakdown shows the biggest directories and files in the initramfs
+func (b *BuildUKIAction) logInitrdBreakdown() {
+	dirs, files := utils.LargestPaths(b.initrdSizes, 4, 15)
+	b.logger.Warnf("Biggest directories in the initramfs:")
+	for _, d := range dirs {
+		b.logger.Warnf("  %10s  /%s", humanize.IBytes(uint64(d.Size)), d.Path)
+	}
+	b.logger.Warnf("Biggest files in the initramfs:")
+	for _, f := range files {
+		b.logger.Warnf("  %10s  /%s", humanize.IBytes(uint64(f.Size)), f.Path)
+	}
+	b.logger.Warnf("Use --initrd-exclude to leave files out of the initramfs")
+}
+
+// loaderOption is an option of loader.conf, with the first systemd-boot version that supports it
+type loaderOption struct {
+	key        string
+	value      string
+	minVersion int
+}
+
+// checkLoaderOptions fails if the systemd-boot installed in the ESP of sourceDir does not support any of the options
+func (b *BuildUKIAction) checkLoaderOptions(sourceDir string, options []loaderOption) error {
+	_, outputSystemdBootEfi, err := b.systemdBoot()
+	if err != nil {
+		return err
+	}
+	systemdBoot := filepath.Join(sourceDir, outputSystemdBootEfi)
+	version, err := utils.SystemdBootVersion(systemdBoot)
+	if err != nil {
+		b.logger.Warnf("Not checking the loader.conf options against the systemd-boot version: %s", err)
+		return nil
+	}
+	for _, o := range options {
+		if version < o.minVersion {
+			return fmt.Errorf("loader.conf option %s %s needs systemd-boot %d, but the one of the image is version %d", o.key, o.value, o.minVersion, version)
+		}
+	}
+	return nil
 }
 
 // createSystemdConf creates the generic conf that systemd-boot uses
 func (b *BuildUKIAction) createSystemdConf(sourceDir string) error {
 	var finalEfiConf string
-	entry := viper.GetString("default-entry")
+	entry := b.spec.DefaultEntry
 	if entry != "" {
 		if !strings.HasSuffix(entry, ".conf") {
 			finalEfiConf = strings.TrimSuffix(entry, " ") + ".conf"
@@ -223,15 +625,55 @@ func (b *BuildUKIAction) createSystemdConf(sourceDir string) error {
 			finalEfiConf = entry
 		}
 
+	} else if i := slices.IndexFunc(b.entries, func(e utils.BootEntry) bool { return e.Default }); i >= 0 {
+		finalEfiConf = b.entries[i].FileName + ".conf"
 	} else {
 		// Get the generic efi file that we produce from the default cmdline
 		// This is the one name that has nothing added, just the version
 		finalEfiConf = utils.NameFromCmdline(constants.ArtifactBaseName, constants.UkiCmdline+" "+constants.UkiCmdlineInstall) + ".conf"
 	}
 
-	secureBootEnroll := viper.GetString("secure-boot-enroll")
 	// Set that as default selection for booting
-	data := fmt.Sprintf("default %s\ntimeout 5\nconsole-mode max\neditor no\nsecure-boot-enroll %s\n", finalEfiConf, secureBootEnroll)
+	options := []loaderOption{
+		{key: "default", value: finalEfiConf},
+		{key: "timeout", value: b.spec.LoaderTimeout},
+		{key: "console-mode", value: b.spec.LoaderConsoleMode},
+		{key: "editor", value: "no"},
+		{key: "secure-boot-enroll", value: b.spec.SecureBootEnroll},
+	}
+	if b.spec.LoaderTimeout == "menu-disabled" {
+		options[1].minVersion = 255
+	}
+	if b.spec.SecureBootEnroll != constants.UkiSecureBootEnroll {
+		options[4].minVersion = 252
+	}
+	for _, o := range []struct {
+		key        string
+		value      *bool
+		minVersion int
+	}{
+		{"auto-entries", b.spec.LoaderAutoEntries, 0},
+		{"auto-firmware", b.spec.LoaderAutoFirmware, 0},
+		{"beep", b.spec.LoaderBeep, 251},
+		{"reboot-for-bitlocker", b.spec.LoaderRebootForBitlocker, 251},
+	} {
+		if o.value == nil {
+			continue
+		}
+		value := "no"
+		if *o.value {
+			value = "yes"
+		}
+		options = append(options, loaderOption{key: o.key, value: value, minVersion: o.minVersion})
+	}
+	if err := b.checkLoaderOptions(sourceDir, options); err != nil {
+		return err
+	}
+
+	data := ""
+	for _, o := range options {
+		data += fmt.Sprintf("%s %s\n", o.key, o.value)
+	}
 	err := os.WriteFile(filepath.Join(sourceDir, "loader.conf"), []byte(data), os.ModePerm)
 	if err != nil {
 		return fmt.Errorf("creating the loader.conf file: %s", err)
@@ -240,7 +682,7 @@ func (b *BuildUKIAction) createSystemdConf(sourceDir string) error {
 }
 
 func (b *BuildUKIAction) extractImage() (string, error) {
-	// TODO: if b.img is a dir, we should not copy or rsync anything and just use that dir as source?
+	// TODO: if b.spec.Image is a dir, we should not copy or rsync anything and just use that dir as source?
 	tmpDir, err := os.MkdirTemp("", "enki-build-uki-")
 	if err != nil {
 		return tmpDir, err
@@ -252,18 +694,21 @@ func (b *BuildUKIAction) extractImage() (string, error) {
 		return tmpDir, err
 	}
 
-	_, err = b.e.DumpSource(tmpDir, b.img)
+	_, err = b.e.DumpSource(tmpDir, b.spec.Image)
 
 	return tmpDir, err
 }
 
 func (b *BuildUKIAction) checkDeps() error {
-	neededBinaries := []string{
-		"dd",
-		"mkfs.msdos",
-		"mmd",
-		"mcopy",
-		"xorriso",
+	var neededBinaries []string
+	if b.spec.OutputType == string(constants.IsoOutput) && b.isoBackend == constants.XorrisoISOBackend {
+		neededBinaries = append(neededBinaries, "xorriso")
+	}
+	if b.isDiskImage() && b.spec.OEMSize > 0 {
+		neededBinaries = append(neededBinaries, "mkfs.ext4")
+	}
+	if b.spec.OutputType == string(constants.Qcow2Output) {
+		neededBinaries = append(neededBinaries, "qemu-img")
 	}
 
 	for _, b := range neededBinaries {
@@ -311,99 +756,64 @@ func (b *BuildUKIAction) setupDirectoriesAndFiles(tmpDir string) error {
 	return nil
 }
 
-// createInitramfs creates a compressed initramfs file (cpio format, gzipped).
-// The resulting file is named "initrd" and is saved inthe sourceDir.
+// createInitramfs creates a compressed initramfs file (cpio format, compressed with the algorithm set in the spec).
+// The archive is compressed as it is written, without an uncompressed copy on disk.
+// The resulting file is named "initrd" and is saved in the artifactsTempDir.
 func (b *BuildUKIAction) createInitramfs(sourceDir, artifactsTempDir string) error {
-	format := "newc"
-	archiver, err := cpio.Format(format)
+	initrdFile, err := os.Create(filepath.Join(artifactsTempDir, "initrd"))
 	if err != nil {
-		return fmt.Errorf("format %q not supported: %w", format, err)
+		return fmt.Errorf("creating initrd file: %w", err)
 	}
+	defer initrdFile.Close()
 
-	cpioFileName := filepath.Join(artifactsTempDir, "initramfs.cpio")
-	cpioFile, err := os.Create(cpioFileName)
+	excludes := append(constants.UkiInitrdExcludes(), b.spec.InitrdExcludes...)
+	filter, err := utils.NewPathFilter(sourceDir, excludes, b.spec.InitrdIncludes)
 	if err != nil {
-		return fmt.Errorf("creating cpio file: %w", err)
+		return err
 	}
-	defer cpioFile.Close()
-
-	rw := archiver.Writer(cpioFile)
-	cr := cpio.NewRecorder()
 
-	// List of directories to exclude
-	excludeDirs := map[string]bool{
-		"sys":  true,
-		"run":  true,
-		"dev":  true,
-		"tmp":  true,
-		"proc": true,
+	// The archive only depends on the contents of sourceDir, so the same rootfs always generates the same initrd
+	archive := cpio.New()
+	archive.ModTime = b.sourceDateEpoch
+	err = archive.AddTree(sourceDir, filter.Skip)
+	if err != nil {
+		return fmt.Errorf("error walking the source dir: %w", err)
 	}
-
-	if err = os.Chdir(sourceDir); err != nil {
-		return fmt.Errorf("changing to %s directory: %w", sourceDir, err)
+	for _, rule := range filter.Excludes() {
+		b.logger.Infof("Initramfs exclude rule %s removed %d files (%d bytes)", rule.Pattern, rule.Files, rule.Bytes)
 	}
+	b.initrdSizes = archive.FileSizes()
 
-	// Walk through the source directory and add files to the cpio archive
-	err = filepath.Walk(".", func(filePath string, fileInfo os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Check if the current directory should be excluded
-		if fileInfo.IsDir() && excludeDirs[filePath] {
-			return filepath.SkipDir
-		}
-
-		if strings.Contains(filePath, "initramfs.cpio") {
-			return nil
-		}
-
-		rec, err := cr.GetRecord(filePath)
-		if err != nil {
-			return fmt.Errorf("getting record of %q failed: %w", filePath, err)
-		}
-
-		// In case the record contains the sourceDir we want to remove it as its not part of the cpio initramfs
-		// All files should have the proper path for the initramfs so SOURCEDIR/usr/bin needs to be stored as /usr/bin
-		// in the cpio image
-		rec.Name = strings.TrimPrefix(rec.Name, sourceDir)
-
-		// MakeReproducible is not working as expected so we canno use it yet
-		// as that breaks hardlinks
-		// See upstream https://github.com/u-root/u-root/issues/3031
-		// When its fixed we should use rw.WriteRecord(cpio.MakeReproducible(rec)) to generate reproducible initrds
-		// Meanwhile we can try to make it as reproducible as possible
-		rec.MTime = 0
-		rec.UID = 0
-		rec.GID = 0
-		rec.Dev = 0
-		rec.Major = 0
-		rec.Minor = 0
-		if err := rw.WriteRecord(rec); err != nil {
-			return fmt.Errorf("writing record %q failed: %w", filePath, err)
-		}
-
-		return nil
-	})
+	b.logger.Infof("Compressing initramfs with %s", b.spec.InitrdCompression)
+	w := bufio.NewWriter(initrdFile)
+	compressor, err := utils.NewInitrdCompressor(w, b.spec.InitrdCompression, b.spec.InitrdCompressionLevel)
 	if err != nil {
-		return fmt.Errorf("error walking the source dir: %w", err)
+		return fmt.Errorf("creating the initrd compressor: %w", err)
 	}
-
-	if err := cpio.WriteTrailer(rw); err != nil {
-		return fmt.Errorf("error writing trailer record: %w", err)
+	if err := archive.Write(compressor); err != nil {
+		compressor.Close()
+		return fmt.Errorf("error writing the cpio archive: %w", err)
 	}
-
-	b.logger.Info("Compressing initramfs")
-
-	if err := ZstdFile(cpioFileName, filepath.Join(artifactsTempDir, "initrd")); err != nil {
-		return err
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("error compressing the cpio archive: %w", err)
 	}
-
-	if err := os.RemoveAll(cpioFileName); err != nil {
-		return fmt.Errorf("error deleting cpio file: %w", err)
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error writing the initrd file: %w", err)
 	}
+	return initrdFile.Close()
+}
 
-	return nil
+// checkKernelCompression warns if the kernel in the rootfs cannot boot an initramfs compressed with the selected algorithm
+func (b *BuildUKIAction) checkKernelCompression(sourceDir string) {
+	configs, err := utils.KernelConfigsWithoutInitrdCompression(sourceDir, b.spec.InitrdCompression)
+	if err != nil {
+		b.logger.Warnf("could not check the kernel support for %s initramfs: %s", b.spec.InitrdCompression, err)
+		return
+	}
+	for _, config := range configs {
+		b.logger.Warnf("The kernel config %s does not enable %s compressed initramfs, the UKI files may not boot",
+			strings.TrimPrefix(config, sourceDir), b.spec.InitrdCompression)
+	}
 }
 
 func (b *BuildUKIAction) copyKernel(sourceDir, targetDir string) error {
@@ -430,40 +840,49 @@ func (b *BuildUKIAction) copyKernel(sourceDir, targetDir string) error {
 	return err
 }
 
-func (b *BuildUKIAction) createConfFiles(sourceDir, cmdline, title, finalEfiName string) error {
+func (b *BuildUKIAction) createConfFiles(sourceDir string, entry utils.BootEntry) error {
 	// This is stored in the config
 	var extraCmdline string
 	// For the config title we get only the extra cmdline we added, no replacement of spaces with underscores needed
-	extraCmdline = strings.TrimSpace(strings.TrimPrefix(cmdline, constants.UkiCmdline))
+	extraCmdline = strings.TrimSpace(strings.TrimPrefix(entry.Cmdline, constants.UkiCmdline))
 	// For the default install entry, do not add anything on the config
 	if extraCmdline == constants.UkiCmdlineInstall {
 		extraCmdline = ""
 	}
-	b.logger.Infof("Creating the %s.conf file", finalEfiName)
+	confName := entry.ConfName()
+	b.logger.Infof("Creating the %s file", confName)
 
 	// You can add entries into the config files, they will be ignored by systemd-boot
 	// So we store the cmdline in a key cmdline for easy tracking of what was added to the uki cmdline
 
-	configData := fmt.Sprintf("title %s\nefi /EFI/kairos/%s.efi\n", title, finalEfiName)
+	configData := fmt.Sprintf("title %s\nefi /EFI/kairos/%s.efi\n", entry.Title, entry.EfiName())
+	if entry.UKI != "" {
+		// Multi-profile UKIs are booted with the uki key, which selects the profile
+		configData = fmt.Sprintf("title %s\nuki /EFI/kairos/%s.efi\nprofile %d\n", entry.Title, entry.EfiName(), entry.Profile)
+	}
 
-	if viper.GetBool("include-version-in-config") {
+	if entry.SortKey != "" {
+		configData = fmt.Sprintf("%ssort-key %s\n", configData, entry.SortKey)
+	}
+
+	if b.spec.IncludeVersionInConfig {
 		configData = fmt.Sprintf("%sversion %s\n", configData, b.version)
 	}
 
-	if viper.GetBool("include-cmdline-in-config") {
+	if b.spec.IncludeCmdlineInConfig {
 		configData = fmt.Sprintf("%scmdline %s\n", configData, strings.Trim(extraCmdline, " "))
 	}
 
-	err := os.WriteFile(filepath.Join(sourceDir, finalEfiName+".conf"), []byte(configData), os.ModePerm)
+	err := os.WriteFile(filepath.Join(sourceDir, confName), []byte(configData), os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("creating the %s.conf file", finalEfiName)
+		return fmt.Errorf("creating the %s file", confName)
 	}
 
 	return nil
 }
 
 func (b *BuildUKIAction) createISO(sourceDir string) error {
-	// isoDir is where we generate the img file. We pass this dir to xorriso.
+	// isoDir is where we generate the img file. It is the root of the iso.
 	isoDir, err := os.MkdirTemp("", "enki-iso-dir-")
 	if err != nil {
 		return err
@@ -475,36 +894,26 @@ func (b *BuildUKIAction) createISO(sourceDir string) error {
 		return err
 	}
 
-	b.logger.Info("Calculating the size of the img file")
-	artifactSize, err := sumFileSizes(filesMap)
+	imgFile := filepath.Join(isoDir, "efiboot.img")
+	img, err := createEfiImg(filesMap, b.sourceDateEpoch)
 	if err != nil {
 		return err
 	}
-
-	// Create just the size we need + 50MB just in case
-	imgSize := artifactSize + 50
-	imgFile := filepath.Join(isoDir, "efiboot.img")
-	b.logger.Info(fmt.Sprintf("Creating the img file with size: %dMb", imgSize))
-	if err = createImgWithSize(imgFile, imgSize); err != nil {
+	imgSize, err := img.Size()
+	if err != nil {
 		return err
 	}
-	defer os.Remove(imgFile)
-
-	b.logger.Info(fmt.Sprintf("Created image: %s", imgFile))
-
-	b.logger.Info("Creating directories in the img file")
-	if err := createImgDirs(imgFile, filesMap); err != nil {
+	b.logger.Info(fmt.Sprintf("Creating the img file with size: %dMb", imgSize/(1024*1024)))
+	if err = img.Write(imgFile); err != nil {
 		return err
 	}
+	defer os.Remove(imgFile)
 
-	b.logger.Info("Copying files in the img file")
-	if err := copyFilesToImg(imgFile, filesMap); err != nil {
-		return err
-	}
+	b.logger.Info(fmt.Sprintf("Created image: %s", imgFile))
 
-	if viper.GetString("overlay-iso") != "" {
-		b.logger.Infof("Adding files from %s to iso", viper.GetString("overlay-iso"))
-		overlay, err := v1.NewSrcFromURI(fmt.Sprintf("dir:%s", viper.GetString("overlay-iso")))
+	if b.spec.OverlayISO != "" {
+		b.logger.Infof("Adding files from %s to iso", b.spec.OverlayISO)
+		overlay, err := v1.NewSrcFromURI(fmt.Sprintf("dir:%s", b.spec.OverlayISO))
 		if err != nil {
 			b.logger.Errorf("error creating overlay image: %s", err)
 			return err
@@ -523,63 +932,219 @@ func (b *BuildUKIAction) createISO(sourceDir string) error {
 		isoName = fmt.Sprintf("%s.iso", b.name)
 	}
 
-	b.logger.Info("Creating the iso files with xorriso")
-	cmd := exec.Command("xorriso", "-as", "mkisofs", "-V", "UKI_ISO_INSTALL", "-isohybrid-gpt-basdat",
-		"-e", filepath.Base(imgFile), "-no-emul-boot", "-o", filepath.Join(b.outputDir, isoName), isoDir)
-	out, err := cmd.CombinedOutput()
+	b.logger.Infof("Creating the iso file with the %s backend", b.isoBackend)
+	err = b.isoWriter.Write(utils.ISOSpec{
+		Label:     "UKI_ISO_INSTALL",
+		Root:      isoDir,
+		Output:    filepath.Join(b.spec.OutputDir, isoName),
+		ModTime:   b.sourceDateEpoch,
+		HybridGPT: true,
+		EFIImage:  filepath.Base(imgFile),
+	})
 	if err != nil {
-		return fmt.Errorf("error creating iso file: %w\n%s", err, string(out))
+		return fmt.Errorf("error creating iso file: %w", err)
 	}
 
 	return nil
 }
 
-func (b *BuildUKIAction) createContainer(sourceDir, version string) error {
-	temp, err := os.CreateTemp("", "image.tar")
+// isDiskImage returns true if the output type is a partitioned disk image
+func (b *BuildUKIAction) isDiskImage() bool {
+	return b.spec.OutputType == string(constants.RawOutput) || b.spec.OutputType == string(constants.Qcow2Output)
+}
+
+// createDiskImage creates a GPT disk image with an EFI System Partition holding the same files as the uki output type,
+// and an empty COS_OEM partition if oem-size is set. The raw image is converted with qemu-img for the qcow2 output type.
+func (b *BuildUKIAction) createDiskImage(sourceDir string) error {
+	tmpDir, err := os.MkdirTemp("", "enki-disk-image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filesMap, err := b.imageFiles(sourceDir)
 	if err != nil {
 		return err
 	}
-	// Create tarball from sourceDir
-	err = utils.Tar(sourceDir, temp)
+	esp, err := createEfiImg(filesMap, b.sourceDateEpoch)
 	if err != nil {
 		return err
 	}
-	_ = temp.Close()
-	defer os.RemoveAll(temp.Name())
-	finalImage := filepath.Join(b.outputDir, fmt.Sprintf("kairos_uki_%s.tar", version))
-	// TODO: get the arch from the running system or by flag? Config.Arch has this value on it
-	arch := "amd64"
-	os := "linux"
-	// Build imageTar from normal tar
-	tarName := fmt.Sprintf("kairos_uki_%s.tar", version)
+	esp.Label = constants.EfiLabel
+	esp.MinSize = b.spec.EspSize * 1024 * 1024
+	espSize, err := esp.Size()
+	if err != nil {
+		return err
+	}
+	b.logger.Infof("Creating the EFI System Partition with size: %dMb", espSize/(1024*1024))
+	espFile := filepath.Join(tmpDir, "esp.img")
+	if err = esp.Write(espFile); err != nil {
+		return err
+	}
+
+	img := disk.New()
+	img.ModTime = b.sourceDateEpoch
+	img.AddPartition(disk.Partition{Name: "efi", Type: disk.TypeEFI, Source: espFile})
+	if b.spec.OEMSize > 0 {
+		oemFile := filepath.Join(tmpDir, "oem.img")
+		if err = b.createOEMImg(oemFile, b.spec.OEMSize*1024*1024); err != nil {
+			return err
+		}
+		img.AddPartition(disk.Partition{Name: "oem", Type: disk.TypeLinux, Source: oemFile})
+	}
+
+	name := fmt.Sprintf("kairos_%s", b.version)
 	if b.name != "" {
-		tarName = fmt.Sprintf("%s.tar", b.name)
+		name = b.name
+	}
+	rawFile := filepath.Join(b.spec.OutputDir, name+".raw")
+	if b.spec.OutputType == string(constants.Qcow2Output) {
+		rawFile = filepath.Join(tmpDir, name+".raw")
 	}
-	err = utils.CreateTar(b.logger, temp.Name(), finalImage, tarName, arch, os)
+	b.logger.Infof("Creating the disk image %s", rawFile)
+	if err = img.Write(rawFile); err != nil {
+		return fmt.Errorf("error creating disk image: %w", err)
+	}
+	if b.spec.OutputType != string(constants.Qcow2Output) {
+		return nil
+	}
+
+	qcow2File := filepath.Join(b.spec.OutputDir, name+".qcow2")
+	b.logger.Infof("Converting the disk image to %s", qcow2File)
+	out, err := b.runner.Run("qemu-img", "convert", "-f", "raw", "-O", "qcow2", rawFile, qcow2File)
+	if err != nil {
+		return fmt.Errorf("error converting disk image to qcow2: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// createOEMImg creates an empty ext4 filesystem image labeled COS_OEM. For reproducible builds, its UUID, hash seed
+// and timestamps are derived from the source date epoch.
+func (b *BuildUKIAction) createOEMImg(file string, size int64) error {
+	f, err := os.Create(file)
 	if err != nil {
 		return err
 	}
-	b.logger.Infof("Done building %s at: %s", b.outputType, finalImage)
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error creating oem image: %w", err)
+	}
 
-	return err
+	args := []string{"-F", "-q", "-L", constants.OEMLabel}
+	if !b.sourceDateEpoch.IsZero() {
+		seed := uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("%d-oem", b.sourceDateEpoch.Unix()))).String()
+		args = append(args, "-U", seed, "-E", fmt.Sprintf("hash_seed=%s,root_owner=0:0", seed))
+	}
+	cmd := b.runner.InitCmd("mkfs.ext4", append(args, file)...)
+	if !b.sourceDateEpoch.IsZero() {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("E2FSPROGS_FAKE_TIME=%d", b.sourceDateEpoch.Unix()))
+	}
+	out, err := b.runner.RunCmd(cmd)
+	if err != nil {
+		return fmt.Errorf("error formatting oem image: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
 }
 
-// Create artifact just outputs the files from the sourceDir to the outputDir
+// createContainer creates a container image with the same files as the uki output type, labeled with the kairos-release
+// values of the rootfs
+func (b *BuildUKIAction) createContainer(sourceDir string) error {
+	// The files are laid out in a temporary dir, so the image only holds them and not other files of the output dir
+	contentDir, err := os.MkdirTemp("", "enki-container-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(contentDir)
+	if err = b.createArtifact(sourceDir, contentDir); err != nil {
+		return err
+	}
+
+	arch := utils.ContainerArch(b.arch)
+	spec := utils.ContainerSpec{
+		Name:        fmt.Sprintf("kairos_uki_%s.tar", b.version),
+		Arch:        arch,
+		OS:          "linux",
+		Created:     b.sourceDateEpoch,
+		Labels:      b.containerLabels(),
+		Compression: b.spec.ContainerCompression,
+		Format:      b.spec.ContainerFormat,
+	}
+	if b.name != "" {
+		spec.Name = fmt.Sprintf("%s.tar", b.name)
+	}
+	output := filepath.Join(b.spec.OutputDir, spec.Name)
+	if b.spec.ContainerFormat == constants.OCIContainerFormat {
+		output = strings.TrimSuffix(output, ".tar")
+		spec.Name = fmt.Sprintf("%s-%s", b.version, arch)
+	}
+	img, err := utils.CreateContainer(contentDir, output, spec)
+	if err != nil {
+		return fmt.Errorf("error creating container image: %w", err)
+	}
+	b.logger.Infof("Done building %s at: %s", b.spec.OutputType, output)
+
+	if b.spec.Push != "" {
+		b.logger.Infof("Pushing the container image to %s", b.spec.Push)
+		pushed, err := utils.PushImage(img, b.spec.Push)
+		if err != nil {
+			return err
+		}
+		b.logger.Infof("Pushed %s", pushed)
+	}
+	return nil
+}
+
+// containerLabels returns the labels of the container image, from the kairos-release file and the source image
+func (b *BuildUKIAction) containerLabels() map[string]string {
+	created := b.sourceDateEpoch
+	if created.IsZero() {
+		created = time.Now()
+	}
+	labels := map[string]string{
+		"org.opencontainers.image.created": created.UTC().Format(time.RFC3339),
+		"org.opencontainers.image.version": b.version,
+	}
+	if v := b.release["KAIROS_VERSION"]; v != "" {
+		labels["org.opencontainers.image.version"] = v
+	}
+	for key, label := range releaseLabels {
+		if v := b.release[key]; v != "" {
+			labels[label] = v
+		}
+	}
+
+	if !b.spec.Image.IsDocker() {
+		return labels
+	}
+	labels["org.opencontainers.image.base.name"] = b.spec.Image.Value()
+	digest, err := utils.ImageDigest(b.spec.Image.Value(), "linux/"+utils.ContainerArch(b.arch))
+	if err != nil {
+		b.logger.Warnf("Could not get the digest of the source image %s: %s", b.spec.Image.Value(), err)
+		return labels
+	}
+	labels["org.opencontainers.image.base.digest"] = digest
+	return labels
+}
+
+// Create artifact just outputs the files from the sourceDir to the targetDir
 // Maintains the same structure as the sourceDir which is the final structure we want
-func (b *BuildUKIAction) createArtifact(sourceDir string) error {
+func (b *BuildUKIAction) createArtifact(sourceDir, targetDir string) error {
 	filesMap, err := b.imageFiles(sourceDir)
 	if err != nil {
 		return err
 	}
 	for dir, files := range filesMap {
-		b.logger.Debugf(fmt.Sprintf("creating dir %s", filepath.Join(b.outputDir, dir)))
-		err = os.MkdirAll(filepath.Join(b.outputDir, dir), os.ModeDir|os.ModePerm)
+		b.logger.Debugf(fmt.Sprintf("creating dir %s", filepath.Join(targetDir, dir)))
+		err = os.MkdirAll(filepath.Join(targetDir, dir), os.ModeDir|os.ModePerm)
 		if err != nil {
 			b.logger.Errorf("creating dir %s: %s", dir, err)
 			return err
 		}
 		for _, f := range files {
-			b.logger.Debugf(fmt.Sprintf("copying %s to %s", f, filepath.Join(b.outputDir, dir, filepath.Base(f))))
+			b.logger.Debugf(fmt.Sprintf("copying %s to %s", f, filepath.Join(targetDir, dir, filepath.Base(f))))
 			source, err := os.Open(f)
 			if err != nil {
 				b.logger.Errorf("opening file %s: %s", f, err)
@@ -592,15 +1157,15 @@ func (b *BuildUKIAction) createArtifact(sourceDir string) error {
 				}
 			}(source)
 
-			destination, err := os.Create(filepath.Join(b.outputDir, dir, filepath.Base(f)))
+			destination, err := os.Create(filepath.Join(targetDir, dir, filepath.Base(f)))
 			if err != nil {
-				b.logger.Errorf("creating file %s: %s", filepath.Join(b.outputDir, dir, filepath.Base(f)), err)
+				b.logger.Errorf("creating file %s: %s", filepath.Join(targetDir, dir, filepath.Base(f)), err)
 				return err
 			}
 			defer func(destination *os.File) {
 				err := destination.Close()
 				if err != nil {
-					b.logger.Errorf("closing file %s: %s", filepath.Join(b.outputDir, dir, filepath.Base(f)), err)
+					b.logger.Errorf("closing file %s: %s", filepath.Join(targetDir, dir, filepath.Base(f)), err)
 				}
 			}(destination)
 			_, err = io.Copy(destination, source)
@@ -614,52 +1179,36 @@ func (b *BuildUKIAction) createArtifact(sourceDir string) error {
 }
 
 func (b *BuildUKIAction) imageFiles(sourceDir string) (map[string][]string, error) {
+	_, systemdBootEfi, err := b.systemdBoot()
+	if err != nil {
+		return nil, err
+	}
 	// the keys are the target dirs
 	// the values are the source files that should be copied into the target dir
 	data := map[string][]string{
 		"EFI":            {},
-		"EFI/BOOT":       {filepath.Join(sourceDir, "BOOTX64.EFI")},
+		"EFI/BOOT":       {filepath.Join(sourceDir, systemdBootEfi)},
 		"EFI/kairos":     {},
 		"EFI/tools":      {},
 		"loader":         {filepath.Join(sourceDir, "loader.conf")},
 		"loader/entries": {},
 		"loader/keys":    {},
 		"loader/keys/auto": {
-			filepath.Join(b.keysDirectory, "PK.der"),
-			filepath.Join(b.keysDirectory, "KEK.der"),
-			filepath.Join(b.keysDirectory, "db.der"),
-			filepath.Join(b.keysDirectory, "PK.auth"),
-			filepath.Join(b.keysDirectory, "KEK.auth"),
-			filepath.Join(b.keysDirectory, "db.auth")},
+			filepath.Join(b.spec.KeysDirectory, "PK.der"),
+			filepath.Join(b.spec.KeysDirectory, "KEK.der"),
+			filepath.Join(b.spec.KeysDirectory, "db.der"),
+			filepath.Join(b.spec.KeysDirectory, "PK.auth"),
+			filepath.Join(b.spec.KeysDirectory, "KEK.auth"),
+			filepath.Join(b.spec.KeysDirectory, "db.auth")},
 	}
 	// Add the kairos efi files and the loader conf files for each cmdline
-	entries := append(utils.GetUkiCmdline(), utils.GetUkiSingleCmdlines(b.logger)...)
-	for _, entry := range entries {
-		data["EFI/kairos"] = append(data["EFI/kairos"], filepath.Join(sourceDir, entry.FileName+".efi"))
-		data["loader/entries"] = append(data["loader/entries"], filepath.Join(sourceDir, entry.FileName+".conf"))
-	}
-	return data, nil
-}
-
-// removeUkiFiles removes all the files and directories inside the output directory that match our filesMap
-// so this should only remove the generated intermediate artifacts that we use to build the container
-func (b *BuildUKIAction) removeUkiFiles() error {
-	filesMap, _ := b.imageFiles(b.outputDir)
-	for dir, files := range filesMap {
-		for _, f := range files {
-			err := os.Remove(filepath.Join(b.outputDir, dir, filepath.Base(f)))
-			if err != nil {
-				return err
-			}
-		}
-	}
-	for dir := range filesMap {
-		err := os.RemoveAll(filepath.Join(b.outputDir, dir))
-		if err != nil {
-			return err
+	for _, entry := range b.entries {
+		if efi := filepath.Join(sourceDir, entry.EfiName()+".efi"); !slices.Contains(data["EFI/kairos"], efi) {
+			data["EFI/kairos"] = append(data["EFI/kairos"], efi)
 		}
+		data["loader/entries"] = append(data["loader/entries"], filepath.Join(sourceDir, entry.ConfName()))
 	}
-	return nil
+	return data, nil
 }
 
 func (b *BuildUKIAction) getEfiStub() (string, error) {
@@ -688,125 +1237,64 @@ func (b *BuildUKIAction) getEfiNeededFiles() ([]string, error) {
 	}
 }
 
-func (b *BuildUKIAction) cleanSource(dir string) {
-	// Remove the boot directory as we already copied the kernel and we dont need the initrd files
-	err := os.RemoveAll(filepath.Join(dir, "boot"))
+// pruneKernelModules removes the kernel modules and firmware not needed by the hardware profile
+func (b *BuildUKIAction) pruneKernelModules(sourceDir string) error {
+	b.logger.Infof("Removing the kernel modules and firmware not needed by the hardware profile %s", b.spec.HardwareProfile)
+	profile, err := kmod.ReadProfile(b.spec.HardwareProfile)
 	if err != nil {
-		b.logger.Errorf("removing boot dir: %s", err)
-		return
-	}
-	// TODO: there should be a copy of the kernel at /usrt/lib/modules/VERSION/kernel/vmlinuz that we may also want to remove
-}
-
-func copyFilesToImg(imgFile string, filesMap map[string][]string) error {
-	for dir, files := range filesMap {
-		for _, f := range files {
-			cmd := exec.Command("mcopy", "-i", imgFile, f, filepath.Join(fmt.Sprintf("::%s", dir), filepath.Base(f)))
-			out, err := cmd.CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("copying %s in img file: %w\n%s", f, err, string(out))
-			}
-		}
-	}
-
-	return nil
-}
-
-func ZstdFile(sourcePath, targetPath string) error {
-	inputFile, err := os.Open(sourcePath)
-	if err != nil {
-		return fmt.Errorf("error opening initramfs file: %w", err)
-	}
-	defer inputFile.Close()
-
-	outputFile, err := os.Create(targetPath)
-	if err != nil {
-		return fmt.Errorf("error creating compressed initramfs file: %w", err)
-	}
-	defer outputFile.Close()
-
-	// SpeedBetterCompression is heavier, takes 36 seconds in my 24core cpu but generates a 919MB file
-	// SpeedBestCompression is really fast, takes 6 seconds but generates a 950Mb file
-	// If we need we can use the heavier one if we need to gain those 30 extra Mb
-	zstdWriter, _ := zstd.NewWriter(outputFile, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
-	defer zstdWriter.Close()
-
-	if _, err = io.Copy(zstdWriter, inputFile); err != nil {
-		return fmt.Errorf("error writing data to the compress initramfs file: %w", err)
+		return err
 	}
-
-	return nil
-}
-
-func findKairosVersion(sourceDir string) (string, error) {
-	var osReleaseBytes []byte
-	osReleaseBytes, err := os.ReadFile(filepath.Join(sourceDir, "etc", "kairos-release"))
+	profile.Firmware = append(profile.Firmware, b.spec.KeepFirmware...)
+	res, err := kmod.Prune(sourceDir, profile)
 	if err != nil {
-		// fallback to os-release
-		osReleaseBytes, err = os.ReadFile(filepath.Join(sourceDir, "etc", "os-release"))
-		if err != nil {
-			return "", fmt.Errorf("reading kairos-release file: %w", err)
-		}
+		return fmt.Errorf("pruning kernel modules: %w", err)
 	}
-
-	re := regexp.MustCompile("(?m)^KAIROS_RELEASE=\"(.*)\"")
-	match := re.FindStringSubmatch(string(osReleaseBytes))
-
-	if len(match) != 2 {
-		return "", fmt.Errorf("unexpected number of matches for KAIROS_RELEASE in os-release: %d", len(match))
+	for _, name := range res.Unknown {
+		b.logger.Warnf("Module %s of the hardware profile not found in the kernel", name)
 	}
-
-	return match[1], nil
-}
-
-func createImgWithSize(imgFile string, size int64) error {
-	cmd := exec.Command("dd",
-		"if=/dev/zero", fmt.Sprintf("of=%s", imgFile),
-		"bs=1M", fmt.Sprintf("count=%d", size),
-	)
-
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("creating the img file: %w\n%s", err, out)
-	}
-
-	return nil
-}
-
-func sumFileSizes(filesMap map[string][]string) (int64, error) {
-	total := int64(0)
-	for _, files := range maps.Values(filesMap) {
-		for _, f := range files {
-			fileInfo, err := os.Stat(f)
-			if err != nil {
-				return total, fmt.Errorf("finding file info for file %s: %w", f, err)
+	// The binary indexes used by modprobe still list the removed modules
+	if _, err := exec.LookPath("depmod"); err != nil {
+		b.logger.Warnf("depmod not found, the modules.*.bin indexes of the initramfs still reference the removed modules")
+	} else {
+		for _, kver := range res.Kernels {
+			if out, err := b.runner.Run("depmod", "-b", sourceDir, kver); err != nil {
+				return fmt.Errorf("running depmod for kernel %s: %s: %w", kver, strings.TrimSpace(string(out)), err)
 			}
-			total += fileInfo.Size()
 		}
 	}
-
-	totalInMB := int64(math.Round(float64(total) / (1024 * 1024)))
-
-	return totalInMB, nil
+	b.logger.Infof("Kept %d kernel modules, removed %d modules and %d firmware files (%s)",
+		res.KeptModules, res.RemovedModules, res.RemovedFirmware, humanize.IBytes(uint64(res.RemovedBytes)))
+	return nil
 }
 
-func createImgDirs(imgFile string, filesMap map[string][]string) error {
-	cmd := exec.Command("mkfs.msdos", "-F", "32", imgFile)
-	out, err := cmd.CombinedOutput()
+func (b *BuildUKIAction) cleanSource(dir string) {
+	// Remove the boot directory as we already copied the kernel and we dont need the initrd files
+	err := os.RemoveAll(filepath.Join(dir, "boot"))
 	if err != nil {
-		return fmt.Errorf("formating the img file to fat: %w\n%s", err, string(out))
+		b.logger.Errorf("removing boot dir: %s", err)
+		return
 	}
+	// TODO: there should be a copy of the kernel at /usrt/lib/modules/VERSION/kernel/vmlinuz that we may also want to remove
+}
 
+// createEfiImg lays out a FAT32 image with the given files.
+// The keys of filesMap are the target dirs and the values the source files to copy into them.
+// modTime is set on every entry, the current time is used if zero
+func createEfiImg(filesMap map[string][]string, modTime time.Time) (*fat32.Image, error) {
+	img := fat32.New("")
+	img.ModTime = modTime
 	dirs := maps.Keys(filesMap)
-	sort.Strings(dirs) // Make sure we create outer dirs first
+	sort.Strings(dirs)
 	for _, dir := range dirs {
-		// Dirs in MSDOS are marked with ::DIR
-		cmd := exec.Command("mmd", "-i", imgFile, fmt.Sprintf("::%s", dir))
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("creating directory %s on the img file: %w\n%s\nThe failed command was: %s", dir, err, string(out), cmd.String())
+		if err := img.AddDir(dir); err != nil {
+			return nil, err
+		}
+		for _, f := range filesMap[dir] {
+			if err := img.AddFile(filepath.Join(dir, filepath.Base(f)), f); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return nil
+	return img, nil
 }
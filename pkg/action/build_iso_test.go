@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 
 	"github.com/kairos-io/enki/pkg/action"
@@ -36,6 +37,16 @@ import (
 	"github.com/twpayne/go-vfs/v5/vfst"
 )
 
+// fakeISOWriter records the spec it is called with and creates a dummy output file
+type fakeISOWriter struct {
+	spec *utils.ISOSpec
+}
+
+func (w *fakeISOWriter) Write(spec utils.ISOSpec) error {
+	w.spec = &spec
+	return os.WriteFile(spec.Output, []byte("profound thoughts"), constants.FilePerm)
+}
+
 var _ = Describe("BuildISOAction", func() {
 	var cfg *types.BuildConfig
 	var runner *v1mock.FakeRunner
@@ -117,11 +128,25 @@ var _ = Describe("BuildISOAction", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "grubx64.efi"))
 			Expect(err).ShouldNot(HaveOccurred())
+			err = utils.MkdirAll(fs, filepath.Join("/tmp/enki-iso/rootfs", "etc"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = fs.WriteFile(filepath.Join("/tmp/enki-iso/rootfs", "etc", "os-release"), []byte("FLAVOR=fedora\n"), constants.FilePerm)
+			Expect(err).ShouldNot(HaveOccurred())
 
-			buildISO := action.NewBuildISOAction(cfg, iso)
+			writer := &fakeISOWriter{}
+			buildISO := action.NewBuildISOAction(cfg, iso, action.WithISOWriter(writer))
 			err = buildISO.ISORun()
 
 			Expect(err).ShouldNot(HaveOccurred())
+			Expect(writer.spec).ToNot(BeNil())
+			isoRoot, err := fs.RawPath("/tmp/enki-iso/iso")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(writer.spec.Label).To(Equal(constants.ISOLabel))
+			Expect(writer.spec.Root).To(Equal(isoRoot))
+			Expect(writer.spec.BIOSImage).To(Equal(constants.IsoBootFile))
+			Expect(writer.spec.EFIPartition).To(Equal(filepath.Join(isoRoot, constants.IsoEFIPath)))
+			Expect(writer.spec.HybridMBR).To(Equal(filepath.Join(isoRoot, constants.IsoHybridMBR)))
+			Expect(fs.ReadFile(filepath.Join(cfg.OutDir, "elemental.iso.sha256"))).To(ContainSubstring("elemental.iso"))
 		})
 		It("Fails if kernel or initrd is not found in rootfs", func() {
 			rootSrc, _ := v1.NewSrcFromURI("oci:image:version")
@@ -190,7 +215,12 @@ var _ = Describe("BuildISOAction", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			_, err = fs.Create(filepath.Join(bootDir, "efi", "EFI", "fedora", "grubx64.efi"))
 			Expect(err).ShouldNot(HaveOccurred())
+			err = utils.MkdirAll(fs, filepath.Join("/tmp/enki-iso/rootfs", "etc"), constants.DirPerm)
+			Expect(err).ShouldNot(HaveOccurred())
+			err = fs.WriteFile(filepath.Join("/tmp/enki-iso/rootfs", "etc", "os-release"), []byte("FLAVOR=fedora\n"), constants.FilePerm)
+			Expect(err).ShouldNot(HaveOccurred())
 
+			cfg.ISOBackend = constants.XorrisoISOBackend
 			runner.SideEffect = func(command string, args ...string) ([]byte, error) {
 				if command == "xorriso" {
 					return []byte{}, errors.New("Burn ISO error")
@@ -0,0 +1,159 @@
+/*
+Copyright © 2022 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package action
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/kairos-io/enki/pkg/config"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BuildUKIAction", Label("uki"), func() {
+	var tmpDir, sourceDir, keysDir, outputDir string
+	var memLog *bytes.Buffer
+	var spec *types.BuildUKISpec
+
+	newAction := func(arch string) *BuildUKIAction {
+		logger := sdkTypes.NewBufferLogger(memLog)
+		cfg := config.NewBuildConfig(config.WithLogger(logger), config.WithArch(arch))
+		cfg.Name = ""
+		return NewBuildUKIAction(cfg, spec)
+	}
+	write := func(file string, data string) {
+		Expect(os.MkdirAll(filepath.Dir(file), constants.DirPerm)).To(Succeed())
+		Expect(os.WriteFile(file, []byte(data), constants.FilePerm)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "enki-build-uki-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpDir)
+		sourceDir = filepath.Join(tmpDir, "source")
+		keysDir = filepath.Join(tmpDir, "keys")
+		outputDir = filepath.Join(tmpDir, "output")
+		Expect(os.MkdirAll(outputDir, constants.DirPerm)).To(Succeed())
+		for _, key := range []string{"PK.der", "KEK.der", "db.der", "PK.auth", "KEK.auth", "db.auth"} {
+			write(filepath.Join(keysDir, key), key)
+		}
+		memLog = &bytes.Buffer{}
+		image, err := v1.NewSrcFromURI("dir:" + sourceDir)
+		Expect(err).ToNot(HaveOccurred())
+		spec = &types.BuildUKISpec{
+			Image:                image,
+			OutputDir:            outputDir,
+			KeysDirectory:        keysDir,
+			OutputType:           string(constants.ContainerOutput),
+			ContainerCompression: constants.GzipCompression,
+			ContainerFormat:      constants.DockerContainerFormat,
+		}
+	})
+
+	Describe("prepareSource", func() {
+		var artifactsDir string
+		BeforeEach(func() {
+			artifactsDir = filepath.Join(tmpDir, "artifacts")
+			Expect(os.MkdirAll(artifactsDir, constants.DirPerm)).To(Succeed())
+			write(filepath.Join(sourceDir, "boot", "vmlinuz-6.6.0"), "kernel")
+			Expect(os.Symlink("vmlinuz-6.6.0", filepath.Join(sourceDir, "boot", "vmlinuz"))).To(Succeed())
+			spec.InitrdCompression = constants.Lz4Compression
+		})
+		It("checks the kernel config before removing the boot dir", func() {
+			write(filepath.Join(sourceDir, "boot", "config-6.6.0"), "CONFIG_RD_ZSTD=y\n# CONFIG_RD_LZ4 is not set\n")
+			b := newAction("amd64")
+			Expect(b.prepareSource(sourceDir, artifactsDir)).To(Succeed())
+			Expect(memLog.String()).To(ContainSubstring("The kernel config /boot/config-6.6.0 does not enable lz4 compressed initramfs"))
+			Expect(filepath.Join(artifactsDir, "vmlinuz")).To(BeARegularFile())
+			Expect(filepath.Join(sourceDir, "boot")).ToNot(BeADirectory())
+		})
+		It("does not warn if the kernel supports the compression", func() {
+			write(filepath.Join(sourceDir, "boot", "config-6.6.0"), "CONFIG_RD_LZ4=y\n")
+			b := newAction("amd64")
+			Expect(b.prepareSource(sourceDir, artifactsDir)).To(Succeed())
+			Expect(memLog.String()).ToNot(ContainSubstring("does not enable"))
+		})
+	})
+
+	Describe("createSystemdConf", func() {
+		BeforeEach(func() {
+			spec.SecureBootEnroll = "force"
+			spec.LoaderTimeout = "5"
+		})
+		It("checks the options against the systemd-boot of the image", func() {
+			write(filepath.Join(sourceDir, constants.EfiFallbackNamex86), "#### LoaderInfo: systemd-boot 252 ####")
+			b := newAction("amd64")
+			Expect(b.createSystemdConf(sourceDir)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(sourceDir, "loader.conf"))).To(ContainSubstring("secure-boot-enroll force\n"))
+		})
+		It("fails if the systemd-boot of the image is too old", func() {
+			write(filepath.Join(sourceDir, constants.EfiFallbackNamex86), "#### LoaderInfo: systemd-boot 251 ####")
+			b := newAction("amd64")
+			Expect(b.createSystemdConf(sourceDir)).To(MatchError(ContainSubstring("secure-boot-enroll force needs systemd-boot 252")))
+		})
+	})
+
+	Describe("createContainer", func() {
+		It("lays out systemd-boot with the fallback name of arm64", func() {
+			b := newAction("arm64")
+			b.version = "v3.2.1"
+			b.sourceDateEpoch = time.Unix(1715941820, 0)
+			b.entries = []utils.BootEntry{{FileName: "norole", Title: "Kairos", Cmdline: constants.UkiCmdline}}
+			write(filepath.Join(sourceDir, constants.EfiFallbackNameArm), "systemd-boot")
+			write(filepath.Join(sourceDir, "loader.conf"), "default norole.conf\n")
+			write(filepath.Join(sourceDir, b.entries[0].EfiName()+".efi"), "uki")
+			write(filepath.Join(sourceDir, b.entries[0].ConfName()), "title Kairos\n")
+
+			Expect(b.createContainer(sourceDir)).To(Succeed())
+
+			img, err := tarball.ImageFromPath(filepath.Join(outputDir, "kairos_uki_v3.2.1.tar"), nil)
+			Expect(err).ToNot(HaveOccurred())
+			cfg, err := img.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Architecture).To(Equal("arm64"))
+			layers, err := img.Layers()
+			Expect(err).ToNot(HaveOccurred())
+			rc, err := layers[0].Uncompressed()
+			Expect(err).ToNot(HaveOccurred())
+			defer rc.Close()
+			var files []string
+			r := tar.NewReader(rc)
+			for {
+				header, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				files = append(files, header.Name)
+			}
+			Expect(files).To(ContainElement("EFI/BOOT/" + constants.EfiFallbackNameArm))
+			Expect(files).ToNot(ContainElement("EFI/BOOT/" + constants.EfiFallbackNamex86))
+		})
+	})
+})
@@ -0,0 +1,112 @@
+package action
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/signer"
+	"github.com/kairos-io/enki/pkg/types"
+	"github.com/kairos-io/enki/pkg/utils"
+)
+
+// SignAction signs EFI files, like the ones of an unsigned build-uki, in place
+type SignAction struct {
+	cfg  *types.BuildConfig
+	spec *types.SignSpec
+}
+
+func NewSignAction(cfg *types.BuildConfig, spec *types.SignSpec) *SignAction {
+	return &SignAction{cfg: cfg, spec: spec}
+}
+
+func (s *SignAction) Run() error {
+	var files []utils.SignFile
+	for _, p := range s.spec.Paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			m, err := utils.ReadSignManifest(s.cfg.Fs, p)
+			if err != nil {
+				return fmt.Errorf("reading the sign manifest of %s: %w", p, err)
+			}
+			for _, f := range m.Files {
+				files = append(files, utils.SignFile{Path: filepath.Join(p, f.Path), UKI: f.UKI})
+			}
+			continue
+		}
+		uki, err := utils.IsUki(p)
+		if err != nil {
+			return err
+		}
+		files = append(files, utils.SignFile{Path: p, UKI: uki})
+	}
+
+	sbSigner, pcrPolicies, err := s.signers()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.UKI && len(pcrPolicies) == 0 {
+			s.cfg.Logger.Warnf("Not signing the PCR policies of %s, there is no PCR key", f.Path)
+		}
+		s.cfg.Logger.Infof("Signing %s", f.Path)
+		if err := s.sign(f, sbSigner, pcrPolicies); err != nil {
+			return fmt.Errorf("signing %s: %w", f.Path, err)
+		}
+	}
+	s.cfg.Logger.Infof("Done signing %d files", len(files))
+	return nil
+}
+
+// sign signs the file in place, by writing the signed one next to it and renaming it
+func (s *SignAction) sign(f utils.SignFile, sbSigner *signer.PESigner, pcrPolicies []signer.PCRPolicy) error {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(f.Path), ".enki-sign-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	input := f.Path
+	if f.UKI && len(pcrPolicies) > 0 {
+		withPCR := filepath.Join(tmpDir, "pcr.efi")
+		if err := utils.AddUkiPCRSignatures(input, withPCR, pcrPolicies); err != nil {
+			return err
+		}
+		input = withPCR
+	}
+	signed := filepath.Join(tmpDir, "signed.efi")
+	if err := sbSigner.Sign(input, signed); err != nil {
+		return err
+	}
+	return os.Rename(signed, f.Path)
+}
+
+// signers returns the signer of the EFI files and the ones of the PCR policies, which are none if there is no PCR key
+func (s *SignAction) signers() (*signer.PESigner, []signer.PCRPolicy, error) {
+	sbKey, sbCert, pcrKeys := s.spec.SecureBootKey, s.spec.SecureBootCert, s.spec.PCRKeys
+	if sbKey == "" {
+		sbKey = filepath.Join(s.spec.KeysDirectory, "db.key")
+	}
+	if sbCert == "" {
+		sbCert = filepath.Join(s.spec.KeysDirectory, "db.pem")
+	}
+	if len(pcrKeys) == 0 && s.spec.KeysDirectory != "" {
+		if _, err := os.Stat(filepath.Join(s.spec.KeysDirectory, "tpm2-pcr-private.pem")); err == nil {
+			pcrKeys = []string{filepath.Join(s.spec.KeysDirectory, "tpm2-pcr-private.pem")}
+		}
+	}
+
+	sbSigner, err := signer.SecureBoot(sbCert, sbKey, s.spec.PrivateKeySource)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the secure boot key: %w", err)
+	}
+	sbSigner.SigningTime = s.cfg.SourceDateEpoch
+	pcrPolicies, err := signer.PCRPolicies(pcrKeys, s.spec.PCRPhases, s.spec.PrivateKeySource)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the PCR policy keys: %w", err)
+	}
+	return sbSigner, pcrPolicies, nil
+}
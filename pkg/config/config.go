@@ -122,6 +122,14 @@ func ReadConfigBuild(configDir string, flags *pflag.FlagSet) (*types.BuildConfig
 		cfg.Logger.Warnf("error unmarshalling config: %s", err)
 	}
 
+	cfg.SourceDateEpoch, err = utils.SourceDateEpoch()
+	if err != nil {
+		return cfg, err
+	}
+	if !cfg.SourceDateEpoch.IsZero() {
+		cfg.Logger.Infof("Using %s=%d for a reproducible build", constants.SourceDateEpochEnv, cfg.SourceDateEpoch.Unix())
+	}
+
 	err = cfg.Sanitize()
 	cfg.Logger.Debugf("Full config loaded: %s", litter.Sdump(cfg))
 	return cfg, err
@@ -145,6 +153,41 @@ func ReadBuildISO(b *types.BuildConfig, flags *pflag.FlagSet) (*types.LiveISO, e
 	return iso, err
 }
 
+func ReadBuildUKI(b *types.BuildConfig, flags *pflag.FlagSet) (*types.BuildUKISpec, error) {
+	uki := NewBuildUKI()
+	vp := viper.Sub("uki")
+	if vp == nil {
+		vp = viper.New()
+	}
+	// Bind build-uki cmd flags
+	bindGivenFlags(vp, flags)
+
+	err := vp.Unmarshal(uki, setDecoder, decodeHook)
+	if err != nil {
+		b.Logger.Warnf("error unmarshalling BuildUKISpec: %s", err)
+	}
+	err = uki.Sanitize()
+	b.Logger.Debugf("Loaded BuildUKISpec: %s", litter.Sdump(uki))
+	return uki, err
+}
+
+func NewBuildUKI() *types.BuildUKISpec {
+	return &types.BuildUKISpec{
+		OutputDir:            ".",
+		OutputType:           string(constants.DefaultOutput),
+		BootBranding:         constants.UkiBootBranding,
+		EfiSizeWarn:          constants.UkiEfiSizeWarn,
+		SecureBootEnroll:     constants.UkiSecureBootEnroll,
+		LoaderTimeout:        constants.UkiLoaderTimeout,
+		LoaderConsoleMode:    constants.UkiLoaderConsole,
+		InitrdCompression:    constants.ZstdCompression,
+		EspSize:              constants.UkiEspSize,
+		ContainerCompression: constants.GzipCompression,
+		ContainerFormat:      constants.DockerContainerFormat,
+		PrivateKeySource:     constants.DefaultPrivateKeySource,
+	}
+}
+
 func NewISO() *types.LiveISO {
 	return &types.LiveISO{
 		Label:     constants.ISOLabel,
@@ -156,8 +199,9 @@ func NewISO() *types.LiveISO {
 
 func NewBuildConfig(opts ...GenericOptions) *types.BuildConfig {
 	b := &types.BuildConfig{
-		Config: *NewConfig(opts...),
-		Name:   constants.BuildImgName,
+		Config:     *NewConfig(opts...),
+		Name:       constants.BuildImgName,
+		ISOBackend: constants.NativeISOBackend,
 	}
 	return b
 }
@@ -1,9 +1,7 @@
 package constants
 
 import (
-	"fmt"
 	"os"
-	"path/filepath"
 )
 
 type UkiOutput string
@@ -11,14 +9,113 @@ type UkiOutput string
 const IsoOutput UkiOutput = "iso"
 const ContainerOutput UkiOutput = "container"
 const DefaultOutput UkiOutput = "uki"
+const RawOutput UkiOutput = "raw"
+const Qcow2Output UkiOutput = "qcow2"
 
 func OutPutTypes() []string {
-	return []string{string(IsoOutput), string(ContainerOutput), string(DefaultOutput)}
+	return []string{string(IsoOutput), string(ContainerOutput), string(DefaultOutput), string(RawOutput), string(Qcow2Output)}
+}
+
+const (
+	NativeISOBackend  = "native"
+	XorrisoISOBackend = "xorriso"
+)
+
+// ISOBackends returns the tools that can be used to write ISO images
+func ISOBackends() []string {
+	return []string{NativeISOBackend, XorrisoISOBackend}
+}
+
+const (
+	ZstdCompression = "zstd"
+	XzCompression   = "xz"
+	Lz4Compression  = "lz4"
+	GzipCompression = "gzip"
+	NoCompression   = "none"
+)
+
+// InitrdCompressions returns the algorithms that can be used to compress the UKI initramfs
+func InitrdCompressions() []string {
+	return []string{ZstdCompression, XzCompression, Lz4Compression, GzipCompression, NoCompression}
+}
+
+// ContainerCompressions returns the algorithms that can be used to compress the layer of the UKI container image
+func ContainerCompressions() []string {
+	return []string{GzipCompression, ZstdCompression}
+}
+
+// Formats of the UKI container image
+const (
+	// DockerContainerFormat is a tarball that can be loaded with docker load
+	DockerContainerFormat = "docker"
+	// OCIContainerFormat is an OCI image layout directory
+	OCIContainerFormat = "oci"
+)
+
+// ContainerFormats returns the formats the UKI container image can be written in
+func ContainerFormats() []string {
+	return []string{DockerContainerFormat, OCIContainerFormat}
+}
+
+// Media types of the sysext images pushed as OCI artifacts
+const (
+	SysextArtifactType = "application/vnd.kairos.sysext.config.v1+json"
+	SysextLayerType    = "application/vnd.kairos.sysext.raw.v1"
+)
+
+// DefaultPrivateKeySource is the OpenSSL provider the keys given as PKCS#11 URIs are used with
+const DefaultPrivateKeySource = "provider:pkcs11"
+
+// SignManifestFile is the file listing the EFI files to sign of the unsigned builds
+const SignManifestFile = "enki-sign.json"
+
+// DefaultPCRBank is the PCR bank the measurements are predicted for by default
+const DefaultPCRBank = "sha256"
+
+// PCRBanks returns the PCR banks the measurements can be predicted for
+func PCRBanks() []string {
+	return []string{"sha1", DefaultPCRBank, "sha384", "sha512"}
+}
+
+const DefaultInspectFormat = "text"
+
+// InspectFormats returns the output formats of inspect-uki
+func InspectFormats() []string {
+	return []string{DefaultInspectFormat, "json"}
+}
+
+// LoaderMenuTimeouts returns the values of the loader.conf timeout option besides a number of seconds
+func LoaderMenuTimeouts() []string {
+	return []string{"menu-force", "menu-hidden", "menu-disabled"}
+}
+
+// LoaderConsoleModes returns the values of the loader.conf console-mode option
+func LoaderConsoleModes() []string {
+	return []string{"0", "1", "2", "auto", "max", "keep"}
+}
+
+// UkiInitrdExcludes returns the paths of the rootfs that are never added to the UKI initramfs
+func UkiInitrdExcludes() []string {
+	return []string{"/sys", "/run", "/dev", "/tmp", "/proc"}
+}
+
+// InitrdCompressionMaxLevel returns the highest compression level of the given algorithm, level 0 always
+// selects the default of the algorithm
+func InitrdCompressionMaxLevel(algorithm string) int {
+	switch algorithm {
+	case ZstdCompression:
+		return 22
+	case XzCompression, Lz4Compression, GzipCompression:
+		return 9
+	default:
+		return 0
+	}
 }
 
 const (
 	GrubDefEntry   = "Kairos"
 	EfiLabel       = "COS_GRUB"
+	OEMLabel       = "COS_OEM"
 	ISOLabel       = "COS_LIVE"
 	MountBinary    = "/usr/bin/mount"
 	EfiFs          = "vfat"
@@ -64,30 +161,31 @@ const (
 	EfiFallbackNameArm = "BOOTAA64.EFI"
 
 	ArtifactBaseName = "norole"
+	// UkiMultiProfileName is the name of the UKI file with all the boot entries as profiles
+	UkiMultiProfileName = "kairos"
+	// UkiProfilesMinVersion is the first systemd version with multi-profile UKIs
+	UkiProfilesMinVersion = 257
+	// UkiMaxDefaultWorkers caps the default number of UKI files built in parallel, as every build holds a few copies of
+	// its UKI file in memory while signing it
+	UkiMaxDefaultWorkers = 4
+
+	UkiBootBranding     = "Kairos"
+	UkiSecureBootEnroll = "if-safe"
+	UkiLoaderTimeout    = "5"
+	UkiLoaderConsole    = "max"
+	// UkiEfiSizeWarn is the UKI file size in megabytes above which a warning is shown
+	UkiEfiSizeWarn = 1024
+	// UkiMaxSize is the biggest UKI file that fits in a FAT32 filesystem
+	UkiMaxSize = 4<<30 - 1
+	// UkiEspSize is the default size in megabytes of the EFI System Partition of disk images
+	UkiEspSize = 1024
+
+	// SourceDateEpochEnv is the environment variable with the timestamp used for reproducible builds
+	// See https://reproducible-builds.org/specs/source-date-epoch/
+	SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
 )
 
 // GetDefaultSquashfsOptions returns the default options to use when creating a squashfs
 func GetDefaultSquashfsOptions() []string {
 	return []string{"-b", "1024k"}
 }
-
-func GetXorrisoBooloaderArgs(root string) []string {
-	args := []string{
-		"-boot_image", "grub", fmt.Sprintf("bin_path=%s", IsoBootFile),
-		"-boot_image", "grub", fmt.Sprintf("grub2_mbr=%s/%s", root, IsoHybridMBR),
-		"-boot_image", "grub", "grub2_boot_info=on",
-		"-boot_image", "any", "partition_offset=16",
-		"-boot_image", "any", fmt.Sprintf("cat_path=%s", IsoBootCatalog),
-		"-boot_image", "any", "cat_hidden=on",
-		"-boot_image", "any", "boot_info_table=on",
-		"-boot_image", "any", "platform_id=0x00",
-		"-boot_image", "any", "emul_type=no_emulation",
-		"-boot_image", "any", "load_size=2048",
-		"-append_partition", "2", "0xef", filepath.Join(root, IsoEFIPath),
-		"-boot_image", "any", "next",
-		"-boot_image", "any", "efi_path=--interval:appended_partition_2:all::",
-		"-boot_image", "any", "platform_id=0xef",
-		"-boot_image", "any", "emul_type=no_emulation",
-	}
-	return args
-}
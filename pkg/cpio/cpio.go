@@ -0,0 +1,298 @@
+// Package cpio writes newc cpio archives, as used for Linux initramfs images.
+//
+// Archives only depend on the contents of the added trees: entries are written in the order they are walked,
+// inode numbers are assigned sequentially, owners are reset to root and every entry gets the same timestamp.
+// Hardlinks inside the archive are kept as newc hardlink groups, with the data stored in the last entry of
+// each group as GNU cpio does.
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	magic       = "070701"
+	headerSize  = 110
+	trailerName = "TRAILER!!!"
+)
+
+// Archive is a cpio archive that has not been written yet.
+type Archive struct {
+	// ModTime is the timestamp set on every entry. If zero, the Unix epoch is used.
+	ModTime time.Time
+
+	entries []*entry
+}
+
+type entry struct {
+	name   string
+	source string
+	mode   uint32
+	size   int64
+	rmajor uint32
+	rminor uint32
+	// link is the host inode of regular files with more than one link, used to find the hardlink groups
+	link *devIno
+}
+
+type devIno struct {
+	dev uint64
+	ino uint64
+}
+
+// header is the newc header of an entry, the fields are written in this order as 8 hex digits
+type header struct {
+	ino      uint32
+	mode     uint32
+	uid      uint32
+	gid      uint32
+	nlink    uint32
+	mtime    uint32
+	fileSize uint32
+	devMajor uint32
+	devMinor uint32
+	rMajor   uint32
+	rMinor   uint32
+	nameSize uint32
+	check    uint32
+}
+
+// New returns an empty archive.
+func New() *Archive {
+	return &Archive{}
+}
+
+// AddTree adds the directory source and all its contents, with names relative to source. The source directory
+// itself is stored as ".". If skip is not nil, it is called with every relative path and the entries it returns
+// true for are left out, including their contents for directories.
+func (a *Archive) AddTree(source string, skip func(p string, d fs.DirEntry) bool) error {
+	return filepath.WalkDir(source, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, file)
+		if err != nil {
+			return err
+		}
+		if rel != "." && skip != nil && skip(rel, d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return a.add(filepath.ToSlash(rel), file)
+	})
+}
+
+// Write writes the archive, including the trailer, to w.
+func (a *Archive) Write(w io.Writer) error {
+	inos, nlinks, last := a.links()
+	cw := &countingWriter{w: w}
+	for i, e := range a.entries {
+		h := header{
+			ino:      inos[i],
+			mode:     e.mode,
+			nlink:    nlinks[i],
+			mtime:    a.mtime(),
+			rMajor:   e.rmajor,
+			rMinor:   e.rminor,
+			nameSize: uint32(len(e.name) + 1),
+		}
+		withData := e.link == nil || last[i]
+		if withData {
+			h.fileSize = uint32(e.size)
+		}
+		if err := writeHeader(cw, h, e.name); err != nil {
+			return err
+		}
+		if !withData {
+			continue
+		}
+		if err := e.writeData(cw); err != nil {
+			return fmt.Errorf("adding %s to the cpio archive: %w", e.source, err)
+		}
+		if err := pad(cw); err != nil {
+			return err
+		}
+	}
+	return writeHeader(cw, header{nlink: 1, nameSize: uint32(len(trailerName) + 1)}, trailerName)
+}
+
+// FileSizes returns the data size of the regular files in the archive by name. The data of hardlinked files is only
+// counted for the first name of each group.
+func (a *Archive) FileSizes() map[string]int64 {
+	sizes := map[string]int64{}
+	seen := map[devIno]bool{}
+	for _, e := range a.entries {
+		if e.mode&syscall.S_IFMT != syscall.S_IFREG {
+			continue
+		}
+		if e.link != nil {
+			if seen[*e.link] {
+				sizes[e.name] = 0
+				continue
+			}
+			seen[*e.link] = true
+		}
+		sizes[e.name] = e.size
+	}
+	return sizes
+}
+
+func (a *Archive) add(name, source string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("cannot read the file details of %s", source)
+	}
+	e := &entry{name: name, source: source, mode: st.Mode}
+
+	switch info.Mode().Type() {
+	case 0:
+		if info.Size() > int64(^uint32(0)) {
+			return fmt.Errorf("%s is too big for a cpio archive", source)
+		}
+		e.size = info.Size()
+		if st.Nlink > 1 {
+			e.link = &devIno{dev: uint64(st.Dev), ino: st.Ino}
+		}
+	case fs.ModeSymlink:
+		target, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		e.size = int64(len(target))
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+		e.rmajor = unix.Major(uint64(st.Rdev))
+		e.rminor = unix.Minor(uint64(st.Rdev))
+	}
+
+	a.entries = append(a.entries, e)
+	return nil
+}
+
+// links assigns the inode numbers and link counts of all the entries and finds the last entry of every hardlink group
+func (a *Archive) links() (inos, nlinks []uint32, last []bool) {
+	inos = make([]uint32, len(a.entries))
+	nlinks = make([]uint32, len(a.entries))
+	last = make([]bool, len(a.entries))
+
+	groupIno := map[devIno]uint32{}
+	groupSize := map[devIno]uint32{}
+	groupLast := map[devIno]int{}
+	next := uint32(1)
+	for i, e := range a.entries {
+		if e.link == nil {
+			inos[i] = next
+			next++
+			continue
+		}
+		ino, ok := groupIno[*e.link]
+		if !ok {
+			ino = next
+			groupIno[*e.link] = ino
+			next++
+		}
+		inos[i] = ino
+		groupSize[*e.link]++
+		groupLast[*e.link] = i
+	}
+
+	for i, e := range a.entries {
+		switch {
+		case e.link != nil:
+			nlinks[i] = groupSize[*e.link]
+			last[i] = groupLast[*e.link] == i
+		case e.mode&syscall.S_IFMT == syscall.S_IFDIR:
+			nlinks[i] = 2
+		default:
+			nlinks[i] = 1
+		}
+	}
+	return inos, nlinks, last
+}
+
+func (a *Archive) mtime() uint32 {
+	if a.ModTime.IsZero() || a.ModTime.Unix() < 0 {
+		return 0
+	}
+	return uint32(min(a.ModTime.Unix(), int64(^uint32(0))))
+}
+
+func (e *entry) writeData(w io.Writer) error {
+	if e.mode&syscall.S_IFMT == syscall.S_IFLNK {
+		target, err := os.Readlink(e.source)
+		if err != nil {
+			return err
+		}
+		if int64(len(target)) != e.size {
+			return fmt.Errorf("link changed while archiving")
+		}
+		_, err = io.WriteString(w, target)
+		return err
+	}
+	if e.size == 0 {
+		return nil
+	}
+
+	f, err := os.Open(e.source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(w, io.LimitReader(f, e.size))
+	if err != nil {
+		return err
+	}
+	if n != e.size {
+		return fmt.Errorf("file changed while archiving")
+	}
+	return nil
+}
+
+func writeHeader(w *countingWriter, h header, name string) error {
+	fields := []uint32{h.ino, h.mode, h.uid, h.gid, h.nlink, h.mtime, h.fileSize,
+		h.devMajor, h.devMinor, h.rMajor, h.rMinor, h.nameSize, h.check}
+	buf := make([]byte, 0, headerSize+len(name)+1)
+	buf = append(buf, magic...)
+	for _, f := range fields {
+		buf = fmt.Appendf(buf, "%08X", f)
+	}
+	buf = append(buf, name...)
+	buf = append(buf, 0)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	return pad(w)
+}
+
+// pad aligns the archive to 4 bytes, as newc requires after every name and file data
+func pad(w *countingWriter) error {
+	if n := w.n % 4; n != 0 {
+		_, err := w.Write(make([]byte, 4-n))
+		return err
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,13 @@
+package cpio_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCpioSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "cpio test suite")
+}
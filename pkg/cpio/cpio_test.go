@@ -0,0 +1,116 @@
+package cpio_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/cpio"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ucpio "github.com/u-root/u-root/pkg/cpio"
+)
+
+var _ = Describe("Archive", Label("cpio"), func() {
+	var tree string
+
+	write := func(archive *cpio.Archive) []byte {
+		var buf bytes.Buffer
+		Expect(archive.Write(&buf)).To(Succeed())
+		return buf.Bytes()
+	}
+
+	readRecords := func(data []byte) []ucpio.Record {
+		records, err := ucpio.ReadAllRecords(ucpio.Newc.Reader(bytes.NewReader(data)))
+		Expect(err).ToNot(HaveOccurred())
+		return records
+	}
+
+	readData := func(r ucpio.Record) string {
+		data, err := io.ReadAll(io.NewSectionReader(r.ReaderAt, 0, int64(r.FileSize)))
+		Expect(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tree, err = os.MkdirTemp("", "enki-cpio-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tree)
+		Expect(os.MkdirAll(filepath.Join(tree, "usr", "bin"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(tree, "proc", "self"), 0555)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tree, "usr", "bin", "busybox"), []byte("binary"), 0755)).To(Succeed())
+		Expect(os.Link(filepath.Join(tree, "usr", "bin", "busybox"), filepath.Join(tree, "usr", "bin", "ash"))).To(Succeed())
+		Expect(os.Link(filepath.Join(tree, "usr", "bin", "busybox"), filepath.Join(tree, "usr", "bin", "sh"))).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tree, "usr", "bin", "kmod"), []byte("other"), 0755)).To(Succeed())
+		Expect(os.Symlink("usr/bin", filepath.Join(tree, "bin"))).To(Succeed())
+	})
+
+	It("writes the tree in order with stable inodes and hardlink groups", func() {
+		archive := cpio.New()
+		archive.ModTime = time.Date(2024, 5, 17, 10, 30, 20, 0, time.UTC)
+		Expect(archive.AddTree(tree, func(p string, d fs.DirEntry) bool { return p == "proc" })).To(Succeed())
+		records := readRecords(write(archive))
+
+		var names []string
+		byName := map[string]ucpio.Record{}
+		for _, r := range records {
+			names = append(names, r.Name)
+			byName[r.Name] = r
+			Expect(r.MTime).To(Equal(uint64(archive.ModTime.Unix())))
+			Expect(r.UID).To(BeZero())
+			Expect(r.GID).To(BeZero())
+		}
+		Expect(names).To(Equal([]string{".", "bin", "usr", "usr/bin", "usr/bin/ash", "usr/bin/busybox", "usr/bin/kmod", "usr/bin/sh"}))
+		Expect(byName["."].Ino).To(Equal(uint64(1)))
+
+		By("grouping the hardlinks with the data in the last entry")
+		for _, name := range []string{"usr/bin/ash", "usr/bin/busybox", "usr/bin/sh"} {
+			Expect(byName[name].Ino).To(Equal(byName["usr/bin/ash"].Ino))
+			Expect(byName[name].NLink).To(Equal(uint64(3)))
+		}
+		Expect(byName["usr/bin/ash"].FileSize).To(BeZero())
+		Expect(byName["usr/bin/busybox"].FileSize).To(BeZero())
+		Expect(readData(byName["usr/bin/sh"])).To(Equal("binary"))
+		Expect(byName["usr/bin/kmod"].Ino).ToNot(Equal(byName["usr/bin/ash"].Ino))
+		Expect(byName["usr/bin/kmod"].NLink).To(Equal(uint64(1)))
+		Expect(readData(byName["usr/bin/kmod"])).To(Equal("other"))
+
+		By("storing the symlink target")
+		Expect(byName["bin"].Mode & syscall.S_IFMT).To(Equal(uint64(syscall.S_IFLNK)))
+		Expect(readData(byName["bin"])).To(Equal("usr/bin"))
+
+		By("counting the data of the hardlinks once")
+		Expect(archive.FileSizes()).To(Equal(map[string]int64{
+			"usr/bin/ash": 6, "usr/bin/busybox": 0, "usr/bin/kmod": 5, "usr/bin/sh": 0,
+		}))
+	})
+
+	It("generates the same archive for the same tree", func() {
+		archive := cpio.New()
+		Expect(archive.AddTree(tree, nil)).To(Succeed())
+		first := write(archive)
+		Expect(readRecords(first)[0].MTime).To(BeZero())
+
+		By("creating the same tree somewhere else, in a different order and with new inodes")
+		copied, err := os.MkdirTemp("", "enki-cpio-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, copied)
+		Expect(os.Symlink("usr/bin", filepath.Join(copied, "bin"))).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(copied, "usr", "bin"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(copied, "proc", "self"), 0555)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(copied, "usr", "bin", "kmod"), []byte("other"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(copied, "usr", "bin", "sh"), []byte("binary"), 0755)).To(Succeed())
+		Expect(os.Link(filepath.Join(copied, "usr", "bin", "sh"), filepath.Join(copied, "usr", "bin", "busybox"))).To(Succeed())
+		Expect(os.Link(filepath.Join(copied, "usr", "bin", "sh"), filepath.Join(copied, "usr", "bin", "ash"))).To(Succeed())
+		Expect(os.Chtimes(filepath.Join(copied, "usr", "bin", "kmod"), time.Now(), time.Now().Add(time.Hour))).To(Succeed())
+
+		second := cpio.New()
+		Expect(second.AddTree(copied, nil)).To(Succeed())
+		Expect(write(second)).To(Equal(first))
+	})
+})
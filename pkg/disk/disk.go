@@ -0,0 +1,197 @@
+// Package disk writes GPT partitioned disk images from partition contents prepared beforehand, like filesystem images.
+//
+// Partitions are laid out in order, aligned to 1MiB, and the disk and partition GUIDs are derived from the partition
+// names and the image timestamp, so the same inputs always produce the same image.
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kairos-io/enki/pkg/gpt"
+)
+
+const (
+	lbaSize = gpt.LBASize
+	// alignment is the alignment of the partition starts and sizes
+	alignment = 1024 * 1024
+
+	mbrTypeProtective = 0xEE
+)
+
+var (
+	// TypeEFI is the partition type of the EFI System Partition
+	TypeEFI = gpt.TypeEFI
+	// TypeLinux is the partition type of Linux filesystems
+	TypeLinux = gpt.TypeLinux
+)
+
+// Partition is a partition of the image
+type Partition struct {
+	// Name is the GPT partition name, at most 36 characters
+	Name string
+	Type uuid.UUID
+	// Source is the file copied at the start of the partition. If empty, the partition is left zeroed.
+	Source string
+	// Size is the size of the partition in bytes, rounded up to 1MiB. If zero, the size of Source is used.
+	Size int64
+}
+
+// Image is a GPT disk image that has not been written yet
+type Image struct {
+	// ModTime seeds the GUIDs of the image. If zero, the current time is used.
+	ModTime    time.Time
+	Partitions []Partition
+}
+
+// New returns an image without partitions
+func New() *Image {
+	return &Image{}
+}
+
+// AddPartition appends a partition to the image
+func (i *Image) AddPartition(p Partition) {
+	i.Partitions = append(i.Partitions, p)
+}
+
+type extent struct {
+	// first and last are inclusive 512 bytes blocks
+	first uint64
+	last  uint64
+}
+
+// Write creates the image at the target path. Any existing file is truncated.
+func (i *Image) Write(target string) error {
+	if len(i.Partitions) == 0 {
+		return fmt.Errorf("no partitions in the disk image")
+	}
+	if len(i.Partitions) > gpt.Entries {
+		return fmt.Errorf("too many partitions in the disk image: %d", len(i.Partitions))
+	}
+
+	extents := make([]extent, len(i.Partitions))
+	next := uint64(alignment / lbaSize)
+	for idx, p := range i.Partitions {
+		size := p.Size
+		if size == 0 && p.Source != "" {
+			info, err := os.Stat(p.Source)
+			if err != nil {
+				return fmt.Errorf("reading the contents of partition %s: %w", p.Name, err)
+			}
+			size = info.Size()
+		}
+		if size == 0 {
+			return fmt.Errorf("partition %s has no size", p.Name)
+		}
+		blocks := uint64((size+alignment-1)/alignment) * alignment / lbaSize
+		extents[idx] = extent{first: next, last: next + blocks - 1}
+		next += blocks
+	}
+	// Leave an aligned area at the end for the backup GPT
+	totalLBAs := next + alignment/lbaSize
+
+	f, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("creating the disk image: %w", err)
+	}
+	defer f.Close()
+	if err = f.Truncate(int64(totalLBAs * lbaSize)); err != nil {
+		return fmt.Errorf("allocating the disk image: %w", err)
+	}
+
+	for idx, p := range i.Partitions {
+		if p.Source == "" {
+			continue
+		}
+		if err := copyAt(f, p.Source, int64(extents[idx].first*lbaSize), int64(extents[idx].last+1-extents[idx].first)*lbaSize); err != nil {
+			return fmt.Errorf("copying the contents of partition %s: %w", p.Name, err)
+		}
+	}
+	if err := i.writeGPT(f, extents, totalLBAs); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeGPT writes the protective MBR and the primary and backup GPT
+func (i *Image) writeGPT(w io.WriterAt, extents []extent, totalLBAs uint64) error {
+	mbr := make([]byte, lbaSize)
+	e := mbr[446:]
+	copy(e[1:4], []byte{0x00, 0x02, 0x00})
+	e[4] = mbrTypeProtective
+	copy(e[5:8], []byte{0xFF, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(e[8:], 1)
+	binary.LittleEndian.PutUint32(e[12:], uint32(min(totalLBAs-1, 0xFFFFFFFF)))
+	mbr[510] = 0x55
+	mbr[511] = 0xAA
+	if _, err := w.WriteAt(mbr, 0); err != nil {
+		return fmt.Errorf("writing the protective MBR: %w", err)
+	}
+
+	parts := make([]gpt.Partition, len(i.Partitions))
+	for idx, p := range i.Partitions {
+		parts[idx] = gpt.Partition{
+			Name:  p.Name,
+			Type:  p.Type,
+			GUID:  i.seedGUID(fmt.Sprintf("partition-%d-%s", idx, p.Name)),
+			First: extents[idx].first,
+			Last:  extents[idx].last,
+		}
+	}
+	return gpt.Write(w, i.seedGUID("disk"), parts, totalLBAs)
+}
+
+// seedGUID returns a GUID derived from the partitions and the timestamp of the image
+func (i *Image) seedGUID(name string) uuid.UUID {
+	modTime := i.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	return gpt.SeedGUID(fmt.Sprintf("%d-%d-%s", len(i.Partitions), modTime.UnixNano(), name))
+}
+
+// copyAt copies the source file to w at the given offset, failing if it does not fit in size bytes.
+// Blocks of zeros are skipped, as the image is created empty, so the free space of filesystem images stays sparse.
+func copyAt(w io.WriterAt, source string, offset, size int64) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > size {
+		return fmt.Errorf("%s does not fit in the partition", source)
+	}
+	buf := make([]byte, alignment)
+	for pos := int64(0); ; {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 && !isZero(buf[:n]) {
+			if _, werr := w.WriteAt(buf[:n], offset+pos); werr != nil {
+				return werr
+			}
+		}
+		pos += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
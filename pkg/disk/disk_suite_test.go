@@ -0,0 +1,13 @@
+package disk_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestDiskSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "disk test suite")
+}
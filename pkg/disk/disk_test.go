@@ -0,0 +1,87 @@
+package disk_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/kairos-io/enki/pkg/disk"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Image", Label("disk"), func() {
+	var tmpDir, target, espImg string
+	var img *disk.Image
+
+	content := func(size int, seed byte) []byte {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i%251) + seed
+		}
+		return data
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "enki-disk-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpDir)
+		target = filepath.Join(tmpDir, "disk.raw")
+		espImg = filepath.Join(tmpDir, "esp.img")
+		Expect(os.WriteFile(espImg, content(3*1024*1024+100, 1), 0644)).To(Succeed())
+
+		img = disk.New()
+		img.ModTime = time.Date(2024, 5, 17, 10, 30, 20, 0, time.UTC)
+		img.AddPartition(disk.Partition{Name: "efi", Type: disk.TypeEFI, Source: espImg})
+		img.AddPartition(disk.Partition{Name: "oem", Type: disk.TypeLinux, Size: 64 * 1024 * 1024})
+	})
+
+	It("writes aligned partitions with a valid GPT", func() {
+		Expect(img.Write(target)).To(Succeed())
+		data, err := os.ReadFile(target)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data[510:512]).To(Equal([]byte{0x55, 0xAA}))
+		Expect(data[446+4]).To(Equal(byte(0xEE)))
+
+		f, err := os.Open(target)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		table, err := gpt.Read(f, 512, 512)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(table.Verify(f, uint64(len(data)))).To(Succeed())
+		parts := table.Partitions
+		Expect(parts).To(HaveLen(2))
+
+		Expect(parts[0].Type).To(Equal(gpt.EFISystemPartition))
+		Expect(parts[0].Name).To(Equal("efi"))
+		Expect(parts[0].Start).To(Equal(uint64(2048)))
+		Expect(parts[0].End).To(Equal(uint64(2048 + 4*2048 - 1)))
+		Expect(data[2048*512 : 2048*512+3*1024*1024+100]).To(Equal(content(3*1024*1024+100, 1)))
+
+		Expect(parts[1].Type).To(Equal(gpt.LinuxFilesystem))
+		Expect(parts[1].Name).To(Equal("oem"))
+		Expect(parts[1].Start).To(Equal(parts[0].End + 1))
+		Expect(parts[1].End - parts[1].Start + 1).To(Equal(uint64(64 * 2048)))
+		Expect(parts[0].GUID).ToNot(Equal(parts[1].GUID))
+		Expect(uint64(len(data))).To(Equal((parts[1].End + 1 + 2048) * 512))
+	})
+
+	It("generates the same image for the same inputs", func() {
+		Expect(img.Write(target)).To(Succeed())
+		first, err := os.ReadFile(target)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(img.Write(target)).To(Succeed())
+		Expect(os.ReadFile(target)).To(Equal(first))
+	})
+
+	It("fails with partitions without size or too small for their contents", func() {
+		img.AddPartition(disk.Partition{Name: "empty", Type: disk.TypeLinux})
+		Expect(img.Write(target)).ToNot(Succeed())
+
+		img = disk.New()
+		img.AddPartition(disk.Partition{Name: "efi", Type: disk.TypeEFI, Source: espImg, Size: 1024 * 1024})
+		Expect(img.Write(target)).ToNot(Succeed())
+	})
+})
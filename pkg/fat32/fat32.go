@@ -0,0 +1,545 @@
+// Package fat32 writes FAT32 filesystem images in-process.
+//
+// The writer is meant for small, write-once images like the EFI System Partition that ships inside our ISOs.
+// The whole tree is known before anything is written, so the image is laid out in a single pass: every
+// directory and file is allocated contiguously and the resulting image has exactly the size needed to
+// hold the data plus the FAT overhead, padded only up to the minimum cluster count FAT32 requires.
+package fat32
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize      = 512
+	reservedSectors = 32
+	numFATs         = 2
+	dirEntrySize    = 32
+	// rootCluster is always the first data cluster, we allocate the root directory first
+	rootCluster = 2
+	// minClusters is the smallest cluster count that is detected as FAT32 by a spec compliant reader.
+	// Anything below this is considered FAT16 regardless of what the BPB says
+	minClusters = 65525
+	// Microsoft recommends 512 bytes clusters up to 260MB and 4K clusters up to 8GB
+	smallClusterLimit = 260 * 1024 * 1024
+
+	attrReadOnly  = 0x01
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLFN       = 0x0F
+
+	fatEOC     = 0x0FFFFFFF
+	fatMedia   = 0x0FFFFFF8
+	lfnLast    = 0x40
+	lfnChars   = 13
+	defaultVol = "NO NAME"
+)
+
+// Image is a FAT32 image that has not been written yet.
+// Directories and files are added to it and its layout is calculated when Size or Write are called.
+type Image struct {
+	// Label is the volume label, at most 11 characters. If empty "NO NAME" is used.
+	Label string
+	// ModTime is the timestamp set on every directory entry. If zero, the current time is used.
+	ModTime time.Time
+	// VolumeID is the volume serial number. If zero, it is derived from ModTime.
+	VolumeID uint32
+	// MinSize is the smallest size of the image in bytes, the space not used by the files is left free.
+	MinSize int64
+
+	root *node
+}
+
+type node struct {
+	name     string
+	dir      bool
+	source   string
+	size     int64
+	children []*node
+	parent   *node
+
+	shortName [11]byte
+	lfn       bool
+	cluster   uint32
+	clusters  uint32
+}
+
+type layout struct {
+	clusterSize  int64
+	spc          uint8
+	fatSectors   uint32
+	dataClusters uint32
+	usedClusters uint32
+	totalSectors uint32
+}
+
+// New returns an empty image with the given volume label.
+func New(label string) *Image {
+	return &Image{
+		Label: label,
+		root:  &node{dir: true},
+	}
+}
+
+// AddDir adds the directory p to the image, creating any missing parents.
+func (i *Image) AddDir(p string) error {
+	_, err := i.mkdirAll(p)
+	return err
+}
+
+// AddFile adds the contents of the file at source under the image path p, creating any missing parents.
+// The source is only read when the image is written.
+func (i *Image) AddFile(p, source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("adding %s to the fat image: %w", source, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("adding %s to the fat image: not a regular file", source)
+	}
+	if info.Size() > 0xFFFFFFFF {
+		return fmt.Errorf("adding %s to the fat image: file is bigger than the 4GiB FAT32 limit", source)
+	}
+	dir, name := path.Split(cleanPath(p))
+	if name == "" {
+		return fmt.Errorf("invalid file path in the fat image: %q", p)
+	}
+	parent, err := i.mkdirAll(dir)
+	if err != nil {
+		return err
+	}
+	if existing := parent.child(name); existing != nil {
+		return fmt.Errorf("%s already exists in the fat image", p)
+	}
+	parent.children = append(parent.children, &node{name: name, source: source, size: info.Size(), parent: parent})
+	return nil
+}
+
+// Size returns the exact size in bytes the image will have once written. It is never smaller than MinSize.
+func (i *Image) Size() (int64, error) {
+	l, err := i.layout()
+	if err != nil {
+		return 0, err
+	}
+	return int64(l.totalSectors) * sectorSize, nil
+}
+
+// Write creates the image at the target path. Any existing file is truncated.
+func (i *Image) Write(target string) error {
+	l, err := i.layout()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("creating the fat image: %w", err)
+	}
+	defer f.Close()
+
+	if err = f.Truncate(int64(l.totalSectors) * sectorSize); err != nil {
+		return fmt.Errorf("allocating the fat image: %w", err)
+	}
+
+	if err = i.writeBootSectors(f, l); err != nil {
+		return err
+	}
+	if err = i.writeFATs(f, l); err != nil {
+		return err
+	}
+
+	dataStart := int64(reservedSectors+numFATs*l.fatSectors) * sectorSize
+	modTime := i.modTime()
+	var walkErr error
+	walk(i.root, func(n *node) {
+		if walkErr != nil {
+			return
+		}
+		offset := dataStart + int64(n.cluster-rootCluster)*l.clusterSize
+		if n.dir {
+			data := i.dirData(n, l, modTime)
+			if _, err := f.WriteAt(data, offset); err != nil {
+				walkErr = fmt.Errorf("writing directory %s to the fat image: %w", n.path(), err)
+			}
+			return
+		}
+		if n.size == 0 {
+			return
+		}
+		if err := copyAt(f, n.source, offset); err != nil {
+			walkErr = fmt.Errorf("copying %s to the fat image: %w", n.source, err)
+		}
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	return f.Close()
+}
+
+func (i *Image) mkdirAll(p string) (*node, error) {
+	current := i.root
+	p = cleanPath(p)
+	if p == "" {
+		return current, nil
+	}
+	for _, part := range strings.Split(p, "/") {
+		next := current.child(part)
+		if next == nil {
+			next = &node{name: part, dir: true, parent: current}
+			current.children = append(current.children, next)
+		}
+		if !next.dir {
+			return nil, fmt.Errorf("%s is a file in the fat image", next.path())
+		}
+		current = next
+	}
+	return current, nil
+}
+
+func (i *Image) modTime() time.Time {
+	if i.ModTime.IsZero() {
+		return time.Now()
+	}
+	return i.ModTime
+}
+
+func (i *Image) volumeID() uint32 {
+	if i.VolumeID != 0 {
+		return i.VolumeID
+	}
+	t := i.modTime()
+	date, tm := dosDateTime(t)
+	return uint32(date)<<16 | uint32(tm)
+}
+
+func (i *Image) label() [11]byte {
+	var l [11]byte
+	copy(l[:], "           ")
+	label := strings.ToUpper(i.Label)
+	if label == "" {
+		label = defaultVol
+	}
+	copy(l[:], label)
+	return l
+}
+
+// layout assigns short names and clusters to every node and calculates the image geometry
+func (i *Image) layout() (layout, error) {
+	var l layout
+	var payload int64
+	var err error
+	walk(i.root, func(n *node) {
+		if err != nil {
+			return
+		}
+		if n.dir {
+			err = assignShortNames(n)
+		}
+		payload += n.size
+	})
+	if err != nil {
+		return l, err
+	}
+
+	l.clusterSize = sectorSize
+	if max(payload, i.MinSize) > smallClusterLimit {
+		l.clusterSize = 8 * sectorSize
+	}
+	l.spc = uint8(l.clusterSize / sectorSize)
+
+	next := uint32(rootCluster)
+	walk(i.root, func(n *node) {
+		bytes := n.size
+		if n.dir {
+			bytes = int64(n.dirEntries()) * dirEntrySize
+		}
+		n.clusters = uint32((bytes + l.clusterSize - 1) / l.clusterSize)
+		if n.clusters == 0 {
+			n.cluster = 0
+			return
+		}
+		n.cluster = next
+		next += n.clusters
+	})
+
+	l.usedClusters = next - rootCluster
+	// Each data cluster also takes a 4 bytes entry in every FAT
+	minSizeClusters := (i.MinSize - reservedSectors*sectorSize + l.clusterSize + numFATs*4 - 1) / (l.clusterSize + numFATs*4)
+	l.dataClusters = max(l.usedClusters, minClusters, uint32(max(minSizeClusters, 0)))
+	l.fatSectors = uint32((int64(l.dataClusters+2)*4 + sectorSize - 1) / sectorSize)
+	total := int64(reservedSectors) + int64(numFATs)*int64(l.fatSectors) + int64(l.dataClusters)*int64(l.spc)
+	if total > 0xFFFFFFFF {
+		return l, fmt.Errorf("fat image too big: %d sectors", total)
+	}
+	l.totalSectors = uint32(total)
+	return l, nil
+}
+
+func (i *Image) writeBootSectors(w io.WriterAt, l layout) error {
+	bs := make([]byte, sectorSize)
+	copy(bs[0:], []byte{0xEB, 0x58, 0x90})
+	copy(bs[3:], "ENKI    ")
+	binary.LittleEndian.PutUint16(bs[11:], sectorSize)
+	bs[13] = l.spc
+	binary.LittleEndian.PutUint16(bs[14:], reservedSectors)
+	bs[16] = numFATs
+	bs[21] = 0xF8
+	binary.LittleEndian.PutUint16(bs[24:], 32)
+	binary.LittleEndian.PutUint16(bs[26:], 64)
+	binary.LittleEndian.PutUint32(bs[32:], l.totalSectors)
+	binary.LittleEndian.PutUint32(bs[36:], l.fatSectors)
+	binary.LittleEndian.PutUint32(bs[44:], rootCluster)
+	binary.LittleEndian.PutUint16(bs[48:], 1)
+	binary.LittleEndian.PutUint16(bs[50:], 6)
+	bs[64] = 0x80
+	bs[66] = 0x29
+	binary.LittleEndian.PutUint32(bs[67:], i.volumeID())
+	label := i.label()
+	copy(bs[71:], label[:])
+	copy(bs[82:], "FAT32   ")
+	bs[510] = 0x55
+	bs[511] = 0xAA
+
+	fsInfo := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(fsInfo[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(fsInfo[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(fsInfo[488:], l.dataClusters-l.usedClusters)
+	nextFree := uint32(0xFFFFFFFF)
+	if l.usedClusters < l.dataClusters {
+		nextFree = rootCluster + l.usedClusters
+	}
+	binary.LittleEndian.PutUint32(fsInfo[492:], nextFree)
+	binary.LittleEndian.PutUint32(fsInfo[508:], 0xAA550000)
+
+	// Main boot sector and fsinfo plus the backup copies at sector 6
+	for _, base := range []int64{0, 6} {
+		if _, err := w.WriteAt(bs, base*sectorSize); err != nil {
+			return fmt.Errorf("writing the fat boot sector: %w", err)
+		}
+		if _, err := w.WriteAt(fsInfo, (base+1)*sectorSize); err != nil {
+			return fmt.Errorf("writing the fat fsinfo sector: %w", err)
+		}
+	}
+	return nil
+}
+
+func (i *Image) writeFATs(w io.WriterAt, l layout) error {
+	fat := make([]byte, int64(l.fatSectors)*sectorSize)
+	binary.LittleEndian.PutUint32(fat[0:], fatMedia)
+	binary.LittleEndian.PutUint32(fat[4:], fatEOC)
+	walk(i.root, func(n *node) {
+		for c := uint32(0); c < n.clusters; c++ {
+			value := n.cluster + c + 1
+			if c == n.clusters-1 {
+				value = fatEOC
+			}
+			binary.LittleEndian.PutUint32(fat[(n.cluster+c)*4:], value)
+		}
+	})
+	for n := int64(0); n < numFATs; n++ {
+		offset := (reservedSectors + n*int64(l.fatSectors)) * sectorSize
+		if _, err := w.WriteAt(fat, offset); err != nil {
+			return fmt.Errorf("writing the fat table: %w", err)
+		}
+	}
+	return nil
+}
+
+// dirData returns the full contents of the clusters allocated to the directory n
+func (i *Image) dirData(n *node, l layout, modTime time.Time) []byte {
+	data := make([]byte, int64(n.clusters)*l.clusterSize)
+	offset := 0
+	put := func(entry []byte) {
+		copy(data[offset:], entry)
+		offset += dirEntrySize
+	}
+
+	if n.parent == nil {
+		if i.Label != "" {
+			put(shortEntry(i.label(), attrVolumeID, 0, 0, modTime))
+		}
+	} else {
+		parentCluster := n.parent.cluster
+		if n.parent.parent == nil {
+			// Entries pointing to the root directory always use cluster 0
+			parentCluster = 0
+		}
+		put(shortEntry(dotName("."), attrDirectory, n.cluster, 0, modTime))
+		put(shortEntry(dotName(".."), attrDirectory, parentCluster, 0, modTime))
+	}
+
+	for _, child := range n.children {
+		if child.lfn {
+			for _, e := range lfnEntries(child.name, child.shortName) {
+				put(e)
+			}
+		}
+		attr := byte(attrArchive)
+		if child.dir {
+			attr = attrDirectory
+		}
+		put(shortEntry(child.shortName, attr, child.cluster, uint32(child.size), modTime))
+	}
+	return data
+}
+
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		// FAT is case-insensitive, so two names differing only in case would clash
+		if strings.EqualFold(c.name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *node) path() string {
+	if n.parent == nil {
+		return "/"
+	}
+	return path.Join(n.parent.path(), n.name)
+}
+
+// dirEntries returns the number of 32 byte entries the directory n holds
+func (n *node) dirEntries() int {
+	entries := 2
+	if n.parent == nil {
+		// The root has no dot entries, but it may hold the volume label
+		entries = 1
+	}
+	for _, c := range n.children {
+		entries++
+		if c.lfn {
+			entries += lfnCount(c.name)
+		}
+	}
+	return entries
+}
+
+// walk visits the root and then every node in pre-order, with children sorted by name
+func walk(n *node, fn func(*node)) {
+	fn(n)
+	sort.Slice(n.children, func(a, b int) bool { return n.children[a].name < n.children[b].name })
+	for _, c := range n.children {
+		walk(c, fn)
+	}
+}
+
+func cleanPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+func copyAt(w io.WriterAt, source string, offset int64) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(io.NewOffsetWriter(w, offset), f)
+	return err
+}
+
+func shortEntry(name [11]byte, attr byte, cluster, size uint32, modTime time.Time) []byte {
+	e := make([]byte, dirEntrySize)
+	copy(e[0:11], name[:])
+	e[11] = attr
+	date, tm := dosDateTime(modTime)
+	binary.LittleEndian.PutUint16(e[14:], tm)
+	binary.LittleEndian.PutUint16(e[16:], date)
+	binary.LittleEndian.PutUint16(e[18:], date)
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[22:], tm)
+	binary.LittleEndian.PutUint16(e[24:], date)
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], size)
+	return e
+}
+
+func dotName(name string) [11]byte {
+	var n [11]byte
+	copy(n[:], "           ")
+	copy(n[:], name)
+	return n
+}
+
+// dosDateTime converts t into the FAT date and time fields.
+// FAT cannot represent dates before 1980, so those are clamped to 1980-01-01.
+func dosDateTime(t time.Time) (uint16, uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0
+	}
+	if t.Year() > 2107 {
+		t = time.Date(2107, 12, 31, 23, 59, 58, 0, time.UTC)
+	}
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+func lfnCount(name string) int {
+	return (len(utf16.Encode([]rune(name))) + lfnChars - 1) / lfnChars
+}
+
+// lfnEntries returns the long file name entries for name in the order they are stored on disk
+func lfnEntries(name string, short [11]byte) [][]byte {
+	chars := utf16.Encode([]rune(name))
+	count := lfnCount(name)
+	// The name is NUL terminated unless it fills the last entry, and padded with 0xFFFF
+	padded := make([]uint16, count*lfnChars)
+	for i := range padded {
+		switch {
+		case i < len(chars):
+			padded[i] = chars[i]
+		case i == len(chars):
+			padded[i] = 0
+		default:
+			padded[i] = 0xFFFF
+		}
+	}
+
+	sum := shortNameChecksum(short)
+	entries := make([][]byte, 0, count)
+	for seq := count; seq >= 1; seq-- {
+		e := make([]byte, dirEntrySize)
+		e[0] = byte(seq)
+		if seq == count {
+			e[0] |= lfnLast
+		}
+		e[11] = attrLFN
+		e[13] = sum
+		part := padded[(seq-1)*lfnChars : seq*lfnChars]
+		for j, c := range part {
+			var off int
+			switch {
+			case j < 5:
+				off = 1 + j*2
+			case j < 11:
+				off = 14 + (j-5)*2
+			default:
+				off = 28 + (j-11)*2
+			}
+			binary.LittleEndian.PutUint16(e[off:], c)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func shortNameChecksum(name [11]byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
@@ -0,0 +1,13 @@
+package fat32_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestFat32Suite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "FAT32 test suite")
+}
@@ -0,0 +1,171 @@
+package fat32_test
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/kairos-io/enki/pkg/fat32"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Image", Label("fat32"), func() {
+	var tmpDir string
+	var img *fat32.Image
+
+	content := func(size int) []byte {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		return data
+	}
+
+	writeSource := func(name string, size int) string {
+		p := filepath.Join(tmpDir, "src", name)
+		Expect(os.MkdirAll(filepath.Dir(p), 0755)).To(Succeed())
+		Expect(os.WriteFile(p, content(size), 0644)).To(Succeed())
+		return p
+	}
+
+	openImage := func(p string) filesystem.FileSystem {
+		d, err := diskfs.Open(p, diskfs.WithOpenMode(diskfs.ReadOnly))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(d.Close)
+		fs, err := d.GetFilesystem(0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fs.Type()).To(Equal(filesystem.TypeFat32))
+		return fs
+	}
+
+	readFile := func(fs filesystem.FileSystem, p string) []byte {
+		f, err := fs.OpenFile(p, os.O_RDONLY)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := io.ReadAll(f)
+		Expect(err).ToNot(HaveOccurred())
+		return data
+	}
+
+	// listDir returns the entries of p, skipping the dot entries that go-diskfs reports
+	listDir := func(fs filesystem.FileSystem, p string) map[string]os.FileInfo {
+		entries, err := fs.ReadDir(p)
+		Expect(err).ToNot(HaveOccurred())
+		result := map[string]os.FileInfo{}
+		for _, e := range entries {
+			if e.Name() != "." && e.Name() != ".." {
+				result[e.Name()] = e
+			}
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "enki-fat32-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpDir)
+		img = fat32.New("")
+	})
+
+	It("writes directories and files that can be read back", func() {
+		Expect(img.AddDir("EFI/tools")).To(Succeed())
+		Expect(img.AddFile("EFI/BOOT/BOOTX64.EFI", writeSource("BOOTX64.EFI", 4096))).To(Succeed())
+		Expect(img.AddFile("EFI/kairos/norole_interactive-install.efi", writeSource("norole.efi", 70000))).To(Succeed())
+		Expect(img.AddFile("loader/loader.conf", writeSource("loader.conf", 12))).To(Succeed())
+		Expect(img.AddFile("loader/keys/auto/PK.der", writeSource("PK.der", 0))).To(Succeed())
+
+		target := filepath.Join(tmpDir, "efiboot.img")
+		Expect(img.Write(target)).To(Succeed())
+
+		fs := openImage(target)
+		Expect(readFile(fs, "/EFI/BOOT/BOOTX64.EFI")).To(Equal(content(4096)))
+		Expect(readFile(fs, "/EFI/kairos/norole_interactive-install.efi")).To(Equal(content(70000)))
+		Expect(readFile(fs, "/loader/loader.conf")).To(Equal(content(12)))
+		// Empty files have no clusters allocated, go-diskfs cannot open those so check the entry instead
+		Expect(listDir(fs, "/loader/keys/auto")).To(HaveKey("PK.der"))
+		Expect(listDir(fs, "/loader/keys/auto")["PK.der"].Size()).To(BeZero())
+		Expect(listDir(fs, "/EFI")).To(And(HaveKey("BOOT"), HaveKey("kairos"), HaveKey("tools")))
+	})
+
+	It("creates an image of exactly the calculated size", func() {
+		Expect(img.AddFile("EFI/BOOT/BOOTX64.EFI", writeSource("BOOTX64.EFI", 1024*1024))).To(Succeed())
+		size, err := img.Size()
+		Expect(err).ToNot(HaveOccurred())
+
+		target := filepath.Join(tmpDir, "efiboot.img")
+		Expect(img.Write(target)).To(Succeed())
+		info, err := os.Stat(target)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(Equal(size))
+
+		// Small images are padded up to the FAT32 minimum of 65525 clusters of 512 bytes
+		Expect(size).To(BeNumerically(">=", int64(65525*512)))
+		Expect(size).To(BeNumerically("<", int64(65525*512+2*1024*1024)))
+	})
+
+	It("leaves free space up to the minimum size", func() {
+		Expect(img.AddFile("EFI/BOOT/BOOTX64.EFI", writeSource("BOOTX64.EFI", 1024*1024))).To(Succeed())
+		img.MinSize = 300 * 1024 * 1024
+		target := filepath.Join(tmpDir, "efiboot.img")
+		Expect(img.Write(target)).To(Succeed())
+		info, err := os.Stat(target)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(BeNumerically(">=", img.MinSize))
+		Expect(info.Size()).To(BeNumerically("<", img.MinSize+1024*1024))
+
+		fs := openImage(target)
+		Expect(readFile(fs, "/EFI/BOOT/BOOTX64.EFI")).To(Equal(content(1024 * 1024)))
+		data, err := os.ReadFile(target)
+		Expect(err).ToNot(HaveOccurred())
+		freeClusters := binary.LittleEndian.Uint32(data[512+488:])
+		Expect(int64(freeClusters) * 4096).To(BeNumerically(">", 290*1024*1024))
+	})
+
+	It("generates unique short names for long names", func() {
+		for _, name := range []string{"norole_debug.efi", "norole_recovery.efi", "norole_reset.efi"} {
+			Expect(img.AddFile(filepath.Join("EFI/kairos", name), writeSource(name, 10))).To(Succeed())
+		}
+		target := filepath.Join(tmpDir, "efiboot.img")
+		Expect(img.Write(target)).To(Succeed())
+
+		fs := openImage(target)
+		entries := listDir(fs, "/EFI/kairos")
+		Expect(entries).To(HaveLen(3))
+		Expect(entries).To(And(HaveKey("norole_debug.efi"), HaveKey("norole_recovery.efi"), HaveKey("norole_reset.efi")))
+	})
+
+	It("sets the volume label and timestamps", func() {
+		img.Label = "uki_esp"
+		img.ModTime = time.Date(2024, 5, 17, 10, 30, 20, 0, time.UTC)
+		Expect(img.AddFile("loader.conf", writeSource("loader.conf", 1))).To(Succeed())
+		target := filepath.Join(tmpDir, "efiboot.img")
+		Expect(img.Write(target)).To(Succeed())
+
+		fs := openImage(target)
+		Expect(strings.TrimSpace(fs.Label())).To(Equal("UKI_ESP"))
+		entries := listDir(fs, "/")
+		Expect(entries).To(HaveKey("loader.conf"))
+		Expect(entries["loader.conf"].ModTime().Year()).To(Equal(2024))
+		Expect(entries["loader.conf"].ModTime().Minute()).To(Equal(30))
+
+		data, err := os.ReadFile(target)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data[510:512]).To(Equal([]byte{0x55, 0xAA}))
+		Expect(string(data[82:90])).To(Equal("FAT32   "))
+		Expect(binary.LittleEndian.Uint32(data[44:])).To(Equal(uint32(2)))
+	})
+
+	It("fails on conflicting paths", func() {
+		src := writeSource("file", 1)
+		Expect(img.AddFile("EFI/file", src)).To(Succeed())
+		Expect(img.AddFile("EFI/FILE", src)).ToNot(Succeed())
+		Expect(img.AddDir("EFI/file/sub")).ToNot(Succeed())
+		Expect(img.AddFile("EFI/missing", filepath.Join(tmpDir, "does-not-exist"))).ToNot(Succeed())
+	})
+})
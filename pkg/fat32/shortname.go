@@ -0,0 +1,113 @@
+package fat32
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// validShortChars are the characters allowed in a short name besides uppercase letters and digits
+const validShortChars = "!#$%&'()-@^_`{}~"
+
+// assignShortNames sets the 8.3 name of every child of the directory n.
+// Names that are already valid uppercase 8.3 names are stored as is, everything else gets
+// a long file name plus a generated BASIS~N short name that is unique in the directory.
+func assignShortNames(n *node) error {
+	used := map[[11]byte]bool{}
+	var needLFN []*node
+	for _, c := range n.children {
+		c.lfn = false
+		if short, ok := exactShortName(c.name); ok && !used[short] {
+			c.shortName = short
+			used[short] = true
+			continue
+		}
+		needLFN = append(needLFN, c)
+	}
+
+	for _, c := range needLFN {
+		base, ext := shortBasis(c.name)
+		found := false
+		for i := 1; i < 1000000; i++ {
+			tail := "~" + strconv.Itoa(i)
+			b := base
+			if len(b)+len(tail) > 8 {
+				b = b[:8-len(tail)]
+			}
+			short := pack(b+tail, ext)
+			if !used[short] {
+				c.shortName = short
+				c.lfn = true
+				used[short] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("could not generate a short name for %s", c.path())
+		}
+	}
+	return nil
+}
+
+// exactShortName returns the 8.3 name for name if it can be stored without a long file name
+func exactShortName(name string) ([11]byte, bool) {
+	if name == "." || name == ".." || name != strings.ToUpper(name) {
+		return [11]byte{}, false
+	}
+	base, ext, _ := strings.Cut(name, ".")
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return [11]byte{}, false
+	}
+	if strings.HasSuffix(name, ".") {
+		return [11]byte{}, false
+	}
+	for _, c := range base + ext {
+		if !isShortChar(c) {
+			return [11]byte{}, false
+		}
+	}
+	return pack(base, ext), true
+}
+
+// shortBasis returns the uppercased and sanitized base (at most 6 chars) and extension (at most 3 chars) of name
+func shortBasis(name string) (string, string) {
+	name = strings.ToUpper(strings.TrimLeft(name, "."))
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	clean := func(s string, limit int) string {
+		var b strings.Builder
+		for _, c := range s {
+			if c == ' ' || c == '.' {
+				continue
+			}
+			if !isShortChar(c) {
+				c = '_'
+			}
+			b.WriteRune(c)
+			if b.Len() >= limit {
+				break
+			}
+		}
+		return b.String()
+	}
+	base = clean(base, 6)
+	if base == "" {
+		base = "_"
+	}
+	return base, clean(ext, 3)
+}
+
+func isShortChar(c rune) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune(validShortChars, c)
+}
+
+func pack(base, ext string) [11]byte {
+	var n [11]byte
+	copy(n[:], "           ")
+	copy(n[0:8], base)
+	copy(n[8:11], ext)
+	return n
+}
@@ -0,0 +1,120 @@
+// Package gpt writes the GUID partition tables of the disk and hybrid ISO images.
+//
+// Only the partition tables are written, the protective or hybrid MBR and the partition contents are up to the callers.
+package gpt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// LBASize is the size of the blocks the partition table refers to
+	LBASize = 512
+	// Entries is the number of partition entries of the table
+	Entries = 128
+	// EntriesLBAs is the size in blocks of the partition entries array
+	EntriesLBAs = Entries * entrySize / LBASize
+	// BackupSize is the size of the backup partition entries plus the backup header, at the end of the disk
+	BackupSize = Entries*entrySize + LBASize
+
+	entrySize  = 128
+	headerSize = 92
+)
+
+var (
+	// TypeEFI is the partition type of the EFI System Partition
+	TypeEFI = uuid.MustParse("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	// TypeLinux is the partition type of Linux filesystems
+	TypeLinux = uuid.MustParse("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	// TypeBasicData is the partition type of Microsoft basic data partitions
+	TypeBasicData = uuid.MustParse("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+)
+
+// Partition is an entry of the partition table
+type Partition struct {
+	// Name is at most 36 characters, longer names are cut
+	Name string
+	Type uuid.UUID
+	GUID uuid.UUID
+	// First and Last are inclusive 512 bytes blocks
+	First uint64
+	Last  uint64
+}
+
+// Write writes the primary GPT at the second block and the backup GPT at the end of a disk of totalLBAs blocks
+func Write(w io.WriterAt, diskGUID uuid.UUID, parts []Partition, totalLBAs uint64) error {
+	if len(parts) > Entries {
+		return fmt.Errorf("too many partitions: %d", len(parts))
+	}
+	entries := make([]byte, Entries*entrySize)
+	for idx, p := range parts {
+		e := entries[idx*entrySize : (idx+1)*entrySize]
+		copy(e[0:], guidBytes(p.Type))
+		copy(e[16:], guidBytes(p.GUID))
+		binary.LittleEndian.PutUint64(e[32:], p.First)
+		binary.LittleEndian.PutUint64(e[40:], p.Last)
+		for j, c := range utf16.Encode([]rune(p.Name)) {
+			if j >= 36 {
+				break
+			}
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	lastLBA := totalLBAs - 1
+	header := func(current, backup, entriesLBA uint64) []byte {
+		h := make([]byte, LBASize)
+		copy(h[0:], "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], headerSize)
+		binary.LittleEndian.PutUint64(h[24:], current)
+		binary.LittleEndian.PutUint64(h[32:], backup)
+		binary.LittleEndian.PutUint64(h[40:], 2+EntriesLBAs)
+		binary.LittleEndian.PutUint64(h[48:], lastLBA-EntriesLBAs-1)
+		copy(h[56:], guidBytes(diskGUID))
+		binary.LittleEndian.PutUint64(h[72:], entriesLBA)
+		binary.LittleEndian.PutUint32(h[80:], Entries)
+		binary.LittleEndian.PutUint32(h[84:], entrySize)
+		binary.LittleEndian.PutUint32(h[88:], entriesCRC)
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:headerSize]))
+		return h
+	}
+
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{1, header(1, lastLBA, 2)},
+		{2, entries},
+		{lastLBA - EntriesLBAs, entries},
+		{lastLBA, header(lastLBA, 1, lastLBA-EntriesLBAs)},
+	}
+	for _, wr := range writes {
+		if _, err := w.WriteAt(wr.data, int64(wr.lba)*LBASize); err != nil {
+			return fmt.Errorf("writing the GPT: %w", err)
+		}
+	}
+	return nil
+}
+
+// SeedGUID returns a GUID derived from the seed, so images built from the same inputs get the same GUIDs
+func SeedGUID(seed string) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(seed))
+}
+
+// guidBytes returns the mixed endian on-disk representation of a GUID
+func guidBytes(u uuid.UUID) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b[0:], binary.BigEndian.Uint32(u[0:4]))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(u[4:6]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(u[6:8]))
+	copy(b[8:], u[8:])
+	return b
+}
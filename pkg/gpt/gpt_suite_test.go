@@ -0,0 +1,13 @@
+package gpt_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestGPTSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "gpt test suite")
+}
@@ -0,0 +1,59 @@
+package gpt_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	diskfsgpt "github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/kairos-io/enki/pkg/gpt"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GPT", Label("gpt"), func() {
+	var target string
+
+	BeforeEach(func() {
+		tmpDir, err := os.MkdirTemp("", "enki-gpt-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpDir)
+		target = filepath.Join(tmpDir, "disk.raw")
+	})
+
+	It("writes a primary and backup table that can be read back", func() {
+		const totalLBAs = 4096
+		f, err := os.Create(target)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(f.Truncate(totalLBAs * gpt.LBASize)).To(Succeed())
+
+		parts := []gpt.Partition{
+			{Name: "efi", Type: gpt.TypeEFI, GUID: gpt.SeedGUID("efi"), First: 2048, Last: 3071},
+			{Name: strings.Repeat("x", 40), Type: gpt.TypeLinux, GUID: gpt.SeedGUID("oem"), First: 3072, Last: 4000},
+		}
+		Expect(gpt.Write(f, gpt.SeedGUID("disk"), parts, totalLBAs)).To(Succeed())
+
+		table, err := diskfsgpt.Read(f, 512, 512)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(table.Verify(f, totalLBAs*gpt.LBASize)).To(Succeed())
+		Expect(strings.ToUpper(table.GUID)).To(Equal(strings.ToUpper(gpt.SeedGUID("disk").String())))
+		Expect(table.Partitions).To(HaveLen(2))
+		Expect(table.Partitions[0].Type).To(Equal(diskfsgpt.EFISystemPartition))
+		Expect(strings.ToUpper(table.Partitions[0].GUID)).To(Equal(strings.ToUpper(gpt.SeedGUID("efi").String())))
+		Expect(table.Partitions[0].Start).To(Equal(uint64(2048)))
+		Expect(table.Partitions[0].End).To(Equal(uint64(3071)))
+		Expect(table.Partitions[1].Type).To(Equal(diskfsgpt.LinuxFilesystem))
+		Expect(table.Partitions[1].Name).To(Equal(strings.Repeat("x", 36)))
+	})
+	It("derives the same GUID from the same seed", func() {
+		Expect(gpt.SeedGUID("disk")).To(Equal(gpt.SeedGUID("disk")))
+		Expect(gpt.SeedGUID("disk")).ToNot(Equal(gpt.SeedGUID("other")))
+	})
+	It("fails with too many partitions", func() {
+		f, err := os.Create(target)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(gpt.Write(f, gpt.SeedGUID("disk"), make([]gpt.Partition, gpt.Entries+1), 4096)).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,156 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	platformX86 = 0x00
+	platformEFI = 0xEF
+
+	bootable          = 0x88
+	sectionHeaderLast = 0x91
+
+	// grub2BootInfoOffset is where GRUB2 eltorito.img expects its own location, in 512 bytes blocks
+	grub2BootInfoOffset = 2548
+	// grub2MBROffset is where GRUB2 boot_hybrid.img expects the location of eltorito.img, in 512 bytes blocks
+	grub2MBROffset = 0x1b0
+)
+
+// writeBoot writes the El Torito boot catalog and patches the BIOS boot image
+func (i *Image) writeBoot(w io.WriterAt, l *layout) error {
+	if l.bootRecord == 0 {
+		return nil
+	}
+
+	catalog := make([]byte, sectorSize)
+	var entries [][]byte
+	if i.BIOS != nil {
+		loadSectors := i.BIOS.LoadSectors
+		if loadSectors == 0 {
+			loadSectors = 4
+		}
+		entries = append(entries, bootEntry(loadSectors, l.biosImage.extent))
+	}
+	if i.EFI != nil {
+		entries = append(entries, bootEntry(efiLoadSectors(l.efiSize), l.efiStart))
+	}
+
+	platform := byte(platformX86)
+	if i.BIOS == nil {
+		platform = platformEFI
+	}
+	copy(catalog[0:], validationEntry(platform))
+	copy(catalog[32:], entries[0])
+	if len(entries) > 1 {
+		// The EFI entry goes in its own section after the default BIOS one
+		header := catalog[64:96]
+		header[0] = sectionHeaderLast
+		header[1] = platformEFI
+		binary.LittleEndian.PutUint16(header[2:], 1)
+		copy(catalog[96:], entries[1])
+	}
+	if _, err := w.WriteAt(catalog, int64(l.catalog)*sectorSize); err != nil {
+		return fmt.Errorf("writing the boot catalog: %w", err)
+	}
+
+	if i.BIOS != nil {
+		return i.patchBIOSImage(w, l)
+	}
+	return nil
+}
+
+func validationEntry(platform byte) []byte {
+	e := make([]byte, 32)
+	e[0] = 1
+	e[1] = platform
+	e[30] = 0x55
+	e[31] = 0xAA
+	var sum uint16
+	for j := 0; j < 32; j += 2 {
+		sum += binary.LittleEndian.Uint16(e[j:])
+	}
+	binary.LittleEndian.PutUint16(e[28:], -sum)
+	return e
+}
+
+func bootEntry(loadSectors uint16, extent uint32) []byte {
+	e := make([]byte, 32)
+	e[0] = bootable
+	binary.LittleEndian.PutUint16(e[6:], loadSectors)
+	binary.LittleEndian.PutUint32(e[8:], extent)
+	return e
+}
+
+// efiLoadSectors returns the sector count for the EFI boot entry.
+// Images that do not fit in the 16 bits field use 0, which firmware reads as "up to the end of the volume"
+func efiLoadSectors(size int64) uint16 {
+	count := (size + 511) / 512
+	if count > 0xFFFF {
+		return 0
+	}
+	return uint16(count)
+}
+
+func (i *Image) patchBIOSImage(w io.WriterAt, l *layout) error {
+	img := l.biosImage
+	offset := int64(img.extent) * sectorSize
+	if i.BIOS.Grub2BootInfo {
+		if img.size < grub2BootInfoOffset+8 {
+			return fmt.Errorf("boot image %s too small for grub2 boot info", i.BIOS.Image)
+		}
+		patch := make([]byte, 8)
+		binary.LittleEndian.PutUint64(patch, uint64(img.extent)*4+5)
+		if _, err := w.WriteAt(patch, offset+grub2BootInfoOffset); err != nil {
+			return fmt.Errorf("patching grub2 boot info: %w", err)
+		}
+	}
+
+	if i.BIOS.BootInfoTable {
+		if img.size < 64 {
+			return fmt.Errorf("boot image %s too small for a boot info table", i.BIOS.Image)
+		}
+		// The checksum covers the image from byte 64 as written, so read it back from the output
+		r, ok := w.(io.ReaderAt)
+		if !ok {
+			return fmt.Errorf("cannot read back the boot image to checksum it")
+		}
+		data := make([]byte, img.size)
+		if _, err := r.ReadAt(data, offset); err != nil {
+			return fmt.Errorf("reading the boot image: %w", err)
+		}
+		var sum uint32
+		for j := 64; j+4 <= len(data); j += 4 {
+			sum += binary.LittleEndian.Uint32(data[j:])
+		}
+		table := make([]byte, 56)
+		binary.LittleEndian.PutUint32(table[0:], l.primary)
+		binary.LittleEndian.PutUint32(table[4:], img.extent)
+		binary.LittleEndian.PutUint32(table[8:], uint32(img.size))
+		binary.LittleEndian.PutUint32(table[12:], sum)
+		if _, err := w.WriteAt(table, offset+8); err != nil {
+			return fmt.Errorf("writing the boot info table: %w", err)
+		}
+	}
+	return nil
+}
+
+// readMBR returns the boot code to install in the first sector, or an empty sector if none was given
+func readMBR(p string) ([]byte, error) {
+	mbr := make([]byte, 512)
+	if p == "" {
+		return mbr, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = io.ReadFull(f, mbr[:mbrCodeSize]); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return mbr, nil
+}
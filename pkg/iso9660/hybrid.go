@@ -0,0 +1,127 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/kairos-io/enki/pkg/gpt"
+)
+
+const (
+	lbaSize = gpt.LBASize
+	// mbrCodeSize is the size of the boot code area of the MBR, before the disk signature
+	mbrCodeSize = 440
+	// isoPartitionStart is the first 512 bytes block after the system area
+	isoPartitionStart = systemAreaSectors * sectorSize / lbaSize
+
+	mbrTypeProtective = 0xEE
+	mbrTypeEFI        = 0xEF
+	mbrTypeISO        = 0x17
+)
+
+type partition struct {
+	name     string
+	typeGUID uuid.UUID
+	mbrType  byte
+	// first and last are inclusive 512 bytes blocks
+	first uint64
+	last  uint64
+}
+
+// writeHybrid writes the MBR and, if requested, the primary and backup GPT in the system area and at the end of the image
+func (i *Image) writeHybrid(w io.WriterAt, l *layout) error {
+	mbr, err := readMBR(i.Hybrid.MBR)
+	if err != nil {
+		return fmt.Errorf("reading the MBR boot code: %w", err)
+	}
+
+	if i.Hybrid.Grub2MBR {
+		if l.biosImage == nil {
+			return fmt.Errorf("grub2 MBR patching needs a BIOS boot image")
+		}
+		binary.LittleEndian.PutUint64(mbr[grub2MBROffset:], uint64(l.biosImage.extent)*4+4)
+	}
+	binary.LittleEndian.PutUint32(mbr[mbrCodeSize:], i.seedGUID(l, "disk-signature").ID())
+
+	totalLBAs := uint64(l.totalSize / lbaSize)
+	parts := i.partitions(l)
+
+	var mbrParts []partition
+	if i.Hybrid.GPT {
+		mbrParts = append(mbrParts, partition{mbrType: mbrTypeProtective, first: 1, last: totalLBAs - 1})
+		for _, p := range parts {
+			if p.mbrType == mbrTypeEFI {
+				mbrParts = append(mbrParts, p)
+			}
+		}
+	} else {
+		mbrParts = parts
+	}
+	for idx, p := range mbrParts {
+		e := mbr[446+16*idx : 446+16*(idx+1)]
+		if idx == 0 && i.Hybrid.MBR != "" && p.mbrType != mbrTypeProtective {
+			e[0] = 0x80
+		}
+		// CHS values are not used by anything that can boot this, mark them as LBA only
+		copy(e[1:4], []byte{0xFE, 0xFF, 0xFF})
+		e[4] = p.mbrType
+		copy(e[5:8], []byte{0xFE, 0xFF, 0xFF})
+		binary.LittleEndian.PutUint32(e[8:], uint32(min(p.first, 0xFFFFFFFF)))
+		binary.LittleEndian.PutUint32(e[12:], uint32(min(p.last-p.first+1, 0xFFFFFFFF)))
+	}
+	mbr[510] = 0x55
+	mbr[511] = 0xAA
+	if _, err = w.WriteAt(mbr, 0); err != nil {
+		return fmt.Errorf("writing the MBR: %w", err)
+	}
+
+	if !i.Hybrid.GPT {
+		return nil
+	}
+
+	gptParts := make([]gpt.Partition, len(parts))
+	for idx, p := range parts {
+		gptParts[idx] = gpt.Partition{
+			Name:  p.name,
+			Type:  p.typeGUID,
+			GUID:  i.seedGUID(l, fmt.Sprintf("partition-%d", idx)),
+			First: p.first,
+			Last:  p.last,
+		}
+	}
+	return gpt.Write(w, i.seedGUID(l, "disk"), gptParts, totalLBAs)
+}
+
+// partitions returns the ISO filesystem and, if present, the EFI image as partitions
+func (i *Image) partitions(l *layout) []partition {
+	isoEnd := uint64(l.isoSectors) * sectorSize / lbaSize
+	if l.efiImage != nil {
+		// The EFI image is the last file of the filesystem, keep it out of the ISO partition so they do not overlap
+		isoEnd = uint64(l.efiStart) * sectorSize / lbaSize
+	}
+	parts := []partition{{
+		name:     "ISO9660",
+		typeGUID: gpt.TypeBasicData,
+		mbrType:  mbrTypeISO,
+		first:    isoPartitionStart,
+		last:     isoEnd - 1,
+	}}
+	if i.EFI != nil && l.efiSize > 0 {
+		first := uint64(l.efiStart) * sectorSize / lbaSize
+		parts = append(parts, partition{
+			name:     "EFI System Partition",
+			typeGUID: gpt.TypeEFI,
+			mbrType:  mbrTypeEFI,
+			first:    first,
+			last:     first + uint64((l.efiSize+lbaSize-1)/lbaSize) - 1,
+		})
+	}
+	return parts
+}
+
+// seedGUID returns a GUID derived from the volume id and the modification time, so the same inputs produce the same image
+func (i *Image) seedGUID(l *layout, name string) uuid.UUID {
+	return gpt.SeedGUID(fmt.Sprintf("%s-%d-%s", i.VolumeID, l.modTime.UnixNano(), name))
+}
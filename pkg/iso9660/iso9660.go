@@ -0,0 +1,331 @@
+// Package iso9660 writes ISO9660 images with Joliet extensions, El Torito boot catalogs and
+// hybrid MBR/GPT partition tables, so they can be booted both from optical media and from USB sticks.
+//
+// As with the fat32 package, the full tree is known before writing. Layout is calculated in one pass and
+// the image is written with the data of each file stored contiguously.
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sectorSize = 2048
+	// systemAreaSectors is the number of sectors reserved at the start of the image, where the hybrid MBR and GPT are stored
+	systemAreaSectors = 16
+	// maxExtentSize is the maximum size of a single extent, bigger files are stored in several extents
+	maxExtentSize = 0xFFFFF800
+
+	flagDirectory   = 0x02
+	flagMultiExtent = 0x80
+)
+
+// Image is an ISO9660 image that has not been written yet.
+type Image struct {
+	// VolumeID is the volume label, stored in the primary and Joliet volume descriptors
+	VolumeID string
+	// Joliet adds a Joliet supplementary volume descriptor with the original (case preserving, long) file names
+	Joliet bool
+	// ModTime is the timestamp used for the volume descriptors and all the directory records.
+	// If zero, the current time is used.
+	ModTime time.Time
+	// BIOS configures the El Torito boot entry for BIOS systems. With BIOS or EFI entries, the boot catalog is
+	// written but hidden from the directory tree.
+	BIOS *BIOSBoot
+	// EFI configures the El Torito boot entry for EFI systems
+	EFI *EFIBoot
+	// Hybrid adds an MBR and GPT to the system area so the image can be written to a disk and booted
+	Hybrid *Hybrid
+
+	root *node
+}
+
+// BIOSBoot is a no emulation El Torito boot entry for BIOS systems.
+type BIOSBoot struct {
+	// Image is the path of the boot image inside the ISO
+	Image string
+	// LoadSectors is the number of 512 bytes sectors loaded by the BIOS, 4 if unset
+	LoadSectors uint16
+	// BootInfoTable patches the boot information table at byte 8 of the boot image
+	BootInfoTable bool
+	// Grub2BootInfo patches the GRUB2 boot image at byte 2548 with its own location
+	Grub2BootInfo bool
+}
+
+// EFIBoot is a no emulation El Torito boot entry for EFI systems, pointing to a FAT image.
+// Exactly one of Image or Partition must be set.
+type EFIBoot struct {
+	// Image is the path of the FAT image inside the ISO
+	Image string
+	// Partition is the path on the host of a FAT image to append after the ISO filesystem
+	Partition string
+}
+
+// Hybrid configures the partition tables written in the system area of the image.
+type Hybrid struct {
+	// MBR is the path on the host of the MBR boot code to install in the first sector, optional
+	MBR string
+	// Grub2MBR patches the MBR boot code with the location of the BIOS boot image, as GRUB2 boot_hybrid.img expects
+	Grub2MBR bool
+	// GPT adds a GPT with the ISO filesystem as basic data and the EFI image as EFI system partition
+	GPT bool
+}
+
+type node struct {
+	name     string
+	dir      bool
+	source   string
+	size     int64
+	children []*node
+	parent   *node
+
+	isoName    string
+	jolietName []uint16
+	// extent is the location of the data for files and the primary directory records for directories
+	extent uint32
+	// jolietExtent is the location of the Joliet directory records, only used for directories
+	jolietExtent  uint32
+	dirSize       uint32
+	jolietDirSize uint32
+	pathNumber    uint16
+	jolietNumber  uint16
+}
+
+// New returns an empty image with the given volume id.
+func New(volumeID string) *Image {
+	return &Image{
+		VolumeID: volumeID,
+		Joliet:   true,
+		root:     &node{dir: true},
+	}
+}
+
+// AddDir adds the directory p to the image, creating any missing parents.
+func (i *Image) AddDir(p string) error {
+	_, err := i.mkdirAll(p)
+	return err
+}
+
+// AddFile adds the contents of the file at source under the image path p, creating any missing parents.
+func (i *Image) AddFile(p, source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("adding %s to the iso: %w", source, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("adding %s to the iso: not a regular file", source)
+	}
+	dir, name := splitPath(p)
+	if name == "" {
+		return fmt.Errorf("invalid file path in the iso: %q", p)
+	}
+	parent, err := i.mkdirAll(dir)
+	if err != nil {
+		return err
+	}
+	if parent.child(name) != nil {
+		return fmt.Errorf("%s already exists in the iso", p)
+	}
+	parent.children = append(parent.children, &node{name: name, source: source, size: info.Size(), parent: parent})
+	return nil
+}
+
+// AddTree adds the contents of the directory source on the host under the image path p.
+// Symlinks to files are followed, any other non regular file is skipped.
+func (i *Image) AddTree(p, source string) error {
+	return filepath.WalkDir(source, func(file string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, file)
+		if err != nil {
+			return err
+		}
+		target := path.Join(p, filepath.ToSlash(rel))
+		if d.IsDir() {
+			return i.AddDir(target)
+		}
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			// Broken links, links to directories and special files cannot be stored
+			return nil
+		}
+		if existing := i.lookup(target); existing != nil && !existing.dir {
+			// Later trees override earlier ones, like copying them on top of each other would do
+			existing.source = file
+			existing.size = info.Size()
+			return nil
+		}
+		return i.AddFile(target, file)
+	})
+}
+
+// Write creates the image at the target path. Any existing file is truncated.
+func (i *Image) Write(target string) error {
+	l, err := i.layout()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("creating the iso: %w", err)
+	}
+	defer f.Close()
+
+	if err = f.Truncate(l.totalSize); err != nil {
+		return fmt.Errorf("allocating the iso: %w", err)
+	}
+
+	if err = i.writeDescriptors(f, l); err != nil {
+		return err
+	}
+	if err = i.writePathTables(f, l); err != nil {
+		return err
+	}
+	if err = i.writeDirectories(f, l); err != nil {
+		return err
+	}
+	if err = i.writeFiles(f, l); err != nil {
+		return err
+	}
+	if err = i.writeBoot(f, l); err != nil {
+		return err
+	}
+	if i.Hybrid != nil {
+		if err = i.writeHybrid(f, l); err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+func (i *Image) mkdirAll(p string) (*node, error) {
+	current := i.root
+	p = cleanPath(p)
+	if p == "" {
+		return current, nil
+	}
+	for _, part := range strings.Split(p, "/") {
+		next := current.child(part)
+		if next == nil {
+			next = &node{name: part, dir: true, parent: current}
+			current.children = append(current.children, next)
+		}
+		if !next.dir {
+			return nil, fmt.Errorf("%s is a file in the iso", next.path())
+		}
+		current = next
+	}
+	return current, nil
+}
+
+func (i *Image) lookup(p string) *node {
+	current := i.root
+	p = cleanPath(p)
+	if p == "" {
+		return current
+	}
+	for _, part := range strings.Split(p, "/") {
+		current = current.child(part)
+		if current == nil {
+			return nil
+		}
+	}
+	return current
+}
+
+func (i *Image) modTime() time.Time {
+	if i.ModTime.IsZero() {
+		return time.Now()
+	}
+	return i.ModTime
+}
+
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *node) path() string {
+	if n.parent == nil {
+		return "/"
+	}
+	return path.Join(n.parent.path(), n.name)
+}
+
+// extents returns the size of every extent needed to store size bytes
+func extents(size int64) []uint32 {
+	if size == 0 {
+		return []uint32{0}
+	}
+	var result []uint32
+	for size > 0 {
+		s := min(size, maxExtentSize)
+		result = append(result, uint32(s))
+		size -= s
+	}
+	return result
+}
+
+func sectors(size int64) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
+
+func splitPath(p string) (string, string) {
+	return path.Split(cleanPath(p))
+}
+
+func fileSize(p string) (int64, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func cleanPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// walk visits the root and then every node in pre-order, with children sorted by name
+func walk(n *node, fn func(*node)) {
+	fn(n)
+	sort.Slice(n.children, func(a, b int) bool { return n.children[a].name < n.children[b].name })
+	for _, c := range n.children {
+		walk(c, fn)
+	}
+}
+
+func copyAt(w io.WriterAt, source string, offset int64) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(io.NewOffsetWriter(w, offset), f)
+	return err
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:], v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:], v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
@@ -0,0 +1,13 @@
+package iso9660_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestISO9660Suite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ISO9660 test suite")
+}
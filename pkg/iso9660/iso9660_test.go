@@ -0,0 +1,230 @@
+package iso9660_test
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	diskiso "github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/kairos-io/enki/pkg/iso9660"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const sectorSize = 2048
+
+var _ = Describe("Image", Label("iso9660"), func() {
+	var tmpDir string
+	var target string
+	var img *iso9660.Image
+
+	content := func(size int, seed byte) []byte {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i%251) + seed
+		}
+		return data
+	}
+
+	writeSource := func(name string, data []byte) string {
+		p := filepath.Join(tmpDir, "src", name)
+		Expect(os.MkdirAll(filepath.Dir(p), 0755)).To(Succeed())
+		Expect(os.WriteFile(p, data, 0644)).To(Succeed())
+		return p
+	}
+
+	readISO := func() []byte {
+		data, err := os.ReadFile(target)
+		Expect(err).ToNot(HaveOccurred())
+		return data
+	}
+
+	// jolietRoot returns the names of the entries in the root directory of the Joliet tree
+	jolietRoot := func(data []byte) []string {
+		for s := 16; ; s++ {
+			vd := data[s*sectorSize : (s+1)*sectorSize]
+			Expect(string(vd[1:6])).To(Equal("CD001"))
+			Expect(vd[0]).ToNot(Equal(byte(255)), "no joliet descriptor found")
+			if vd[0] != 2 {
+				continue
+			}
+			Expect(string(vd[88:91])).To(Equal("%/E"))
+			extent := binary.LittleEndian.Uint32(vd[156+2:])
+			size := binary.LittleEndian.Uint32(vd[156+10:])
+			records := data[int(extent)*sectorSize : int(extent)*sectorSize+int(size)]
+			var names []string
+			for off := 0; off < len(records); {
+				recLen := int(records[off])
+				if recLen == 0 {
+					off += sectorSize - off%sectorSize
+					continue
+				}
+				nameLen := int(records[off+32])
+				name := records[off+33 : off+33+nameLen]
+				if nameLen > 1 {
+					chars := make([]uint16, nameLen/2)
+					for j := range chars {
+						chars[j] = binary.BigEndian.Uint16(name[2*j:])
+					}
+					names = append(names, string(utf16.Decode(chars)))
+				}
+				off += recLen
+			}
+			return names
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "enki-iso9660-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpDir)
+		target = filepath.Join(tmpDir, "test.iso")
+		img = iso9660.New("COS_LIVE")
+	})
+
+	It("writes a tree that can be read back", func() {
+		tree := filepath.Join(tmpDir, "tree")
+		Expect(os.MkdirAll(filepath.Join(tree, "boot"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tree, "boot", "kernel"), content(5000, 1), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tree, "rootfs.squashfs"), content(10000, 2), 0644)).To(Succeed())
+		Expect(os.Symlink("rootfs.squashfs", filepath.Join(tree, "link"))).To(Succeed())
+		Expect(img.AddTree("/", tree)).To(Succeed())
+		Expect(img.AddDir("EFI/BOOT")).To(Succeed())
+		Expect(img.Write(target)).To(Succeed())
+
+		f, err := os.Open(target)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		fs, err := diskiso.Read(f, 0, 0, sectorSize)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.TrimSpace(fs.Label())).To(Equal("COS_LIVE"))
+
+		entries, err := fs.ReadDir("/")
+		Expect(err).ToNot(HaveOccurred())
+		var names []string
+		for _, e := range entries {
+			names = append(names, strings.ToLower(e.Name()))
+		}
+		Expect(names).To(ContainElements("boot", "efi", "rootfs.squashfs", "link"))
+
+		// go-diskfs looks up the primary names as stored, which are upper case
+		file, err := fs.OpenFile("/BOOT/KERNEL", os.O_RDONLY)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := io.ReadAll(file)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal(content(5000, 1)))
+
+		Expect(jolietRoot(readISO())).To(ConsistOf("boot", "EFI", "rootfs.squashfs", "link"))
+	})
+
+	It("uses the given timestamp for the volume", func() {
+		img.ModTime = time.Date(2024, 5, 17, 10, 30, 20, 0, time.UTC)
+		Expect(img.AddFile("file", writeSource("file", content(10, 0)))).To(Succeed())
+		Expect(img.Write(target)).To(Succeed())
+		first := readISO()
+		Expect(string(first[16*sectorSize+813 : 16*sectorSize+827])).To(Equal("20240517103020"))
+
+		Expect(img.Write(target)).To(Succeed())
+		Expect(readISO()).To(Equal(first))
+	})
+
+	It("writes the El Torito catalog for BIOS and EFI with a hybrid GPT", func() {
+		biosImg := content(4096, 3)
+		efiImg := content(300*1024, 4)
+		mbr := content(512, 5)
+		Expect(img.AddFile("boot/x86_64/loader/eltorito.img", writeSource("eltorito.img", biosImg))).To(Succeed())
+		img.BIOS = &iso9660.BIOSBoot{Image: "boot/x86_64/loader/eltorito.img", BootInfoTable: true, Grub2BootInfo: true}
+		img.EFI = &iso9660.EFIBoot{Partition: writeSource("uefi.img", efiImg)}
+		img.Hybrid = &iso9660.Hybrid{MBR: writeSource("boot_hybrid.img", mbr), Grub2MBR: true, GPT: true}
+		Expect(img.Write(target)).To(Succeed())
+		data := readISO()
+
+		By("pointing the boot record to a valid catalog")
+		bootRecord := data[17*sectorSize : 18*sectorSize]
+		Expect(bootRecord[0]).To(Equal(byte(0)))
+		Expect(string(bootRecord[7:30])).To(Equal("EL TORITO SPECIFICATION"))
+		catalogLBA := binary.LittleEndian.Uint32(bootRecord[71:])
+		catalog := data[int(catalogLBA)*sectorSize : int(catalogLBA+1)*sectorSize]
+		var sum uint16
+		for j := 0; j < 32; j += 2 {
+			sum += binary.LittleEndian.Uint16(catalog[j:])
+		}
+		Expect(sum).To(BeZero())
+		Expect(catalog[1]).To(Equal(byte(0x00)))
+		Expect(catalog[30:32]).To(Equal([]byte{0x55, 0xAA}))
+
+		By("booting the BIOS image from the default entry")
+		Expect(catalog[32]).To(Equal(byte(0x88)))
+		Expect(binary.LittleEndian.Uint16(catalog[38:])).To(Equal(uint16(4)))
+		biosLBA := binary.LittleEndian.Uint32(catalog[40:])
+		written := data[int(biosLBA)*sectorSize : int(biosLBA)*sectorSize+len(biosImg)]
+		Expect(written[:8]).To(Equal(biosImg[:8]))
+		Expect(written[64:2548]).To(Equal(biosImg[64:2548]))
+		Expect(binary.LittleEndian.Uint32(written[8:])).To(Equal(uint32(16)))
+		Expect(binary.LittleEndian.Uint32(written[12:])).To(Equal(biosLBA))
+		Expect(binary.LittleEndian.Uint32(written[16:])).To(Equal(uint32(len(biosImg))))
+		Expect(binary.LittleEndian.Uint64(written[2548:])).To(Equal(uint64(biosLBA)*4 + 5))
+		Expect(binary.LittleEndian.Uint64(data[0x1b0:])).To(Equal(uint64(biosLBA)*4 + 4))
+		Expect(data[:0x1b0]).To(Equal(mbr[:0x1b0]))
+
+		By("booting the EFI image from its own section")
+		Expect(catalog[64]).To(Equal(byte(0x91)))
+		Expect(catalog[65]).To(Equal(byte(0xEF)))
+		Expect(catalog[96]).To(Equal(byte(0x88)))
+		efiLBA := binary.LittleEndian.Uint32(catalog[104:])
+		Expect(data[int(efiLBA)*sectorSize : int(efiLBA)*sectorSize+len(efiImg)]).To(Equal(efiImg))
+
+		By("exposing the EFI image as a partition")
+		f, err := os.Open(target)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		table, err := gpt.Read(f, 512, 512)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(table.Verify(f, uint64(len(data)))).To(Succeed())
+		parts := table.Partitions
+		Expect(parts).To(HaveLen(2))
+		Expect(parts[0].Type).To(Equal(gpt.MicrosoftBasicData))
+		Expect(parts[1].Type).To(Equal(gpt.EFISystemPartition))
+		Expect(parts[1].Start).To(Equal(uint64(efiLBA) * 4))
+		Expect(parts[1].End).To(Equal(uint64(efiLBA)*4 + uint64(len(efiImg))/512 - 1))
+		Expect(parts[0].End).To(BeNumerically("<", parts[1].Start))
+
+		By("hiding the catalog from the tree")
+		Expect(jolietRoot(data)).To(ConsistOf("boot"))
+	})
+
+	It("places an EFI image from the tree last and boots it from the default entry", func() {
+		efiImg := content(70*1024, 6)
+		Expect(img.AddFile("efiboot.img", writeSource("efiboot.img", efiImg))).To(Succeed())
+		Expect(img.AddFile("zzz", writeSource("zzz", content(100, 7)))).To(Succeed())
+		img.EFI = &iso9660.EFIBoot{Image: "efiboot.img"}
+		img.Hybrid = &iso9660.Hybrid{GPT: true}
+		Expect(img.Write(target)).To(Succeed())
+		data := readISO()
+
+		catalogLBA := binary.LittleEndian.Uint32(data[17*sectorSize+71:])
+		catalog := data[int(catalogLBA)*sectorSize : int(catalogLBA+1)*sectorSize]
+		Expect(catalog[1]).To(Equal(byte(0xEF)))
+		Expect(binary.LittleEndian.Uint16(catalog[38:])).To(Equal(uint16(len(efiImg) / 512)))
+		efiLBA := binary.LittleEndian.Uint32(catalog[40:])
+		Expect(data[int(efiLBA)*sectorSize : int(efiLBA)*sectorSize+len(efiImg)]).To(Equal(efiImg))
+
+		volumeSectors := binary.LittleEndian.Uint32(data[16*sectorSize+80:])
+		Expect(efiLBA + uint32(len(efiImg)/sectorSize)).To(Equal(volumeSectors))
+		Expect(jolietRoot(data)).To(ConsistOf("efiboot.img", "zzz"))
+	})
+
+	It("fails with invalid boot setups", func() {
+		img.BIOS = &iso9660.BIOSBoot{Image: "missing.img"}
+		Expect(img.Write(target)).ToNot(Succeed())
+		img.BIOS = nil
+		img.EFI = &iso9660.EFIBoot{}
+		Expect(img.Write(target)).ToNot(Succeed())
+	})
+})
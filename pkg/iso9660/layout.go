@@ -0,0 +1,557 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+	"unicode/utf16"
+
+	"github.com/kairos-io/enki/pkg/gpt"
+)
+
+const (
+	descriptorPrimary       = 1
+	descriptorSupplementary = 2
+	descriptorBootRecord    = 0
+	descriptorTerminator    = 255
+)
+
+type layout struct {
+	modTime time.Time
+
+	primary    uint32
+	bootRecord uint32
+	joliet     uint32
+	terminator uint32
+
+	pathTableSize       uint32
+	pathTableL          uint32
+	pathTableM          uint32
+	jolietPathTableSize uint32
+	jolietPathTableL    uint32
+	jolietPathTableM    uint32
+
+	catalog uint32
+
+	// dirs and jolietDirs are the directories in path table order
+	dirs       []*node
+	jolietDirs []*node
+
+	// files are the regular files in allocation order
+	files []*node
+
+	biosImage *node
+	efiImage  *node
+	// efiStart and efiSize locate the EFI image, be it a file in the tree or an appended partition
+	efiStart uint32
+	efiSize  int64
+
+	// isoSectors is the end of the ISO filesystem, the EFI image is stored last when part of the tree
+	isoSectors uint32
+	// volumeSectors includes the appended partition, if any
+	volumeSectors uint32
+	totalSize     int64
+}
+
+func (i *Image) layout() (*layout, error) {
+	l := &layout{modTime: i.modTime()}
+
+	if i.EFI != nil && (i.EFI.Image == "") == (i.EFI.Partition == "") {
+		return nil, fmt.Errorf("the EFI boot entry needs exactly one of image or partition")
+	}
+
+	var err error
+	walk(i.root, func(n *node) {
+		if err == nil && n.dir {
+			err = assignNames(n)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if i.BIOS != nil {
+		l.biosImage = i.lookup(i.BIOS.Image)
+		if l.biosImage == nil || l.biosImage.dir {
+			return nil, fmt.Errorf("BIOS boot image %s not found in the iso", i.BIOS.Image)
+		}
+	}
+	if i.EFI != nil && i.EFI.Image != "" {
+		l.efiImage = i.lookup(i.EFI.Image)
+		if l.efiImage == nil || l.efiImage.dir {
+			return nil, fmt.Errorf("EFI boot image %s not found in the iso", i.EFI.Image)
+		}
+	}
+
+	// Volume descriptors
+	next := uint32(systemAreaSectors)
+	l.primary = next
+	next++
+	if i.BIOS != nil || i.EFI != nil {
+		l.bootRecord = next
+		next++
+	}
+	if i.Joliet {
+		l.joliet = next
+		next++
+	}
+	l.terminator = next
+	next++
+
+	// Path tables, numbering the directories in the process
+	l.dirs = pathTableOrder(i.root, func(n *node) string { return n.isoName })
+	for idx, d := range l.dirs {
+		d.pathNumber = uint16(idx + 1)
+	}
+	l.pathTableSize = pathTableSize(l.dirs, func(n *node) int { return len(n.isoName) })
+	l.pathTableL = next
+	next += sectors(int64(l.pathTableSize))
+	l.pathTableM = next
+	next += sectors(int64(l.pathTableSize))
+	if i.Joliet {
+		l.jolietDirs = pathTableOrder(i.root, func(n *node) string { return string(utf16Bytes(n.jolietName)) })
+		for idx, d := range l.jolietDirs {
+			d.jolietNumber = uint16(idx + 1)
+		}
+		l.jolietPathTableSize = pathTableSize(l.jolietDirs, func(n *node) int { return 2 * len(n.jolietName) })
+		l.jolietPathTableL = next
+		next += sectors(int64(l.jolietPathTableSize))
+		l.jolietPathTableM = next
+		next += sectors(int64(l.jolietPathTableSize))
+	}
+
+	if l.bootRecord != 0 {
+		// The catalog is not referenced from any directory, like xorriso does with cat_hidden=on
+		l.catalog = next
+		next++
+	}
+
+	// Directory records
+	for _, d := range l.dirs {
+		d.dirSize = dirRecordsSize(d, false)
+		d.extent = next
+		next += sectors(int64(d.dirSize))
+	}
+	for _, d := range l.jolietDirs {
+		d.jolietDirSize = dirRecordsSize(d, true)
+		d.jolietExtent = next
+		next += sectors(int64(d.jolietDirSize))
+	}
+
+	// File data, the EFI image goes last so it can be exposed as its own partition
+	walk(i.root, func(n *node) {
+		if n.dir || n == l.efiImage {
+			return
+		}
+		l.files = append(l.files, n)
+	})
+	if l.efiImage != nil {
+		l.files = append(l.files, l.efiImage)
+	}
+	for _, f := range l.files {
+		f.extent = next
+		if f == l.efiImage {
+			l.efiStart = next
+			l.efiSize = f.size
+		}
+		next += sectors(f.size)
+	}
+	l.isoSectors = next
+
+	if i.EFI != nil && i.EFI.Partition != "" {
+		size, err := fileSize(i.EFI.Partition)
+		if err != nil {
+			return nil, fmt.Errorf("reading the EFI partition: %w", err)
+		}
+		l.efiStart = next
+		l.efiSize = size
+		next += sectors(size)
+	}
+	l.volumeSectors = next
+	l.totalSize = int64(next) * sectorSize
+	if i.Hybrid != nil && i.Hybrid.GPT {
+		// Room for the backup GPT at the end of the image, rounded up to a full sector
+		l.totalSize += int64(sectors(gpt.BackupSize)) * sectorSize
+	}
+
+	return l, nil
+}
+
+// pathTableOrder returns the directories ordered by level, then by parent number and then by name
+func pathTableOrder(root *node, name func(*node) string) []*node {
+	result := []*node{root}
+	level := []*node{root}
+	for len(level) > 0 {
+		var nextLevel []*node
+		for _, parent := range level {
+			var children []*node
+			for _, c := range parent.children {
+				if c.dir {
+					children = append(children, c)
+				}
+			}
+			sort.Slice(children, func(a, b int) bool { return name(children[a]) < name(children[b]) })
+			result = append(result, children...)
+			nextLevel = append(nextLevel, children...)
+		}
+		level = nextLevel
+	}
+	return result
+}
+
+func pathTableSize(dirs []*node, nameLen func(*node) int) uint32 {
+	var size uint32
+	for _, d := range dirs {
+		l := 1
+		if d.parent != nil {
+			l = nameLen(d)
+		}
+		size += uint32(8 + l + l%2)
+	}
+	return size
+}
+
+// pathTable describes the path tables of one of the directory trees
+type pathTable struct {
+	dirs   []*node
+	size   uint32
+	lLoc   uint32
+	mLoc   uint32
+	name   func(*node) []byte
+	number func(*node) uint16
+	extent func(*node) uint32
+}
+
+func (i *Image) writePathTables(w io.WriterAt, l *layout) error {
+	tables := []pathTable{{
+		dirs: l.dirs, size: l.pathTableSize, lLoc: l.pathTableL, mLoc: l.pathTableM,
+		name:   func(n *node) []byte { return []byte(n.isoName) },
+		number: func(n *node) uint16 { return n.pathNumber },
+		extent: func(n *node) uint32 { return n.extent },
+	}}
+	if i.Joliet {
+		tables = append(tables, pathTable{
+			dirs: l.jolietDirs, size: l.jolietPathTableSize, lLoc: l.jolietPathTableL, mLoc: l.jolietPathTableM,
+			name:   func(n *node) []byte { return utf16Bytes(n.jolietName) },
+			number: func(n *node) uint16 { return n.jolietNumber },
+			extent: func(n *node) uint32 { return n.jolietExtent },
+		})
+	}
+
+	for _, t := range tables {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			var buf bytes.Buffer
+			for _, d := range t.dirs {
+				name := []byte{0}
+				parent := uint16(1)
+				if d.parent != nil {
+					name = t.name(d)
+					parent = t.number(d.parent)
+				}
+				rec := make([]byte, 8+len(name)+len(name)%2)
+				rec[0] = byte(len(name))
+				order.PutUint32(rec[2:], t.extent(d))
+				order.PutUint16(rec[6:], parent)
+				copy(rec[8:], name)
+				buf.Write(rec)
+			}
+			loc := t.lLoc
+			if order == binary.BigEndian {
+				loc = t.mLoc
+			}
+			if _, err := w.WriteAt(buf.Bytes(), int64(loc)*sectorSize); err != nil {
+				return fmt.Errorf("writing the path table: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// dirRecordsSize returns the size of the records of the directory n, padded to full sectors
+func dirRecordsSize(n *node, joliet bool) uint32 {
+	var size uint32
+	add := func(recLen uint32) {
+		if size%sectorSize+recLen > sectorSize {
+			size += sectorSize - size%sectorSize
+		}
+		size += recLen
+	}
+	add(34)
+	add(34)
+	for _, c := range n.children {
+		nameLen := len(c.isoName)
+		if joliet {
+			nameLen = 2 * len(c.jolietName)
+		}
+		count := 1
+		if !c.dir {
+			count = len(extents(c.size))
+		}
+		for j := 0; j < count; j++ {
+			add(uint32(recordLen(nameLen)))
+		}
+	}
+	return sectors(int64(size)) * sectorSize
+}
+
+func recordLen(nameLen int) int {
+	return 33 + nameLen + (nameLen+1)%2
+}
+
+func (i *Image) writeDirectories(w io.WriterAt, l *layout) error {
+	write := func(dirs []*node, joliet bool) error {
+		for _, d := range dirs {
+			data := i.dirRecords(d, l, joliet)
+			extent := d.extent
+			if joliet {
+				extent = d.jolietExtent
+			}
+			if _, err := w.WriteAt(data, int64(extent)*sectorSize); err != nil {
+				return fmt.Errorf("writing directory %s: %w", d.path(), err)
+			}
+		}
+		return nil
+	}
+	if err := write(l.dirs, false); err != nil {
+		return err
+	}
+	return write(l.jolietDirs, true)
+}
+
+// dirRecords returns the records of the directory n, sorted by their name in the given tree
+func (i *Image) dirRecords(n *node, l *layout, joliet bool) []byte {
+	size := n.dirSize
+	if joliet {
+		size = n.jolietDirSize
+	}
+	data := make([]byte, size)
+	offset := 0
+	put := func(rec []byte) {
+		if offset%sectorSize+len(rec) > sectorSize {
+			offset += sectorSize - offset%sectorSize
+		}
+		copy(data[offset:], rec)
+		offset += len(rec)
+	}
+
+	self, parent := n, n.parent
+	if parent == nil {
+		parent = n
+	}
+	put(dirRecord([]byte{0}, dirExtent(self, joliet), dirSize(self, joliet), flagDirectory, l.modTime))
+	put(dirRecord([]byte{1}, dirExtent(parent, joliet), dirSize(parent, joliet), flagDirectory, l.modTime))
+
+	children := make([]*node, len(n.children))
+	copy(children, n.children)
+	name := func(c *node) []byte {
+		if joliet {
+			return utf16Bytes(c.jolietName)
+		}
+		return []byte(c.isoName)
+	}
+	sort.Slice(children, func(a, b int) bool { return bytes.Compare(name(children[a]), name(children[b])) < 0 })
+
+	for _, c := range children {
+		if c.dir {
+			put(dirRecord(name(c), dirExtent(c, joliet), dirSize(c, joliet), flagDirectory, l.modTime))
+			continue
+		}
+		parts := extents(c.size)
+		extent := c.extent
+		for idx, size := range parts {
+			var flags byte
+			if idx < len(parts)-1 {
+				flags = flagMultiExtent
+			}
+			put(dirRecord(name(c), extent, size, flags, l.modTime))
+			extent += sectors(int64(size))
+		}
+	}
+	return data
+}
+
+func dirExtent(n *node, joliet bool) uint32 {
+	if joliet {
+		return n.jolietExtent
+	}
+	return n.extent
+}
+
+func dirSize(n *node, joliet bool) uint32 {
+	if joliet {
+		return n.jolietDirSize
+	}
+	return n.dirSize
+}
+
+func dirRecord(name []byte, extent, size uint32, flags byte, modTime time.Time) []byte {
+	rec := make([]byte, recordLen(len(name)))
+	rec[0] = byte(len(rec))
+	bothEndian32(rec[2:], extent)
+	bothEndian32(rec[10:], size)
+	copy(rec[18:25], recordDate(modTime))
+	rec[25] = flags
+	bothEndian16(rec[28:], 1)
+	rec[32] = byte(len(name))
+	copy(rec[33:], name)
+	return rec
+}
+
+// recordDate returns the 7 bytes date used in directory records
+func recordDate(t time.Time) []byte {
+	t = t.UTC()
+	year := t.Year() - 1900
+	if year < 0 {
+		year = 0
+	}
+	if year > 255 {
+		year = 255
+	}
+	return []byte{byte(year), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+// descriptorDate returns the 17 bytes date used in volume descriptors
+func descriptorDate(t time.Time) []byte {
+	t = t.UTC()
+	d := []byte(fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/10000000))
+	return append(d, 0)
+}
+
+func (i *Image) writeDescriptors(w io.WriterAt, l *layout) error {
+	write := func(sector uint32, data []byte) error {
+		if _, err := w.WriteAt(data, int64(sector)*sectorSize); err != nil {
+			return fmt.Errorf("writing the volume descriptors: %w", err)
+		}
+		return nil
+	}
+
+	if err := write(l.primary, i.volumeDescriptor(l, false)); err != nil {
+		return err
+	}
+	if i.Joliet {
+		if err := write(l.joliet, i.volumeDescriptor(l, true)); err != nil {
+			return err
+		}
+	}
+	if l.bootRecord != 0 {
+		br := descriptorHeader(descriptorBootRecord)
+		copy(br[7:], "EL TORITO SPECIFICATION")
+		binary.LittleEndian.PutUint32(br[71:], l.catalog)
+		if err := write(l.bootRecord, br); err != nil {
+			return err
+		}
+	}
+	return write(l.terminator, descriptorHeader(descriptorTerminator))
+}
+
+func descriptorHeader(t byte) []byte {
+	d := make([]byte, sectorSize)
+	d[0] = t
+	copy(d[1:], "CD001")
+	d[6] = 1
+	return d
+}
+
+func (i *Image) volumeDescriptor(l *layout, joliet bool) []byte {
+	d := descriptorHeader(descriptorPrimary)
+	text := func(offset, length int, value string) {
+		field := d[offset : offset+length]
+		if joliet {
+			// Joliet strings are UCS-2 big endian, padded with spaces
+			for j := 0; j+1 < length; j += 2 {
+				field[j], field[j+1] = 0, ' '
+			}
+			copy(field, utf16Bytes(utf16.Encode([]rune(truncate(value, length/2)))))
+			return
+		}
+		copy(field, bytes.Repeat([]byte{' '}, length))
+		copy(field, truncate(value, length))
+	}
+
+	pathTableSize, pathL, pathM := l.pathTableSize, l.pathTableL, l.pathTableM
+	root := dirRecord([]byte{0}, i.root.extent, i.root.dirSize, flagDirectory, l.modTime)
+	volumeID := toDChars(i.VolumeID)
+	if joliet {
+		d[0] = descriptorSupplementary
+		// UCS-2 level 3 escape sequence
+		copy(d[88:], "%/E")
+		pathTableSize, pathL, pathM = l.jolietPathTableSize, l.jolietPathTableL, l.jolietPathTableM
+		root = dirRecord([]byte{0}, i.root.jolietExtent, i.root.jolietDirSize, flagDirectory, l.modTime)
+		volumeID = i.VolumeID
+	}
+
+	text(8, 32, "LINUX")
+	text(40, 32, volumeID)
+	bothEndian32(d[80:], l.volumeSectors)
+	bothEndian16(d[120:], 1)
+	bothEndian16(d[124:], 1)
+	bothEndian16(d[128:], sectorSize)
+	bothEndian32(d[132:], pathTableSize)
+	binary.LittleEndian.PutUint32(d[140:], pathL)
+	binary.BigEndian.PutUint32(d[148:], pathM)
+	copy(d[156:190], root)
+	text(190, 128, "")
+	text(318, 128, "")
+	text(446, 128, "")
+	text(574, 128, "ENKI")
+	text(702, 37, "")
+	text(739, 37, "")
+	text(776, 37, "")
+	date := descriptorDate(l.modTime)
+	copy(d[813:], date)
+	copy(d[830:], date)
+	copy(d[847:], "0000000000000000")
+	copy(d[864:], date)
+	d[881] = 1
+	return d
+}
+
+// toDChars maps s to the uppercase character set allowed in the primary volume id
+func toDChars(s string) string {
+	b := []byte(s)
+	for j, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[j] = c - 'a' + 'A'
+		case (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_':
+		default:
+			b[j] = '_'
+		}
+	}
+	return string(b)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func utf16Bytes(chars []uint16) []byte {
+	b := make([]byte, 2*len(chars))
+	for j, c := range chars {
+		binary.BigEndian.PutUint16(b[2*j:], c)
+	}
+	return b
+}
+
+func (i *Image) writeFiles(w io.WriterAt, l *layout) error {
+	for _, f := range l.files {
+		if f.size == 0 {
+			continue
+		}
+		if err := copyAt(w, f.source, int64(f.extent)*sectorSize); err != nil {
+			return fmt.Errorf("copying %s to the iso: %w", f.source, err)
+		}
+	}
+	if i.EFI != nil && i.EFI.Partition != "" {
+		if err := copyAt(w, i.EFI.Partition, int64(l.efiStart)*sectorSize); err != nil {
+			return fmt.Errorf("appending the EFI partition %s: %w", i.EFI.Partition, err)
+		}
+	}
+	return nil
+}
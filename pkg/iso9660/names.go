@@ -0,0 +1,115 @@
+package iso9660
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// maxISONameLen is the level 2 limit for names, without the ";1" version suffix
+	maxISONameLen = 30
+	// maxJolietNameLen is the number of UCS-2 characters allowed in a Joliet name
+	maxJolietNameLen = 64
+	jolietForbidden  = "*/:;?\\"
+)
+
+// assignNames sets the primary and Joliet names for every child of the directory n, making sure they are unique
+func assignNames(n *node) error {
+	usedISO := map[string]bool{}
+	usedJoliet := map[string]bool{}
+	for _, c := range n.children {
+		isoName, err := uniqueName(isoBaseName(c), usedISO, func(base, ext, tail string) string {
+			return joinISOName(base, ext, tail, c.dir)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.path(), err)
+		}
+		c.isoName = isoName
+
+		jolietName, err := uniqueName(jolietBaseName(c.name), usedJoliet, joinJolietName)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.path(), err)
+		}
+		c.jolietName = utf16.Encode([]rune(jolietName))
+	}
+	return nil
+}
+
+type nameParts struct {
+	base string
+	ext  string
+}
+
+// uniqueName joins the name parts and, if the name is already taken, appends a numeric tail to the base until it is not
+func uniqueName(parts nameParts, used map[string]bool, join func(base, ext, tail string) string) (string, error) {
+	name := join(parts.base, parts.ext, "")
+	for i := 1; used[name]; i++ {
+		if i > 99999 {
+			return "", fmt.Errorf("cannot generate a unique name")
+		}
+		name = join(parts.base, parts.ext, "_"+strconv.Itoa(i))
+	}
+	used[name] = true
+	return name, nil
+}
+
+// isoBaseName maps the name to d-characters, as required by the primary volume descriptor
+func isoBaseName(n *node) nameParts {
+	name := strings.ToUpper(n.name)
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, c := range s {
+			if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+				b.WriteRune(c)
+			} else {
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+	if n.dir {
+		return nameParts{base: clean(name)}
+	}
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	return nameParts{base: clean(base), ext: clean(ext)}
+}
+
+func joinISOName(base, ext, tail string, dir bool) string {
+	if dir {
+		if len(base)+len(tail) > maxISONameLen+1 {
+			base = base[:maxISONameLen+1-len(tail)]
+		}
+		return base + tail
+	}
+	if len(ext) > 8 {
+		ext = ext[:8]
+	}
+	if len(base)+len(tail)+len(ext)+1 > maxISONameLen {
+		base = base[:max(0, maxISONameLen-1-len(ext)-len(tail))]
+	}
+	return base + tail + "." + ext + ";1"
+}
+
+func jolietBaseName(name string) nameParts {
+	var b strings.Builder
+	for _, c := range name {
+		if c > 0xFFFF || c < 0x20 || strings.ContainsRune(jolietForbidden, c) {
+			c = '_'
+		}
+		b.WriteRune(c)
+	}
+	return nameParts{base: b.String()}
+}
+
+func joinJolietName(base, _, tail string) string {
+	runes := []rune(base)
+	if len(runes)+len(tail) > maxJolietNameLen {
+		runes = runes[:maxJolietNameLen-len(tail)]
+	}
+	return string(runes) + tail
+}
@@ -0,0 +1,13 @@
+package kmod_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestKmodSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "kmod test suite")
+}
@@ -0,0 +1,217 @@
+package kmod_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/kmod"
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// elfModule returns a minimal relocatable ELF object with a .modinfo section holding the given entries
+func elfModule(modinfo ...string) []byte {
+	info := []byte(strings.Join(modinfo, "\x00") + "\x00")
+	shstrtab := []byte("\x00.modinfo\x00.shstrtab\x00")
+	infoOff := uint64(64)
+	strOff := infoOff + uint64(len(info))
+	shOff := (strOff + uint64(len(shstrtab)) + 7) &^ 7
+
+	type sectionHeader struct {
+		Name, Type                uint32
+		Flags, Addr, Offset, Size uint64
+		Link, Info                uint32
+		AddrAlign, EntSize        uint64
+	}
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	for _, v := range []any{uint16(1), uint16(62), uint32(1), uint64(0), uint64(0), shOff, uint32(0),
+		uint16(64), uint16(0), uint16(0), uint16(64), uint16(3), uint16(2)} {
+		Expect(binary.Write(buf, binary.LittleEndian, v)).To(Succeed())
+	}
+	buf.Write(info)
+	buf.Write(shstrtab)
+	buf.Write(make([]byte, int(shOff)-buf.Len()))
+	for _, sh := range []sectionHeader{
+		{},
+		{Name: 1, Type: 1, Offset: infoOff, Size: uint64(len(info)), AddrAlign: 1},
+		{Name: 10, Type: 3, Offset: strOff, Size: uint64(len(shstrtab)), AddrAlign: 1},
+	} {
+		Expect(binary.Write(buf, binary.LittleEndian, sh)).To(Succeed())
+	}
+	return buf.Bytes()
+}
+
+var _ = Describe("kmod", Label("kmod"), func() {
+	var root, modDir, fwDir string
+
+	write := func(file string, data []byte) {
+		Expect(os.MkdirAll(filepath.Dir(file), 0755)).To(Succeed())
+		Expect(os.WriteFile(file, data, 0644)).To(Succeed())
+	}
+	exists := func(file string) bool {
+		_, err := os.Lstat(file)
+		return err == nil
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = os.MkdirTemp("", "enki-kmod-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, root)
+		Expect(os.MkdirAll(filepath.Join(root, "usr", "lib"), 0755)).To(Succeed())
+		Expect(os.Symlink("usr/lib", filepath.Join(root, "lib"))).To(Succeed())
+
+		modDir = filepath.Join(root, "usr", "lib", "modules", "6.6.0")
+		fwDir = filepath.Join(root, "usr", "lib", "firmware")
+		write(filepath.Join(modDir, "modules.dep"), []byte(strings.Join([]string{
+			"kernel/drivers/net/e1000e.ko: kernel/drivers/ptp/ptp.ko kernel/drivers/pps/pps_core.ko",
+			"kernel/drivers/ptp/ptp.ko: kernel/drivers/pps/pps_core.ko",
+			"kernel/drivers/pps/pps_core.ko:",
+			"kernel/drivers/gpu/amdgpu.ko.zst:",
+			"kernel/drivers/net/wifi/iwlwifi.ko:",
+			"kernel/drivers/net/wifi/iwlmvm.ko: kernel/drivers/net/wifi/iwlwifi.ko",
+			"kernel/fs/nls/nls-cp437.ko:",
+		}, "\n")+"\n"))
+		write(filepath.Join(modDir, "modules.alias"), []byte(strings.Join([]string{
+			"# Aliases extracted from modules themselves.",
+			"alias pci:v00008086d000015BCsv*sd*bc*sc*i* e1000e",
+			"alias pci:v00001002d*sv*sd*bc03sc*i* amdgpu",
+			"alias pci:v00008086d00002723sv*sd*bc*sc*i* iwlwifi",
+			"alias nls-cp437 nls-cp437",
+		}, "\n")+"\n"))
+		write(filepath.Join(modDir, "modules.softdep"), []byte("softdep iwlwifi post: iwlmvm\n"))
+		write(filepath.Join(modDir, "modules.builtin"), []byte("kernel/fs/ext4/ext4.ko\n"))
+		write(filepath.Join(modDir, "modules.builtin.modinfo"), []byte("ext4.license=GPL\x00regulatory.firmware=regulatory.db\x00"))
+
+		write(filepath.Join(modDir, "kernel/drivers/net/e1000e.ko"), elfModule("license=GPL", "firmware=intel/e1000e.bin"))
+		write(filepath.Join(modDir, "kernel/drivers/ptp/ptp.ko"), elfModule("license=GPL"))
+		write(filepath.Join(modDir, "kernel/drivers/pps/pps_core.ko"), elfModule("license=GPL"))
+		compressed := &bytes.Buffer{}
+		zw, err := zstd.NewWriter(compressed)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = zw.Write(elfModule("firmware=amdgpu/navi10_*.bin"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(zw.Close()).To(Succeed())
+		write(filepath.Join(modDir, "kernel/drivers/gpu/amdgpu.ko.zst"), compressed.Bytes())
+		write(filepath.Join(modDir, "kernel/drivers/net/wifi/iwlwifi.ko"), elfModule("firmware=iwlwifi-cc-a0-77.ucode"))
+		write(filepath.Join(modDir, "kernel/drivers/net/wifi/iwlmvm.ko"), elfModule("license=GPL"))
+		write(filepath.Join(modDir, "kernel/fs/nls/nls-cp437.ko"), elfModule("license=GPL"))
+
+		write(filepath.Join(fwDir, "intel/e1000e.bin.zst"), make([]byte, 10))
+		write(filepath.Join(fwDir, "amdgpu/navi10_sos.bin"), make([]byte, 100))
+		write(filepath.Join(fwDir, "amdgpu/navi10_ta.bin"), make([]byte, 100))
+		write(filepath.Join(fwDir, "amdgpu/vega10_sos.bin"), make([]byte, 100))
+		write(filepath.Join(fwDir, "iwlwifi-cc-a0-77.ucode.xz"), make([]byte, 50))
+		write(filepath.Join(fwDir, "regulatory.db"), make([]byte, 5))
+		write(filepath.Join(fwDir, "nvidia/gsp.bin"), make([]byte, 1000))
+		Expect(os.Symlink("../intel/e1000e.bin.zst", filepath.Join(fwDir, "amdgpu", "link.bin"))).To(Succeed())
+	})
+
+	Describe("ParseProfile", func() {
+		It("reads module names, modaliases and lsmod output", func() {
+			profile, err := kmod.ParseProfile(strings.NewReader(strings.Join([]string{
+				"# my board",
+				"Module                  Size  Used by",
+				"e1000e                323584  0",
+				"ptp                    45056  1 e1000e",
+				"",
+				"pci:v00001002d0000731Fsv00001458sd00002313bc03sc00i00",
+				"nls-cp437",
+			}, "\n")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(profile.Modules).To(Equal([]string{"e1000e", "ptp", "nls-cp437"}))
+			Expect(profile.Modaliases).To(Equal([]string{"pci:v00001002d0000731Fsv00001458sd00002313bc03sc00i00"}))
+		})
+		It("fails with an empty profile", func() {
+			_, err := kmod.ParseProfile(strings.NewReader("# nothing\n"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Prune", func() {
+		It("keeps the modules of the profile with their dependencies and firmware", func() {
+			res, err := kmod.Prune(root, &kmod.Profile{
+				Modules:    []string{"e1000e", "nls_cp437", "ext4", "fs-xfs"},
+				Modaliases: []string{"pci:v00001002d0000731Fsv00001458sd00002313bc03sc00i00"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.KeptModules).To(Equal(5))
+			Expect(res.RemovedModules).To(Equal(2))
+			Expect(res.RemovedFirmware).To(Equal(4))
+			Expect(res.Unknown).To(Equal([]string{"fs-xfs"}))
+
+			for _, kept := range []string{"net/e1000e.ko", "ptp/ptp.ko", "pps/pps_core.ko", "gpu/amdgpu.ko.zst", "../fs/nls/nls-cp437.ko"} {
+				Expect(exists(filepath.Join(modDir, "kernel/drivers", kept))).To(BeTrue(), kept)
+			}
+			Expect(exists(filepath.Join(modDir, "kernel/drivers/net/wifi"))).To(BeFalse())
+			Expect(exists(filepath.Join(modDir, "modules.dep"))).To(BeTrue())
+
+			for _, kept := range []string{"intel/e1000e.bin.zst", "amdgpu/navi10_sos.bin", "amdgpu/navi10_ta.bin", "regulatory.db"} {
+				Expect(exists(filepath.Join(fwDir, kept))).To(BeTrue(), kept)
+			}
+			for _, removed := range []string{"amdgpu/vega10_sos.bin", "amdgpu/link.bin", "iwlwifi-cc-a0-77.ucode.xz", "nvidia"} {
+				Expect(exists(filepath.Join(fwDir, removed))).To(BeFalse(), removed)
+			}
+			removedModules := len(elfModule("firmware=iwlwifi-cc-a0-77.ucode")) + len(elfModule("license=GPL"))
+			Expect(res.RemovedBytes).To(Equal(int64(100 + 50 + 1000 + removedModules)))
+		})
+		It("follows the soft dependencies and links to firmware", func() {
+			Expect(os.Symlink("iwlwifi-cc-a0-77.ucode.xz", filepath.Join(fwDir, "iwlwifi-so-a0.ucode.xz"))).To(Succeed())
+			write(filepath.Join(modDir, "kernel/drivers/net/wifi/iwlwifi.ko"), elfModule("firmware=iwlwifi-so-a0.ucode"))
+
+			res, err := kmod.Prune(root, &kmod.Profile{Modaliases: []string{"pci:v00008086d00002723sv00008086sd00000084bc02sc80i00"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.KeptModules).To(Equal(2))
+			Expect(exists(filepath.Join(modDir, "kernel/drivers/net/wifi/iwlmvm.ko"))).To(BeTrue())
+			Expect(exists(filepath.Join(fwDir, "iwlwifi-so-a0.ucode.xz"))).To(BeTrue())
+			Expect(exists(filepath.Join(fwDir, "iwlwifi-cc-a0-77.ucode.xz"))).To(BeTrue())
+			Expect(exists(filepath.Join(fwDir, "regulatory.db"))).To(BeTrue())
+			Expect(exists(filepath.Join(fwDir, "amdgpu"))).To(BeFalse())
+		})
+		It("drops the removed modules from the depmod files", func() {
+			write(filepath.Join(modDir, "modules.symbols"), []byte("# Aliases for symbols, used by symbol_request().\nalias symbol:ptp_clock_register ptp\nalias symbol:iwl_opmode_register iwlwifi\n"))
+			res, err := kmod.Prune(root, &kmod.Profile{Modules: []string{"e1000e"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Kernels).To(Equal([]string{"6.6.0"}))
+
+			dep, err := os.ReadFile(filepath.Join(modDir, "modules.dep"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dep)).To(Equal(strings.Join([]string{
+				"kernel/drivers/net/e1000e.ko: kernel/drivers/ptp/ptp.ko kernel/drivers/pps/pps_core.ko",
+				"kernel/drivers/ptp/ptp.ko: kernel/drivers/pps/pps_core.ko",
+				"kernel/drivers/pps/pps_core.ko:",
+			}, "\n") + "\n"))
+			alias, err := os.ReadFile(filepath.Join(modDir, "modules.alias"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(alias)).To(Equal("# Aliases extracted from modules themselves.\nalias pci:v00008086d000015BCsv*sd*bc*sc*i* e1000e\n"))
+			symbols, err := os.ReadFile(filepath.Join(modDir, "modules.symbols"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(symbols)).To(Equal("# Aliases for symbols, used by symbol_request().\nalias symbol:ptp_clock_register ptp\n"))
+		})
+		It("keeps the CPU microcode and the firmware of the profile", func() {
+			write(filepath.Join(fwDir, "intel-ucode/06-8e-09"), make([]byte, 10))
+			write(filepath.Join(fwDir, "amd-ucode/microcode_amd_fam17h.bin"), make([]byte, 10))
+			write(filepath.Join(fwDir, "qcom/a630_sqe.fw"), make([]byte, 10))
+
+			res, err := kmod.Prune(root, &kmod.Profile{Modules: []string{"e1000e"}, Firmware: []string{"nvidia", "amdgpu/navi10_*.bin"}})
+			Expect(err).ToNot(HaveOccurred())
+			for _, kept := range []string{"intel-ucode/06-8e-09", "amd-ucode/microcode_amd_fam17h.bin", "nvidia/gsp.bin", "amdgpu/navi10_sos.bin", "amdgpu/navi10_ta.bin"} {
+				Expect(exists(filepath.Join(fwDir, kept))).To(BeTrue(), kept)
+			}
+			for _, removed := range []string{"qcom", "amdgpu/vega10_sos.bin", "iwlwifi-cc-a0-77.ucode.xz"} {
+				Expect(exists(filepath.Join(fwDir, removed))).To(BeFalse(), removed)
+			}
+			Expect(res.RemovedFirmware).To(Equal(4))
+		})
+		It("fails without kernel modules", func() {
+			Expect(os.RemoveAll(filepath.Join(root, "usr", "lib", "modules"))).To(Succeed())
+			_, err := kmod.Prune(root, &kmod.Profile{Modules: []string{"e1000e"}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
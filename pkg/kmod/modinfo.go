@@ -0,0 +1,128 @@
+package kmod
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// moduleSuffixes are the file extensions of kernel modules, compressed or not
+var moduleSuffixes = []string{".ko", ".ko.xz", ".ko.zst", ".ko.gz"}
+
+// firmwareSuffixes are the extensions the kernel tries when loading a compressed firmware file
+var firmwareSuffixes = []string{"", ".xz", ".zst"}
+
+// isModule returns true if the file name is a kernel module
+func isModule(name string) bool {
+	for _, s := range moduleSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleName returns the name of the module in the given path, with dashes replaced by underscores as the kernel does
+func moduleName(p string) string {
+	name := p[strings.LastIndex(p, "/")+1:]
+	for _, s := range moduleSuffixes {
+		if strings.HasSuffix(name, s) {
+			name = strings.TrimSuffix(name, s)
+			break
+		}
+	}
+	return normalizeName(name)
+}
+
+func normalizeName(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// moduleFirmware returns the firmware files listed in the modinfo of a module file
+func moduleFirmware(file string) ([]string, error) {
+	data, err := readModule(file)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading module %s: %w", file, err)
+	}
+	section := obj.Section(".modinfo")
+	if section == nil {
+		return nil, nil
+	}
+	modinfo, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("reading the modinfo of %s: %w", file, err)
+	}
+
+	var firmware []string
+	for _, entry := range bytes.Split(modinfo, []byte{0}) {
+		if fw, ok := strings.CutPrefix(string(entry), "firmware="); ok {
+			firmware = append(firmware, fw)
+		}
+	}
+	return firmware, nil
+}
+
+// readModule returns the uncompressed contents of a module file
+func readModule(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader
+	switch {
+	case strings.HasSuffix(file, ".xz"):
+		r, err = xz.NewReader(f)
+	case strings.HasSuffix(file, ".zst"):
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(f)
+		if err == nil {
+			defer d.Close()
+		}
+		r = d
+	case strings.HasSuffix(file, ".gz"):
+		r, err = gzip.NewReader(f)
+	default:
+		r = f
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decompressing module %s: %w", file, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading module %s: %w", file, err)
+	}
+	return data, nil
+}
+
+// builtinFirmware returns the firmware files listed in modules.builtin.modinfo, which holds the modinfo of the modules
+// built in the kernel as "module.key=value" entries
+func builtinFirmware(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var firmware []string
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		key, value, ok := strings.Cut(string(entry), "=")
+		if ok && strings.HasSuffix(key, ".firmware") {
+			firmware = append(firmware, value)
+		}
+	}
+	return firmware, nil
+}
@@ -0,0 +1,65 @@
+// Package kmod trims the kernel modules and firmware of a rootfs down to the ones needed by a known set of hardware.
+//
+// The hardware is described by a Profile, and the modules it needs are resolved with the modules.dep, modules.alias
+// and modules.softdep files generated by depmod for every kernel in the rootfs. The firmware kept is the one listed in
+// the modinfo of the kept and built-in modules, along with the CPU microcode and the firmware listed in the Profile.
+package kmod
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Profile is the hardware a system is built for
+type Profile struct {
+	// Modules are the names of the kernel modules to keep
+	Modules []string
+	// Modaliases are device modaliases, as found in /sys/devices/**/modalias, the modules matching them are kept
+	Modaliases []string
+	// Firmware are paths or globs relative to the firmware directory that are kept even if no module uses them, like
+	// the firmware loaded from userspace. Directories are kept with all their files.
+	Firmware []string
+}
+
+// ReadProfile reads a profile file, see ParseProfile for its format
+func ReadProfile(file string) (*Profile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening hardware profile: %w", err)
+	}
+	defer f.Close()
+	return ParseProfile(f)
+}
+
+// ParseProfile parses a profile with an entry per line. Each line can be a module name, a modalias like
+// "pci:v00008086d000015BCsv*" or a line of the lsmod output, so the output of lsmod and of
+// "cat /sys/bus/*/devices/*/modalias" on the target system can be used directly, and mixed.
+// Empty lines, comments starting with "#" and the lsmod header are ignored.
+func ParseProfile(r io.Reader) (*Profile, error) {
+	p := &Profile{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) >= 3 && fields[0] == "Module" && fields[1] == "Size" {
+			continue
+		}
+		if strings.Contains(fields[0], ":") {
+			p.Modaliases = append(p.Modaliases, fields[0])
+			continue
+		}
+		p.Modules = append(p.Modules, fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading hardware profile: %w", err)
+	}
+	if len(p.Modules) == 0 && len(p.Modaliases) == 0 {
+		return nil, fmt.Errorf("empty hardware profile")
+	}
+	return p, nil
+}
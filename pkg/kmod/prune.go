@@ -0,0 +1,470 @@
+package kmod
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Result is the summary of a Prune call
+type Result struct {
+	KeptModules     int
+	RemovedModules  int
+	RemovedFirmware int
+	RemovedBytes    int64
+	// Kernels are the versions of the kernels found in the rootfs
+	Kernels []string
+	// Unknown are the profile modules not found in any of the kernels of the rootfs
+	Unknown []string
+}
+
+// microcodeFirmware is the firmware always kept, the CPU microcode is loaded by the kernel without any module asking for it
+var microcodeFirmware = []string{"intel-ucode", "amd-ucode"}
+
+// kernel is the depmod data of a kernel in the rootfs
+type kernel struct {
+	// deps are the module files with their dependencies, as paths relative to the module directory
+	deps map[string][]string
+	// files are the module files by module name
+	files   map[string]string
+	aliases [][2]string
+	softdep map[string][]string
+	builtin map[string]bool
+}
+
+// Prune removes from the rootfs at root the kernel modules not needed by the profile, and the firmware not used by the
+// modules that are kept or built in the kernel, except for the CPU microcode and the firmware of the profile.
+// The removed modules are dropped from the modules.dep, modules.alias and modules.symbols files, but the binary
+// indexes of depmod are left as they are, so depmod has to be run again on the kernels of the result to update them.
+func Prune(root string, profile *Profile) (*Result, error) {
+	res := &Result{}
+	dirs, err := kernelDirs(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no kernel modules found in %s", root)
+	}
+
+	found := map[string]bool{}
+	var firmware []string
+	for _, dir := range dirs {
+		k, err := readKernel(dir)
+		if err != nil {
+			return nil, err
+		}
+		keep := k.resolve(profile, found)
+		res.KeptModules += len(keep)
+
+		err = walkFiles(dir, func(rel string, d fs.DirEntry) error {
+			if !isModule(d.Name()) {
+				return nil
+			}
+			if keep[rel] {
+				fw, err := moduleFirmware(filepath.Join(dir, rel))
+				firmware = append(firmware, fw...)
+				return err
+			}
+			res.RemovedModules++
+			return remove(filepath.Join(dir, rel), d, res)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := updateModuleFiles(dir, keep); err != nil {
+			return nil, err
+		}
+		res.Kernels = append(res.Kernels, filepath.Base(dir))
+		fw, err := builtinFirmware(filepath.Join(dir, "modules.builtin.modinfo"))
+		if err != nil {
+			return nil, err
+		}
+		firmware = append(firmware, fw...)
+		removeEmptyDirs(dir)
+	}
+	firmware = append(firmware, microcodeFirmware...)
+	firmware = append(firmware, profile.Firmware...)
+
+	for _, name := range profile.Modules {
+		if !found[normalizeName(name)] {
+			res.Unknown = append(res.Unknown, name)
+		}
+	}
+
+	fwDirs, err := uniqueDirs(root, "usr/lib/firmware", "lib/firmware")
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range fwDirs {
+		if err := pruneFirmware(dir, firmware, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// resolve returns the module files needed by the profile with all their dependencies, and marks the profile modules
+// found in this kernel, as modules or built in
+func (k *kernel) resolve(profile *Profile, found map[string]bool) map[string]bool {
+	var queue []string
+	for _, name := range profile.Modules {
+		name = normalizeName(name)
+		switch {
+		case k.files[name] != "":
+			queue = append(queue, name)
+		case k.builtin[name]:
+		default:
+			// Module aliases like fs-ext4 are accepted as names too
+			aliased := k.matchAlias(name)
+			if len(aliased) == 0 {
+				continue
+			}
+			queue = append(queue, aliased...)
+		}
+		found[name] = true
+	}
+	for _, modalias := range profile.Modaliases {
+		queue = append(queue, k.matchAlias(modalias)...)
+	}
+
+	keep := map[string]bool{}
+	seen := map[string]bool{}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		queue = append(queue, k.softdep[name]...)
+		file := k.files[name]
+		if file == "" {
+			continue
+		}
+		keep[file] = true
+		for _, dep := range k.deps[file] {
+			keep[dep] = true
+			queue = append(queue, moduleName(dep))
+		}
+	}
+	return keep
+}
+
+// matchAlias returns the modules with an alias matching the given modalias
+func (k *kernel) matchAlias(modalias string) []string {
+	var modules []string
+	for _, alias := range k.aliases {
+		if ok, _ := path.Match(alias[0], modalias); ok && !slices.Contains(modules, alias[1]) {
+			modules = append(modules, alias[1])
+		}
+	}
+	return modules
+}
+
+// kernelDirs returns the module directories of the kernels in the rootfs, the ones with a modules.dep file
+func kernelDirs(root string) ([]string, error) {
+	parents, err := uniqueDirs(root, "usr/lib/modules", "lib/modules")
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, parent := range parents {
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			dir := filepath.Join(parent, e.Name())
+			if _, err := os.Stat(filepath.Join(dir, "modules.dep")); err == nil {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// uniqueDirs returns the real paths of the given directories under root that exist, without duplicates, as /lib is
+// usually a link to /usr/lib. Directories resolving out of root, like through absolute links, are left out.
+func uniqueDirs(root string, dirs ...string) ([]string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	var unique []string
+	for _, dir := range dirs {
+		real, err := filepath.EvalSymlinks(filepath.Join(root, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(realRoot, real)
+		if err != nil || strings.HasPrefix(rel, "..") || slices.Contains(unique, real) {
+			continue
+		}
+		if info, err := os.Stat(real); err != nil || !info.IsDir() {
+			continue
+		}
+		unique = append(unique, real)
+	}
+	return unique, nil
+}
+
+func readKernel(dir string) (*kernel, error) {
+	k := &kernel{
+		deps:    map[string][]string{},
+		files:   map[string]string{},
+		softdep: map[string][]string{},
+		builtin: map[string]bool{},
+	}
+
+	// kernel/drivers/net/e1000e/e1000e.ko.zst: kernel/drivers/ptp/ptp.ko.zst kernel/drivers/pps/pps_core.ko.zst
+	err := readLines(filepath.Join(dir, "modules.dep"), true, func(fields []string) {
+		file := strings.TrimSuffix(fields[0], ":")
+		k.deps[file] = fields[1:]
+		k.files[moduleName(file)] = file
+	})
+	if err != nil {
+		return nil, err
+	}
+	// alias pci:v00008086d000015BCsv*sd*bc*sc*i* e1000e
+	err = readLines(filepath.Join(dir, "modules.alias"), false, func(fields []string) {
+		if len(fields) == 3 && fields[0] == "alias" {
+			k.aliases = append(k.aliases, [2]string{fields[1], normalizeName(fields[2])})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// softdep i915 pre: intel_gtt post: snd_hda_intel
+	err = readLines(filepath.Join(dir, "modules.softdep"), false, func(fields []string) {
+		if len(fields) < 2 || fields[0] != "softdep" {
+			return
+		}
+		name := normalizeName(fields[1])
+		for _, f := range fields[2:] {
+			if f != "pre:" && f != "post:" {
+				k.softdep[name] = append(k.softdep[name], normalizeName(f))
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// kernel/fs/ext4/ext4.ko
+	err = readLines(filepath.Join(dir, "modules.builtin"), false, func(fields []string) {
+		k.builtin[moduleName(fields[0])] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// updateModuleFiles drops the modules that are not kept from the depmod files of the module directory
+func updateModuleFiles(dir string, keep map[string]bool) error {
+	names := map[string]bool{}
+	for file := range keep {
+		names[moduleName(file)] = true
+	}
+	// kernel/drivers/net/e1000e/e1000e.ko.zst: kernel/drivers/ptp/ptp.ko.zst kernel/drivers/pps/pps_core.ko.zst
+	err := filterLines(filepath.Join(dir, "modules.dep"), func(fields []string) bool {
+		return keep[strings.TrimSuffix(fields[0], ":")]
+	})
+	if err != nil {
+		return err
+	}
+	// alias pci:v00008086d000015BCsv*sd*bc*sc*i* e1000e
+	// alias symbol:ptp_clock_register ptp
+	for _, file := range []string{"modules.alias", "modules.symbols"} {
+		err := filterLines(filepath.Join(dir, file), func(fields []string) bool {
+			return len(fields) != 3 || fields[0] != "alias" || names[normalizeName(fields[2])]
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterLines rewrites the file with the lines that are empty, comments or for which keep returns true, if it exists
+func filterLines(file string, keep func(fields []string) bool) error {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", file, err)
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || keep(fields) {
+			kept = append(kept, line)
+		}
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, []byte(strings.Join(kept, "")), info.Mode()); err != nil {
+		return fmt.Errorf("writing %s: %w", file, err)
+	}
+	return nil
+}
+
+// readLines calls fn with the fields of every line of the file that is not empty or a comment
+func readLines(file string, required bool, fn func(fields []string)) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", file, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fn(fields)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", file, err)
+	}
+	return nil
+}
+
+// pruneFirmware removes the files of the firmware directory not matching any of the firmware names, which can be
+// globs. All the files of the matching directories are kept, links to kept files and their targets are kept, and so
+// are links to directories.
+func pruneFirmware(dir string, firmware []string, res *Result) error {
+	keep := map[string]bool{}
+	for _, fw := range firmware {
+		for _, suffix := range firmwareSuffixes {
+			matches, err := filepath.Glob(filepath.Join(dir, fw+suffix))
+			if err != nil {
+				continue
+			}
+			for _, m := range matches {
+				if info, err := os.Stat(m); err == nil && info.IsDir() {
+					err := walkFiles(m, func(rel string, _ fs.DirEntry) error {
+						keepFirmware(dir, filepath.Join(m, rel), keep)
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				keepFirmware(dir, m, keep)
+			}
+		}
+	}
+
+	err := walkFiles(dir, func(rel string, d fs.DirEntry) error {
+		if keep[rel] {
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			if info, err := os.Stat(filepath.Join(dir, rel)); err == nil && info.IsDir() {
+				return nil
+			}
+		}
+		res.RemovedFirmware++
+		return remove(filepath.Join(dir, rel), d, res)
+	})
+	if err != nil {
+		return err
+	}
+	removeEmptyDirs(dir)
+	return nil
+}
+
+// keepFirmware marks the firmware file to be kept, following the links to other files of the firmware directory
+func keepFirmware(dir, file string, keep map[string]bool) {
+	if rel, err := filepath.Rel(dir, file); err == nil {
+		keep[rel] = true
+	}
+	target, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return
+	}
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	keep[rel] = true
+	// Keep the links found on the way to the target too
+	for p := file; ; {
+		info, err := os.Lstat(p)
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			return
+		}
+		link, err := os.Readlink(p)
+		if err != nil {
+			return
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(p), link)
+		}
+		if r, err := filepath.Rel(dir, link); err == nil && !strings.HasPrefix(r, "..") {
+			keep[r] = true
+		}
+		p = link
+	}
+}
+
+// walkFiles calls fn for every file in dir that is not a directory, with its path relative to dir
+func walkFiles(dir string, fn func(rel string, d fs.DirEntry) error) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return fn(rel, d)
+	})
+}
+
+func remove(file string, d fs.DirEntry, res *Result) error {
+	if d.Type().IsRegular() {
+		if info, err := d.Info(); err == nil {
+			res.RemovedBytes += info.Size()
+		}
+	}
+	return os.Remove(file)
+}
+
+// removeEmptyDirs removes the empty directories under dir, ignoring errors
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		sub := filepath.Join(dir, e.Name())
+		removeEmptyDirs(sub)
+		if left, err := os.ReadDir(sub); err == nil && len(left) == 0 {
+			_ = os.Remove(sub)
+		}
+	}
+}
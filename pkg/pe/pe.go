@@ -0,0 +1,342 @@
+// Package pe reads and appends sections of PE32+ images, like the UKI files built from the systemd stub.
+//
+// Sections are appended after the last section of the image. If there is no room in the headers for the new section
+// table entries, the data of the existing sections is moved forward in the file to make room, up to the address the
+// first section is loaded at. The virtual addresses of the existing sections never change.
+package pe
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+const (
+	peMagic           = "PE\x00\x00"
+	coffHeaderSize    = 20
+	sectionHeaderSize = 40
+	magicPE32Plus     = 0x20b
+	// securityDirectory is the index of the certificate table in the data directories
+	securityDirectory = 4
+	// debugDirectory is the index of the debug directory in the data directories
+	debugDirectory        = 6
+	debugDirectorySize    = 28
+	debugPointerToRawData = 24
+
+	// sectionFlags marks the appended sections as initialized read only data
+	sectionFlags = pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ
+)
+
+// Offsets in the PE32+ optional header
+const (
+	optSizeOfInitializedData = 8
+	optSectionAlignment      = 32
+	optFileAlignment         = 36
+	optSizeOfImage           = 56
+	optSizeOfHeaders         = 60
+	optCheckSum              = 64
+	optNumberOfRvaAndSizes   = 108
+	optDataDirectories       = 112
+)
+
+// Section is a named section of an image
+type Section struct {
+	// Name is the section name, at most 8 characters
+	Name string
+	Data []byte
+}
+
+// Sections returns the sections of the image in order, with their data trimmed to their virtual size, as the
+// systemd stub reads and measures them
+func Sections(file string) ([]Section, error) {
+	f, err := pe.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+	defer f.Close()
+
+	sections := make([]Section, 0, len(f.Sections))
+	for _, s := range f.Sections {
+		size := min(s.VirtualSize, s.Size)
+		data, err := io.ReadAll(io.LimitReader(s.Open(), int64(size)))
+		if err != nil {
+			return nil, fmt.Errorf("reading section %s of %s: %w", s.Name, file, err)
+		}
+		sections = append(sections, Section{Name: s.Name, Data: data})
+	}
+	return sections, nil
+}
+
+// AddSections writes to output the image at input with the given sections appended after its last one. The image
+// must not be signed, as the signature would not cover the new sections.
+func AddSections(input, output string, sections []Section) error {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	data, err = addSections(data, sections)
+	if err != nil {
+		return fmt.Errorf("adding sections to %s: %w", input, err)
+	}
+	return os.WriteFile(output, data, 0644)
+}
+
+// ReplaceSections writes to output the image at input with only its first keep sections, and the given sections
+// appended after them. The data of the dropped sections is left in the file, so they must be small, like the ones
+// of the UKI profiles. The image must not be signed.
+func ReplaceSections(input, output string, keep int, sections []Section) error {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	data, err = dropSections(data, keep)
+	if err == nil {
+		data, err = addSections(data, sections)
+	}
+	if err != nil {
+		return fmt.Errorf("replacing sections of %s: %w", input, err)
+	}
+	return os.WriteFile(output, data, 0644)
+}
+
+// RewriteSection writes to output the image at input with the data of the named section replaced. The section is
+// removed from the section table and appended after the last one, as ukify does with the .sbat section of the stub,
+// so its old data is left unreferenced in the file. The image must not be signed.
+func RewriteSection(input, output, name string, data []byte) error {
+	image, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	image, err = removeSection(image, name)
+	if err == nil {
+		image, err = addSections(image, []Section{{Name: name, Data: data}})
+	}
+	if err != nil {
+		return fmt.Errorf("rewriting section %s of %s: %w", name, input, err)
+	}
+	return os.WriteFile(output, image, 0644)
+}
+
+// removeSection removes the section table entry of the named section, moving the following entries up
+func removeSection(data []byte, name string) ([]byte, error) {
+	le := binary.LittleEndian
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(f.Sections, func(s *pe.Section) bool { return s.Name == name })
+	if i < 0 {
+		return nil, fmt.Errorf("no %s section", name)
+	}
+	peOffset := int(le.Uint32(data[0x3c:]))
+	coff := peOffset + 4
+	opt := coff + coffHeaderSize
+	table := opt + int(f.SizeOfOptionalHeader)
+	tableEnd := table + len(f.Sections)*sectionHeaderSize
+	data = bytes.Clone(data)
+	copy(data[table+i*sectionHeaderSize:], data[table+(i+1)*sectionHeaderSize:tableEnd])
+	clear(data[tableEnd-sectionHeaderSize : tableEnd])
+	le.PutUint16(data[coff+2:], uint16(len(f.Sections)-1))
+	if s := f.Sections[i]; s.Characteristics&pe.IMAGE_SCN_CNT_INITIALIZED_DATA != 0 {
+		if initialized := le.Uint32(data[opt+optSizeOfInitializedData:]); initialized >= s.Size {
+			le.PutUint32(data[opt+optSizeOfInitializedData:], initialized-s.Size)
+		}
+	}
+	return data, nil
+}
+
+// dropSections removes the section table entries after the first keep ones
+func dropSections(data []byte, keep int) ([]byte, error) {
+	le := binary.LittleEndian
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if keep < 0 || keep > len(f.Sections) {
+		return nil, fmt.Errorf("the image has %d sections, can not keep %d", len(f.Sections), keep)
+	}
+	peOffset := int(le.Uint32(data[0x3c:]))
+	coff := peOffset + 4
+	opt := coff + coffHeaderSize
+	table := opt + int(f.SizeOfOptionalHeader)
+	var dropped uint32
+	for _, s := range f.Sections[keep:] {
+		if s.Characteristics&pe.IMAGE_SCN_CNT_INITIALIZED_DATA != 0 {
+			dropped += s.Size
+		}
+	}
+	data = bytes.Clone(data)
+	clear(data[table+keep*sectionHeaderSize : table+len(f.Sections)*sectionHeaderSize])
+	le.PutUint16(data[coff+2:], uint16(keep))
+	if initialized := le.Uint32(data[opt+optSizeOfInitializedData:]); initialized >= dropped {
+		le.PutUint32(data[opt+optSizeOfInitializedData:], initialized-dropped)
+	}
+	return data, nil
+}
+
+func addSections(data []byte, sections []Section) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(data) < 0x40 {
+		return nil, fmt.Errorf("not a PE image")
+	}
+	peOffset := int(le.Uint32(data[0x3c:]))
+	if peOffset+4+coffHeaderSize > len(data) || string(data[peOffset:peOffset+4]) != peMagic {
+		return nil, fmt.Errorf("not a PE image")
+	}
+	coff := peOffset + 4
+	numSections := int(le.Uint16(data[coff+2:]))
+	optSize := int(le.Uint16(data[coff+16:]))
+	opt := coff + coffHeaderSize
+	if opt+optSize > len(data) || optSize < optDataDirectories || le.Uint16(data[opt:]) != magicPE32Plus {
+		return nil, fmt.Errorf("not a PE32+ image")
+	}
+	if int(le.Uint32(data[opt+optNumberOfRvaAndSizes:])) > securityDirectory {
+		security := opt + optDataDirectories + securityDirectory*8
+		if security+8 <= opt+optSize && le.Uint32(data[security+4:]) != 0 {
+			return nil, fmt.Errorf("the image is signed")
+		}
+	}
+
+	sectionAlignment := le.Uint32(data[opt+optSectionAlignment:])
+	fileAlignment := le.Uint32(data[opt+optFileAlignment:])
+	if sectionAlignment == 0 || fileAlignment == 0 {
+		return nil, fmt.Errorf("invalid section alignment")
+	}
+	table := opt + optSize
+	tableEnd := table + numSections*sectionHeaderSize
+	needed := uint32(tableEnd + len(sections)*sectionHeaderSize)
+	sizeOfHeaders := le.Uint32(data[opt+optSizeOfHeaders:])
+	firstRaw, firstVA := uint32(len(data)), uint32(math.MaxUint32)
+	var nextVA uint32
+	for i := 0; i < numSections; i++ {
+		h := data[table+i*sectionHeaderSize:]
+		nextVA = max(nextVA, le.Uint32(h[12:])+le.Uint32(h[8:]))
+		firstVA = min(firstVA, le.Uint32(h[12:]))
+		if rawSize, rawPtr := le.Uint32(h[16:]), le.Uint32(h[20:]); rawSize > 0 {
+			firstRaw = min(firstRaw, rawPtr)
+		}
+	}
+	if needed > firstVA {
+		return nil, fmt.Errorf("not enough space in the headers for %d more sections", len(sections))
+	}
+	if needed > firstRaw {
+		var err error
+		if data, err = growHeaders(data, opt, table, numSections, firstRaw, alignUp(needed-firstRaw, fileAlignment)); err != nil {
+			return nil, err
+		}
+	}
+	if needed > sizeOfHeaders {
+		le.PutUint32(data[opt+optSizeOfHeaders:], alignUp(needed, fileAlignment))
+	}
+
+	out := bytes.NewBuffer(data)
+	var initializedData uint32
+	for i, s := range sections {
+		if len(s.Name) == 0 || len(s.Name) > 8 {
+			return nil, fmt.Errorf("invalid section name %q", s.Name)
+		}
+		nextVA = alignUp(nextVA, sectionAlignment)
+		rawPtr := alignUp(uint32(out.Len()), fileAlignment)
+		rawSize := alignUp(uint32(len(s.Data)), fileAlignment)
+		out.Write(make([]byte, int(rawPtr)-out.Len()))
+		out.Write(s.Data)
+		out.Write(make([]byte, int(rawSize)-len(s.Data)))
+
+		h := make([]byte, sectionHeaderSize)
+		copy(h, s.Name)
+		le.PutUint32(h[8:], uint32(len(s.Data)))
+		le.PutUint32(h[12:], nextVA)
+		le.PutUint32(h[16:], rawSize)
+		le.PutUint32(h[20:], rawPtr)
+		le.PutUint32(h[36:], sectionFlags)
+		copy(out.Bytes()[tableEnd+i*sectionHeaderSize:], h)
+
+		nextVA += uint32(len(s.Data))
+		initializedData += rawSize
+	}
+
+	data = out.Bytes()
+	le.PutUint16(data[coff+2:], uint16(numSections+len(sections)))
+	le.PutUint32(data[opt+optSizeOfInitializedData:], le.Uint32(data[opt+optSizeOfInitializedData:])+initializedData)
+	le.PutUint32(data[opt+optSizeOfImage:], alignUp(nextVA, sectionAlignment))
+	le.PutUint32(data[opt+optCheckSum:], checksum(data, opt+optCheckSum))
+	return data, nil
+}
+
+// growHeaders inserts delta bytes at offset firstRaw, where the data of the first section starts, and updates the file
+// offsets of the image pointing past it
+func growHeaders(data []byte, opt, table, numSections int, firstRaw, delta uint32) ([]byte, error) {
+	le := binary.LittleEndian
+	grown := make([]byte, 0, len(data)+int(delta))
+	grown = append(grown, data[:firstRaw]...)
+	grown = append(grown, make([]byte, delta)...)
+	grown = append(grown, data[firstRaw:]...)
+
+	moved := func(offset []byte) {
+		if v := le.Uint32(offset); v >= firstRaw {
+			le.PutUint32(offset, v+delta)
+		}
+	}
+	for i := 0; i < numSections; i++ {
+		h := grown[table+i*sectionHeaderSize:]
+		if le.Uint32(h[16:]) > 0 {
+			moved(h[20:])
+		}
+	}
+	// The COFF symbol table, before the optional header
+	if symbols := grown[opt-coffHeaderSize+8:]; le.Uint32(symbols) != 0 {
+		moved(symbols)
+	}
+
+	// The debug directory entries point to their data with file offsets too
+	if int(le.Uint32(grown[opt+optNumberOfRvaAndSizes:])) <= debugDirectory {
+		return grown, nil
+	}
+	dir := grown[opt+optDataDirectories+debugDirectory*8:]
+	rva, size := le.Uint32(dir), le.Uint32(dir[4:])
+	if size == 0 {
+		return grown, nil
+	}
+	for i := 0; i < numSections; i++ {
+		h := grown[table+i*sectionHeaderSize:]
+		va, rawSize, rawPtr := le.Uint32(h[12:]), le.Uint32(h[16:]), le.Uint32(h[20:])
+		if rva < va || rva+size > va+rawSize {
+			continue
+		}
+		entries := grown[rawPtr+rva-va : rawPtr+rva-va+size]
+		for e := 0; e+debugDirectorySize <= len(entries); e += debugDirectorySize {
+			if le.Uint32(entries[e+debugPointerToRawData:]) != 0 {
+				moved(entries[e+debugPointerToRawData:])
+			}
+		}
+		return grown, nil
+	}
+	return nil, fmt.Errorf("the debug directory is not in any section")
+}
+
+// checksum returns the PE image checksum, skipping the checksum field itself at the given offset
+func checksum(data []byte, offset int) uint32 {
+	var sum uint64
+	for i := 0; i < len(data); i += 2 {
+		if i == offset || i == offset+2 {
+			continue
+		}
+		word := uint64(data[i])
+		if i+1 < len(data) {
+			word |= uint64(data[i+1]) << 8
+		}
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return uint32(sum) + uint32(len(data))
+}
+
+func alignUp(v, alignment uint32) uint32 {
+	return (v + alignment - 1) / alignment * alignment
+}
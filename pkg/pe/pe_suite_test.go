@@ -0,0 +1,13 @@
+package pe_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPESuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "pe test suite")
+}
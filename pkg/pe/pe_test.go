@@ -0,0 +1,184 @@
+package pe_test
+
+import (
+	"bytes"
+	debugpe "debug/pe"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/kairos-io/enki/pkg/pe"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// peImage returns a minimal PE32+ image with a single .text section, with room in its headers for 16 more sections
+func peImage() []byte {
+	le := binary.LittleEndian
+	data := make([]byte, 0x600)
+	copy(data, "MZ")
+	le.PutUint32(data[0x3c:], 0x40)
+	copy(data[0x40:], "PE\x00\x00")
+	coff := data[0x44:]
+	le.PutUint16(coff[0:], debugpe.IMAGE_FILE_MACHINE_AMD64)
+	le.PutUint16(coff[2:], 1)
+	le.PutUint16(coff[16:], 240)
+	le.PutUint16(coff[18:], debugpe.IMAGE_FILE_EXECUTABLE_IMAGE)
+	opt := data[0x58:]
+	le.PutUint16(opt[0:], 0x20b)
+	le.PutUint32(opt[4:], 0x200)
+	le.PutUint32(opt[16:], 0x1000)
+	le.PutUint64(opt[24:], 0x10000000)
+	le.PutUint32(opt[32:], 0x1000)
+	le.PutUint32(opt[36:], 0x200)
+	le.PutUint32(opt[56:], 0x2000)
+	le.PutUint32(opt[60:], 0x400)
+	le.PutUint16(opt[68:], 10)
+	le.PutUint32(opt[108:], 16)
+	section := data[0x58+240:]
+	copy(section, ".text")
+	le.PutUint32(section[8:], 4)
+	le.PutUint32(section[12:], 0x1000)
+	le.PutUint32(section[16:], 0x200)
+	le.PutUint32(section[20:], 0x400)
+	le.PutUint32(section[36:], debugpe.IMAGE_SCN_CNT_CODE|debugpe.IMAGE_SCN_MEM_EXECUTE|debugpe.IMAGE_SCN_MEM_READ)
+	copy(data[0x400:], []byte{0xc3, 0x90, 0x90, 0x90})
+	return data
+}
+
+var _ = Describe("pe", Label("pe"), func() {
+	var tmpDir, input, output string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "enki-pe-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpDir)
+		input = filepath.Join(tmpDir, "stub.efi")
+		output = filepath.Join(tmpDir, "uki.efi")
+		Expect(os.WriteFile(input, peImage(), 0644)).To(Succeed())
+	})
+
+	It("appends sections after the last one", func() {
+		profile := []byte("ID=debug\nTITLE=Debug\n")
+		cmdline := bytes.Repeat([]byte("a"), 0x1100)
+		Expect(pe.AddSections(input, output, []pe.Section{
+			{Name: ".profile", Data: profile},
+			{Name: ".cmdline", Data: cmdline},
+		})).To(Succeed())
+
+		f, err := debugpe.Open(output)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(f.Sections).To(HaveLen(3))
+		Expect(f.Sections[1].VirtualAddress).To(Equal(uint32(0x2000)))
+		Expect(f.Sections[2].VirtualAddress).To(Equal(uint32(0x3000)))
+		Expect(f.OptionalHeader.(*debugpe.OptionalHeader64).SizeOfImage).To(Equal(uint32(0x5000)))
+
+		sections, err := pe.Sections(output)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sections).To(Equal([]pe.Section{
+			{Name: ".text", Data: []byte{0xc3, 0x90, 0x90, 0x90}},
+			{Name: ".profile", Data: profile},
+			{Name: ".cmdline", Data: cmdline},
+		}))
+
+		data, err := os.ReadFile(output)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = authenticode.Parse(bytes.NewReader(data))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("moves the sections to make room in the headers", func() {
+		sections := make([]pe.Section, 20)
+		for i := range sections {
+			sections[i] = pe.Section{Name: fmt.Sprintf(".s%d", i), Data: []byte{byte(i)}}
+		}
+		Expect(pe.AddSections(input, output, sections)).To(Succeed())
+
+		f, err := debugpe.Open(output)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(f.Sections).To(HaveLen(21))
+		Expect(f.Sections[0].VirtualAddress).To(Equal(uint32(0x1000)))
+		Expect(f.Sections[0].Offset).To(Equal(uint32(0x600)))
+		Expect(f.OptionalHeader.(*debugpe.OptionalHeader64).SizeOfHeaders).To(Equal(uint32(0x600)))
+
+		read, err := pe.Sections(output)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read[0].Data).To(Equal([]byte{0xc3, 0x90, 0x90, 0x90}))
+		Expect(read[1:]).To(Equal(sections))
+	})
+
+	It("fails without room before the first section", func() {
+		sections := make([]pe.Section, 100)
+		for i := range sections {
+			sections[i] = pe.Section{Name: ".cmdline", Data: []byte("a")}
+		}
+		Expect(pe.AddSections(input, output, sections)).To(MatchError(ContainSubstring("not enough space")))
+		_, err := os.Stat(output)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("replaces the sections after the kept ones", func() {
+		Expect(pe.AddSections(input, output, []pe.Section{
+			{Name: ".profile", Data: []byte("ID=debug\n")},
+			{Name: ".cmdline", Data: []byte("rd.debug")},
+		})).To(Succeed())
+		replaced := filepath.Join(tmpDir, "replaced.efi")
+		Expect(pe.ReplaceSections(output, replaced, 1, []pe.Section{
+			{Name: ".pcrpkey", Data: []byte("key")},
+			{Name: ".profile", Data: []byte("ID=debug\n")},
+		})).To(Succeed())
+
+		sections, err := pe.Sections(replaced)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sections).To(Equal([]pe.Section{
+			{Name: ".text", Data: []byte{0xc3, 0x90, 0x90, 0x90}},
+			{Name: ".pcrpkey", Data: []byte("key")},
+			{Name: ".profile", Data: []byte("ID=debug\n")},
+		}))
+		f, err := debugpe.Open(replaced)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(f.Sections[1].VirtualAddress).To(Equal(uint32(0x2000)))
+		Expect(f.OptionalHeader.(*debugpe.OptionalHeader64).SizeOfImage).To(Equal(uint32(0x4000)))
+
+		Expect(pe.ReplaceSections(output, replaced, 4, nil)).ToNot(Succeed())
+	})
+
+	It("rewrites a section after the last one", func() {
+		Expect(pe.AddSections(input, output, []pe.Section{
+			{Name: ".sbat", Data: []byte("sbat,1\n")},
+			{Name: ".osrel", Data: []byte("ID=kairos\n")},
+		})).To(Succeed())
+		rewritten := filepath.Join(tmpDir, "rewritten.efi")
+		Expect(pe.RewriteSection(output, rewritten, ".sbat", []byte("sbat,1\nkairos,2\n"))).To(Succeed())
+
+		sections, err := pe.Sections(rewritten)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sections).To(Equal([]pe.Section{
+			{Name: ".text", Data: []byte{0xc3, 0x90, 0x90, 0x90}},
+			{Name: ".osrel", Data: []byte("ID=kairos\n")},
+			{Name: ".sbat", Data: []byte("sbat,1\nkairos,2\n")},
+		}))
+		f, err := debugpe.Open(rewritten)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		// The other sections keep their addresses
+		Expect(f.Sections[1].VirtualAddress).To(Equal(uint32(0x3000)))
+		Expect(f.Sections[2].VirtualAddress).To(Equal(uint32(0x4000)))
+
+		Expect(pe.RewriteSection(output, rewritten, ".pcrsig", nil)).To(MatchError(ContainSubstring("no .pcrsig section")))
+	})
+
+	It("fails with signed images", func() {
+		data := peImage()
+		binary.LittleEndian.PutUint32(data[0x58+112+4*8:], 0x600)
+		binary.LittleEndian.PutUint32(data[0x58+112+4*8+4:], 0x100)
+		Expect(os.WriteFile(input, data, 0644)).To(Succeed())
+		Expect(pe.AddSections(input, output, []pe.Section{{Name: ".cmdline"}})).To(MatchError(ContainSubstring("signed")))
+	})
+})
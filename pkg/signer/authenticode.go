@@ -0,0 +1,183 @@
+package signer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	encasn1 "encoding/asn1"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/pkcs7"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// oidSignatureECDSAWithSHA256 is the ecdsa-with-SHA256 algorithm of the signatures made with EC keys
+var oidSignatureECDSAWithSHA256 = encasn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+// PESigner adds Authenticode signatures to EFI files, like the pesign.Signer of go-ukify but with the signing time of
+// the signatures set by the caller, so the signed files are reproducible
+type PESigner struct {
+	signer crypto.Signer
+	cert   *x509.Certificate
+	// SigningTime is the signing time attribute of the signatures, the current time if it is zero
+	SigningTime time.Time
+}
+
+// Sign writes to output the EFI file at input with a signature appended
+func (s *PESigner) Sign(input, output string) error {
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	bin, err := authenticode.Parse(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", input, err)
+	}
+	// Files already signed with the certificate are kept as they are, like pesign.Signer does
+	if VerifyPE(bin, s.cert) {
+		return os.WriteFile(output, data, info.Mode())
+	}
+	digest := sha256.Sum256(bin.HashContent.Bytes())
+	content, err := authenticode.CreateSpcIndirectDataContent(digest[:], crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	signingTime := s.SigningTime
+	if signingTime.IsZero() {
+		signingTime = time.Now()
+	}
+	sig, err := s.signPKCS7(content, signingTime.UTC())
+	if err != nil {
+		return fmt.Errorf("signing %s: %w", input, err)
+	}
+	if err := bin.AppendSignature(sig); err != nil {
+		return fmt.Errorf("appending the signature to %s: %w", input, err)
+	}
+	return os.WriteFile(output, bin.Bytes(), info.Mode())
+}
+
+// VerifyPE returns whether the EFI file has a signature made with the key of the certificate
+func VerifyPE(bin *authenticode.PECOFFBinary, cert *x509.Certificate) bool {
+	sigs, err := bin.Signatures()
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256(bin.HashContent.Bytes())
+	for _, sig := range sigs {
+		auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err == nil && VerifyAuthenticode(auth, digest[:], cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyAuthenticode returns whether the Authenticode signature is the one of a file with the given SHA256 digest, made
+// with the key of the certificate. Unlike Authenticode.Verify, it accepts signatures made with EC keys too.
+func VerifyAuthenticode(auth *authenticode.Authenticode, digest []byte, cert *x509.Certificate) bool {
+	if !auth.Algid.Algorithm.Equal(pkcs7.OIDDigestAlgorithmSHA256) || !bytes.Equal(auth.Digest, digest) {
+		return false
+	}
+	for _, si := range auth.Pkcs.SignerInfo {
+		if !bytes.Equal(si.IssuerAndSerialnumber.RawIssuer, cert.RawIssuer) || si.IssuerAndSerialnumber.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			continue
+		}
+		algorithm := x509.SHA256WithRSA
+		if si.EncryptedDigestAlgorithm.Algorithm.Equal(oidSignatureECDSAWithSHA256) {
+			algorithm = x509.ECDSAWithSHA256
+		}
+		if cert.CheckSignature(algorithm, si.AuthenticatedAttributes.Marshal(), si.EncryptedDigest) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// signPKCS7 returns the PKCS#7 SignedData of the SpcIndirectDataContent, as pkcs7.SignPKCS7 builds it but with the
+// given signing time and with EC keys too. RSA PKCS#1 v1.5 signatures are deterministic, so is the result with RSA keys.
+func (s *PESigner) signPKCS7(content []byte, signingTime time.Time) ([]byte, error) {
+	digest := sha256.Sum256(content)
+	attrs := (&pkcs7.Attributes{
+		ContentType:   authenticode.OIDSpcIndirectDataContent,
+		MessageDigest: digest[:],
+		SigningTime:   signingTime,
+	}).Marshal()
+	attrsDigest := sha256.Sum256(attrs)
+	sig, err := s.signer.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var b cryptobyte.Builder
+	// ContentInfo
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(pkcs7.OIDSignedData)
+		b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+			// SignedData
+			b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				b.AddASN1Int64(1)
+				b.AddASN1(asn1.SET, func(b *cryptobyte.Builder) {
+					addSHA256Algorithm(b)
+				})
+				b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(authenticode.OIDSpcIndirectDataContent)
+					b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+						b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddBytes(content)
+						})
+					})
+				})
+				b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+					b.AddBytes(s.cert.Raw)
+				})
+				// SignerInfos, with the only signer of Authenticode
+				b.AddASN1(asn1.SET, func(b *cryptobyte.Builder) {
+					b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+						b.AddASN1Int64(1)
+						b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddBytes(s.cert.RawIssuer)
+							b.AddASN1BigInt(s.cert.SerialNumber)
+						})
+						addSHA256Algorithm(b)
+						// The authenticated attributes are the SET marshalled above, with an implicit tag instead
+						b.AddASN1(asn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+							outer := cryptobyte.String(attrs)
+							var inner cryptobyte.String
+							outer.ReadASN1(&inner, asn1.SET)
+							b.AddBytes(inner)
+						})
+						b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							switch s.signer.Public().(type) {
+							case *ecdsa.PublicKey:
+								b.AddASN1ObjectIdentifier(oidSignatureECDSAWithSHA256)
+							default:
+								b.AddASN1ObjectIdentifier(pkcs7.OIDEncryptionAlgorithmRSA)
+								b.AddASN1NULL()
+							}
+						})
+						b.AddASN1OctetString(sig)
+					})
+				})
+			})
+		})
+	})
+	return b.Bytes()
+}
+
+func addSHA256Algorithm(b *cryptobyte.Builder) {
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(pkcs7.OIDDigestAlgorithmSHA256)
+		b.AddASN1NULL()
+	})
+}
@@ -0,0 +1,320 @@
+// Package signer loads the private keys enki signs with, either from PEM files or from PKCS#11 tokens like HSMs.
+//
+// Keys in PKCS#11 tokens are given as RFC 7512 URIs, like "pkcs11:token=kairos;object=db;pin-source=/run/pin", and
+// never leave the token: every signature is made by OpenSSL, through the engine or provider of the key source, the
+// same way systemd-repart does with its --private-key-source option. The PKCS#11 module to load is set in the OpenSSL
+// configuration, or with the module-path attribute of the URI for the engine.
+package signer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	ukiTypes "github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// uriScheme is the scheme of the PKCS#11 URIs
+const uriScheme = "pkcs11:"
+
+// IsPKCS11URI returns whether the key is a PKCS#11 URI instead of a file
+func IsPKCS11URI(key string) bool {
+	return strings.HasPrefix(key, uriScheme)
+}
+
+// ParseKeySource returns the kind, engine or provider, and the name of an OpenSSL key source like "provider:pkcs11"
+func ParseKeySource(source string) (string, string, error) {
+	kind, name, found := strings.Cut(source, ":")
+	if !found || name == "" || (kind != "engine" && kind != "provider") {
+		return "", "", fmt.Errorf("invalid private key source %q, it must be engine:NAME or provider:NAME", source)
+	}
+	return kind, name, nil
+}
+
+// Load returns the signer of the given key, a PEM file or a PKCS#11 URI loaded with the given OpenSSL key source
+func Load(key, source string) (crypto.Signer, error) {
+	if IsPKCS11URI(key) {
+		return loadOpenSSLKey(key, source)
+	}
+	data, err := os.ReadFile(key)
+	if err != nil {
+		return nil, fmt.Errorf("reading private key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", key)
+	}
+	var parsed any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key %s: %w", key, err)
+	}
+	s, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type in %s", key)
+	}
+	return s, nil
+}
+
+// SecureBoot returns the signer of the EFI files with the given db certificate file and key
+func SecureBoot(cert, key, source string) (*PESigner, error) {
+	s, err := Load(key, source)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ReadCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeysEqual(c.PublicKey, s.Public()) {
+		return nil, fmt.Errorf("the private key %s does not match the certificate %s", key, cert)
+	}
+	switch s.Public().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("the secure boot key %s is not an RSA or EC key", key)
+	}
+	return &PESigner{signer: s, cert: c}, nil
+}
+
+// PCR returns the signer of the PCR policies with the given key, which must be an RSA one
+func PCR(key, source string) (ukiTypes.RSAKey, error) {
+	s, err := Load(key, source)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := s.Public().(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the PCR policy key %s is not an RSA key", key)
+	}
+	return rsaSigner{Signer: s, public: public}, nil
+}
+
+// PCRPolicy is a key signing the PCR 11 policies of the UKI files for some phase paths, like a --pcr-private-key
+// option of ukify along with its --phases option
+type PCRPolicy struct {
+	Key ukiTypes.RSAKey
+	// Phases are the phase paths a policy is signed for, each one the boot phases measured in order before the
+	// policy is checked
+	Phases [][]ukiTypes.PhaseInfo
+}
+
+// DefaultPhases returns the phase paths systemd-measure signs by default, one after every ordered boot phase
+func DefaultPhases() [][]ukiTypes.PhaseInfo {
+	phases := ukiTypes.OrderedPhases()
+	var paths [][]ukiTypes.PhaseInfo
+	for i := range phases {
+		paths = append(paths, phases[:i+1])
+	}
+	return paths
+}
+
+// ParsePhases parses a comma separated list of phase paths, with the phases of each path separated by colons, like
+// "enter-initrd,enter-initrd:leave-initrd"
+func ParsePhases(list string) ([][]ukiTypes.PhaseInfo, error) {
+	var paths [][]ukiTypes.PhaseInfo
+	for _, path := range strings.Split(list, ",") {
+		var phases []ukiTypes.PhaseInfo
+		for _, name := range strings.Split(strings.TrimSpace(path), ":") {
+			i := slices.IndexFunc(ukiTypes.OrderedPhases(), func(p ukiTypes.PhaseInfo) bool { return string(p.Phase) == name })
+			if i < 0 {
+				return nil, fmt.Errorf("invalid phase %q in %q, it must be one of %s", name, list, ukiTypes.PhasesToString(ukiTypes.OrderedPhases()))
+			}
+			phases = append(phases, ukiTypes.OrderedPhases()[i])
+		}
+		paths = append(paths, phases)
+	}
+	return paths, nil
+}
+
+// CheckPCRPhases checks the phase paths of the PCR policy keys, as given to PCRPolicies
+func CheckPCRPhases(keys, phases []string) error {
+	if len(phases) > max(len(keys), 1) {
+		return fmt.Errorf("there are %d PCR phase lists for %d PCR keys", len(phases), max(len(keys), 1))
+	}
+	for _, p := range phases {
+		if _, err := ParsePhases(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PCRPolicies returns the PCR policy signers of the given keys, each signing the phase paths at the same position of
+// phases, or the default ones if there are none
+func PCRPolicies(keys, phases []string, source string) ([]PCRPolicy, error) {
+	if err := CheckPCRPhases(keys, phases); err != nil {
+		return nil, err
+	}
+	var policies []PCRPolicy
+	for i, key := range keys {
+		s, err := PCR(key, source)
+		if err != nil {
+			return nil, err
+		}
+		policy := PCRPolicy{Key: s, Phases: DefaultPhases()}
+		if i < len(phases) {
+			policy.Phases, _ = ParsePhases(phases[i])
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// rsaSigner implements ukiTypes.RSAKey
+type rsaSigner struct {
+	crypto.Signer
+	public *rsa.PublicKey
+}
+
+func (r rsaSigner) PublicRSAKey() *rsa.PublicKey {
+	return r.public
+}
+
+// ReadCertificate reads the certificate in the file, PEM or DER encoded
+func ReadCertificate(file string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading certificate: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate %s: %w", file, err)
+	}
+	return cert, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+// openSSLKey is a key in a PKCS#11 token, which signs by running OpenSSL
+type openSSLKey struct {
+	uri    string
+	source []string
+	public crypto.PublicKey
+}
+
+func loadOpenSSLKey(uri, source string) (*openSSLKey, error) {
+	kind, name, err := ParseKeySource(source)
+	if err != nil {
+		return nil, err
+	}
+	k := &openSSLKey{uri: uri}
+	if kind == "engine" {
+		k.source = []string{"-engine", name, "-keyform", "engine"}
+	} else {
+		// The default provider is still needed for the digests and the encoders
+		k.source = []string{"-provider", name, "-provider", "default"}
+	}
+
+	pkeyArgs := []string{"pkey", "-in", uri, "-pubout", "-outform", "DER"}
+	if kind == "engine" {
+		pkeyArgs = append(pkeyArgs, "-engine", name, "-inform", "engine")
+	} else {
+		pkeyArgs = append(pkeyArgs, k.source...)
+	}
+	der, err := openssl(nil, pkeyArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("reading the public key of %s: %w", uri, err)
+	}
+	if k.public, err = x509.ParsePKIXPublicKey(der); err != nil {
+		return nil, fmt.Errorf("parsing the public key of %s: %w", uri, err)
+	}
+	return k, nil
+}
+
+func (k *openSSLKey) Public() crypto.PublicKey {
+	return k.public
+}
+
+// Sign signs the digest with OpenSSL, which adds the DigestInfo and the padding for RSA keys
+func (k *openSSLKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	args := append([]string{"pkeyutl", "-sign", "-inkey", k.uri}, k.source...)
+	if h := opts.HashFunc(); h != 0 {
+		name, err := digestName(h)
+		if err != nil {
+			return nil, err
+		}
+		if len(digest) != h.Size() {
+			return nil, fmt.Errorf("the digest size does not match %s", name)
+		}
+		args = append(args, "-pkeyopt", "digest:"+name)
+	}
+	switch key := k.public.(type) {
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			args = append(args, "-pkeyopt", "rsa_padding_mode:pss", "-pkeyopt", "rsa_pss_saltlen:"+pssSaltLength(pss))
+		} else {
+			args = append(args, "-pkeyopt", "rsa_padding_mode:pkcs1")
+		}
+	case *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	sig, err := openssl(digest, args...)
+	if err != nil {
+		return nil, fmt.Errorf("signing with %s: %w", k.uri, err)
+	}
+	return sig, nil
+}
+
+func digestName(h crypto.Hash) (string, error) {
+	switch h {
+	case crypto.SHA1:
+		return "sha1", nil
+	case crypto.SHA256:
+		return "sha256", nil
+	case crypto.SHA384:
+		return "sha384", nil
+	case crypto.SHA512:
+		return "sha512", nil
+	}
+	return "", fmt.Errorf("unsupported digest %s", h)
+}
+
+// pssSaltLength returns the rsa_pss_saltlen option with the salt length of the PSS options
+func pssSaltLength(opts *rsa.PSSOptions) string {
+	switch opts.SaltLength {
+	case rsa.PSSSaltLengthAuto:
+		return "max"
+	case rsa.PSSSaltLengthEqualsHash:
+		return "digest"
+	default:
+		return strconv.Itoa(opts.SaltLength)
+	}
+}
+
+// openssl runs openssl with the given args and stdin, returning its stdout
+func openssl(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("openssl", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,13 @@
+package signer_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSignerSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "signer test suite")
+}
@@ -0,0 +1,299 @@
+package signer_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	debugpe "debug/pe"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/kairos-io/enki/pkg/signer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// softHSMModules are the paths the SoftHSM PKCS#11 module is installed at by the distributions
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+}
+
+func writeKey(dir, name string, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	file := filepath.Join(dir, name)
+	Expect(os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)).To(Succeed())
+	return file
+}
+
+func writeCert(dir, name string, key crypto.Signer) string {
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	Expect(err).ToNot(HaveOccurred())
+	file := filepath.Join(dir, name)
+	Expect(os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)).To(Succeed())
+	return file
+}
+
+// efiImage returns a minimal PE32+ EFI file with a .text section
+func efiImage() []byte {
+	le := binary.LittleEndian
+	data := make([]byte, 0x600)
+	copy(data, "MZ")
+	le.PutUint32(data[0x3c:], 0x40)
+	copy(data[0x40:], "PE\x00\x00")
+	coff := data[0x44:]
+	le.PutUint16(coff[0:], debugpe.IMAGE_FILE_MACHINE_AMD64)
+	le.PutUint16(coff[2:], 1)
+	le.PutUint16(coff[16:], 240)
+	le.PutUint16(coff[18:], debugpe.IMAGE_FILE_EXECUTABLE_IMAGE)
+	opt := data[0x58:]
+	le.PutUint16(opt[0:], 0x20b)
+	le.PutUint32(opt[16:], 0x1000)
+	le.PutUint32(opt[32:], 0x1000)
+	le.PutUint32(opt[36:], 0x200)
+	le.PutUint32(opt[56:], 0x2000)
+	le.PutUint32(opt[60:], 0x400)
+	le.PutUint16(opt[68:], 10)
+	le.PutUint32(opt[108:], 16)
+	section := data[0x58+240:]
+	copy(section, ".text")
+	le.PutUint32(section[8:], 4)
+	le.PutUint32(section[12:], 0x1000)
+	le.PutUint32(section[16:], 0x200)
+	le.PutUint32(section[20:], 0x400)
+	le.PutUint32(section[36:], debugpe.IMAGE_SCN_CNT_CODE|debugpe.IMAGE_SCN_MEM_EXECUTE|debugpe.IMAGE_SCN_MEM_READ)
+	copy(data[0x400:], []byte{0xc3, 0x90, 0x90, 0x90})
+	return data
+}
+
+var _ = Describe("signer", Label("signer"), func() {
+	var tmpDir string
+	var rsaKey *rsa.PrivateKey
+	var ecKey *ecdsa.PrivateKey
+	digest := sha256.Sum256([]byte("kairos"))
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "enki-signer-test-")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmpDir)
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("loads PKCS#1 and PKCS#8 key files", func() {
+		pkcs1 := filepath.Join(tmpDir, "pkcs1.pem")
+		Expect(os.WriteFile(pkcs1, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600)).To(Succeed())
+		for _, file := range []string{pkcs1, writeKey(tmpDir, "pkcs8.pem", rsaKey)} {
+			s, err := signer.Load(file, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rsaKey.PublicKey.Equal(s.Public())).To(BeTrue())
+		}
+	})
+
+	It("fails to load files without a key", func() {
+		file := filepath.Join(tmpDir, "empty.pem")
+		Expect(os.WriteFile(file, []byte("not a key"), 0600)).To(Succeed())
+		_, err := signer.Load(file, "")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("checks the key matches the secure boot certificate", func() {
+		cert := writeCert(tmpDir, "db.pem", rsaKey)
+		_, err := signer.SecureBoot(cert, writeKey(tmpDir, "db.key", rsaKey), "")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = signer.SecureBoot(cert, writeKey(tmpDir, "other.key", ecKey), "")
+		Expect(err).To(MatchError(ContainSubstring("does not match")))
+	})
+
+	It("signs EFI files with RSA and EC keys", func() {
+		input := filepath.Join(tmpDir, "input.efi")
+		Expect(os.WriteFile(input, efiImage(), 0644)).To(Succeed())
+		for name, key := range map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey} {
+			s, err := signer.SecureBoot(writeCert(tmpDir, name+".pem", key), writeKey(tmpDir, name+".key", key), "")
+			Expect(err).ToNot(HaveOccurred(), name)
+			output := filepath.Join(tmpDir, name+".efi")
+			Expect(s.Sign(input, output)).To(Succeed(), name)
+
+			cert, err := signer.ReadCertificate(filepath.Join(tmpDir, name+".pem"))
+			Expect(err).ToNot(HaveOccurred())
+			data, err := os.ReadFile(output)
+			Expect(err).ToNot(HaveOccurred())
+			bin, err := authenticode.Parse(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.VerifyPE(bin, cert)).To(BeTrue(), name)
+			sigs, err := bin.Signatures()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sigs).To(HaveLen(1), name)
+
+			// Signing it again keeps the existing signature
+			Expect(s.Sign(output, output)).To(Succeed(), name)
+			Expect(os.ReadFile(output)).To(Equal(data), name)
+		}
+
+		By("telling the RSA and EC signatures apart")
+		rsaCert, err := signer.ReadCertificate(filepath.Join(tmpDir, "rsa.pem"))
+		Expect(err).ToNot(HaveOccurred())
+		data, err := os.ReadFile(filepath.Join(tmpDir, "ec.efi"))
+		Expect(err).ToNot(HaveOccurred())
+		bin, err := authenticode.Parse(bytes.NewReader(data))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signer.VerifyPE(bin, rsaCert)).To(BeFalse())
+		sigs, err := bin.Signatures()
+		Expect(err).ToNot(HaveOccurred())
+		auth, err := authenticode.ParseAuthenticode(sigs[0].Certificate)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(auth.Pkcs.SignerInfo[0].EncryptedDigestAlgorithm.Algorithm.String()).To(Equal("1.2.840.10045.4.3.2"))
+	})
+
+	It("only accepts RSA and EC keys for secure boot", func() {
+		_, edKey, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = signer.SecureBoot(writeCert(tmpDir, "ed.pem", edKey), writeKey(tmpDir, "ed.key", edKey), "")
+		Expect(err).To(MatchError(ContainSubstring("not an RSA or EC key")))
+	})
+
+	It("only accepts RSA keys for the PCR policies", func() {
+		s, err := signer.PCR(writeKey(tmpDir, "pcr.pem", rsaKey), "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.PublicRSAKey().Equal(&rsaKey.PublicKey)).To(BeTrue())
+		_, err = signer.PCR(writeKey(tmpDir, "ec.pem", ecKey), "")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("parses the key sources", func() {
+		kind, name, err := signer.ParseKeySource("engine:pkcs11")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(kind).To(Equal("engine"))
+		Expect(name).To(Equal("pkcs11"))
+		for _, source := range []string{"", "pkcs11", "provider:", "module:pkcs11"} {
+			_, _, err = signer.ParseKeySource(source)
+			Expect(err).To(HaveOccurred(), source)
+		}
+		_, err = signer.Load("pkcs11:object=db", "pkcs11")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("parses the PCR phase paths", func() {
+		paths, err := signer.ParsePhases("enter-initrd, enter-initrd:leave-initrd")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(paths).To(Equal(signer.DefaultPhases()[:2]))
+		Expect(signer.DefaultPhases()).To(HaveLen(4))
+		for _, phases := range []string{"", "enter-initrd,", "enter-initrd:shutdown"} {
+			_, err = signer.ParsePhases(phases)
+			Expect(err).To(HaveOccurred(), phases)
+		}
+	})
+
+	It("pairs the PCR keys with their phases", func() {
+		key := writeKey(tmpDir, "pcr.pem", rsaKey)
+		policies, err := signer.PCRPolicies([]string{key, key}, []string{"enter-initrd"}, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(policies).To(HaveLen(2))
+		Expect(policies[0].Phases).To(Equal(signer.DefaultPhases()[:1]))
+		Expect(policies[1].Phases).To(Equal(signer.DefaultPhases()))
+		_, err = signer.PCRPolicies([]string{key}, []string{"enter-initrd", "enter-initrd"}, "")
+		Expect(err).To(MatchError(ContainSubstring("2 PCR phase lists for 1 PCR keys")))
+	})
+
+	// Set ENKI_TEST_PKCS11_SOURCE to the OpenSSL key source to test, provider:pkcs11 by default. The test is skipped
+	// if SoftHSM or the OpenSSL PKCS#11 engine or provider are not installed.
+	Describe("PKCS#11", Label("pkcs11"), func() {
+		var source, module string
+
+		BeforeEach(func() {
+			source = os.Getenv("ENKI_TEST_PKCS11_SOURCE")
+			if source == "" {
+				source = "provider:pkcs11"
+			}
+			kind, name, err := signer.ParseKeySource(source)
+			Expect(err).ToNot(HaveOccurred())
+			for _, m := range softHSMModules {
+				if _, err := os.Stat(m); err == nil {
+					module = m
+				}
+			}
+			if _, err := exec.LookPath("softhsm2-util"); err != nil || module == "" {
+				Skip("SoftHSM is not installed")
+			}
+			check := exec.Command("openssl", "list", "-providers", "-provider", name)
+			if kind == "engine" {
+				check = exec.Command("openssl", "engine", name)
+			}
+			if err := check.Run(); err != nil {
+				Skip(fmt.Sprintf("the OpenSSL %s %s is not installed", kind, name))
+			}
+
+			conf := filepath.Join(tmpDir, "softhsm2.conf")
+			Expect(os.MkdirAll(filepath.Join(tmpDir, "tokens"), 0700)).To(Succeed())
+			Expect(os.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\n", filepath.Join(tmpDir, "tokens"))), 0600)).To(Succeed())
+			DeferCleanup(os.Setenv, "SOFTHSM2_CONF", os.Getenv("SOFTHSM2_CONF"))
+			DeferCleanup(os.Setenv, "PKCS11_PROVIDER_MODULE", os.Getenv("PKCS11_PROVIDER_MODULE"))
+			Expect(os.Setenv("SOFTHSM2_CONF", conf)).To(Succeed())
+			Expect(os.Setenv("PKCS11_PROVIDER_MODULE", module)).To(Succeed())
+
+			out, err := exec.Command("softhsm2-util", "--init-token", "--free", "--label", "enki", "--pin", "1234", "--so-pin", "5678").CombinedOutput()
+			Expect(err).ToNot(HaveOccurred(), string(out))
+			for id, key := range map[string]crypto.Signer{"01": rsaKey, "02": ecKey} {
+				out, err = exec.Command("softhsm2-util", "--import", writeKey(tmpDir, id+".pem", key), "--token", "enki", "--label", "key"+id, "--id", id, "--pin", "1234").CombinedOutput()
+				Expect(err).ToNot(HaveOccurred(), string(out))
+			}
+		})
+
+		uri := func(object string) string {
+			return fmt.Sprintf("pkcs11:token=enki;object=%s;type=private?pin-value=1234&module-path=%s", object, module)
+		}
+
+		It("signs with RSA keys in the token", func() {
+			s, err := signer.Load(uri("key01"), source)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rsaKey.PublicKey.Equal(s.Public())).To(BeTrue())
+
+			sig, err := s.Sign(rand.Reader, digest[:], crypto.SHA256)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig)).To(Succeed())
+
+			pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			sig, err = s.Sign(rand.Reader, digest[:], pss)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig, pss)).To(Succeed())
+
+			cert := writeCert(tmpDir, "db.pem", rsaKey)
+			_, err = signer.SecureBoot(cert, uri("key01"), source)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("signs with EC keys in the token", func() {
+			s, err := signer.Load(uri("key02"), source)
+			Expect(err).ToNot(HaveOccurred())
+			sig, err := s.Sign(rand.Reader, digest[:], crypto.SHA256)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ecdsa.VerifyASN1(&ecKey.PublicKey, digest[:], sig)).To(BeTrue())
+		})
+
+		It("fails with a key not in the token", func() {
+			_, err := signer.Load(uri("missing"), source)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -2,7 +2,14 @@ package types
 
 import (
 	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/signer"
 	cfg "github.com/kairos-io/kairos-agent/v2/pkg/config"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 )
@@ -16,11 +23,211 @@ type LiveISO struct {
 	BootloaderInRootFs bool              `yaml:"bootloader-in-rootfs" mapstructure:"bootloader-in-rootfs"`
 }
 
+// BuildUKISpec represents the options to build UKI artifacts
+type BuildUKISpec struct {
+	// Image is the source image with the rootfs to build the UKI files from
+	Image         *v1.ImageSource `yaml:"image,omitempty" mapstructure:"image"`
+	OutputDir     string          `yaml:"output-dir,omitempty" mapstructure:"output-dir"`
+	OutputType    string          `yaml:"output-type,omitempty" mapstructure:"output-type"`
+	KeysDirectory string          `yaml:"keys,omitempty" mapstructure:"keys"`
+	// SecureBootKey is the db key the EFI files are signed with, a PEM file or a PKCS#11 URI. Defaults to the db.key
+	// file of the keys directory.
+	SecureBootKey string `yaml:"sb-key,omitempty" mapstructure:"sb-key"`
+	// PCRKeys are the keys the PCR policies are signed with, PEM files or PKCS#11 URIs. Defaults to the
+	// tpm2-pcr-private.pem file of the keys directory.
+	PCRKeys []string `yaml:"pcr-key,omitempty" mapstructure:"pcr-key"`
+	// PCRPhases are the phase paths every PCR key signs, like "enter-initrd,enter-initrd:leave-initrd", in the same
+	// order as the keys. Keys without phases sign the policies after every boot phase.
+	PCRPhases []string `yaml:"pcr-phases,omitempty" mapstructure:"pcr-phases"`
+	// PrivateKeySource is the OpenSSL engine or provider the PKCS#11 keys are used with, like "provider:pkcs11"
+	PrivateKeySource string `yaml:"private-key-source,omitempty" mapstructure:"private-key-source"`
+	// OverlayRootfs is a dir with files copied into the rootfs before building the initramfs
+	OverlayRootfs string `yaml:"overlay-rootfs,omitempty" mapstructure:"overlay-rootfs"`
+	// OverlayISO is a dir with files copied into the root of the ISO, only for the iso output type
+	OverlayISO   string `yaml:"overlay-iso,omitempty" mapstructure:"overlay-iso"`
+	BootBranding string `yaml:"boot-branding,omitempty" mapstructure:"boot-branding"`
+	// ExtraCmdlines adds one more UKI file for each value, with the value appended to the default cmdline
+	ExtraCmdlines []string `yaml:"extra-cmdline,omitempty" mapstructure:"extra-cmdline"`
+	// BootTries enables the boot counting of systemd-boot, so entries failing to boot this many times are marked as
+	// bad and the next one is booted. 0 disables it.
+	BootTries int `yaml:"boot-tries,omitempty" mapstructure:"boot-tries"`
+	// BootTriesEntries are glob patterns of the entry file names boot counting is enabled for, all if empty
+	BootTriesEntries []string `yaml:"boot-tries-entries,omitempty" mapstructure:"boot-tries-entries"`
+	// Entries are the boot entries, set in the manifest. They replace the ones from the cmdline options.
+	Entries []UkiEntry `yaml:"entries,omitempty" mapstructure:"entries"`
+	// SBAT are added to the SBAT entries of systemd-stub and systemd-boot in the generated EFI files, to revoke them
+	// by their generation
+	SBAT []SbatEntry `yaml:"sbat,omitempty" mapstructure:"sbat"`
+	// ExtendCmdline is appended to the default cmdline, instead of creating new UKI files
+	ExtendCmdline string `yaml:"extend-cmdline,omitempty" mapstructure:"extend-cmdline"`
+	// SingleEfiCmdlines adds one more UKI file for each value, with the syntax "Entry name: cmdline"
+	SingleEfiCmdlines      []string `yaml:"single-efi-cmdline,omitempty" mapstructure:"single-efi-cmdline"`
+	IncludeVersionInConfig bool     `yaml:"include-version-in-config,omitempty" mapstructure:"include-version-in-config"`
+	IncludeCmdlineInConfig bool     `yaml:"include-cmdline-in-config,omitempty" mapstructure:"include-cmdline-in-config"`
+	// DefaultEntry is the entry selected by default in systemd-boot, glob patterns are allowed
+	DefaultEntry     string `yaml:"default-entry,omitempty" mapstructure:"default-entry"`
+	EfiSizeWarn      int64  `yaml:"efi-size-warn,omitempty" mapstructure:"efi-size-warn"`
+	SecureBootEnroll string `yaml:"secure-boot-enroll,omitempty" mapstructure:"secure-boot-enroll"`
+	// LoaderTimeout is the timeout option of loader.conf, in seconds or one of menu-force, menu-hidden and menu-disabled
+	LoaderTimeout     string `yaml:"loader-timeout,omitempty" mapstructure:"loader-timeout"`
+	LoaderConsoleMode string `yaml:"loader-console-mode,omitempty" mapstructure:"loader-console-mode"`
+	// The boolean loader.conf options are only written if set, so the systemd-boot defaults apply otherwise
+	LoaderAutoEntries        *bool  `yaml:"loader-auto-entries,omitempty" mapstructure:"loader-auto-entries"`
+	LoaderAutoFirmware       *bool  `yaml:"loader-auto-firmware,omitempty" mapstructure:"loader-auto-firmware"`
+	LoaderBeep               *bool  `yaml:"loader-beep,omitempty" mapstructure:"loader-beep"`
+	LoaderRebootForBitlocker *bool  `yaml:"loader-reboot-for-bitlocker,omitempty" mapstructure:"loader-reboot-for-bitlocker"`
+	Splash                   string `yaml:"splash,omitempty" mapstructure:"splash"`
+	// MultiProfile builds a single UKI file with a profile for each boot entry, instead of a UKI file per entry
+	MultiProfile bool `yaml:"multi-profile,omitempty" mapstructure:"multi-profile"`
+	// Unsigned leaves the EFI files unsigned, along with a manifest to sign them later with enki sign
+	Unsigned bool `yaml:"unsigned,omitempty" mapstructure:"unsigned"`
+	// PCRPredict writes the expected PCR values of booting the UKI files as JSON next to the artifacts
+	PCRPredict bool `yaml:"pcr-predict,omitempty" mapstructure:"pcr-predict"`
+	// Workers is the number of UKI files built in parallel, 0 uses the number of CPUs up to UkiMaxDefaultWorkers
+	Workers int `yaml:"workers,omitempty" mapstructure:"workers"`
+	// InitrdCompression is the algorithm used to compress the initramfs embedded in the UKI files
+	InitrdCompression string `yaml:"initrd-compression,omitempty" mapstructure:"initrd-compression"`
+	// InitrdCompressionLevel is the compression level, 0 uses the default of the algorithm
+	InitrdCompressionLevel int `yaml:"initrd-compression-level,omitempty" mapstructure:"initrd-compression-level"`
+	// InitrdExcludes are glob patterns of rootfs paths left out of the initramfs
+	InitrdExcludes []string `yaml:"initrd-exclude,omitempty" mapstructure:"initrd-exclude"`
+	// InitrdIncludes are glob patterns of rootfs paths added to the initramfs even if they match an exclude pattern
+	InitrdIncludes []string `yaml:"initrd-include,omitempty" mapstructure:"initrd-include"`
+	// HardwareProfile is a file with the modules or modaliases of the target hardware, the kernel modules and firmware
+	// not needed by it are removed from the initramfs
+	HardwareProfile string `yaml:"hardware-profile,omitempty" mapstructure:"hardware-profile"`
+	// KeepFirmware are paths or globs relative to the firmware directory kept along with the hardware profile firmware
+	KeepFirmware []string `yaml:"keep-firmware,omitempty" mapstructure:"keep-firmware"`
+	// EspSize is the minimum size in megabytes of the EFI System Partition of the raw and qcow2 output types
+	EspSize int64 `yaml:"esp-size,omitempty" mapstructure:"esp-size"`
+	// OEMSize is the size in megabytes of the empty COS_OEM partition of the raw and qcow2 output types, 0 leaves it out
+	OEMSize int64 `yaml:"oem-size,omitempty" mapstructure:"oem-size"`
+	// ContainerCompression is the compression of the layer of the container output type
+	ContainerCompression string `yaml:"container-compression,omitempty" mapstructure:"container-compression"`
+	// ContainerFormat is the format the container output type is written in, a docker tarball or an OCI layout
+	ContainerFormat string `yaml:"container-format,omitempty" mapstructure:"container-format"`
+	// Push is an image reference the container output type is uploaded to, using the docker credentials
+	Push string `yaml:"push,omitempty" mapstructure:"push"`
+}
+
+// UkiEntry is a boot entry of the UKI artifacts, each one is a UKI file with its own cmdline
+type UkiEntry struct {
+	// Title is the name of the entry in the boot menu, the boot branding is used if empty
+	Title string `yaml:"title,omitempty" mapstructure:"title"`
+	// Cmdline is appended to the default cmdline
+	Cmdline string `yaml:"cmdline,omitempty" mapstructure:"cmdline"`
+	// FileName is the name of the efi and conf files of the entry, without extension. It is generated from the cmdline
+	// if empty.
+	FileName string `yaml:"file-name,omitempty" mapstructure:"file-name"`
+	SortKey  string `yaml:"sort-key,omitempty" mapstructure:"sort-key"`
+	// Default selects the entry by default in the boot menu
+	Default bool `yaml:"default,omitempty" mapstructure:"default"`
+	// Tries enables boot counting for the entry, overriding boot-tries
+	Tries int `yaml:"tries,omitempty" mapstructure:"tries"`
+}
+
+// SbatEntry is an entry of the .sbat section of an EFI file, checked by shim and systemd-boot against the revoked
+// generations in the SbatLevel variable
+type SbatEntry struct {
+	// Component is the name the generation applies to, like "kairos"
+	Component string `yaml:"component,omitempty" mapstructure:"component"`
+	// Generation is increased to revoke the EFI files with a lower one
+	Generation int    `yaml:"generation,omitempty" mapstructure:"generation"`
+	Vendor     string `yaml:"vendor,omitempty" mapstructure:"vendor"`
+	Package    string `yaml:"package,omitempty" mapstructure:"package"`
+	Version    string `yaml:"version,omitempty" mapstructure:"version"`
+	URL        string `yaml:"url,omitempty" mapstructure:"url"`
+}
+
+// ParseSbatEntry parses an SBAT CSV line, "component,generation,vendor,package,version,url"
+func ParseSbatEntry(line string) (SbatEntry, error) {
+	fields := strings.Split(strings.TrimSpace(line), ",")
+	if len(fields) != 6 {
+		return SbatEntry{}, fmt.Errorf("invalid SBAT entry %q, it must be component,generation,vendor,package,version,url", line)
+	}
+	generation, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return SbatEntry{}, fmt.Errorf("invalid generation in SBAT entry %q", line)
+	}
+	e := SbatEntry{Component: fields[0], Generation: generation, Vendor: fields[2], Package: fields[3], Version: fields[4], URL: fields[5]}
+	return e, e.Validate()
+}
+
+// CustomUnmarshal parses the entries given as CSV lines, like the ones of the --sbat flag
+func (e *SbatEntry) CustomUnmarshal(data interface{}) (bool, error) {
+	line, ok := data.(string)
+	if !ok {
+		return true, nil
+	}
+	entry, err := ParseSbatEntry(line)
+	if err != nil {
+		return false, err
+	}
+	*e = entry
+	return false, nil
+}
+
+// Validate checks the entry can be written as a CSV line, which has no quoting in SBAT
+func (e SbatEntry) Validate() error {
+	for _, f := range []string{e.Component, e.Vendor, e.Package, e.Version, e.URL} {
+		if f == "" || strings.ContainsAny(f, ",\"\n\r\x00") {
+			return fmt.Errorf("invalid SBAT entry %q, the fields must be set and not contain commas, quotes or newlines", e.String())
+		}
+	}
+	if e.Component == "sbat" {
+		return fmt.Errorf("the sbat SBAT entry is the version of the format and can not be set")
+	}
+	if e.Generation < 1 {
+		return fmt.Errorf("invalid generation in SBAT entry %q, it must be at least 1", e.String())
+	}
+	return nil
+}
+
+// String returns the entry as a CSV line of the .sbat section
+func (e SbatEntry) String() string {
+	return strings.Join([]string{e.Component, strconv.Itoa(e.Generation), e.Vendor, e.Package, e.Version, e.URL}, ",")
+}
+
+// SignSpec represents the options to sign EFI files
+type SignSpec struct {
+	// Paths are the EFI files to sign, or directories with the manifest of an unsigned build-uki
+	Paths         []string
+	KeysDirectory string
+	// SecureBootKey and SecureBootCert default to the db.key and db.pem files of the keys directory
+	SecureBootKey  string
+	SecureBootCert string
+	// PCRKeys default to the tpm2-pcr-private.pem file of the keys directory. If there is none, the PCR policies
+	// of the UKI files are not signed.
+	PCRKeys          []string
+	PCRPhases        []string
+	PrivateKeySource string
+}
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (s *SignSpec) Sanitize() error {
+	if len(s.Paths) == 0 {
+		return fmt.Errorf("no files to sign")
+	}
+	if s.KeysDirectory == "" && (s.SecureBootKey == "" || s.SecureBootCert == "") {
+		return fmt.Errorf("either the keys directory or the secure boot key and certificate must be set")
+	}
+	if _, _, err := signer.ParseKeySource(s.PrivateKeySource); err != nil {
+		return err
+	}
+	return signer.CheckPCRPhases(s.PCRKeys, s.PCRPhases)
+}
+
 // BuildConfig represents the config we need for building isos, raw images, artifacts
 type BuildConfig struct {
 	Date   bool   `yaml:"date,omitempty" mapstructure:"date"`
 	Name   string `yaml:"name,omitempty" mapstructure:"name"`
 	OutDir string `yaml:"output,omitempty" mapstructure:"output"`
+	// ISOBackend is the tool used to write ISO images, see constants.ISOBackends
+	ISOBackend string `yaml:"iso-backend,omitempty" mapstructure:"iso-backend"`
+	// SourceDateEpoch is the timestamp set on all the generated artifacts, read from the SOURCE_DATE_EPOCH
+	// environment variable. If zero, the build is not reproducible and the current time is used.
+	SourceDateEpoch time.Time `yaml:"-" mapstructure:"-"`
 
 	// 'inline' and 'squash' labels ensure config fields
 	// are embedded from a yaml and map PoV
@@ -48,3 +255,77 @@ func (i *LiveISO) Sanitize() error {
 
 	return nil
 }
+
+// Sanitize checks the consistency of the struct, returns error
+// if unsolvable inconsistencies are found
+func (u *BuildUKISpec) Sanitize() error {
+	if !slices.Contains(constants.OutPutTypes(), u.OutputType) {
+		return fmt.Errorf("invalid output type: %s", u.OutputType)
+	}
+	if u.OverlayISO != "" && u.OutputType != "iso" {
+		return fmt.Errorf("overlay-iso is only supported for iso artifacts")
+	}
+	if u.ExtendCmdline != "" && len(u.ExtraCmdlines) > 0 {
+		return fmt.Errorf("extend-cmdline and extra-cmdline cannot be used together")
+	}
+	if len(u.Entries) > 0 && (u.ExtendCmdline != "" || len(u.ExtraCmdlines) > 0 || len(u.SingleEfiCmdlines) > 0) {
+		return fmt.Errorf("entries cannot be used together with extend-cmdline, extra-cmdline or single-efi-cmdline")
+	}
+	if u.DefaultEntry != "" && slices.ContainsFunc(u.Entries, func(e UkiEntry) bool { return e.Default }) {
+		return fmt.Errorf("default-entry cannot be used together with a default entry in entries")
+	}
+	if timeout, err := strconv.Atoi(u.LoaderTimeout); (err != nil || timeout < 0) && !slices.Contains(constants.LoaderMenuTimeouts(), u.LoaderTimeout) {
+		return fmt.Errorf("invalid loader timeout: %s", u.LoaderTimeout)
+	}
+	if !slices.Contains(constants.LoaderConsoleModes(), u.LoaderConsoleMode) {
+		return fmt.Errorf("invalid loader console mode: %s", u.LoaderConsoleMode)
+	}
+	if u.BootTries < 0 {
+		return fmt.Errorf("invalid boot tries: %d", u.BootTries)
+	}
+	for _, p := range u.BootTriesEntries {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid boot-tries-entries pattern %q: %w", p, err)
+		}
+	}
+	if _, _, err := signer.ParseKeySource(u.PrivateKeySource); err != nil {
+		return err
+	}
+	if err := signer.CheckPCRPhases(u.PCRKeys, u.PCRPhases); err != nil {
+		return err
+	}
+	for _, e := range u.SBAT {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+	if u.Workers < 0 {
+		return fmt.Errorf("invalid number of workers: %d", u.Workers)
+	}
+	if !slices.Contains(constants.ContainerCompressions(), u.ContainerCompression) {
+		return fmt.Errorf("invalid container compression: %s", u.ContainerCompression)
+	}
+	if !slices.Contains(constants.ContainerFormats(), u.ContainerFormat) {
+		return fmt.Errorf("invalid container format: %s", u.ContainerFormat)
+	}
+	if u.Unsigned && u.OutputType != string(constants.DefaultOutput) {
+		return fmt.Errorf("unsigned is only supported for %s artifacts", constants.DefaultOutput)
+	}
+	if u.Unsigned && u.PCRPredict {
+		return fmt.Errorf("unsigned and pcr-predict cannot be used together, predict the PCR values after signing")
+	}
+	if u.Push != "" && u.OutputType != string(constants.ContainerOutput) {
+		return fmt.Errorf("push is only supported for container artifacts")
+	}
+	if u.EspSize < 0 || u.OEMSize < 0 {
+		return fmt.Errorf("invalid partition sizes: esp-size %d, oem-size %d", u.EspSize, u.OEMSize)
+	}
+	if !slices.Contains(constants.InitrdCompressions(), u.InitrdCompression) {
+		return fmt.Errorf("invalid initrd compression: %s", u.InitrdCompression)
+	}
+	maxLevel := constants.InitrdCompressionMaxLevel(u.InitrdCompression)
+	if u.InitrdCompressionLevel < 0 || u.InitrdCompressionLevel > maxLevel {
+		return fmt.Errorf("invalid %s compression level %d, it must be between 0 and %d", u.InitrdCompression, u.InitrdCompressionLevel, maxLevel)
+	}
+	return nil
+}
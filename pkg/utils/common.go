@@ -6,27 +6,116 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	containerdCompression "github.com/containerd/containerd/archive/compression"
-	"github.com/google/go-containerregistry/pkg/name"
-	container "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/empty"
-	"github.com/google/go-containerregistry/pkg/v1/mutate"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/types"
 	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
-	"github.com/spf13/viper"
 )
 
+// SourceDateEpoch returns the time set in the SOURCE_DATE_EPOCH environment variable.
+// A zero time is returned if it is not set.
+func SourceDateEpoch() (time.Time, error) {
+	value := os.Getenv(constants.SourceDateEpochEnv)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	epoch, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s value %q: %w", constants.SourceDateEpochEnv, value, err)
+	}
+	return time.Unix(epoch, 0).UTC(), nil
+}
+
 type BootEntry struct {
 	FileName string
 	Cmdline  string
 	Title    string
+	// SortKey orders the entry in the systemd-boot menu, entries without it are shown after the ones with it
+	SortKey string
+	// Default makes the entry the one selected by default in systemd-boot
+	Default bool
+	// Tries enables the boot counting of systemd-boot for the entry, with the given number of tries to boot it
+	// successfully before it is marked as bad. 0 disables it.
+	Tries int
+	// UKI is the name of the UKI file booted by the entry, without extension, when it is shared by all the entries
+	// as a multi-profile UKI. If empty, the entry has its own UKI file named after FileName.
+	UKI string
+	// Profile is the number of the profile booted in the multi-profile UKI
+	Profile int
+}
+
+// EfiName returns the name of the UKI file booted by the entry, without extension
+func (e BootEntry) EfiName() string {
+	if e.UKI != "" {
+		return e.UKI
+	}
+	return e.FileName
+}
+
+// ConfName returns the name of the loader entry file, with the boot counting suffix if tries are set. The suffix is
+// not part of the entry id, so the loader.conf default does not need it.
+func (e BootEntry) ConfName() string {
+	if e.Tries > 0 {
+		return fmt.Sprintf("%s+%d.conf", e.FileName, e.Tries)
+	}
+	return e.FileName + ".conf"
+}
+
+// MatchesAny returns true if the name matches any of the glob patterns, or if there are no patterns
+func MatchesAny(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidNameChars matches the characters replaced in the file names generated from titles and cmdlines
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// validName matches the file names and sort keys that are safe to use in the ESP and the loader entries
+var validName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// ValidateBootEntries checks that the entries have valid and unique file names, as two entries with the same name
+// would overwrite each other's files. Names are compared ignoring the case, as the ESP is a FAT filesystem.
+func ValidateBootEntries(entries []BootEntry) error {
+	names := map[string]string{}
+	hasDefault := false
+	for _, entry := range entries {
+		if !validName.MatchString(entry.FileName) || strings.HasPrefix(entry.FileName, ".") {
+			return fmt.Errorf("invalid boot entry file name %q, only letters, numbers, '.', '_' and '-' are allowed", entry.FileName)
+		}
+		if other, ok := names[strings.ToLower(entry.FileName)]; ok {
+			return fmt.Errorf("boot entries %q and %q have the same file name %s", other, entry.Title, entry.FileName)
+		}
+		names[strings.ToLower(entry.FileName)] = entry.Title
+		if entry.SortKey != "" && !validName.MatchString(entry.SortKey) {
+			return fmt.Errorf("invalid sort key %q for boot entry %s", entry.SortKey, entry.FileName)
+		}
+		if strings.ContainsAny(entry.Title+entry.Cmdline, "\n\r") {
+			return fmt.Errorf("boot entry %s has a line break in its title or cmdline", entry.FileName)
+		}
+		if entry.Tries < 0 {
+			return fmt.Errorf("invalid tries %d for boot entry %s", entry.Tries, entry.FileName)
+		}
+		if entry.Default && hasDefault {
+			return fmt.Errorf("more than one default boot entry")
+		}
+		hasDefault = hasDefault || entry.Default
+	}
+	return nil
 }
 
 // CreateSquashFS creates a squash file at destination from a source, with options
@@ -66,59 +155,82 @@ func GolangArchToArch(arch string) (string, error) {
 // For each cmdline passed, we generate a uki file with that cmdline
 // extend-cmdline will just extend the default cmdline so we only create one efi file
 // extra-cmdline will create a new efi file for each cmdline passed
-func GetUkiCmdline() []BootEntry {
+func GetUkiCmdline(bootBranding, cmdlineExtend string, extraCmdlines []string, manifestEntries []types.UkiEntry) ([]BootEntry, error) {
 	defaultCmdLine := constants.UkiCmdline + " " + constants.UkiCmdlineInstall
 
+	// Entries set in the manifest replace the ones from the flags
+	if len(manifestEntries) > 0 {
+		result := []BootEntry{}
+		for _, e := range manifestEntries {
+			entry := BootEntry{
+				Cmdline:  strings.TrimSpace(defaultCmdLine + " " + e.Cmdline),
+				Title:    e.Title,
+				FileName: e.FileName,
+				SortKey:  e.SortKey,
+				Default:  e.Default,
+				Tries:    e.Tries,
+			}
+			if entry.Title == "" {
+				entry.Title = bootBranding
+			}
+			if entry.FileName == "" {
+				entry.FileName = NameFromCmdline(constants.ArtifactBaseName, entry.Cmdline)
+			}
+			result = append(result, entry)
+		}
+		return result, ValidateBootEntries(result)
+	}
+
 	// Extend only
-	cmdlineExtend := viper.GetString("extend-cmdline")
 	if cmdlineExtend != "" {
 		cmdline := defaultCmdLine + " " + cmdlineExtend
 		return []BootEntry{{
 			Cmdline:  cmdline,
-			Title:    viper.GetString("boot-branding"),
+			Title:    bootBranding,
 			FileName: NameFromCmdline(constants.ArtifactBaseName, cmdline),
-		}}
+		}}, nil
 	}
 
 	// default entry
 	result := []BootEntry{{
 		Cmdline:  defaultCmdLine,
-		Title:    viper.GetString("boot-branding"),
+		Title:    bootBranding,
 		FileName: NameFromCmdline(constants.ArtifactBaseName, defaultCmdLine),
 	}}
 
 	// extra
-	for _, extra := range viper.GetStringSlice("extra-cmdline") {
+	for _, extra := range extraCmdlines {
 		cmdline := defaultCmdLine + " " + extra
 		result = append(result, BootEntry{
 			Cmdline:  cmdline,
-			Title:    viper.GetString("boot-branding"),
+			Title:    bootBranding,
 			FileName: NameFromCmdline(constants.ArtifactBaseName, cmdline),
 		})
 	}
 
-	return result
+	return result, ValidateBootEntries(result)
 }
 
 // GetUkiSingleCmdlines returns the single-efi-cmdline as passed by the user.
-func GetUkiSingleCmdlines(logger sdkTypes.KairosLogger) []BootEntry {
+func GetUkiSingleCmdlines(bootBranding string, cmdlines []string, logger sdkTypes.KairosLogger) []BootEntry {
 	result := []BootEntry{}
 	// extra
 	defaultCmdLine := constants.UkiCmdline + " " + constants.UkiCmdlineInstall
 
-	cmdlines := viper.GetStringSlice("single-efi-cmdline")
 	for _, userValue := range cmdlines {
 		bootEntry := BootEntry{}
 
 		before, after, hasTitle := strings.Cut(userValue, ":")
-		if hasTitle {
-			bootEntry.Title = fmt.Sprintf("%s (%s)", viper.GetString("boot-branding"), before)
+		// Colons are valid in cmdline values, like in ip=..., so a value without a title can have them.
+		// Titles never have a "=".
+		if hasTitle && !strings.Contains(before, "=") {
+			bootEntry.Title = fmt.Sprintf("%s (%s)", bootBranding, before)
 			bootEntry.Cmdline = defaultCmdLine + " " + after
-			bootEntry.FileName = strings.ReplaceAll(before, " ", "_")
+			bootEntry.FileName = invalidNameChars.ReplaceAllString(strings.TrimSpace(before), "_")
 		} else {
-			bootEntry.Title = viper.GetString("boot-branding")
-			bootEntry.Cmdline = defaultCmdLine + " " + before
-			bootEntry.FileName = NameFromCmdline("single_entry", before)
+			bootEntry.Title = bootBranding
+			bootEntry.Cmdline = defaultCmdLine + " " + userValue
+			bootEntry.FileName = NameFromCmdline("single_entry", userValue)
 		}
 		result = append(result, bootEntry)
 	}
@@ -129,22 +241,27 @@ func GetUkiSingleCmdlines(logger sdkTypes.KairosLogger) []BootEntry {
 // Tar takes a source and variable writers and walks 'source' writing each file
 // found to the tar writer; the purpose for accepting multiple writers is to allow
 // for multiple outputs (for example a file, or md5 hash)
-func Tar(src string, writers ...io.Writer) error {
-	// ensure the src actually exists before trying to tar it
-	if _, err := os.Stat(src); err != nil {
-		return fmt.Errorf("Unable to tar files - %v", err.Error())
-	}
-
+// If modTime is not zero it is set on every entry and the owners are reset, so the tarball is reproducible
+func Tar(src string, modTime time.Time, writers ...io.Writer) error {
 	mw := io.MultiWriter(writers...)
 
 	gzw := gzip.NewWriter(mw)
 	defer gzw.Close()
 
-	tw := tar.NewWriter(gzw)
-	defer tw.Close()
+	return tarDir(src, modTime, gzw)
+}
+
+// tarDir writes the regular files found in src to w as an uncompressed tarball, see Tar
+func tarDir(src string, modTime time.Time, w io.Writer) error {
+	// ensure the src actually exists before trying to tar it
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("Unable to tar files - %v", err.Error())
+	}
+
+	tw := tar.NewWriter(w)
 
 	// walk path
-	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+	err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
 
 		// return on any error
 		if err != nil {
@@ -165,6 +282,14 @@ func Tar(src string, writers ...io.Writer) error {
 		// update the name to correctly reflect the desired destination when untaring
 		header.Name = strings.TrimPrefix(strings.Replace(file, src, "", -1), string(filepath.Separator))
 
+		if !modTime.IsZero() {
+			header.ModTime = modTime
+			header.AccessTime = time.Time{}
+			header.ChangeTime = time.Time{}
+			header.Uid, header.Gid = 0, 0
+			header.Uname, header.Gname = "", ""
+		}
+
 		// write the header
 		if err := tw.WriteHeader(header); err != nil {
 			return err
@@ -187,93 +312,58 @@ func Tar(src string, writers ...io.Writer) error {
 
 		return nil
 	})
-}
-
-// CreateTar a imagetarball from a standard tarball
-func CreateTar(log sdkTypes.KairosLogger, srctar, dstimageTar, imagename, architecture, OS string) error {
-
-	dstFile, err := os.Create(dstimageTar)
 	if err != nil {
-		return fmt.Errorf("Cannot create %s: %s", dstimageTar, err)
+		return err
 	}
-	defer dstFile.Close()
+	return tw.Close()
+}
 
-	newRef, img, err := imageFromTar(imagename, architecture, OS, func() (io.ReadCloser, error) {
-		f, err := os.Open(srctar)
-		if err != nil {
-			return nil, fmt.Errorf("cannot open %s: %s", srctar, err)
-		}
-		decompressed, err := containerdCompression.DecompressStream(f)
+// ReadKairosRelease returns the variables set in the kairos-release file of the rootfs at rootDir. The os-release file
+// is read instead if it does not exist, as older releases kept the kairos variables there.
+func ReadKairosRelease(rootDir string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(rootDir, "etc", "kairos-release"))
+	if err != nil {
+		data, err = os.ReadFile(filepath.Join(rootDir, "etc", "os-release"))
 		if err != nil {
-			return nil, fmt.Errorf("cannot open %s: %s", srctar, err)
+			return nil, fmt.Errorf("reading kairos-release file: %w", err)
 		}
-
-		return decompressed, nil
-	})
-	if err != nil {
-		return err
 	}
+	return ParseOsRelease(data), nil
+}
 
-	// Lets try to load it into the docker daemon?
-	// Code left here in case we want to use it in the future
-	/*
-		tag, err := name.NewTag(imagename)
-
-		if err != nil {
-			log.Warnf("Cannot create tag for %s: %s", imagename, err)
+// ParseOsRelease returns the values of an os-release like file, unquoted
+func ParseOsRelease(data []byte) map[string]string {
+	release := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
 		}
-		if err == nil {
-			// Best effort only, just try and forget
-			out, err := daemon.Write(tag, img)
-			if err != nil {
-				log.Warnf("Cannot write image %s to daemon: %s\noutput: %s", imagename, err, out)
-			} else {
-				log.Infof("Image %s written to daemon", tag.String())
-			}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, "'")
 		}
-	*/
-
-	return tarball.Write(newRef, img, dstFile)
-
-}
-
-func imageFromTar(imagename, architecture, OS string, opener func() (io.ReadCloser, error)) (name.Reference, container.Image, error) {
-	newRef, err := name.ParseReference(imagename)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	layer, err := tarball.LayerFromOpener(opener)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	baseImage := empty.Image
-	cfg, err := baseImage.ConfigFile()
-	if err != nil {
-		return nil, nil, err
+		release[key] = value
 	}
+	return release
+}
 
-	cfg.Architecture = architecture
-	cfg.OS = OS
+// systemdBootVersion matches the version in the LoaderInfo string embedded in systemd-boot and systemd-stub, like
+// "#### LoaderInfo: systemd-boot 254.5 ####"
+var systemdBootVersion = regexp.MustCompile(`#### LoaderInfo: systemd-(?:boot|stub) (\d+)`)
 
-	baseImage, err = mutate.ConfigFile(baseImage, cfg)
+// SystemdBootVersion returns the major version of the given systemd-boot or systemd-stub EFI binary
+func SystemdBootVersion(file string) (int, error) {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		return nil, nil, err
+		return 0, err
 	}
-	img, err := mutate.Append(baseImage, mutate.Addendum{
-		Layer: layer,
-		History: container.History{
-			CreatedBy: "Enki",
-			Comment:   "Custom image",
-			Created:   container.Time{Time: time.Now()},
-		},
-	})
-	if err != nil {
-		return nil, nil, err
+	match := systemdBootVersion.FindSubmatch(data)
+	if match == nil {
+		return 0, fmt.Errorf("no systemd-boot version found in %s", file)
 	}
-
-	return newRef, img, nil
+	return strconv.Atoi(string(match[1]))
 }
 
 func IsAmd64(arch string) bool {
@@ -307,10 +397,45 @@ func NameFromCmdline(basename, cmdline string) string {
 	}
 	// Although only slashes are truly forbidden, we also replace other characters,
 	// as they can be problematic when interpreted by the shell (e.g. &, |, etc.)
-	allowedChars := regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
-	cleanCmdline := allowedChars.ReplaceAllString(cmdlineForEfi, "_")
+	cleanCmdline := invalidNameChars.ReplaceAllString(cmdlineForEfi, "_")
 	name := basename + "_" + cleanCmdline
 	// If the cmdline is empty, we remove the underscore as to not get a dangling one
 	finalName := strings.TrimSuffix(name, "_")
 	return finalName
 }
+
+// PathSize is the size of a file or of all the files under a directory
+type PathSize struct {
+	Path string
+	Size int64
+}
+
+// LargestPaths returns the n biggest directories, up to the given depth, and the n biggest files from the sizes of
+// the files in a tree
+func LargestPaths(sizes map[string]int64, depth, n int) (dirs, files []PathSize) {
+	dirSizes := map[string]int64{}
+	for file, size := range sizes {
+		files = append(files, PathSize{Path: file, Size: size})
+		elems := strings.Split(file, "/")
+		for i := 1; i < len(elems) && i <= depth; i++ {
+			dirSizes[strings.Join(elems[:i], "/")] += size
+		}
+	}
+	for dir, size := range dirSizes {
+		dirs = append(dirs, PathSize{Path: dir, Size: size})
+	}
+	return largest(dirs, n), largest(files, n)
+}
+
+func largest(paths []PathSize, n int) []PathSize {
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Size != paths[j].Size {
+			return paths[i].Size > paths[j].Size
+		}
+		return paths[i].Path < paths[j].Path
+	})
+	if len(paths) > n {
+		paths = paths[:n]
+	}
+	return paths
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// xzDictCaps are the dictionary sizes of the xz presets 0 to 9
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// kernelInitrdOptions are the kernel config options needed to boot an initramfs compressed with each algorithm
+var kernelInitrdOptions = map[string]string{
+	constants.ZstdCompression: "CONFIG_RD_ZSTD",
+	constants.XzCompression:   "CONFIG_RD_XZ",
+	constants.Lz4Compression:  "CONFIG_RD_LZ4",
+	constants.GzipCompression: "CONFIG_RD_GZIP",
+}
+
+// NewInitrdCompressor returns a writer that compresses everything written to it into w with the given algorithm, in a
+// format the kernel can decompress. Level 0 selects the default level of the algorithm.
+// The returned writer must be closed to flush the compressed stream, closing it does not close w.
+func NewInitrdCompressor(w io.Writer, algorithm string, level int) (io.WriteCloser, error) {
+	if level < 0 || level > constants.InitrdCompressionMaxLevel(algorithm) {
+		return nil, fmt.Errorf("invalid %s compression level: %d", algorithm, level)
+	}
+
+	switch algorithm {
+	case constants.ZstdCompression:
+		encoderLevel := zstd.SpeedBestCompression
+		if level > 0 {
+			// The encoder only has 4 levels, the zstd ones are mapped to the closest
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+	case constants.XzCompression:
+		// The kernel only verifies crc32 checksums
+		cfg := xz.WriterConfig{CheckSum: xz.CRC32, DictCap: xzDictCaps[6]}
+		if level > 0 {
+			cfg.DictCap = xzDictCaps[level]
+		}
+		return cfg.NewWriter(w)
+	case constants.Lz4Compression:
+		// The kernel only reads the legacy lz4 format, as written by "lz4 -l"
+		compressionLevel := lz4.Fast
+		if level > 0 {
+			compressionLevel = lz4.CompressionLevel(1 << (8 + level))
+		}
+		lw := lz4.NewWriter(w)
+		if err := lw.Apply(lz4.LegacyOption(true), lz4.CompressionLevelOption(compressionLevel)); err != nil {
+			return nil, err
+		}
+		return lw, nil
+	case constants.GzipCompression:
+		gzipLevel := gzip.DefaultCompression
+		if level > 0 {
+			gzipLevel = level
+		}
+		return gzip.NewWriterLevel(w, gzipLevel)
+	case constants.NoCompression:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported initrd compression: %s", algorithm)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// KernelConfigsWithoutInitrdCompression returns the kernel configs found at boot/config-* under rootDir that do not
+// enable the option needed to boot an initramfs compressed with the given algorithm.
+func KernelConfigsWithoutInitrdCompression(rootDir, algorithm string) (unsupported []string, err error) {
+	option, ok := kernelInitrdOptions[algorithm]
+	if !ok {
+		return nil, nil
+	}
+
+	configs, err := filepath.Glob(filepath.Join(rootDir, "boot", "config-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, config := range configs {
+		enabled, err := kernelConfigEnabled(config, option)
+		if err != nil {
+			return nil, fmt.Errorf("reading kernel config %s: %w", config, err)
+		}
+		if !enabled {
+			unsupported = append(unsupported, config)
+		}
+	}
+	return unsupported, nil
+}
+
+// kernelConfigEnabled returns whether the option is built in the kernel config file
+func kernelConfigEnabled(config, option string) (bool, error) {
+	f, err := os.Open(config)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == option+"=y" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PathFilter selects the files of a tree with glob rules. Patterns are matched against the path of each file from the
+// root of the tree, with a leading "/" being optional. Besides the path.Match syntax, a "**" element matches any number
+// of directories. A rule matching a directory also matches everything under it.
+// A file is left out if it matches an exclude rule and no include rule, so includes can pick files back from an
+// excluded directory. The directories leading to them are kept as well.
+type PathFilter struct {
+	root     string
+	excludes []*FilterRule
+	includes []*FilterRule
+}
+
+// FilterRule is a rule of a PathFilter, with the files and bytes it left out of the tree so far
+type FilterRule struct {
+	Pattern string
+	Files   int
+	Bytes   int64
+
+	elems []string
+}
+
+// NewPathFilter returns a filter for the tree at root with the given exclude and include glob patterns
+func NewPathFilter(root string, excludes, includes []string) (*PathFilter, error) {
+	f := &PathFilter{root: root}
+	for _, p := range excludes {
+		r, err := newFilterRule(p)
+		if err != nil {
+			return nil, err
+		}
+		f.excludes = append(f.excludes, r)
+	}
+	for _, p := range includes {
+		r, err := newFilterRule(p)
+		if err != nil {
+			return nil, err
+		}
+		f.includes = append(f.includes, r)
+	}
+	return f, nil
+}
+
+func newFilterRule(pattern string) (*FilterRule, error) {
+	elems := splitPath(pattern)
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("empty filter pattern")
+	}
+	for _, e := range elems {
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %s: %w", pattern, err)
+		}
+	}
+	return &FilterRule{Pattern: pattern, elems: elems}, nil
+}
+
+// Skip returns true for the files left out of the tree, p is the path relative to the root. It is meant to be called
+// while walking the tree from the root, every skipped file is accounted to the first exclude rule matching it.
+// Skipped directories are accounted with all their contents, as they are not walked any further.
+func (f *PathFilter) Skip(p string, d fs.DirEntry) bool {
+	elems := splitPath(p)
+	var excludedBy *FilterRule
+	for _, r := range f.excludes {
+		if r.matchesOrParent(elems) {
+			excludedBy = r
+			break
+		}
+	}
+	if excludedBy == nil {
+		return false
+	}
+	for _, r := range f.includes {
+		if r.matchesOrParent(elems) || (d.IsDir() && r.mayMatchBelow(elems)) {
+			return false
+		}
+	}
+
+	files, size := 1, int64(0)
+	if d.IsDir() {
+		files, size = treeSize(filepath.Join(f.root, p))
+	} else if d.Type().IsRegular() {
+		if info, err := d.Info(); err == nil {
+			size = info.Size()
+		}
+	}
+	excludedBy.Files += files
+	excludedBy.Bytes += size
+	return true
+}
+
+// Excludes returns the exclude rules of the filter, with the files and bytes they left out
+func (f *PathFilter) Excludes() []*FilterRule {
+	return f.excludes
+}
+
+// matchesOrParent returns true if the rule matches the path or any of its parents
+func (r *FilterRule) matchesOrParent(elems []string) bool {
+	for i := 1; i <= len(elems); i++ {
+		if matchElems(r.elems, elems[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayMatchBelow returns true if the rule could match a file under the directory
+func (r *FilterRule) mayMatchBelow(dir []string) bool {
+	for i, e := range r.elems {
+		if e == "**" {
+			return true
+		}
+		if i >= len(dir) {
+			return true
+		}
+		if ok, _ := path.Match(e, dir[i]); !ok {
+			return false
+		}
+	}
+	return false
+}
+
+func matchElems(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchElems(pattern[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+		return false
+	}
+	return matchElems(pattern[1:], elems[1:])
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+filepath.ToSlash(p)), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// treeSize returns the number of files in the tree and the size of its regular files, ignoring errors
+func treeSize(root string) (files int, size int64) {
+	_ = filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		files++
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return files, size
+}
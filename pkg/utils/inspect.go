@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/pe"
+	ukiConstants "github.com/kairos-io/go-ukify/pkg/constants"
+	ukiTypes "github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// UkiInspection describes the contents of a UKI, or of any other EFI file
+type UkiInspection struct {
+	File     string           `json:"file"`
+	Sections []SectionSummary `json:"sections"`
+	// Cmdline, OsRelease, Uname and SBAT are the text sections of the base UKI
+	Cmdline   string            `json:"cmdline,omitempty"`
+	OsRelease map[string]string `json:"osrel,omitempty"`
+	Uname     string            `json:"uname,omitempty"`
+	SBAT      string            `json:"sbat,omitempty"`
+	// PCRPKeyFingerprint is the fingerprint of the .pcrpkey public key, as in the pkfp field of the PCR signatures
+	PCRPKeyFingerprint string             `json:"pcrpkey-fingerprint,omitempty"`
+	PCRSig             *ukiTypes.PCRData  `json:"pcrsig,omitempty"`
+	Profiles           []ProfileSummary   `json:"profiles,omitempty"`
+	Signatures         []SignatureSummary `json:"signatures"`
+}
+
+// SectionSummary is a section of the EFI file, as systemd-stub reads it
+type SectionSummary struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Profile is the index of the profile the section belongs to, if any
+	Profile *int `json:"profile,omitempty"`
+}
+
+// ProfileSummary is a profile of a multi-profile UKI, with the sections overriding the base ones
+type ProfileSummary struct {
+	ID      string            `json:"id,omitempty"`
+	Title   string            `json:"title,omitempty"`
+	Cmdline string            `json:"cmdline,omitempty"`
+	PCRSig  *ukiTypes.PCRData `json:"pcrsig,omitempty"`
+}
+
+// SignatureSummary is an Authenticode signature of the EFI file
+type SignatureSummary struct {
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer"`
+	Serial  string `json:"serial"`
+	// Verified is whether the signature is valid for one of the given certificates, nil if none were given
+	Verified *bool `json:"verified,omitempty"`
+}
+
+// InspectUki returns the description of the EFI file, verifying its signatures with the given certificates if any
+func InspectUki(file string, certs []*x509.Certificate) (*UkiInspection, error) {
+	sections, err := pe.Sections(file)
+	if err != nil {
+		return nil, err
+	}
+	i := &UkiInspection{File: file}
+	base, profiles := splitUkiProfiles(sections)
+	for _, s := range base {
+		i.Sections = append(i.Sections, summarizeSection(s, nil))
+		switch s.Name {
+		case string(ukiConstants.CMDLine):
+			i.Cmdline = sectionText(s)
+		case string(ukiConstants.OSRel):
+			i.OsRelease = ParseOsRelease(s.Data)
+		case string(ukiConstants.Uname):
+			i.Uname = sectionText(s)
+		case string(ukiConstants.SBAT):
+			i.SBAT = sectionText(s)
+		case string(ukiConstants.PCRPKey):
+			if i.PCRPKeyFingerprint, err = pcrPKeyFingerprint(s.Data); err != nil {
+				return nil, err
+			}
+		case string(ukiConstants.PCRSig):
+			if i.PCRSig, err = parsePCRSig(s); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for n, profile := range profiles {
+		release := ParseOsRelease(profile[0].Data)
+		p := ProfileSummary{ID: release["ID"], Title: release["TITLE"]}
+		for _, s := range profile {
+			i.Sections = append(i.Sections, summarizeSection(s, &n))
+			switch s.Name {
+			case string(ukiConstants.CMDLine):
+				p.Cmdline = sectionText(s)
+			case string(ukiConstants.PCRSig):
+				if p.PCRSig, err = parsePCRSig(s); err != nil {
+					return nil, err
+				}
+			}
+		}
+		i.Profiles = append(i.Profiles, p)
+	}
+
+	if i.Signatures, err = signatures(file, certs); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// ExtractUki writes the kernel, initrd and cmdline of the UKI into dir, as vmlinuz, initrd and cmdline. The cmdline of
+// every profile is written as cmdline.ID too.
+func ExtractUki(file, dir string) error {
+	sections, err := pe.Sections(file)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, constants.DirPerm); err != nil {
+		return err
+	}
+	names := map[string]string{
+		string(ukiConstants.Linux):   "vmlinuz",
+		string(ukiConstants.Initrd):  "initrd",
+		string(ukiConstants.CMDLine): "cmdline",
+	}
+	base, profiles := splitUkiProfiles(sections)
+	for _, s := range base {
+		if name, ok := names[s.Name]; ok {
+			if err := os.WriteFile(filepath.Join(dir, name), sectionData(s), constants.FilePerm); err != nil {
+				return err
+			}
+		}
+	}
+	for n, profile := range profiles {
+		id := ParseOsRelease(profile[0].Data)["ID"]
+		if id == "" || !filepath.IsLocal(id) {
+			id = fmt.Sprint(n)
+		}
+		for _, s := range profile {
+			if s.Name != string(ukiConstants.CMDLine) {
+				continue
+			}
+			if err := os.WriteFile(filepath.Join(dir, "cmdline."+id), sectionData(s), constants.FilePerm); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func summarizeSection(s pe.Section, profile *int) SectionSummary {
+	sum := sha256.Sum256(s.Data)
+	summary := SectionSummary{Name: s.Name, Size: len(s.Data), SHA256: hex.EncodeToString(sum[:])}
+	if profile != nil {
+		n := *profile
+		summary.Profile = &n
+	}
+	return summary
+}
+
+// sectionData returns the data of a section without the NUL padding of the text sections
+func sectionData(s pe.Section) []byte {
+	if s.Name == string(ukiConstants.Linux) || s.Name == string(ukiConstants.Initrd) {
+		return s.Data
+	}
+	return bytes.TrimRight(s.Data, "\x00")
+}
+
+func sectionText(s pe.Section) string {
+	return strings.TrimSpace(string(sectionData(s)))
+}
+
+func parsePCRSig(s pe.Section) (*ukiTypes.PCRData, error) {
+	data := &ukiTypes.PCRData{}
+	if err := json.Unmarshal(sectionData(s), data); err != nil {
+		return nil, fmt.Errorf("parsing the %s section: %w", s.Name, err)
+	}
+	return data, nil
+}
+
+// pcrPKeyFingerprint returns the SHA256 of the PKCS#1 public key in the .pcrpkey section, as systemd-measure puts in
+// the pkfp field of the signatures
+func pcrPKeyFingerprint(data []byte) (string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("no PEM public key in the %s section", ukiConstants.PCRPKey)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parsing the %s section: %w", ukiConstants.PCRPKey, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("the %s section is not an RSA key", ukiConstants.PCRPKey)
+	}
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(rsaKey))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// signatures returns the Authenticode signatures of the file, verified with the given certificates if any
+func signatures(file string, certs []*x509.Certificate) ([]SignatureSummary, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	bin, err := authenticode.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	sigs, err := bin.Signatures()
+	if err != nil {
+		return nil, fmt.Errorf("reading the signatures of %s: %w", file, err)
+	}
+	summaries := []SignatureSummary{}
+	for _, sig := range sigs {
+		auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("parsing the signature of %s: %w", file, err)
+		}
+		summary := SignatureSummary{}
+		if cert := signerCertificate(auth); cert != nil {
+			summary.Subject, summary.Issuer, summary.Serial = cert.Subject.String(), cert.Issuer.String(), cert.SerialNumber.String()
+		}
+		if len(certs) > 0 {
+			verified := false
+			for _, cert := range certs {
+				// An error means the signature or the file digest does not match
+				if ok, err := auth.Verify(cert, bin.HashContent.Bytes()); err == nil && ok {
+					verified = true
+					break
+				}
+			}
+			summary.Verified = &verified
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// signerCertificate returns the certificate of the signer among the ones embedded in the signature, which can also
+// hold the certificates of its chain. It is the one matching the issuer and serial number of the signer info.
+func signerCertificate(auth *authenticode.Authenticode) *x509.Certificate {
+	for _, si := range auth.Pkcs.SignerInfo {
+		for _, cert := range auth.Pkcs.Certs {
+			if bytes.Equal(cert.RawIssuer, si.IssuerAndSerialnumber.RawIssuer) && cert.SerialNumber.Cmp(si.IssuerAndSerialnumber.SerialNumber) == 0 {
+				return cert
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/iso9660"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+)
+
+// ISOSpec describes a bootable ISO image created from a directory tree
+type ISOSpec struct {
+	// Label is the volume id of the image
+	Label string
+	// Root is the directory with the contents of the image
+	Root string
+	// Output is the path of the image to create
+	Output string
+	// ModTime is the timestamp of the volume and all the files in it. If zero, the current time is used.
+	// xorriso reads SOURCE_DATE_EPOCH by itself instead.
+	ModTime time.Time
+	// BIOSImage is the path inside the image of the GRUB2 El Torito image booted on BIOS systems
+	BIOSImage string
+	// BootCatalog is the path of the El Torito boot catalog recorded by xorriso. Both writers hide the catalog from
+	// the tree, so the native one does not use it.
+	BootCatalog string
+	// HybridMBR is the path of the GRUB2 MBR boot code installed in the image so it can be booted from disks
+	HybridMBR string
+	// HybridGPT adds a GPT to the image so it can be booted from disks on EFI systems
+	HybridGPT bool
+	// EFIImage is the path inside the image of the FAT image booted on EFI systems
+	EFIImage string
+	// EFIPartition is the path of a FAT image appended to the image as EFI system partition and booted on EFI systems
+	EFIPartition string
+}
+
+// ISOWriter creates ISO images
+type ISOWriter interface {
+	Write(spec ISOSpec) error
+}
+
+// NewISOWriter returns the ISOWriter for the given backend, defaulting to the native one
+func NewISOWriter(backend string, runner v1.Runner, logger sdkTypes.KairosLogger) ISOWriter {
+	if backend == constants.XorrisoISOBackend {
+		return &XorrisoISOWriter{runner: runner, logger: logger}
+	}
+	return &NativeISOWriter{}
+}
+
+// NativeISOWriter writes ISO images with the iso9660 package, without any external tool
+type NativeISOWriter struct{}
+
+func (w *NativeISOWriter) Write(spec ISOSpec) error {
+	img := iso9660.New(spec.Label)
+	img.ModTime = spec.ModTime
+	if err := img.AddTree("/", spec.Root); err != nil {
+		return fmt.Errorf("adding %s to the iso: %w", spec.Root, err)
+	}
+
+	if spec.BIOSImage != "" {
+		img.BIOS = &iso9660.BIOSBoot{Image: spec.BIOSImage, BootInfoTable: true, Grub2BootInfo: true}
+	}
+	if spec.EFIImage != "" || spec.EFIPartition != "" {
+		img.EFI = &iso9660.EFIBoot{Image: spec.EFIImage, Partition: spec.EFIPartition}
+	}
+	if spec.HybridMBR != "" || spec.HybridGPT {
+		img.Hybrid = &iso9660.Hybrid{MBR: spec.HybridMBR, Grub2MBR: spec.HybridMBR != "", GPT: spec.HybridGPT}
+	}
+
+	if err := img.Write(spec.Output); err != nil {
+		return fmt.Errorf("writing iso %s: %w", spec.Output, err)
+	}
+	return nil
+}
+
+// XorrisoISOWriter writes ISO images by calling xorriso
+type XorrisoISOWriter struct {
+	runner v1.Runner
+	logger sdkTypes.KairosLogger
+}
+
+func (w *XorrisoISOWriter) Write(spec ISOSpec) error {
+	out, err := w.runner.Run("xorriso", xorrisoArgs(spec)...)
+	w.logger.Debugf("Xorriso: %s", string(out))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// xorrisoArgs translates the spec to xorriso arguments.
+// Images without a BIOS entry use the mkisofs emulation, as the GPT for an in-tree EFI image is only available there.
+func xorrisoArgs(spec ISOSpec) []string {
+	if spec.BIOSImage == "" {
+		args := []string{"-as", "mkisofs", "-V", spec.Label}
+		if spec.HybridGPT {
+			args = append(args, "-isohybrid-gpt-basdat")
+		}
+		if spec.EFIPartition != "" {
+			args = append(args, "-append_partition", "2", "0xef", spec.EFIPartition,
+				"-e", "--interval:appended_partition_2:all::", "-no-emul-boot")
+		}
+		if spec.EFIImage != "" {
+			args = append(args, "-e", strings.TrimPrefix(spec.EFIImage, "/"), "-no-emul-boot")
+		}
+		return append(args, "-o", spec.Output, spec.Root)
+	}
+
+	args := []string{
+		"-volid", spec.Label, "-joliet", "on", "-padding", "0",
+		"-outdev", spec.Output, "-map", spec.Root, "/", "-chmod", "0755", "--",
+		"-boot_image", "grub", fmt.Sprintf("bin_path=%s", spec.BIOSImage),
+	}
+	if spec.HybridMBR != "" {
+		args = append(args, "-boot_image", "grub", fmt.Sprintf("grub2_mbr=%s", spec.HybridMBR))
+	}
+	args = append(args,
+		"-boot_image", "grub", "grub2_boot_info=on",
+		"-boot_image", "any", "partition_offset=16",
+	)
+	if spec.BootCatalog != "" {
+		args = append(args, "-boot_image", "any", fmt.Sprintf("cat_path=%s", spec.BootCatalog))
+	}
+	args = append(args,
+		"-boot_image", "any", "cat_hidden=on",
+		"-boot_image", "any", "boot_info_table=on",
+		"-boot_image", "any", "platform_id=0x00",
+		"-boot_image", "any", "emul_type=no_emulation",
+		"-boot_image", "any", "load_size=2048",
+	)
+	if spec.EFIPartition != "" {
+		args = append(args,
+			"-append_partition", "2", "0xef", spec.EFIPartition,
+			"-boot_image", "any", "next",
+			"-boot_image", "any", "efi_path=--interval:appended_partition_2:all::",
+			"-boot_image", "any", "platform_id=0xef",
+			"-boot_image", "any", "emul_type=no_emulation",
+		)
+	}
+	if spec.EFIImage != "" {
+		args = append(args,
+			"-boot_image", "any", "next",
+			"-boot_image", "any", fmt.Sprintf("efi_path=%s", filepath.Join("/", spec.EFIImage)),
+			"-boot_image", "any", "platform_id=0xef",
+			"-boot_image", "any", "emul_type=no_emulation",
+		)
+	}
+	return args
+}
@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/compression"
+	"github.com/google/go-containerregistry/pkg/name"
+	container "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/kairos-io/enki/pkg/constants"
+)
+
+// refNameAnnotation is the annotation with the name of an image in an OCI layout
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// ContainerSpec are the options of a UKI container image
+type ContainerSpec struct {
+	// Name is the image reference in a docker tarball, or the reference name of the image in an OCI layout
+	Name string
+	Arch string
+	OS   string
+	// Created is the creation time of the image. If zero, the current time is used and the layer keeps the file
+	// timestamps and owners.
+	Created time.Time
+	// Labels are set both as labels of the image config and as annotations of the image manifest
+	Labels map[string]string
+	// Compression is the compression of the layer, see constants.ContainerCompressions
+	Compression string
+	// Format is the format of the output, see constants.ContainerFormats
+	Format string
+}
+
+// CreateContainer writes an image with the files of srcDir as its only layer, using the OCI media types. The output
+// is a docker tarball or an OCI layout directory depending on the format of the spec. The image is returned so it can
+// be pushed too, its layer is read from srcDir so it must not be changed meanwhile.
+func CreateContainer(srcDir, output string, spec ContainerSpec) (container.Image, error) {
+	created := spec.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	layerType, layerCompression := types.OCILayer, compression.GZip
+	if spec.Compression == constants.ZstdCompression {
+		layerType, layerCompression = types.OCILayerZStd, compression.ZStd
+	}
+	// The layer is read more than once, to get its digests and to write it, so the tarball is generated every time
+	// instead of keeping a copy of it
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(tarDir(srcDir, spec.Created, pw))
+		}()
+		return pr, nil
+	}, tarball.WithCompression(layerCompression), tarball.WithMediaType(layerType))
+	if err != nil {
+		return nil, err
+	}
+
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, types.OCIConfigJSON)
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Architecture = spec.Arch
+	cfg.OS = spec.OS
+	cfg.Created = container.Time{Time: created}
+	cfg.Config.Labels = spec.Labels
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		return nil, err
+	}
+	img, err = mutate.Append(img, mutate.Addendum{
+		Layer: layer,
+		History: container.History{
+			CreatedBy: "Enki",
+			Comment:   "Custom image",
+			Created:   container.Time{Time: created},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(spec.Labels) > 0 {
+		img = mutate.Annotations(img, spec.Labels).(container.Image)
+	}
+
+	if spec.Format == constants.OCIContainerFormat {
+		p, err := newLayout(output)
+		if err != nil {
+			return nil, err
+		}
+		var opts []layout.Option
+		if spec.Name != "" {
+			opts = append(opts, layout.WithAnnotations(map[string]string{refNameAnnotation: spec.Name}))
+		}
+		if err = p.AppendImage(img, opts...); err != nil {
+			return nil, fmt.Errorf("writing the image to %s: %w", output, err)
+		}
+		return img, nil
+	}
+
+	ref, err := name.ParseReference(spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err = tarball.WriteToFile(output, ref, img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// ImageDigest returns the digest of the image for the given platform, like "linux/amd64", from its registry.
+// If the reference already has a digest, it is returned without checking the registry.
+func ImageDigest(image, platform string) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	if d, ok := ref.(name.Digest); ok {
+		return d.DigestStr(), nil
+	}
+	p, err := container.ParsePlatform(platform)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	desc, err := remote.Get(ref, remote.WithContext(ctx), remote.WithPlatform(*p), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", err
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return "", err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// ContainerArch returns the architecture name used in container images for the given architecture,
+// like amd64 for x86_64
+func ContainerArch(arch string) string {
+	switch {
+	case IsAmd64(arch):
+		return constants.ArchAmd64
+	case IsArm64(arch):
+		return constants.ArchArm64
+	default:
+		return arch
+	}
+}
+
+// CreateImageIndex combines the images in the given docker tarballs or OCI layouts, like the ones of the container
+// output type of build-uki, into a multi-platform OCI image index. The index is written as an OCI layout directory at output, or as
+// a tarball of the layout if output ends with ".tar". If refName is not empty, it is set as the reference name of the
+// index in the layout. created is used as the timestamp of the tarball entries, the current time is used if zero.
+func CreateImageIndex(images []string, output, refName string, created time.Time) error {
+	if len(images) == 0 {
+		return fmt.Errorf("no images to add to the index")
+	}
+	var idx container.ImageIndex = empty.Index
+	idx = mutate.IndexMediaType(idx, types.OCIImageIndex)
+	var platforms []string
+	for _, file := range images {
+		img, err := readImage(file)
+		if err != nil {
+			return fmt.Errorf("reading image %s: %w", file, err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return fmt.Errorf("reading the config of image %s: %w", file, err)
+		}
+		platform := cfg.Platform()
+		if platform == nil || platform.OS == "" || platform.Architecture == "" {
+			return fmt.Errorf("image %s has no platform set", file)
+		}
+		for _, p := range platforms {
+			if p == platform.String() {
+				return fmt.Errorf("more than one image for platform %s", p)
+			}
+		}
+		platforms = append(platforms, platform.String())
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: container.Descriptor{Platform: platform},
+		})
+	}
+
+	layoutDir := output
+	if strings.HasSuffix(output, ".tar") {
+		tmp, err := os.MkdirTemp("", "enki-oci-layout-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		layoutDir = tmp
+	}
+
+	var opts []layout.Option
+	if refName != "" {
+		opts = append(opts, layout.WithAnnotations(map[string]string{refNameAnnotation: refName}))
+	}
+	p, err := newLayout(layoutDir)
+	if err != nil {
+		return err
+	}
+	if err = p.AppendIndex(idx, opts...); err != nil {
+		return fmt.Errorf("writing the image index: %w", err)
+	}
+	if layoutDir == output {
+		return nil
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = tarLayout(layoutDir, created, f); err != nil {
+		return fmt.Errorf("writing %s: %w", output, err)
+	}
+	return f.Close()
+}
+
+// newLayout creates an empty OCI layout at dir, which must not exist or be empty
+func newLayout(dir string) (layout.Path, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return "", fmt.Errorf("output directory %s is not empty", dir)
+	}
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return "", fmt.Errorf("creating OCI layout: %w", err)
+	}
+	return p, nil
+}
+
+// readImage reads the image in a docker tarball, or the only image in an OCI layout directory
+func readImage(file string) (container.Image, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return tarball.ImageFromPath(file, nil)
+	}
+	idx, err := layout.ImageIndexFromPath(file)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Manifests) != 1 || !manifest.Manifests[0].MediaType.IsImage() {
+		return nil, fmt.Errorf("the OCI layout must have a single image")
+	}
+	return idx.Image(manifest.Manifests[0].Digest)
+}
+
+// tarLayout writes the contents of an OCI layout directory as an uncompressed tarball, with fixed owners and
+// timestamps so the same layout always gives the same tarball
+func tarLayout(dir string, modTime time.Time, w io.Writer) error {
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	tw := tar.NewWriter(w)
+	// WalkDir visits the files in lexical order
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    0644,
+			ModTime: modTime,
+			Format:  tar.FormatPAX,
+		}
+		if d.IsDir() {
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			header.Mode = 0755
+			return tw.WriteHeader(header)
+		}
+		header.Typeflag = tar.TypeReg
+		header.Size = info.Size()
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/kairos-io/enki/pkg/pe"
+	"github.com/kairos-io/enki/pkg/signer"
+	ukiConstants "github.com/kairos-io/go-ukify/pkg/constants"
+	ukiTypes "github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// pcrBanks are the hashes of the PCR banks, see constants.PCRBanks
+var pcrBanks = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// PCRPrediction are the measurements expected when booting a set of EFI files
+type PCRPrediction struct {
+	// Bank is the PCR bank of all the digests
+	Bank  string          `json:"bank"`
+	Files []EfiPrediction `json:"files"`
+	// PCR7 are the digests of the secure boot events implied by the keys directory, when the keys are enrolled and
+	// used to verify the boot loader, in the order the firmware measures them. The dbx variable and the separator are
+	// measured too, but they do not depend on the keys.
+	PCR7 []PCREvent `json:"pcr7,omitempty"`
+}
+
+// EfiPrediction are the measurements of an EFI file, like systemd-boot or a UKI
+type EfiPrediction struct {
+	File string `json:"file"`
+	// PCR4 are the Authenticode hashes the firmware measures when loading the file, and the kernel for UKIs
+	PCR4 []PCREvent `json:"pcr4"`
+	// Profiles are the PCR 11 values of every profile of a UKI, or of the whole UKI if it has no profiles
+	Profiles []ProfilePrediction `json:"profiles,omitempty"`
+}
+
+// ProfilePrediction are the PCR 11 values expected when booting a UKI profile
+type ProfilePrediction struct {
+	ID    string `json:"id,omitempty"`
+	Title string `json:"title,omitempty"`
+	// PCR11 is the value after every boot phase, the last phase is the one of the booted system
+	PCR11 []PhaseValue `json:"pcr11"`
+	// PCRSig is the signed PCR 11 policy in the .pcrsig section of the profile, or of the UKI if it has no profiles
+	PCRSig json.RawMessage `json:"pcrsig,omitempty"`
+}
+
+// PhaseValue is the value of a PCR after a boot phase, named like systemd-measure does
+type PhaseValue struct {
+	Phase string `json:"phase"`
+	Value string `json:"value"`
+}
+
+// PCREvent is the digest of a measured event
+type PCREvent struct {
+	Description string `json:"description"`
+	Digest      string `json:"digest"`
+}
+
+// PredictPCRs returns the measurements expected when booting the given EFI files, with the PCR 7 events of the
+// secure boot keys in keysDir if set
+func PredictPCRs(files []string, keysDir string, bank string) (*PCRPrediction, error) {
+	h, ok := pcrBanks[bank]
+	if !ok {
+		return nil, fmt.Errorf("unsupported PCR bank: %s", bank)
+	}
+	prediction := &PCRPrediction{Bank: bank}
+	for _, file := range files {
+		p, err := predictEfi(file, h)
+		if err != nil {
+			return nil, err
+		}
+		prediction.Files = append(prediction.Files, *p)
+	}
+	if keysDir != "" {
+		events, err := secureBootEvents(keysDir, h)
+		if err != nil {
+			return nil, err
+		}
+		prediction.PCR7 = events
+	}
+	return prediction, nil
+}
+
+// FindEfiFiles returns the given files, with the directories replaced by the .efi files in them
+func FindEfiFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		err = filepath.WalkDir(p, func(file string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if strings.EqualFold(filepath.Ext(file), ".efi") {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no EFI files found")
+	}
+	return files, nil
+}
+
+func predictEfi(file string, h crypto.Hash) (*EfiPrediction, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := authenticodeHash(data, h)
+	if err != nil {
+		return nil, fmt.Errorf("hashing %s: %w", file, err)
+	}
+	p := &EfiPrediction{File: file, PCR4: []PCREvent{{Description: filepath.Base(file), Digest: digest}}}
+
+	sections, err := pe.Sections(file)
+	if err != nil {
+		return nil, err
+	}
+	base, profiles := splitUkiProfiles(sections)
+	i := slices.IndexFunc(base, func(s pe.Section) bool { return s.Name == string(ukiConstants.Linux) })
+	if i < 0 {
+		// Not a UKI, like systemd-boot
+		return p, nil
+	}
+	// systemd-stub loads the kernel as another PE image, so the firmware measures it too
+	kernelDigest, err := authenticodeHash(base[i].Data, h)
+	if err != nil {
+		return nil, fmt.Errorf("hashing the kernel of %s: %w", file, err)
+	}
+	p.PCR4 = append(p.PCR4, PCREvent{Description: filepath.Base(file) + " kernel", Digest: kernelDigest})
+
+	if len(profiles) == 0 {
+		p.Profiles = []ProfilePrediction{{PCR11: predictUkiPCR(base, h), PCRSig: pcrSig(base)}}
+		return p, nil
+	}
+	for _, profile := range profiles {
+		release := ParseOsRelease(profile[0].Data)
+		p.Profiles = append(p.Profiles, ProfilePrediction{
+			ID:     release["ID"],
+			Title:  release["TITLE"],
+			PCR11:  predictUkiPCR(overrideSections(base, profile), h),
+			PCRSig: pcrSig(profile),
+		})
+	}
+	return p, nil
+}
+
+// pcrSig returns the contents of the .pcrsig section, if any and valid JSON
+func pcrSig(sections []pe.Section) json.RawMessage {
+	for _, s := range sections {
+		if s.Name != string(ukiConstants.PCRSig) {
+			continue
+		}
+		// The section may be padded with NULs
+		data := bytes.TrimRight(s.Data, "\x00")
+		if json.Valid(data) {
+			return data
+		}
+	}
+	return nil
+}
+
+// predictUkiPCR returns the PCR 11 value after every boot phase when booting the given UKI sections
+func predictUkiPCR(sections []pe.Section, h crypto.Hash) []PhaseValue {
+	digest := measureUkiSections(h, sections)
+	phases := ukiTypes.OrderedPhases()
+	var values []PhaseValue
+	for i, phase := range phases {
+		digest.Extend([]byte(phase.Phase))
+		values = append(values, PhaseValue{Phase: ukiTypes.PhasesToString(phases[:i+1]), Value: hex.EncodeToString(digest.Hash())})
+	}
+	return values
+}
+
+func authenticodeHash(data []byte, h crypto.Hash) (string, error) {
+	bin, err := authenticode.Parse(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bin.Hash(h)), nil
+}
+
+// secureBootEvents returns the PCR 7 events of enrolling the keys of keysDir and booting an image signed with the
+// db key
+func secureBootEvents(keysDir string, h crypto.Hash) ([]PCREvent, error) {
+	events := []PCREvent{{Description: "SecureBoot", Digest: variableEventDigest(efivar.SecureBoot, []byte{1}, h)}}
+	for _, v := range []efivar.Efivar{efivar.PK, efivar.KEK, efivar.Db} {
+		esl, err := readESL(keysDir, v.Name)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, PCREvent{Description: v.Name, Digest: variableEventDigest(v, esl, h)})
+	}
+
+	// The firmware measures the db entry that verified the boot loader as the authority
+	esl, err := readESL(keysDir, efivar.Db.Name)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := dbCertificate(keysDir)
+	if err != nil {
+		return nil, err
+	}
+	db, err := signature.ReadSignatureDatabase(bytes.NewReader(esl))
+	if err != nil {
+		return nil, fmt.Errorf("reading the db signature list: %w", err)
+	}
+	for _, list := range db {
+		for _, sig := range list.Signatures {
+			if bytes.Equal(sig.Data, cert) {
+				events = append(events, PCREvent{Description: "db authority", Digest: variableEventDigest(efivar.Db, sig.Bytes(), h)})
+				return events, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("the db certificate is not in the db signature list")
+}
+
+// dbCertificate returns the DER certificate of the db key the EFI files are signed with, db.pem in the keys dir, or
+// the last one in db.der as genkey rotate appends the new certificates to it
+func dbCertificate(keysDir string) ([]byte, error) {
+	if cert, err := signer.ReadCertificate(filepath.Join(keysDir, "db.pem")); err == nil {
+		return cert.Raw, nil
+	}
+	der, err := os.ReadFile(filepath.Join(keysDir, "db.der"))
+	if err != nil {
+		return nil, fmt.Errorf("reading the db certificate: %w", err)
+	}
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the db certificate: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no db certificate in db.der")
+	}
+	return certs[len(certs)-1].Raw, nil
+}
+
+// readESL returns the EFI signature list of the given variable in the keys dir, from its .esl file or its .auth one
+func readESL(keysDir, name string) ([]byte, error) {
+	esl, err := os.ReadFile(filepath.Join(keysDir, name+".esl"))
+	if err == nil {
+		return esl, nil
+	}
+	auth, err := os.ReadFile(filepath.Join(keysDir, name+".auth"))
+	if err != nil {
+		return nil, fmt.Errorf("reading the %s signature list: %w", name, err)
+	}
+	// An EFI_VARIABLE_AUTHENTICATION_2 header, a timestamp and a WIN_CERTIFICATE, comes before the signature list
+	const timestampSize = 16
+	if len(auth) < timestampSize+4 {
+		return nil, fmt.Errorf("invalid %s.auth file", name)
+	}
+	certSize := int(binary.LittleEndian.Uint32(auth[timestampSize:]))
+	if timestampSize+certSize > len(auth) {
+		return nil, fmt.Errorf("invalid %s.auth file", name)
+	}
+	return auth[timestampSize+certSize:], nil
+}
+
+// variableEventDigest returns the digest of the UEFI_VARIABLE_DATA event data for the given variable
+func variableEventDigest(v efivar.Efivar, data []byte, h crypto.Hash) string {
+	name := utf16.Encode([]rune(v.Name))
+	buf := &bytes.Buffer{}
+	_ = binary.Write(buf, binary.LittleEndian, v.GUID)
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(name)))
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(data)))
+	_ = binary.Write(buf, binary.LittleEndian, name)
+	buf.Write(data)
+	hash := h.New()
+	hash.Write(buf.Bytes())
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	container "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// PushImage uploads the image to the registry of the given reference, like "quay.io/kairos/uki:v3.2.1".
+// The credentials are read from the docker config file, as docker login leaves them.
+func PushImage(img container.Image, ref string) (string, error) {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid reference %s: %w", ref, err)
+	}
+	if err = remote.Write(r, img, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+		return "", fmt.Errorf("pushing %s: %w", ref, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return r.Context().Digest(digest.String()).String(), nil
+}
+
+// FileArtifact returns an OCI artifact with the file as its only layer, with the given media types for the config and
+// the layer. The file name is kept in the title annotation of the layer, so tools like oras pull it with the same
+// name.
+func FileArtifact(file string, artifactType, layerType types.MediaType, platform *container.Platform) (container.Image, error) {
+	layer, err := newFileLayer(file, layerType)
+	if err != nil {
+		return nil, err
+	}
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, artifactType)
+	if platform != nil {
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		cfg.OS = platform.OS
+		cfg.Architecture = platform.Architecture
+		if img, err = mutate.ConfigFile(img, cfg); err != nil {
+			return nil, err
+		}
+	}
+	return mutate.Append(img, mutate.Addendum{
+		Layer:       layer,
+		Annotations: map[string]string{"org.opencontainers.image.title": filepath.Base(file)},
+	})
+}
+
+// fileLayer is a layer with the contents of a file as they are, without compressing them
+type fileLayer struct {
+	file      string
+	mediaType types.MediaType
+	digest    container.Hash
+	size      int64
+}
+
+func newFileLayer(file string, mediaType types.MediaType) (*fileLayer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+	return &fileLayer{
+		file:      file,
+		mediaType: mediaType,
+		digest:    container.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))},
+		size:      size,
+	}, nil
+}
+
+func (l *fileLayer) Digest() (container.Hash, error)      { return l.digest, nil }
+func (l *fileLayer) DiffID() (container.Hash, error)      { return l.digest, nil }
+func (l *fileLayer) Compressed() (io.ReadCloser, error)   { return os.Open(l.file) }
+func (l *fileLayer) Uncompressed() (io.ReadCloser, error) { return os.Open(l.file) }
+func (l *fileLayer) Size() (int64, error)                 { return l.size, nil }
+func (l *fileLayer) MediaType() (types.MediaType, error)  { return l.mediaType, nil }
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/enki/pkg/pe"
+	ukiConstants "github.com/kairos-io/go-ukify/pkg/constants"
+)
+
+// SbatHeader is the first entry of every .sbat section, with the version of the SBAT format
+const SbatHeader = "sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md"
+
+// MergeSbat returns the .sbat section data with the given entries appended to the ones of sbat, skipping the ones
+// already there
+func MergeSbat(sbat string, entries []string) string {
+	lines := []string{SbatHeader}
+	for _, line := range append(strings.Split(sbat, "\n"), entries...) {
+		line = strings.TrimSpace(line)
+		if line == "" || slices.Contains(lines, line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// AddSbatEntries writes to output the EFI file at input with the given SBAT entries added to its .sbat section, or to
+// a new one if it has none. The file must not be signed.
+func AddSbatEntries(input, output string, entries []string) error {
+	sections, err := pe.Sections(input)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(sections, func(s pe.Section) bool { return s.Name == string(ukiConstants.SBAT) })
+	if i < 0 {
+		return pe.AddSections(input, output, []pe.Section{{Name: string(ukiConstants.SBAT), Data: []byte(MergeSbat("", entries))}})
+	}
+	sbat := string(bytes.TrimRight(sections[i].Data, "\x00"))
+	return pe.RewriteSection(input, output, string(ukiConstants.SBAT), []byte(MergeSbat(sbat, entries)))
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/kairos-io/enki/pkg/constants"
+	v1 "github.com/kairos-io/kairos-agent/v2/pkg/types/v1"
+)
+
+// SignManifest lists the unsigned EFI files of a build, so they can be signed later on another machine
+type SignManifest struct {
+	Files []SignFile `json:"files"`
+}
+
+// SignFile is an EFI file to sign
+type SignFile struct {
+	// Path is the path of the file relative to the manifest
+	Path string `json:"path"`
+	// SHA256 is the checksum of the unsigned file, to check it was not changed before signing it
+	SHA256 string `json:"sha256"`
+	// UKI is whether the PCR policies of the file are signed too
+	UKI bool `json:"uki,omitempty"`
+}
+
+// WriteSignManifest writes the manifest of the given files, relative to dir, into dir
+func WriteSignManifest(fs v1.FS, dir string, files []SignFile) error {
+	m := SignManifest{}
+	for _, f := range files {
+		sum, err := CalcFileChecksum(fs, filepath.Join(dir, f.Path))
+		if err != nil {
+			return err
+		}
+		f.SHA256 = sum
+		m.Files = append(m.Files, f)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(filepath.Join(dir, constants.SignManifestFile), append(data, '\n'), constants.FilePerm)
+}
+
+// ReadSignManifest reads the manifest in dir, checking the files were not changed since it was written
+func ReadSignManifest(fs v1.FS, dir string) (*SignManifest, error) {
+	data, err := fs.ReadFile(filepath.Join(dir, constants.SignManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &SignManifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", constants.SignManifestFile, err)
+	}
+	for _, f := range m.Files {
+		if !filepath.IsLocal(f.Path) {
+			return nil, fmt.Errorf("invalid path in %s: %s", constants.SignManifestFile, f.Path)
+		}
+		sum, err := CalcFileChecksum(fs, filepath.Join(dir, f.Path))
+		if err != nil {
+			return nil, err
+		}
+		if sum != f.SHA256 {
+			return nil, fmt.Errorf("%s changed since the build, it may be signed already", f.Path)
+		}
+	}
+	return m, nil
+}
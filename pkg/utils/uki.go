@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"slices"
+
+	"github.com/kairos-io/enki/pkg/pe"
+	"github.com/kairos-io/enki/pkg/signer"
+	ukiConstants "github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	ukiTypes "github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// ProfileSection is the section that starts a profile in a multi-profile UKI
+const ProfileSection = ".profile"
+
+// measuredSections are the UKI sections systemd-stub measures into PCR 11, in the order it measures them.
+// .pcrsig is left out as it holds the signature of the measurements.
+var measuredSections = []string{
+	string(ukiConstants.Linux),
+	string(ukiConstants.OSRel),
+	string(ukiConstants.CMDLine),
+	string(ukiConstants.Initrd),
+	".ucode",
+	string(ukiConstants.Splash),
+	string(ukiConstants.DTB),
+	string(ukiConstants.Uname),
+	string(ukiConstants.SBAT),
+	string(ukiConstants.PCRPKey),
+	ProfileSection,
+	".dtbauto",
+	".hwids",
+}
+
+// UkiProfile is a profile of a multi-profile UKI, which overrides the cmdline of the base UKI
+type UkiProfile struct {
+	ID      string
+	Title   string
+	Cmdline string
+}
+
+// AddUkiProfiles writes to output the UKI at input with a profile appended for each of the given ones. The UKI must
+// not be signed yet, its PCR policies are signed for every profile afterwards with AddUkiPCRSignatures.
+func AddUkiProfiles(input, output string, profiles []UkiProfile) error {
+	base, err := pe.Sections(input)
+	if err != nil {
+		return err
+	}
+	for _, s := range base {
+		if s.Name == ProfileSection {
+			return fmt.Errorf("%s already has profiles", input)
+		}
+	}
+
+	var sections []pe.Section
+	for _, p := range profiles {
+		sections = append(sections,
+			pe.Section{Name: ProfileSection, Data: []byte(fmt.Sprintf("ID=%s\nTITLE=%s\n", p.ID, p.Title))},
+			pe.Section{Name: string(ukiConstants.CMDLine), Data: []byte(p.Cmdline)},
+		)
+	}
+	return pe.AddSections(input, output, sections)
+}
+
+// AddUkiPCRSignatures writes to output the UKI at input with its PCR policies signed, as built without a PCR signer.
+// The .pcrpkey section with the public key of the first policy is added to the base sections, as it is measured too,
+// followed by the .pcrsig section of the base UKI and the one of every profile, as systemd-stub only measures the
+// sections of the profile it boots.
+func AddUkiPCRSignatures(input, output string, policies []signer.PCRPolicy) error {
+	if len(policies) == 0 {
+		return fmt.Errorf("no PCR policy keys")
+	}
+	sections, err := pe.Sections(input)
+	if err != nil {
+		return err
+	}
+	base, profiles := splitUkiProfiles(sections)
+	var added []pe.Section
+	for _, s := range sections {
+		if s.Name == string(ukiConstants.PCRSig) {
+			return fmt.Errorf("%s already has PCR signatures", input)
+		}
+	}
+	if !slices.ContainsFunc(base, func(s pe.Section) bool { return s.Name == string(ukiConstants.PCRPKey) }) {
+		publicKey, err := x509.MarshalPKIXPublicKey(policies[0].Key.PublicRSAKey())
+		if err != nil {
+			return err
+		}
+		pkey := pe.Section{Name: string(ukiConstants.PCRPKey), Data: pem.EncodeToMemory(&pem.Block{Type: ukiConstants.PEMTypeRSAPublic, Bytes: publicKey})}
+		base = append(base, pkey)
+		added = append(added, pkey)
+	}
+	sig, err := SignUkiPCR(base, policies)
+	if err != nil {
+		return fmt.Errorf("signing the PCR policy: %w", err)
+	}
+	added = append(added, pe.Section{Name: string(ukiConstants.PCRSig), Data: sig})
+
+	for _, profile := range profiles {
+		sig, err := SignUkiPCR(overrideSections(base, profile), policies)
+		if err != nil {
+			return fmt.Errorf("signing the PCR policy of profile %s: %w", ParseOsRelease(profile[0].Data)["ID"], err)
+		}
+		added = append(added, profile...)
+		added = append(added, pe.Section{Name: string(ukiConstants.PCRSig), Data: sig})
+	}
+	// The profiles are dropped and appended again after the new base sections
+	return pe.ReplaceSections(input, output, len(sections)-countSections(profiles), added)
+}
+
+// IsUki returns whether the EFI file is a UKI, with a kernel in it
+func IsUki(file string) (bool, error) {
+	sections, err := pe.Sections(file)
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(sections, func(s pe.Section) bool { return s.Name == string(ukiConstants.Linux) }), nil
+}
+
+func countSections(profiles [][]pe.Section) int {
+	n := 0
+	for _, p := range profiles {
+		n += len(p)
+	}
+	return n
+}
+
+// overrideSections returns the base sections replaced by the profile ones with the same name, as systemd-stub does
+// when booting the profile
+func overrideSections(base, profile []pe.Section) []pe.Section {
+	sections := map[string]pe.Section{}
+	for _, s := range base {
+		sections[s.Name] = s
+	}
+	for _, s := range profile {
+		sections[s.Name] = s
+	}
+	var merged []pe.Section
+	for _, s := range sections {
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// SignUkiPCR returns the .pcrsig section data, with the PCR 11 policies for the given UKI sections signed by every
+// policy key for each of its phase paths
+func SignUkiPCR(sections []pe.Section, policies []signer.PCRPolicy) ([]byte, error) {
+	data, algs := ukiTypes.GetTPMALGorithm()
+	for _, alg := range algs {
+		hashAlg, err := alg.Alg.Hash()
+		if err != nil {
+			return nil, err
+		}
+		measured := measureUkiSections(hashAlg, sections)
+		var banks []ukiTypes.BankData
+		for _, policy := range policies {
+			for _, phases := range policy.Phases {
+				// Extending replaces the hash, so a copy starts from the same sections measurements
+				digest := *measured
+				for _, phase := range phases {
+					pcr.MeasurePhase(phase, alg.Alg, &digest)
+				}
+				bank, err := pcr.SignPolicy(ukiConstants.UKIPCR, alg.Alg, policy.Key, &digest)
+				if err != nil {
+					return nil, err
+				}
+				banks = append(banks, bank)
+			}
+		}
+		*alg.BankDataSetter = banks
+	}
+	return json.Marshal(data)
+}
+
+// measureUkiSections returns the digest of PCR 11 after systemd-stub measures the given UKI sections, before any
+// boot phase is measured
+func measureUkiSections(hashAlg crypto.Hash, sections []pe.Section) *pcr.Digest {
+	digest := pcr.NewDigest(hashAlg)
+	for _, name := range measuredSections {
+		for _, s := range sections {
+			if s.Name != name {
+				continue
+			}
+			// Section names are measured NUL terminated
+			digest.Extend(append([]byte(s.Name), 0))
+			digest.Extend(s.Data)
+		}
+	}
+	return digest
+}
+
+// splitUkiProfiles returns the base sections of a UKI and the sections of each of its profiles, every profile
+// starting with its .profile section
+func splitUkiProfiles(sections []pe.Section) ([]pe.Section, [][]pe.Section) {
+	var base []pe.Section
+	var profiles [][]pe.Section
+	for _, s := range sections {
+		switch {
+		case s.Name == ProfileSection:
+			profiles = append(profiles, []pe.Section{s})
+		case len(profiles) > 0:
+			profiles[len(profiles)-1] = append(profiles[len(profiles)-1], s)
+		default:
+			base = append(base, s)
+		}
+	}
+	return base, profiles
+}
@@ -17,20 +17,61 @@ limitations under the License.
 package utils_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	debugpe "debug/pe"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	iofs "io/fs"
+	"log"
+	"math/big"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	efiutil "github.com/foxboron/go-uefi/efi/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	container "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-tpm/tpm2"
 	"github.com/kairos-io/enki/pkg/constants"
+	"github.com/kairos-io/enki/pkg/pe"
+	enkiSigner "github.com/kairos-io/enki/pkg/signer"
+	enkiTypes "github.com/kairos-io/enki/pkg/types"
 	"github.com/kairos-io/enki/pkg/utils"
+	ukiConstants "github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	ukiTypes "github.com/kairos-io/go-ukify/pkg/types"
 	v1mock "github.com/kairos-io/kairos-agent/v2/tests/mocks"
 	sdkTypes "github.com/kairos-io/kairos-sdk/types"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
-	"github.com/spf13/viper"
+	"github.com/pierrec/lz4/v4"
 	"github.com/twpayne/go-vfs/v5"
 	"github.com/twpayne/go-vfs/v5/vfst"
+	"github.com/ulikunitz/xz"
 )
 
 var _ = Describe("Utils", Label("utils"), func() {
@@ -181,6 +222,515 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(err).To(HaveOccurred())
 		})
 	})
+	Describe("SourceDateEpoch", Label("reproducible"), func() {
+		It("returns a zero time if not set", func() {
+			GinkgoT().Setenv(constants.SourceDateEpochEnv, "")
+			epoch, err := utils.SourceDateEpoch()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(epoch.IsZero()).To(BeTrue())
+		})
+		It("parses the timestamp", func() {
+			GinkgoT().Setenv(constants.SourceDateEpochEnv, "1715941820")
+			epoch, err := utils.SourceDateEpoch()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(epoch).To(Equal(time.Date(2024, 5, 17, 10, 30, 20, 0, time.UTC)))
+		})
+		It("fails on invalid values", func() {
+			GinkgoT().Setenv(constants.SourceDateEpochEnv, "yesterday")
+			_, err := utils.SourceDateEpoch()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("InitrdCompressor", Label("initrd"), func() {
+		decompress := func(algorithm string, data []byte) []byte {
+			var r io.Reader
+			var err error
+			switch algorithm {
+			case constants.ZstdCompression:
+				r, err = zstd.NewReader(bytes.NewReader(data))
+			case constants.XzCompression:
+				r, err = xz.NewReader(bytes.NewReader(data))
+			case constants.Lz4Compression:
+				Expect(data[:4]).To(Equal([]byte{0x02, 0x21, 0x4c, 0x18}), "not a legacy lz4 stream")
+				r = lz4.NewReader(bytes.NewReader(data))
+			case constants.GzipCompression:
+				r, err = gzip.NewReader(bytes.NewReader(data))
+			default:
+				r = bytes.NewReader(data)
+			}
+			Expect(err).ToNot(HaveOccurred())
+			out, err := io.ReadAll(r)
+			Expect(err).ToNot(HaveOccurred())
+			return out
+		}
+
+		It("compresses with every algorithm and level", func() {
+			input := bytes.Repeat([]byte("kairos initramfs contents "), 10000)
+			for _, algorithm := range constants.InitrdCompressions() {
+				for _, level := range []int{0, constants.InitrdCompressionMaxLevel(algorithm)} {
+					out := &bytes.Buffer{}
+					w, err := utils.NewInitrdCompressor(out, algorithm, level)
+					Expect(err).ToNot(HaveOccurred(), algorithm)
+					_, err = w.Write(input)
+					Expect(err).ToNot(HaveOccurred(), algorithm)
+					Expect(w.Close()).To(Succeed(), algorithm)
+					if algorithm != constants.NoCompression {
+						Expect(out.Len()).To(BeNumerically("<", len(input)), algorithm)
+					}
+					Expect(decompress(algorithm, out.Bytes())).To(Equal(input), algorithm)
+				}
+			}
+		})
+		It("fails with invalid algorithms or levels", func() {
+			_, err := utils.NewInitrdCompressor(io.Discard, "bzip2", 0)
+			Expect(err).To(HaveOccurred())
+			_, err = utils.NewInitrdCompressor(io.Discard, constants.GzipCompression, 10)
+			Expect(err).To(HaveOccurred())
+			_, err = utils.NewInitrdCompressor(io.Discard, constants.ZstdCompression, 23)
+			Expect(err).To(HaveOccurred())
+		})
+		It("finds the kernel configs without support for the algorithm", func() {
+			root, err := os.MkdirTemp("", "enki-kernel-config-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, root)
+			Expect(os.MkdirAll(filepath.Join(root, "boot"), constants.DirPerm)).To(Succeed())
+			config := filepath.Join(root, "boot", "config-6.6.0")
+			Expect(os.WriteFile(config, []byte("CONFIG_RD_GZIP=y\n# CONFIG_RD_LZ4 is not set\nCONFIG_RD_ZSTD=y\n"), constants.FilePerm)).To(Succeed())
+
+			Expect(utils.KernelConfigsWithoutInitrdCompression(root, constants.ZstdCompression)).To(BeEmpty())
+			Expect(utils.KernelConfigsWithoutInitrdCompression(root, constants.NoCompression)).To(BeEmpty())
+			Expect(utils.KernelConfigsWithoutInitrdCompression(root, constants.Lz4Compression)).To(ConsistOf(config))
+			Expect(utils.KernelConfigsWithoutInitrdCompression(filepath.Join(root, "boot"), constants.Lz4Compression)).To(BeEmpty())
+		})
+	})
+	Describe("PathFilter", Label("filter"), func() {
+		var root string
+		BeforeEach(func() {
+			var err error
+			root, err = os.MkdirTemp("", "enki-filter-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, root)
+			for file, size := range map[string]int{
+				"usr/share/doc/pkg/README":             100,
+				"usr/share/doc/pkg/LICENSE":            50,
+				"usr/share/locale/de/LC_MESSAGES/a.mo": 10,
+				"usr/share/locale/en/LC_MESSAGES/a.mo": 20,
+				"usr/lib/python/mod/__init__.pyc":      30,
+				"usr/bin/tool":                         40,
+			} {
+				Expect(os.MkdirAll(filepath.Join(root, filepath.Dir(file)), constants.DirPerm)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(root, file), make([]byte, size), constants.FilePerm)).To(Succeed())
+			}
+		})
+		walk := func(filter *utils.PathFilter) []string {
+			var kept []string
+			err := filepath.WalkDir(root, func(file string, d iofs.DirEntry, err error) error {
+				Expect(err).ToNot(HaveOccurred())
+				rel, _ := filepath.Rel(root, file)
+				if rel == "." {
+					return nil
+				}
+				if filter.Skip(rel, d) {
+					if d.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !d.IsDir() {
+					kept = append(kept, rel)
+				}
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return kept
+		}
+
+		It("excludes and includes files with glob patterns", func() {
+			filter, err := utils.NewPathFilter(root,
+				[]string{"/usr/share/doc", "usr/share/locale/*", "**/*.pyc"},
+				[]string{"/usr/share/locale/en"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(walk(filter)).To(ConsistOf("usr/share/locale/en/LC_MESSAGES/a.mo", "usr/bin/tool"))
+
+			rules := filter.Excludes()
+			Expect(rules).To(HaveLen(3))
+			Expect(rules[0].Pattern).To(Equal("/usr/share/doc"))
+			Expect(rules[0].Files).To(Equal(4))
+			Expect(rules[0].Bytes).To(Equal(int64(150)))
+			Expect(rules[1].Files).To(Equal(3))
+			Expect(rules[1].Bytes).To(Equal(int64(10)))
+			Expect(rules[2].Files).To(Equal(1))
+			Expect(rules[2].Bytes).To(Equal(int64(30)))
+		})
+		It("fails with invalid patterns", func() {
+			_, err := utils.NewPathFilter(root, []string{"/usr/[a"}, nil)
+			Expect(err).To(HaveOccurred())
+			_, err = utils.NewPathFilter(root, nil, []string{"/"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("LargestPaths", Label("size"), func() {
+		It("returns the biggest directories and files", func() {
+			dirs, files := utils.LargestPaths(map[string]int64{
+				"usr/lib/modules/6.6/kernel/drivers/gpu/amdgpu.ko": 300,
+				"usr/lib/modules/6.6/kernel/net/wifi.ko":           100,
+				"usr/lib/firmware/nvidia/gsp.bin":                  250,
+				"usr/bin/tool":                                     40,
+				"init":                                             10,
+			}, 3, 3)
+			Expect(dirs).To(Equal([]utils.PathSize{
+				{Path: "usr", Size: 690},
+				{Path: "usr/lib", Size: 650},
+				{Path: "usr/lib/modules", Size: 400},
+			}))
+			Expect(files).To(Equal([]utils.PathSize{
+				{Path: "usr/lib/modules/6.6/kernel/drivers/gpu/amdgpu.ko", Size: 300},
+				{Path: "usr/lib/firmware/nvidia/gsp.bin", Size: 250},
+				{Path: "usr/lib/modules/6.6/kernel/net/wifi.ko", Size: 100},
+			}))
+		})
+	})
+	Describe("Tar", Label("tar"), func() {
+		var src, out string
+		BeforeEach(func() {
+			var err error
+			src, err = os.MkdirTemp("", "enki-tar-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, src)
+			out, err = os.MkdirTemp("", "enki-tar-out-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, out)
+			Expect(os.MkdirAll(filepath.Join(src, "EFI", "kairos"), constants.DirPerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(src, "EFI", "kairos", "norole.efi"), []byte("efi"), constants.FilePerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(src, "loader.conf"), []byte("conf"), constants.FilePerm)).To(Succeed())
+		})
+		It("generates the same tarball and image when a timestamp is given", func() {
+			epoch := time.Date(2024, 5, 17, 10, 30, 20, 0, time.UTC)
+			build := func() ([]byte, []byte) {
+				var tarball bytes.Buffer
+				Expect(utils.Tar(src, epoch, &tarball)).To(Succeed())
+				imageFile := filepath.Join(out, "image.tar")
+				spec := utils.ContainerSpec{Name: "test:latest", Arch: "amd64", OS: "linux", Created: epoch}
+				_, err := utils.CreateContainer(src, imageFile, spec)
+				Expect(err).ToNot(HaveOccurred())
+				image, err := os.ReadFile(imageFile)
+				Expect(err).ToNot(HaveOccurred())
+				return tarball.Bytes(), image
+			}
+			firstTar, firstImage := build()
+			now := time.Now()
+			Expect(os.Chtimes(filepath.Join(src, "loader.conf"), now, now)).To(Succeed())
+			secondTar, secondImage := build()
+			Expect(secondTar).To(Equal(firstTar))
+			Expect(secondImage).To(Equal(firstImage))
+
+			gz, err := gzip.NewReader(bytes.NewReader(firstTar))
+			Expect(err).ToNot(HaveOccurred())
+			tr := tar.NewReader(gz)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				Expect(header.ModTime.Equal(epoch)).To(BeTrue())
+				Expect(header.Uid).To(BeZero())
+			}
+		})
+	})
+	Describe("CreateContainer", Label("oci"), func() {
+		var src, out string
+		BeforeEach(func() {
+			var err error
+			src, err = os.MkdirTemp("", "enki-container-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, src)
+			out, err = os.MkdirTemp("", "enki-container-out-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, out)
+			Expect(os.WriteFile(filepath.Join(src, "loader.conf"), []byte("conf"), constants.FilePerm)).To(Succeed())
+		})
+		It("writes an OCI layout with labels, annotations and a zstd layer", func() {
+			labels := map[string]string{"org.opencontainers.image.version": "v3.2.1", "io.kairos.flavor": "ubuntu"}
+			_, err := utils.CreateContainer(src, filepath.Join(out, "layout"), utils.ContainerSpec{
+				Name:        "v3.2.1-arm64",
+				Arch:        "arm64",
+				OS:          "linux",
+				Labels:      labels,
+				Compression: constants.ZstdCompression,
+				Format:      constants.OCIContainerFormat,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			p, err := layout.FromPath(filepath.Join(out, "layout"))
+			Expect(err).ToNot(HaveOccurred())
+			idx, err := p.ImageIndex()
+			Expect(err).ToNot(HaveOccurred())
+			index, err := idx.IndexManifest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(index.Manifests).To(HaveLen(1))
+			Expect(index.Manifests[0].Annotations).To(HaveKeyWithValue("org.opencontainers.image.ref.name", "v3.2.1-arm64"))
+			img, err := idx.Image(index.Manifests[0].Digest)
+			Expect(err).ToNot(HaveOccurred())
+
+			manifest, err := img.Manifest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.MediaType).To(Equal(types.OCIManifestSchema1))
+			Expect(manifest.Config.MediaType).To(Equal(types.OCIConfigJSON))
+			Expect(manifest.Annotations).To(Equal(labels))
+			Expect(manifest.Layers).To(HaveLen(1))
+			Expect(manifest.Layers[0].MediaType).To(Equal(types.OCILayerZStd))
+			cfg, err := img.ConfigFile()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cfg.Architecture).To(Equal("arm64"))
+			Expect(cfg.Config.Labels).To(Equal(labels))
+
+			layers, err := img.Layers()
+			Expect(err).ToNot(HaveOccurred())
+			rc, err := layers[0].Uncompressed()
+			Expect(err).ToNot(HaveOccurred())
+			defer rc.Close()
+			header, err := tar.NewReader(rc).Next()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(header.Name).To(Equal("loader.conf"))
+		})
+	})
+	Describe("Push", Label("oci", "push"), func() {
+		var out, registryHost string
+		BeforeEach(func() {
+			var err error
+			out, err = os.MkdirTemp("", "enki-push-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, out)
+			server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+			DeferCleanup(server.Close)
+			registryHost = strings.TrimPrefix(server.URL, "http://")
+			// Use an empty docker config, so no credentials are sent to the local registry
+			GinkgoT().Setenv("DOCKER_CONFIG", out)
+		})
+		It("pushes a container image", func() {
+			Expect(os.MkdirAll(filepath.Join(out, "src"), constants.DirPerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(out, "src", "loader.conf"), []byte("conf"), constants.FilePerm)).To(Succeed())
+			spec := utils.ContainerSpec{Name: "test:latest", Arch: "amd64", OS: "linux", Format: constants.OCIContainerFormat}
+			img, err := utils.CreateContainer(filepath.Join(out, "src"), filepath.Join(out, "layout"), spec)
+			Expect(err).ToNot(HaveOccurred())
+			pushed, err := utils.PushImage(img, registryHost+"/kairos/uki:v1.0.0")
+			Expect(err).ToNot(HaveOccurred())
+			digest, err := img.Digest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pushed).To(Equal(registryHost + "/kairos/uki@" + digest.String()))
+
+			ref, err := name.ParseReference(registryHost + "/kairos/uki:v1.0.0")
+			Expect(err).ToNot(HaveOccurred())
+			remoteImg, err := remote.Image(ref)
+			Expect(err).ToNot(HaveOccurred())
+			remoteDigest, err := remoteImg.Digest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(remoteDigest).To(Equal(digest))
+		})
+		It("pushes a file as an OCI artifact", func() {
+			raw := filepath.Join(out, "test.sysext.raw")
+			Expect(os.WriteFile(raw, []byte("sysext contents"), constants.FilePerm)).To(Succeed())
+			artifact, err := utils.FileArtifact(raw, constants.SysextArtifactType, constants.SysextLayerType, &container.Platform{OS: "linux", Architecture: "arm64"})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = utils.PushImage(artifact, registryHost+"/kairos/sysext:v1.0.0")
+			Expect(err).ToNot(HaveOccurred())
+
+			ref, err := name.ParseReference(registryHost + "/kairos/sysext:v1.0.0")
+			Expect(err).ToNot(HaveOccurred())
+			remoteImg, err := remote.Image(ref)
+			Expect(err).ToNot(HaveOccurred())
+			manifest, err := remoteImg.Manifest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifest.Config.MediaType).To(Equal(types.MediaType(constants.SysextArtifactType)))
+			Expect(manifest.Layers).To(HaveLen(1))
+			Expect(manifest.Layers[0].MediaType).To(Equal(types.MediaType(constants.SysextLayerType)))
+			Expect(manifest.Layers[0].Annotations).To(HaveKeyWithValue("org.opencontainers.image.title", "test.sysext.raw"))
+			layers, err := remoteImg.Layers()
+			Expect(err).ToNot(HaveOccurred())
+			rc, err := layers[0].Compressed()
+			Expect(err).ToNot(HaveOccurred())
+			defer rc.Close()
+			data, err := io.ReadAll(rc)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("sysext contents"))
+		})
+	})
+	Describe("SystemdBootVersion", Label("loader"), func() {
+		It("reads the version from the LoaderInfo string", func() {
+			dir, err := os.MkdirTemp("", "enki-sdboot-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, dir)
+			efi := filepath.Join(dir, "systemd-bootx64.efi")
+			Expect(os.WriteFile(efi, []byte("MZ\x00\x00#### LoaderInfo: systemd-boot 254.5 ####\x00"), constants.FilePerm)).To(Succeed())
+			version, err := utils.SystemdBootVersion(efi)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version).To(Equal(254))
+
+			Expect(os.WriteFile(efi, []byte("MZ\x00\x00"), constants.FilePerm)).To(Succeed())
+			_, err = utils.SystemdBootVersion(efi)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("ReadKairosRelease", Label("release"), func() {
+		It("reads quoted and unquoted values", func() {
+			root, err := os.MkdirTemp("", "enki-release-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, root)
+			Expect(os.MkdirAll(filepath.Join(root, "etc"), constants.DirPerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(root, "etc", "kairos-release"), []byte(strings.Join([]string{
+				"# comment",
+				`KAIROS_RELEASE="v3.2.1"`,
+				"KAIROS_FLAVOR=ubuntu",
+				"KAIROS_MODEL='generic'",
+			}, "\n")), constants.FilePerm)).To(Succeed())
+			release, err := utils.ReadKairosRelease(root)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(release).To(Equal(map[string]string{"KAIROS_RELEASE": "v3.2.1", "KAIROS_FLAVOR": "ubuntu", "KAIROS_MODEL": "generic"}))
+		})
+	})
+	Describe("CreateImageIndex", Label("oci"), func() {
+		var out string
+		var images []string
+		epoch := time.Date(2024, 5, 17, 10, 30, 20, 0, time.UTC)
+		BeforeEach(func() {
+			var err error
+			out, err = os.MkdirTemp("", "enki-oci-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, out)
+			Expect(os.MkdirAll(filepath.Join(out, "src"), constants.DirPerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(out, "src", "loader.conf"), []byte("conf"), constants.FilePerm)).To(Succeed())
+			images = nil
+			for _, arch := range []string{"x86_64", "aarch64"} {
+				image := filepath.Join(out, fmt.Sprintf("image-%s.tar", arch))
+				spec := utils.ContainerSpec{Name: "test:latest", Arch: utils.ContainerArch(arch), OS: "linux", Created: epoch}
+				_, err := utils.CreateContainer(filepath.Join(out, "src"), image, spec)
+				Expect(err).ToNot(HaveOccurred())
+				images = append(images, image)
+			}
+		})
+		platforms := func(dir string) []string {
+			p, err := layout.FromPath(dir)
+			Expect(err).ToNot(HaveOccurred())
+			root, err := p.ImageIndex()
+			Expect(err).ToNot(HaveOccurred())
+			rootManifest, err := root.IndexManifest()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rootManifest.Manifests).To(HaveLen(1))
+			Expect(rootManifest.Manifests[0].Annotations).To(HaveKeyWithValue("org.opencontainers.image.ref.name", "v1.0.0"))
+			idx, err := root.ImageIndex(rootManifest.Manifests[0].Digest)
+			Expect(err).ToNot(HaveOccurred())
+			manifest, err := idx.IndexManifest()
+			Expect(err).ToNot(HaveOccurred())
+			var result []string
+			for _, m := range manifest.Manifests {
+				result = append(result, m.Platform.String())
+			}
+			return result
+		}
+		It("writes an OCI layout with an image per platform", func() {
+			Expect(utils.CreateImageIndex(images, filepath.Join(out, "layout"), "v1.0.0", epoch)).To(Succeed())
+			Expect(platforms(filepath.Join(out, "layout"))).To(Equal([]string{"linux/amd64", "linux/arm64"}))
+		})
+		It("writes the same tarball of the layout twice", func() {
+			Expect(utils.CreateImageIndex(images, filepath.Join(out, "first.tar"), "v1.0.0", epoch)).To(Succeed())
+			Expect(utils.CreateImageIndex(images, filepath.Join(out, "second.tar"), "v1.0.0", epoch)).To(Succeed())
+			first, err := os.ReadFile(filepath.Join(out, "first.tar"))
+			Expect(err).ToNot(HaveOccurred())
+			second, err := os.ReadFile(filepath.Join(out, "second.tar"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first).To(Equal(second))
+
+			tr := tar.NewReader(bytes.NewReader(first))
+			var names []string
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				names = append(names, header.Name)
+			}
+			Expect(names).To(ContainElements("oci-layout", "index.json", "blobs/"))
+		})
+		It("reads images from OCI layouts", func() {
+			spec := utils.ContainerSpec{Arch: "arm64", OS: "linux", Created: epoch, Format: constants.OCIContainerFormat}
+			_, err := utils.CreateContainer(filepath.Join(out, "src"), filepath.Join(out, "arm64"), spec)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(utils.CreateImageIndex([]string{images[0], filepath.Join(out, "arm64")}, filepath.Join(out, "layout"), "v1.0.0", epoch)).To(Succeed())
+			Expect(platforms(filepath.Join(out, "layout"))).To(Equal([]string{"linux/amd64", "linux/arm64"}))
+		})
+		It("fails with two images of the same platform", func() {
+			err := utils.CreateImageIndex([]string{images[0], images[0]}, filepath.Join(out, "layout"), "", epoch)
+			Expect(err).To(MatchError(ContainSubstring("linux/amd64")))
+		})
+	})
+	Describe("ISOWriter", Label("iso"), func() {
+		var tmpDir string
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = os.MkdirTemp("", "enki-iso-writer-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+			Expect(os.MkdirAll(filepath.Join(tmpDir, "root"), constants.DirPerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(tmpDir, "root", "efiboot.img"), make([]byte, 4096), constants.FilePerm)).To(Succeed())
+		})
+		It("writes the iso natively by default", func() {
+			spec := utils.ISOSpec{
+				Label:     "UKI_ISO_INSTALL",
+				Root:      filepath.Join(tmpDir, "root"),
+				Output:    filepath.Join(tmpDir, "test.iso"),
+				HybridGPT: true,
+				EFIImage:  "efiboot.img",
+			}
+			Expect(utils.NewISOWriter("", runner, logger).Write(spec)).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{})).To(Succeed())
+			data, err := os.ReadFile(spec.Output)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data[16*2048+1 : 16*2048+6])).To(Equal("CD001"))
+			Expect(string(data[512 : 512+8])).To(Equal("EFI PART"))
+		})
+		It("calls xorriso with the xorriso backend", func() {
+			spec := utils.ISOSpec{
+				Label:     "UKI_ISO_INSTALL",
+				Root:      "root",
+				Output:    "test.iso",
+				HybridGPT: true,
+				EFIImage:  "efiboot.img",
+			}
+			Expect(utils.NewISOWriter(constants.XorrisoISOBackend, runner, logger).Write(spec)).To(Succeed())
+			Expect(runner.CmdsMatch([][]string{
+				{"xorriso", "-as", "mkisofs", "-V", "UKI_ISO_INSTALL", "-isohybrid-gpt-basdat", "-e", "efiboot.img", "-no-emul-boot", "-o", "test.iso", "root"},
+			})).To(Succeed())
+
+			var args string
+			runner.SideEffect = func(cmd string, a ...string) ([]byte, error) {
+				args = strings.Join(a, " ")
+				return []byte{}, nil
+			}
+			spec = utils.ISOSpec{
+				Label:        "COS_LIVE",
+				Root:         "root",
+				Output:       "test.iso",
+				BIOSImage:    constants.IsoBootFile,
+				BootCatalog:  constants.IsoBootCatalog,
+				HybridMBR:    "root" + constants.IsoHybridMBR,
+				EFIPartition: "root" + constants.IsoEFIPath,
+			}
+			Expect(utils.NewISOWriter(constants.XorrisoISOBackend, runner, logger).Write(spec)).To(Succeed())
+			Expect(runner.IncludesCmds([][]string{
+				{"xorriso", "-volid", "COS_LIVE", "-joliet", "on", "-padding", "0", "-outdev", "test.iso", "-map", "root", "/"},
+			})).To(Succeed())
+			Expect(args).To(ContainSubstring("bin_path=" + constants.IsoBootFile))
+			Expect(args).To(ContainSubstring("grub2_mbr=root" + constants.IsoHybridMBR))
+			Expect(args).To(ContainSubstring("cat_path=" + constants.IsoBootCatalog))
+			Expect(args).To(ContainSubstring("-append_partition 2 0xef root" + constants.IsoEFIPath))
+
+			runner.SideEffect = nil
+			runner.ReturnError = errors.New("xorriso failed")
+			Expect(utils.NewISOWriter(constants.XorrisoISOBackend, runner, logger).Write(spec)).ToNot(Succeed())
+		})
+	})
 	Describe("GetUkiCmdline", Label("GetUkiCmdline"), func() {
 		var defaultCmdline string
 		BeforeEach(func() {
@@ -188,13 +738,14 @@ var _ = Describe("Utils", Label("utils"), func() {
 		})
 
 		It("returns the default cmdline", func() {
-			entries := utils.GetUkiCmdline()
+			entries, err := utils.GetUkiCmdline("Kairos", "", nil, nil)
+			Expect(err).ToNot(HaveOccurred())
 			Expect(entries[0].Cmdline).To(Equal(defaultCmdline))
 		})
 
 		It("returns the default cmdline with the cmdline flag and install-mode", func() {
-			viper.Set("extra-cmdline", []string{"key=value testkey"})
-			entries := utils.GetUkiCmdline()
+			entries, err := utils.GetUkiCmdline("Kairos", "", []string{"key=value testkey"}, nil)
+			Expect(err).ToNot(HaveOccurred())
 			cmdlines := []string{}
 			for _, entry := range entries {
 				cmdlines = append(cmdlines, entry.Cmdline)
@@ -204,8 +755,8 @@ var _ = Describe("Utils", Label("utils"), func() {
 		})
 
 		It("returns more than one cmdline with the cmdline flag if specified multiple values", func() {
-			viper.Set("extra-cmdline", []string{"key=value testkey", "another=value anotherkey"})
-			entries := utils.GetUkiCmdline()
+			entries, err := utils.GetUkiCmdline("Kairos", "", []string{"key=value testkey", "another=value anotherkey"}, nil)
+			Expect(err).ToNot(HaveOccurred())
 			cmdlines := []string{}
 			for _, entry := range entries {
 				cmdlines = append(cmdlines, entry.Cmdline)
@@ -218,15 +769,56 @@ var _ = Describe("Utils", Label("utils"), func() {
 			Expect(cmdlines).To(ContainElements(defaultCmdline + " another=value anotherkey"))
 		})
 
+		It("uses the entries of the manifest", func() {
+			entries, err := utils.GetUkiCmdline("Kairos", "", nil, []enkiTypes.UkiEntry{
+				{Cmdline: ""},
+				{Title: "Recovery", Cmdline: "rd.immucore.recovery", FileName: "recovery", SortKey: "b", Default: true},
+				{Title: "Active", Cmdline: "a=b", FileName: "active", Tries: 3},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(Equal([]utils.BootEntry{
+				{Title: "Kairos", Cmdline: defaultCmdline, FileName: "norole"},
+				{Title: "Recovery", Cmdline: defaultCmdline + " rd.immucore.recovery", FileName: "recovery", SortKey: "b", Default: true},
+				{Title: "Active", Cmdline: defaultCmdline + " a=b", FileName: "active", Tries: 3},
+			}))
+		})
+
+		It("fails with duplicated or invalid file names", func() {
+			_, err := utils.GetUkiCmdline("Kairos", "", nil, []enkiTypes.UkiEntry{{FileName: "entry"}, {FileName: "Entry", Cmdline: "a=b"}})
+			Expect(err).To(MatchError(ContainSubstring("same file name")))
+			_, err = utils.GetUkiCmdline("Kairos", "", nil, []enkiTypes.UkiEntry{{FileName: "../entry"}})
+			Expect(err).To(MatchError(ContainSubstring("invalid boot entry file name")))
+			_, err = utils.GetUkiCmdline("Kairos", "", nil, []enkiTypes.UkiEntry{{FileName: "a", Default: true}, {FileName: "b", Default: true}})
+			Expect(err).To(MatchError(ContainSubstring("more than one default")))
+			_, err = utils.GetUkiCmdline("Kairos", "", nil, []enkiTypes.UkiEntry{{FileName: "a", Tries: -1}})
+			Expect(err).To(MatchError(ContainSubstring("invalid tries")))
+		})
+
 		It("expands the default cmdline if extended-cmdline is used", func() {
-			viper.Set("extend-cmdline", "key=value testkey")
-			entries := utils.GetUkiCmdline()
+			entries, err := utils.GetUkiCmdline("Kairos", "key=value testkey", nil, nil)
+			Expect(err).ToNot(HaveOccurred())
 			for _, entry := range entries {
 				Expect(entry.Cmdline).To(MatchRegexp(".*key=value testkey"))
 			}
 		})
 	})
 
+	Describe("BootEntry", Label("BootEntry"), func() {
+		It("adds the boot counting suffix to the conf file name", func() {
+			Expect(utils.BootEntry{FileName: "active"}.ConfName()).To(Equal("active.conf"))
+			Expect(utils.BootEntry{FileName: "active", Tries: 3}.ConfName()).To(Equal("active+3.conf"))
+		})
+		It("boots the shared multi-profile UKI if set", func() {
+			Expect(utils.BootEntry{FileName: "debug"}.EfiName()).To(Equal("debug"))
+			Expect(utils.BootEntry{FileName: "debug", UKI: "kairos", Profile: 1}.EfiName()).To(Equal("kairos"))
+		})
+		It("matches the entry names against glob patterns", func() {
+			Expect(utils.MatchesAny("norole", nil)).To(BeTrue())
+			Expect(utils.MatchesAny("norole", []string{"recovery", "no*"})).To(BeTrue())
+			Expect(utils.MatchesAny("recovery", []string{"active", "no*"})).To(BeFalse())
+		})
+	})
+
 	Describe("GetUkiSingleCmdlines", Label("GetUkiSingleCmdlines"), func() {
 		var defaultCmdline string
 		BeforeEach(func() {
@@ -234,13 +826,698 @@ var _ = Describe("Utils", Label("utils"), func() {
 		})
 
 		It("returns the specified entry", func() {
-			viper.Set("single-efi-cmdline", []string{"My Entry: key=value"})
-			viper.Set("boot-branding", "Kairos")
-
-			entries := utils.GetUkiSingleCmdlines(sdkTypes.NewNullLogger())
+			entries := utils.GetUkiSingleCmdlines("Kairos", []string{"My Entry: key=value"}, sdkTypes.NewNullLogger())
 			Expect(entries[0].Cmdline).To(MatchRegexp(defaultCmdline + "  key=value"))
 			Expect(entries[0].Title).To(ContainSubstring("Kairos (My Entry)"))
 			Expect(entries[0].FileName).To(Equal("My_Entry"))
 		})
+
+		It("does not take a cmdline value with a colon as a title", func() {
+			entries := utils.GetUkiSingleCmdlines("Kairos", []string{"ip=10.0.0.2::10.0.0.1:255.255.255.0"}, sdkTypes.NewNullLogger())
+			Expect(entries[0].Cmdline).To(Equal(defaultCmdline + " ip=10.0.0.2::10.0.0.1:255.255.255.0"))
+			Expect(entries[0].Title).To(Equal("Kairos"))
+			Expect(utils.ValidateBootEntries(entries)).To(Succeed())
+		})
+	})
+
+	Describe("SignUkiPCR", Label("SignUkiPCR"), func() {
+		var tmpDir string
+		var signer *pesign.PCRSigner
+		var sections []pe.Section
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = os.MkdirTemp("", "enki-pcr-test-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			keyFile := filepath.Join(tmpDir, "tpm2-pcr-private.pem")
+			Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)).To(Succeed())
+			signer, err = pesign.NewPCRSigner(keyFile)
+			Expect(err).ToNot(HaveOccurred())
+			sections = []pe.Section{
+				{Name: ".text", Data: []byte("stub code")},
+				{Name: ".sbat", Data: []byte("sbat,1\n")},
+				{Name: ".osrel", Data: []byte("ID=kairos\n")},
+				{Name: ".cmdline", Data: []byte("console=tty1")},
+				{Name: ".initrd", Data: []byte("initrd")},
+				{Name: ".linux", Data: []byte("kernel")},
+			}
+		})
+
+		It("measures the sections like go-ukify", func() {
+			data := measure.SectionsData{}
+			for _, s := range sections[1:] {
+				file := filepath.Join(tmpDir, s.Name)
+				Expect(os.WriteFile(file, s.Data, 0644)).To(Succeed())
+				data[ukiConstants.Section(s.Name)] = file
+			}
+			expected, err := measure.GenerateSignedPCR(data, ukiTypes.OrderedPhases(), signer, ukiConstants.UKIPCR)
+			Expect(err).ToNot(HaveOccurred())
+			expectedJSON, err := json.Marshal(expected)
+			Expect(err).ToNot(HaveOccurred())
+
+			sig, err := utils.SignUkiPCR(sections, pcrPolicies(signer))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sig).To(MatchJSON(expectedJSON))
+		})
+
+		It("signs the phase paths of every key", func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			keyFile := filepath.Join(tmpDir, "initrd.pem")
+			Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)).To(Succeed())
+			initrdSigner, err := pesign.NewPCRSigner(keyFile)
+			Expect(err).ToNot(HaveOccurred())
+			initrdPhases, err := enkiSigner.ParsePhases("enter-initrd")
+			Expect(err).ToNot(HaveOccurred())
+			systemPhases, err := enkiSigner.ParsePhases("enter-initrd:leave-initrd,enter-initrd:leave-initrd:sysinit")
+			Expect(err).ToNot(HaveOccurred())
+
+			sig, err := utils.SignUkiPCR(sections, []enkiSigner.PCRPolicy{
+				{Key: initrdSigner, Phases: initrdPhases},
+				{Key: signer, Phases: systemPhases},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defaultSig, err := utils.SignUkiPCR(sections, pcrPolicies(signer))
+			Expect(err).ToNot(HaveOccurred())
+
+			data, defaultData := ukiTypes.PCRData{}, ukiTypes.PCRData{}
+			Expect(json.Unmarshal(sig, &data)).To(Succeed())
+			Expect(json.Unmarshal(defaultSig, &defaultData)).To(Succeed())
+			for _, banks := range [][]ukiTypes.BankData{data.SHA1, data.SHA256, data.SHA384, data.SHA512} {
+				Expect(banks).To(HaveLen(3))
+			}
+			// Same phases, same policy, whatever the key
+			Expect(data.SHA256[0].Pol).To(Equal(defaultData.SHA256[0].Pol))
+			Expect(data.SHA256[0].PKFP).ToNot(Equal(defaultData.SHA256[0].PKFP))
+			Expect(data.SHA256[1:]).To(Equal(defaultData.SHA256[1:3]))
+		})
+
+		It("measures the profile section", func() {
+			sig, err := utils.SignUkiPCR(sections, pcrPolicies(signer))
+			Expect(err).ToNot(HaveOccurred())
+			withProfile, err := utils.SignUkiPCR(append(sections, pe.Section{Name: utils.ProfileSection, Data: []byte("ID=debug\n")}), pcrPolicies(signer))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(withProfile).ToNot(MatchJSON(sig))
+		})
+	})
+
+	Describe("PredictPCRs", Label("pcr"), func() {
+		var tmpDir, stub, uki string
+		var sections []pe.Section
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = os.MkdirTemp("", "enki-pcr-predict-test-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+			stub = filepath.Join(tmpDir, "BOOTX64.EFI")
+			Expect(os.WriteFile(stub, efiImage(), constants.FilePerm)).To(Succeed())
+			sections = []pe.Section{
+				{Name: ".osrel", Data: []byte("ID=kairos\n")},
+				{Name: ".cmdline", Data: []byte("console=tty1")},
+				{Name: ".initrd", Data: []byte("initrd")},
+				{Name: ".linux", Data: efiImage()},
+			}
+			uki = filepath.Join(tmpDir, "uki.efi")
+			Expect(pe.AddSections(stub, uki, sections)).To(Succeed())
+		})
+
+		It("predicts the PCR 11 values of a UKI like go-ukify", func() {
+			data := measure.SectionsData{}
+			for _, s := range sections {
+				file := filepath.Join(tmpDir, s.Name)
+				Expect(os.WriteFile(file, s.Data, constants.FilePerm)).To(Succeed())
+				data[ukiConstants.Section(s.Name)] = file
+			}
+			digest, err := pcr.MeasureSections(tpm2.TPMAlgSHA256, data)
+			Expect(err).ToNot(HaveOccurred())
+			var expected []string
+			for _, phase := range ukiTypes.OrderedPhases() {
+				digest = pcr.MeasurePhase(phase, tpm2.TPMAlgSHA256, digest)
+				expected = append(expected, hex.EncodeToString(digest.Hash()))
+			}
+
+			prediction, err := utils.PredictPCRs([]string{stub, uki}, "", constants.DefaultPCRBank)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prediction.Files).To(HaveLen(2))
+			Expect(prediction.Files[0].Profiles).To(BeEmpty())
+			Expect(prediction.Files[1].Profiles).To(HaveLen(1))
+			var values []string
+			for _, v := range prediction.Files[1].Profiles[0].PCR11 {
+				values = append(values, v.Value)
+			}
+			Expect(values).To(Equal(expected))
+			Expect(prediction.Files[1].Profiles[0].PCR11[0].Phase).To(Equal("enter-initrd"))
+		})
+
+		It("reports the Authenticode hashes of the files and the kernel", func() {
+			bin, err := authenticode.Parse(bytes.NewReader(efiImage()))
+			Expect(err).ToNot(HaveOccurred())
+			kernelHash := hex.EncodeToString(bin.Hash(crypto.SHA256))
+
+			prediction, err := utils.PredictPCRs([]string{stub, uki}, "", constants.DefaultPCRBank)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prediction.Files[0].PCR4).To(Equal([]utils.PCREvent{{Description: "BOOTX64.EFI", Digest: kernelHash}}))
+			Expect(prediction.Files[1].PCR4).To(HaveLen(2))
+			Expect(prediction.Files[1].PCR4[0].Digest).ToNot(Equal(kernelHash))
+			Expect(prediction.Files[1].PCR4[1]).To(Equal(utils.PCREvent{Description: "uki.efi kernel", Digest: kernelHash}))
+		})
+
+		It("predicts every profile of a multi-profile UKI, with its signed policy", func() {
+			multi := filepath.Join(tmpDir, "multi.efi")
+			Expect(utils.AddUkiProfiles(uki, multi, []utils.UkiProfile{
+				{ID: "active", Title: "Kairos", Cmdline: "console=tty1"},
+				{ID: "recovery", Title: "Kairos recovery", Cmdline: "console=tty1 recovery"},
+			})).To(Succeed())
+
+			prediction, err := utils.PredictPCRs([]string{uki, multi}, "", constants.DefaultPCRBank)
+			Expect(err).ToNot(HaveOccurred())
+			profiles := prediction.Files[1].Profiles
+			Expect(profiles).To(HaveLen(2))
+			Expect(profiles[0].ID).To(Equal("active"))
+			Expect(profiles[1].Title).To(Equal("Kairos recovery"))
+			Expect(profiles[0].PCR11).ToNot(Equal(profiles[1].PCR11))
+			// The profile section is measured too, so even the same cmdline gives another value
+			Expect(profiles[0].PCR11).ToNot(Equal(prediction.Files[0].Profiles[0].PCR11))
+			Expect(profiles[0].PCRSig).To(BeNil())
+		})
+
+		It("exports the signed PCR policy of the UKI", func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			keyFile := filepath.Join(tmpDir, "tpm2-pcr-private.pem")
+			Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)).To(Succeed())
+			signer, err := pesign.NewPCRSigner(keyFile)
+			Expect(err).ToNot(HaveOccurred())
+			sig, err := utils.SignUkiPCR(sections, pcrPolicies(signer))
+			Expect(err).ToNot(HaveOccurred())
+			signed := filepath.Join(tmpDir, "signed.efi")
+			Expect(pe.AddSections(uki, signed, []pe.Section{{Name: ".pcrsig", Data: sig}})).To(Succeed())
+
+			prediction, err := utils.PredictPCRs([]string{signed}, "", constants.DefaultPCRBank)
+			Expect(err).ToNot(HaveOccurred())
+			Expect([]byte(prediction.Files[0].Profiles[0].PCRSig)).To(MatchJSON(sig))
+		})
+
+		Describe("PCR 7", func() {
+			var keysDir string
+			var dbESL []byte
+
+			BeforeEach(func() {
+				keysDir = filepath.Join(tmpDir, "keys")
+				Expect(os.MkdirAll(keysDir, constants.DirPerm)).To(Succeed())
+				owner := efiutil.StringToGUID("11111111-2222-3333-4444-555555555555")
+				for _, name := range []string{"PK", "KEK", "db"} {
+					key, err := rsa.GenerateKey(rand.Reader, 2048)
+					Expect(err).ToNot(HaveOccurred())
+					template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}, NotAfter: time.Now().Add(time.Hour)}
+					der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+					Expect(err).ToNot(HaveOccurred())
+					db := signature.NewSignatureDatabase()
+					Expect(db.Append(signature.CERT_X509_GUID, *owner, der)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(keysDir, name+".esl"), db.Bytes(), constants.FilePerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(keysDir, name+".der"), der, constants.FilePerm)).To(Succeed())
+					if name == "db" {
+						dbESL = db.Bytes()
+					}
+				}
+			})
+
+			It("predicts the secure boot events of the keys", func() {
+				prediction, err := utils.PredictPCRs([]string{stub}, keysDir, constants.DefaultPCRBank)
+				Expect(err).ToNot(HaveOccurred())
+				var names []string
+				for _, e := range prediction.PCR7 {
+					names = append(names, e.Description)
+				}
+				Expect(names).To(Equal([]string{"SecureBoot", "PK", "KEK", "db", "db authority"}))
+				// The digest of SecureBoot being enabled is the same on every machine
+				Expect(prediction.PCR7[0].Digest).To(Equal("ccfc4bb32888a345bc8aeadaba552b627d99348c767681ab3141f5b01e40a40e"))
+			})
+
+			It("reads the signature lists from the .auth files", func() {
+				expected, err := utils.PredictPCRs([]string{stub}, keysDir, constants.DefaultPCRBank)
+				Expect(err).ToNot(HaveOccurred())
+
+				// A timestamp and a WIN_CERTIFICATE with its length as the first field go before the signature list
+				auth := make([]byte, 16+24)
+				binary.LittleEndian.PutUint32(auth[16:], 24)
+				Expect(os.WriteFile(filepath.Join(keysDir, "db.auth"), append(auth, dbESL...), constants.FilePerm)).To(Succeed())
+				Expect(os.Remove(filepath.Join(keysDir, "db.esl"))).To(Succeed())
+				prediction, err := utils.PredictPCRs([]string{stub}, keysDir, constants.DefaultPCRBank)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(prediction.PCR7).To(Equal(expected.PCR7))
+			})
+
+			It("takes the last certificate of db.der after a db key rotation", func() {
+				key, err := rsa.GenerateKey(rand.Reader, 2048)
+				Expect(err).ToNot(HaveOccurred())
+				template := &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "db"}, NotAfter: time.Now().Add(time.Hour)}
+				newCert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+				Expect(err).ToNot(HaveOccurred())
+				db, err := signature.ReadSignatureDatabase(bytes.NewReader(dbESL))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(db.Append(signature.CERT_X509_GUID, db[0].Signatures[0].Owner, newCert)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(keysDir, "db.esl"), db.Bytes(), constants.FilePerm)).To(Succeed())
+				Expect(os.WriteFile(filepath.Join(keysDir, "db.der"), newCert, constants.FilePerm)).To(Succeed())
+				expected, err := utils.PredictPCRs([]string{stub}, keysDir, constants.DefaultPCRBank)
+				Expect(err).ToNot(HaveOccurred())
+
+				// genkey rotate appends the new certificate to db.der
+				der := append(bytes.Clone(db[0].Signatures[0].Data), newCert...)
+				Expect(os.WriteFile(filepath.Join(keysDir, "db.der"), der, constants.FilePerm)).To(Succeed())
+				prediction, err := utils.PredictPCRs([]string{stub}, keysDir, constants.DefaultPCRBank)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(prediction.PCR7).To(Equal(expected.PCR7))
+			})
+
+			It("fails if the db certificate is not in the db signature list", func() {
+				Expect(os.Rename(filepath.Join(keysDir, "KEK.der"), filepath.Join(keysDir, "db.der"))).To(Succeed())
+				_, err := utils.PredictPCRs([]string{stub}, keysDir, constants.DefaultPCRBank)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		It("fails with an unknown bank", func() {
+			_, err := utils.PredictPCRs([]string{stub}, "", "md5")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("AddUkiPCRSignatures", Label("sign"), func() {
+		var tmpDir, uki string
+		var signer *pesign.PCRSigner
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = os.MkdirTemp("", "enki-sign-test-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+			stub := filepath.Join(tmpDir, "stub.efi")
+			Expect(os.WriteFile(stub, efiImage(), constants.FilePerm)).To(Succeed())
+			uki = filepath.Join(tmpDir, "uki.efi")
+			Expect(pe.AddSections(stub, uki, []pe.Section{
+				{Name: ".osrel", Data: []byte("ID=kairos\n")},
+				{Name: ".cmdline", Data: []byte("console=tty1")},
+				{Name: ".linux", Data: efiImage()},
+			})).To(Succeed())
+
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			keyFile := filepath.Join(tmpDir, "tpm2-pcr-private.pem")
+			Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)).To(Succeed())
+			signer, err = pesign.NewPCRSigner(keyFile)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		sectionNames := func(file string) []string {
+			sections, err := pe.Sections(file)
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, s := range sections {
+				names = append(names, s.Name)
+			}
+			return names
+		}
+
+		It("adds the PCR public key and signature", func() {
+			signed := filepath.Join(tmpDir, "signed.efi")
+			Expect(utils.AddUkiPCRSignatures(uki, signed, pcrPolicies(signer))).To(Succeed())
+			Expect(sectionNames(signed)).To(Equal([]string{".text", ".osrel", ".cmdline", ".linux", ".pcrpkey", ".pcrsig"}))
+
+			sections, err := pe.Sections(signed)
+			Expect(err).ToNot(HaveOccurred())
+			expected, err := utils.SignUkiPCR(sections[:5], pcrPolicies(signer))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sections[5].Data).To(MatchJSON(expected))
+
+			Expect(utils.AddUkiPCRSignatures(signed, filepath.Join(tmpDir, "again.efi"), pcrPolicies(signer))).To(MatchError(ContainSubstring("already has PCR signatures")))
+		})
+
+		It("signs every profile after the base sections", func() {
+			multi := filepath.Join(tmpDir, "multi.efi")
+			Expect(utils.AddUkiProfiles(uki, multi, []utils.UkiProfile{
+				{ID: "active", Title: "Kairos", Cmdline: "console=tty1"},
+				{ID: "recovery", Title: "Kairos recovery", Cmdline: "console=tty1 recovery"},
+			})).To(Succeed())
+			signed := filepath.Join(tmpDir, "signed.efi")
+			Expect(utils.AddUkiPCRSignatures(multi, signed, pcrPolicies(signer))).To(Succeed())
+			Expect(sectionNames(signed)).To(Equal([]string{
+				".text", ".osrel", ".cmdline", ".linux", ".pcrpkey", ".pcrsig",
+				".profile", ".cmdline", ".pcrsig",
+				".profile", ".cmdline", ".pcrsig",
+			}))
+
+			prediction, err := utils.PredictPCRs([]string{signed}, "", constants.DefaultPCRBank)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(prediction.Files[0].Profiles).To(HaveLen(2))
+			Expect(prediction.Files[0].Profiles[0].PCRSig).ToNot(BeNil())
+			Expect(prediction.Files[0].Profiles[1].PCRSig).ToNot(MatchJSON(prediction.Files[0].Profiles[0].PCRSig))
+		})
+	})
+
+	Describe("InspectUki", Label("inspect"), func() {
+		var tmpDir, uki, signed string
+		var cert *x509.Certificate
+		var signer *pesign.PCRSigner
+
+		writeCert := func(name string) (string, string) {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			template := &x509.Certificate{SerialNumber: big.NewInt(7), Subject: pkix.Name{CommonName: name}, NotAfter: time.Now().Add(time.Hour)}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			Expect(err).ToNot(HaveOccurred())
+			keyFile, certFile := filepath.Join(tmpDir, name+".key"), filepath.Join(tmpDir, name+".pem")
+			Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)).To(Succeed())
+			Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)).To(Succeed())
+			return keyFile, certFile
+		}
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = os.MkdirTemp("", "enki-inspect-test-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+			stub := filepath.Join(tmpDir, "stub.efi")
+			Expect(os.WriteFile(stub, efiImage(), constants.FilePerm)).To(Succeed())
+			base := filepath.Join(tmpDir, "base.efi")
+			Expect(pe.AddSections(stub, base, []pe.Section{
+				{Name: ".osrel", Data: []byte("ID=kairos\nPRETTY_NAME=\"Kairos\"\n")},
+				{Name: ".cmdline", Data: []byte("console=tty1\x00\x00")},
+				{Name: ".uname", Data: []byte("6.8.0-kairos")},
+				{Name: ".sbat", Data: []byte("sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\n")},
+				{Name: ".initrd", Data: []byte("initrd")},
+				{Name: ".linux", Data: efiImage()},
+			})).To(Succeed())
+			withProfiles := filepath.Join(tmpDir, "profiles.efi")
+			Expect(utils.AddUkiProfiles(base, withProfiles, []utils.UkiProfile{
+				{ID: "active", Title: "Kairos", Cmdline: "console=tty1"},
+				{ID: "recovery", Title: "Kairos recovery", Cmdline: "console=tty1 recovery"},
+			})).To(Succeed())
+
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			keyFile := filepath.Join(tmpDir, "tpm2-pcr-private.pem")
+			Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)).To(Succeed())
+			signer, err = pesign.NewPCRSigner(keyFile)
+			Expect(err).ToNot(HaveOccurred())
+			uki = filepath.Join(tmpDir, "uki.efi")
+			Expect(utils.AddUkiPCRSignatures(withProfiles, uki, pcrPolicies(signer))).To(Succeed())
+
+			dbKey, dbCert := writeCert("db")
+			sbSigner, err := enkiSigner.SecureBoot(dbCert, dbKey, constants.DefaultPrivateKeySource)
+			Expect(err).ToNot(HaveOccurred())
+			cert, err = enkiSigner.ReadCertificate(dbCert)
+			Expect(err).ToNot(HaveOccurred())
+			signed = filepath.Join(tmpDir, "signed.efi")
+			Expect(sbSigner.Sign(uki, signed)).To(Succeed())
+		})
+
+		It("describes the sections, profiles and PCR signatures", func() {
+			i, err := utils.InspectUki(signed, nil)
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, s := range i.Sections {
+				names = append(names, s.Name)
+			}
+			Expect(names).To(Equal([]string{
+				".text", ".osrel", ".cmdline", ".uname", ".sbat", ".initrd", ".linux", ".pcrpkey", ".pcrsig",
+				".profile", ".cmdline", ".pcrsig", ".profile", ".cmdline", ".pcrsig",
+			}))
+			sum := sha256.Sum256([]byte("initrd"))
+			Expect(i.Sections[5]).To(Equal(utils.SectionSummary{Name: ".initrd", Size: 6, SHA256: hex.EncodeToString(sum[:])}))
+			Expect(*i.Sections[10].Profile).To(Equal(0))
+			Expect(*i.Sections[13].Profile).To(Equal(1))
+
+			Expect(i.Cmdline).To(Equal("console=tty1"))
+			Expect(i.OsRelease["PRETTY_NAME"]).To(Equal("Kairos"))
+			Expect(i.Uname).To(Equal("6.8.0-kairos"))
+			Expect(i.SBAT).To(HavePrefix("sbat,1,SBAT Version"))
+			Expect(i.PCRSig.SHA256).To(HaveLen(4))
+			Expect(i.PCRSig.SHA256[0].PKFP).To(Equal(i.PCRPKeyFingerprint))
+			Expect(i.Profiles).To(HaveLen(2))
+			Expect(i.Profiles[1].ID).To(Equal("recovery"))
+			Expect(i.Profiles[1].Title).To(Equal("Kairos recovery"))
+			Expect(i.Profiles[1].Cmdline).To(Equal("console=tty1 recovery"))
+			Expect(i.Profiles[1].PCRSig.SHA256[0].Pol).ToNot(Equal(i.Profiles[0].PCRSig.SHA256[0].Pol))
+
+			Expect(i.Signatures).To(HaveLen(1))
+			Expect(i.Signatures[0].Subject).To(Equal("CN=db"))
+			Expect(i.Signatures[0].Serial).To(Equal("7"))
+			Expect(i.Signatures[0].Verified).To(BeNil())
+		})
+
+		It("verifies the signatures with the given certificates", func() {
+			_, otherCert := writeCert("other")
+			other, err := enkiSigner.ReadCertificate(otherCert)
+			Expect(err).ToNot(HaveOccurred())
+
+			i, err := utils.InspectUki(signed, []*x509.Certificate{other})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*i.Signatures[0].Verified).To(BeFalse())
+			i, err = utils.InspectUki(signed, []*x509.Certificate{other, cert})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*i.Signatures[0].Verified).To(BeTrue())
+
+			i, err = utils.InspectUki(uki, []*x509.Certificate{cert})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(i.Signatures).To(BeEmpty())
+		})
+
+		It("describes the signer when the signature also embeds its chain", func() {
+			_, chainCert := writeCert("chain")
+			chain, err := enkiSigner.ReadCertificate(chainCert)
+			Expect(err).ToNot(HaveOccurred())
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			template := &x509.Certificate{SerialNumber: big.NewInt(8), Subject: pkix.Name{CommonName: "db"}, NotAfter: time.Now().Add(time.Hour)}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			Expect(err).ToNot(HaveOccurred())
+			dbCert, err := x509.ParseCertificate(der)
+			Expect(err).ToNot(HaveOccurred())
+
+			// The embedded certificates are the raw bytes of the given one, so the chain goes first
+			withChain := *dbCert
+			withChain.Raw = append(bytes.Clone(chain.Raw), dbCert.Raw...)
+			data, err := os.ReadFile(uki)
+			Expect(err).ToNot(HaveOccurred())
+			bin, err := authenticode.Parse(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = bin.Sign(key, &withChain)
+			Expect(err).ToNot(HaveOccurred())
+			chained := filepath.Join(tmpDir, "chained.efi")
+			Expect(os.WriteFile(chained, bin.Bytes(), constants.FilePerm)).To(Succeed())
+
+			i, err := utils.InspectUki(chained, []*x509.Certificate{dbCert})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(i.Signatures).To(HaveLen(1))
+			Expect(i.Signatures[0].Subject).To(Equal("CN=db"))
+			Expect(i.Signatures[0].Serial).To(Equal("8"))
+			Expect(*i.Signatures[0].Verified).To(BeTrue())
+		})
+
+		It("extracts the kernel, initrd and cmdlines", func() {
+			dir := filepath.Join(tmpDir, "extracted")
+			Expect(utils.ExtractUki(signed, dir)).To(Succeed())
+			Expect(os.ReadFile(filepath.Join(dir, "vmlinuz"))).To(Equal(efiImage()))
+			Expect(os.ReadFile(filepath.Join(dir, "initrd"))).To(Equal([]byte("initrd")))
+			Expect(os.ReadFile(filepath.Join(dir, "cmdline"))).To(Equal([]byte("console=tty1")))
+			Expect(os.ReadFile(filepath.Join(dir, "cmdline.recovery"))).To(Equal([]byte("console=tty1 recovery")))
+		})
+	})
+
+	Describe("signed UKI", Label("reproducible", "sign"), func() {
+		It("is the same on every build with SOURCE_DATE_EPOCH", func() {
+			tmpDir, err := os.MkdirTemp("", "enki-reproducible-test-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+			stub := filepath.Join(tmpDir, "stub.efi")
+			Expect(os.WriteFile(stub, efiImage(), constants.FilePerm)).To(Succeed())
+
+			pcrKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			pcrKeyFile := filepath.Join(tmpDir, "tpm2-pcr-private.pem")
+			Expect(os.WriteFile(pcrKeyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pcrKey)}), 0600)).To(Succeed())
+			pcrSigner, err := pesign.NewPCRSigner(pcrKeyFile)
+			Expect(err).ToNot(HaveOccurred())
+			dbKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "db"}, NotAfter: time.Now().Add(time.Hour)}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &dbKey.PublicKey, dbKey)
+			Expect(err).ToNot(HaveOccurred())
+			dbCert, err := x509.ParseCertificate(der)
+			Expect(err).ToNot(HaveOccurred())
+			dbKeyFile, dbCertFile := filepath.Join(tmpDir, "db.key"), filepath.Join(tmpDir, "db.pem")
+			Expect(os.WriteFile(dbKeyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(dbKey)}), 0600)).To(Succeed())
+			Expect(os.WriteFile(dbCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)).To(Succeed())
+
+			// build assembles, PCR signs and secure boot signs a UKI from scratch, as build-uki does
+			build := func(name string) []byte {
+				epoch, err := utils.SourceDateEpoch()
+				Expect(err).ToNot(HaveOccurred())
+				dir := filepath.Join(tmpDir, name)
+				Expect(os.MkdirAll(dir, constants.DirPerm)).To(Succeed())
+				uki := filepath.Join(dir, "uki.efi")
+				Expect(pe.AddSections(stub, uki, []pe.Section{
+					{Name: ".osrel", Data: []byte("ID=kairos\n")},
+					{Name: ".cmdline", Data: []byte("console=tty1")},
+					{Name: ".linux", Data: efiImage()},
+				})).To(Succeed())
+				withPCR := filepath.Join(dir, "pcr.efi")
+				Expect(utils.AddUkiPCRSignatures(uki, withPCR, pcrPolicies(pcrSigner))).To(Succeed())
+				sbSigner, err := enkiSigner.SecureBoot(dbCertFile, dbKeyFile, constants.DefaultPrivateKeySource)
+				Expect(err).ToNot(HaveOccurred())
+				sbSigner.SigningTime = epoch
+				signed := filepath.Join(dir, "signed.efi")
+				Expect(sbSigner.Sign(withPCR, signed)).To(Succeed())
+
+				i, err := utils.InspectUki(signed, []*x509.Certificate{dbCert})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(i.Signatures).To(HaveLen(1))
+				Expect(*i.Signatures[0].Verified).To(BeTrue())
+				data, err := os.ReadFile(signed)
+				Expect(err).ToNot(HaveOccurred())
+				return data
+			}
+
+			GinkgoT().Setenv(constants.SourceDateEpochEnv, "1715941820")
+			first := build("first")
+			// A second later, when a signing time of the current time would differ
+			time.Sleep(1100 * time.Millisecond)
+			Expect(build("second")).To(Equal(first))
+
+			// The signing time is part of the signature
+			GinkgoT().Setenv(constants.SourceDateEpochEnv, "1715941821")
+			Expect(build("third")).ToNot(Equal(first))
+		})
+	})
+
+	Describe("SignManifest", Label("sign"), func() {
+		It("checks the files did not change since the build", func() {
+			dir, err := os.MkdirTemp("", "enki-sign-manifest-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, dir)
+			Expect(os.MkdirAll(filepath.Join(dir, "EFI", "kairos"), constants.DirPerm)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "EFI", "kairos", "active.efi"), []byte("uki"), constants.FilePerm)).To(Succeed())
+
+			fs := vfs.OSFS
+			Expect(utils.WriteSignManifest(fs, dir, []utils.SignFile{{Path: "EFI/kairos/active.efi", UKI: true}})).To(Succeed())
+			m, err := utils.ReadSignManifest(fs, dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.Files).To(HaveLen(1))
+			Expect(m.Files[0].UKI).To(BeTrue())
+			sum := sha256.Sum256([]byte("uki"))
+			Expect(m.Files[0].SHA256).To(Equal(hex.EncodeToString(sum[:])))
+
+			Expect(os.WriteFile(filepath.Join(dir, "EFI", "kairos", "active.efi"), []byte("signed uki"), constants.FilePerm)).To(Succeed())
+			_, err = utils.ReadSignManifest(fs, dir)
+			Expect(err).To(MatchError(ContainSubstring("changed since the build")))
+		})
+	})
+
+	Describe("SBAT", Label("sbat"), func() {
+		It("parses and validates the SBAT entries", func() {
+			e, err := enkiTypes.ParseSbatEntry("kairos,2,Kairos,kairos,v3.2.1,https://kairos.io")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.Generation).To(Equal(2))
+			Expect(e.String()).To(Equal("kairos,2,Kairos,kairos,v3.2.1,https://kairos.io"))
+
+			for _, line := range []string{
+				"kairos,1,Kairos,kairos,v3.2.1",
+				"kairos,one,Kairos,kairos,v3.2.1,https://kairos.io",
+				"kairos,0,Kairos,kairos,v3.2.1,https://kairos.io",
+				"kairos,1,\"Kairos\",kairos,v3.2.1,https://kairos.io",
+				"kairos,1,,kairos,v3.2.1,https://kairos.io",
+				"sbat,1,Kairos,kairos,v3.2.1,https://kairos.io",
+			} {
+				_, err := enkiTypes.ParseSbatEntry(line)
+				Expect(err).To(HaveOccurred(), line)
+			}
+		})
+
+		It("adds the entries to the .sbat section", func() {
+			tmpDir, err := os.MkdirTemp("", "enki-sbat-test-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+			stub := filepath.Join(tmpDir, "stub.efi")
+			Expect(os.WriteFile(stub, efiImage(), constants.FilePerm)).To(Succeed())
+			systemd := "systemd,1,The systemd Developers,systemd,256,https://systemd.io/"
+			withSbat := filepath.Join(tmpDir, "sbat.efi")
+			Expect(pe.AddSections(stub, withSbat, []pe.Section{
+				{Name: ".sbat", Data: []byte(utils.SbatHeader + "\n" + systemd + "\n\x00\x00")},
+				{Name: ".linux", Data: []byte("kernel")},
+			})).To(Succeed())
+
+			kairos := "kairos,1,Kairos,kairos,v3.2.1,https://kairos.io"
+			output := filepath.Join(tmpDir, "output.efi")
+			Expect(utils.AddSbatEntries(withSbat, output, []string{kairos, systemd})).To(Succeed())
+			sections, err := pe.Sections(output)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sections).To(HaveLen(3))
+			Expect(sections[1].Name).To(Equal(".linux"))
+			Expect(sections[2].Name).To(Equal(".sbat"))
+			Expect(string(bytes.TrimRight(sections[2].Data, "\x00"))).To(Equal(utils.SbatHeader + "\n" + systemd + "\n" + kairos + "\n"))
+
+			Expect(utils.AddSbatEntries(stub, output, []string{kairos})).To(Succeed())
+			sections, err = pe.Sections(output)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sections[len(sections)-1].Name).To(Equal(".sbat"))
+			Expect(string(bytes.TrimRight(sections[len(sections)-1].Data, "\x00"))).To(Equal(utils.SbatHeader + "\n" + kairos + "\n"))
+		})
+	})
+
+	Describe("FindEfiFiles", Label("pcr"), func() {
+		It("finds the EFI files in directories", func() {
+			dir, err := os.MkdirTemp("", "enki-efi-files-")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, dir)
+			Expect(os.MkdirAll(filepath.Join(dir, "EFI", "BOOT"), constants.DirPerm)).To(Succeed())
+			for _, f := range []string{"EFI/BOOT/BOOTX64.EFI", "EFI/kairos.efi", "loader.conf"} {
+				Expect(os.WriteFile(filepath.Join(dir, f), []byte{}, constants.FilePerm)).To(Succeed())
+			}
+			files, err := utils.FindEfiFiles([]string{dir, filepath.Join(dir, "loader.conf")})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(Equal([]string{filepath.Join(dir, "EFI/BOOT/BOOTX64.EFI"), filepath.Join(dir, "EFI/kairos.efi"), filepath.Join(dir, "loader.conf")}))
+		})
 	})
 })
+
+// pcrPolicies returns the policy of the key for the default phases, like build-uki signs with tpm2-pcr-private.pem
+func pcrPolicies(key ukiTypes.RSAKey) []enkiSigner.PCRPolicy {
+	return []enkiSigner.PCRPolicy{{Key: key, Phases: enkiSigner.DefaultPhases()}}
+}
+
+// efiImage returns a minimal PE32+ image with a single .text section, with room in its headers for more sections
+func efiImage() []byte {
+	le := binary.LittleEndian
+	data := make([]byte, 0x600)
+	copy(data, "MZ")
+	le.PutUint32(data[0x3c:], 0x40)
+	copy(data[0x40:], "PE\x00\x00")
+	coff := data[0x44:]
+	le.PutUint16(coff[0:], debugpe.IMAGE_FILE_MACHINE_AMD64)
+	le.PutUint16(coff[2:], 1)
+	le.PutUint16(coff[16:], 240)
+	le.PutUint16(coff[18:], debugpe.IMAGE_FILE_EXECUTABLE_IMAGE)
+	opt := data[0x58:]
+	le.PutUint16(opt[0:], 0x20b)
+	le.PutUint32(opt[16:], 0x1000)
+	le.PutUint32(opt[32:], 0x1000)
+	le.PutUint32(opt[36:], 0x200)
+	le.PutUint32(opt[56:], 0x2000)
+	le.PutUint32(opt[60:], 0x400)
+	le.PutUint16(opt[68:], 10)
+	le.PutUint32(opt[108:], 16)
+	section := data[0x58+240:]
+	copy(section, ".text")
+	le.PutUint32(section[8:], 4)
+	le.PutUint32(section[12:], 0x1000)
+	le.PutUint32(section[16:], 0x200)
+	le.PutUint32(section[20:], 0x400)
+	le.PutUint32(section[36:], debugpe.IMAGE_SCN_CNT_CODE|debugpe.IMAGE_SCN_MEM_EXECUTE|debugpe.IMAGE_SCN_MEM_READ)
+	copy(data[0x400:], []byte{0xc3, 0x90, 0x90, 0x90})
+	return data
+}